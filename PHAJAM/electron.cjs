@@ -1,8 +1,32 @@
 const { app, BrowserWindow, ipcMain } = require("electron");
 const fs = require("fs");
 const path = require("path");
+const http = require("http");
 const { exec } = require("child_process");
 
+// The node writes the token of its HTTP API to this cookie file, as
+// "__cookie__:<token>", each time it starts.
+const cookiePath =
+  process.env.ORCANET_AUTH_COOKIE || path.join(__dirname, "..", "dht", "orcanet.cookie");
+
+// The UI is served from the origin the node allows by default (-allowedorigins),
+// by Vite in development and by uiServer otherwise.
+const uiPort = 5173;
+const uiURL = `http://localhost:${uiPort}`;
+const distDir = path.join(__dirname, "dist");
+
+const contentTypes = {
+  ".html": "text/html; charset=utf-8",
+  ".js": "text/javascript",
+  ".css": "text/css",
+  ".json": "application/json",
+  ".svg": "image/svg+xml",
+  ".png": "image/png",
+  ".jpg": "image/jpeg",
+  ".ico": "image/x-icon",
+  ".woff2": "font/woff2",
+};
+
 // Function to determine the wallet path based on the operating system
 function getWalletPath() {
   const homeDir = require("os").homedir();
@@ -67,6 +91,36 @@ ipcMain.handle("create-wallet", async (event, password) => {
   }
 });
 
+// IPC handler for reading the token of the node's HTTP API
+ipcMain.handle("api-token", async () => {
+  try {
+    const cookie = await fs.promises.readFile(cookiePath, "utf8");
+    const [, token] = cookie.trim().split(":");
+    return token || null;
+  } catch (error) {
+    console.error(`[Main Process] Failed to read auth cookie ${cookiePath}:`, error.message);
+    return null;
+  }
+});
+
+// Serve the built UI on uiURL.  Paths that aren't files get index.html, so
+// the router handles them.
+function startUIServer() {
+  const server = http.createServer((req, res) => {
+    const urlPath = decodeURIComponent(new URL(req.url, uiURL).pathname);
+    let file = path.join(distDir, path.normalize(urlPath));
+    if (!file.startsWith(distDir + path.sep) || !fs.existsSync(file) || fs.statSync(file).isDirectory()) {
+      file = path.join(distDir, "index.html");
+    }
+    res.setHeader("Content-Type", contentTypes[path.extname(file)] || "application/octet-stream");
+    fs.createReadStream(file).pipe(res);
+  });
+  return new Promise((resolve, reject) => {
+    server.once("error", reject);
+    server.listen(uiPort, "127.0.0.1", resolve);
+  });
+}
+
 // Create the Electron browser window
 const createWindow = () => {
   const win = new BrowserWindow({
@@ -83,16 +137,15 @@ const createWindow = () => {
 
   win.maximize();
 
-  // Load React app based on environment
+  // Load React app from the origin the node allows
   //win.setMenu(null);
-  if (process.env.NODE_ENV === "development") {
-    win.loadURL("http://localhost:5173");
-  } else {
-    win.loadFile(path.join(__dirname, "./dist/index.html"));
-  }
+  win.loadURL(uiURL);
 };
 
-app.whenReady().then(() => {
+app.whenReady().then(async () => {
+  if (process.env.NODE_ENV !== "development") {
+    await startUIServer();
+  }
   createWindow();
 
   app.on("activate", () => {
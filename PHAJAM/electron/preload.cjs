@@ -8,4 +8,9 @@ contextBridge.exposeInMainWorld("walletApi", {
   createWallet: (password) => ipcRenderer.invoke("create-wallet", password),
 });
 
+contextBridge.exposeInMainWorld("orcanetApi", {
+  // Get the token authenticating requests to the node's HTTP API
+  getToken: () => ipcRenderer.invoke("api-token"),
+});
+
 console.log("Preload script loaded!");
@@ -0,0 +1,18 @@
+// The node's HTTP API only answers requests carrying the token it writes to
+// its cookie file.  The Electron preload reads the cookie for the UI, so a
+// restarted node's new token is picked up on the next request.
+export const API_URL = "http://localhost:8080";
+
+// authHeaders returns the headers authenticating a request to the node.
+export async function authHeaders() {
+  const token = await window.orcanetApi?.getToken();
+  return token ? { Authorization: `Bearer ${token}` } : {};
+}
+
+// apiFetch calls the node's HTTP API at path with the auth token.
+export async function apiFetch(path, options = {}) {
+  return fetch(API_URL + path, {
+    ...options,
+    headers: { ...(await authHeaders()), ...options.headers },
+  });
+}
@@ -13,6 +13,7 @@ import {
 import SearchIcon from "@mui/icons-material/Search";
 import { DataGrid } from "@mui/x-data-grid";
 import { useTheme } from "../../ThemeContext"; // Assuming useTheme is imported for dark mode context
+import { apiFetch } from "../../api";
 
 function CustomNoRowsOverlay() {
   const { darkMode } = useTheme();
@@ -62,7 +63,7 @@ export default function Explore() {
   const handleKeyDown = async (e) => {
     if (e.key === "Enter") {
       try {
-        const response = await fetch("http://localhost:8080/getproviders", {
+        const response = await apiFetch("/getproviders", {
           method: "POST",
           headers: {
             "Content-Type": "application/json",
@@ -118,7 +119,7 @@ export default function Explore() {
 
   const handlePurchase = async (id, hash) => {
     try {
-      const response = await fetch("http://localhost:8080/purchase", {
+      const response = await apiFetch("/purchase", {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
@@ -15,6 +15,7 @@ import CloseIcon from "@mui/icons-material/Close";
 import { useTheme } from "../../ThemeContext";
 import SearchBar from "./SearchBar";
 import DataTable from "./DataTable";
+import { apiFetch } from "../../api";
 
 export default function Files() {
   const { darkMode } = useTheme();
@@ -72,7 +73,7 @@ export default function Files() {
     formData.append("price", price);
 
     try {
-      const response = await fetch("http://localhost:8080/upload", {
+      const response = await apiFetch("/upload", {
         method: "POST",
         body: formData,
       });
@@ -97,7 +98,7 @@ export default function Files() {
 
   const fetchFiles = async () => {
     try {
-      const response = await fetch("http://localhost:8080/files");
+      const response = await apiFetch("/files");
       if (!response.ok) {
         throw new Error("Failed to fetch files");
       }
@@ -121,7 +122,7 @@ export default function Files() {
 
   const handleDelete = async (hash) => {
     try {
-      const response = await fetch(`http://localhost:8080/delete`, {
+      const response = await apiFetch("/delete", {
         method: "DELETE",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({ hash }),
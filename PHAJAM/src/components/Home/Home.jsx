@@ -14,6 +14,7 @@ import {
 } from 'chart.js';
 import { useTheme } from "../../ThemeContext";
 import { useState } from "react";
+import { API_URL, authHeaders } from "../../api";
 
 ChartJS.register(
   CategoryScale,
@@ -164,9 +165,11 @@ export default function Home() {
       const numBlocks = 5;
   
       // API call to the backend
-      const response = await axios.post("http://localhost:8080/mine", {
-        num_blocks: numBlocks,
-      });
+      const response = await axios.post(
+        `${API_URL}/mine`,
+        { num_blocks: numBlocks },
+        { headers: await authHeaders() }
+      );
   
       // Handle successful response
       alert(`Mining started: ${response.data.message}`);
@@ -6,6 +6,7 @@ import { useTheme } from "../../ThemeContext";
 import ProxyBox from "./ProxyBox";
 import proxyInstructionsImage from './proxyInstructions.png'
 import disconnectProxyInstructionsImage from './disconnectProxyInstructions.png'
+import { apiFetch } from "../../api";
 
 export default function Proxy() {
 
@@ -22,7 +23,7 @@ export default function Proxy() {
     // Check if I am a proxy
     const fetchProxyStatus = async () => {
         try {
-            const response = await fetch("http://localhost:8080/isProxy");
+            const response = await apiFetch("/isProxy");
             if (!response.ok) {
                 throw new Error("Failed to fetch proxy status");
             }
@@ -36,7 +37,7 @@ export default function Proxy() {
     // Fetch list of proxies
     const fetchProxyList = async () => {
         try {
-            const response = await fetch("http://localhost:8080/fetchProxyList");
+            const response = await apiFetch("/fetchProxyList");
             if (!response.ok) {
                 throw new Error("Failed to fetch proxy list");
             }
@@ -126,7 +127,7 @@ export default function Proxy() {
             initialFee: initialFee,
             price: price,
         };
-        const response = await fetch("http://localhost:8080/registerProxy", {
+        const response = await apiFetch("/registerProxy", {
             method: "POST",
             headers: {
                 "Content-Type": "application/json",
@@ -144,7 +145,7 @@ export default function Proxy() {
                 const data2 = {
                     action: "deregister",  // Deregister the proxy
                 };
-                await fetch("http://localhost:8080/registerProxy", {
+                await apiFetch("/registerProxy", {
                     method: "POST",
                     headers: {
                         "Content-Type": "application/json",
@@ -421,7 +422,7 @@ export default function Proxy() {
                             const data = {
                                 action: "deregister",  // Deregister the proxy
                             };
-                            const response = await fetch("http://localhost:8080/registerProxy", {
+                            const response = await apiFetch("/registerProxy", {
                                 method: "POST",
                                 headers: {
                                     "Content-Type": "application/json",
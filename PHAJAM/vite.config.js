@@ -7,5 +7,7 @@ export default defineConfig({
   base: "./",
   server: {
     port: 5173,
+    // The node only allows this origin by default.
+    strictPort: true,
   },
 });
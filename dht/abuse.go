@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// Inbound streams of the orcanet protocols are read with a size limit and a
+// deadline, requests are rate limited per peer, and every violation adds to
+// the sender's ban score.  The score has a persistent part for protocol
+// violations and a part that decays with a half-life of banScoreHalfLife for
+// floods, as btcd's dynamic ban score does.  Content that fails
+// verification counts as a violation too.  A peer whose score reaches the
+// ban threshold is put on the blocklist for the ban duration.
+const (
+	// maxRequestSize is the largest request accepted on the file transfer
+	// protocol, which has room for an ACCESS token.
+	maxRequestSize = 2 << 10
+
+	// maxChunkReplySize is the largest reply accepted to a request other
+	// than a legacy whole-file REQUEST: a chunk and its proof.
+	maxChunkReplySize = chunkSize + 64<<10
+
+	// maxLegacyFileSize is the largest legacy file accepted as a reply to a
+	// REQUEST.
+	maxLegacyFileSize = 1 << 30
+
+	// maxPeerExchangeSize is the largest peer exchange message accepted.
+	maxPeerExchangeSize = 256 << 10
+
+	// maxReceiptSize is the largest purchase receipt accepted.
+	maxReceiptSize = 4 << 10
+
+	// maxMetaRequestSize is the largest metadata request accepted, and
+	// maxMetaReplySize the largest reply, which has room for a preview.
+	maxMetaRequestSize = 1 << 10
+	maxMetaReplySize   = 128 << 10
+
+	// maxPeerExchangeDials is the most peers dialed for one peer exchange
+	// message.
+	maxPeerExchangeDials = 16
+
+	// requestReadTimeout is how long a peer has to send a request or a
+	// peer exchange message.
+	requestReadTimeout = 30 * time.Second
+
+	// replyReadTimeout is how long a peer has to send a reply.
+	replyReadTimeout = 30 * time.Minute
+
+	// replyTimeout is how long a request waits for its reply, and
+	// fileReplyTimeout how long a legacy whole-file REQUEST does.
+	replyTimeout     = 2 * time.Minute
+	fileReplyTimeout = replyReadTimeout
+
+	// requestRate and requestBurst limit the requests of every peer.
+	requestRate  = 20
+	requestBurst = 40
+
+	// peerExchangeInterval is the minimum time between two peer exchange
+	// messages of a peer, beyond a burst of peerExchangeBurst.
+	peerExchangeInterval = 10 * time.Second
+	peerExchangeBurst    = 3
+
+	// receiptInterval is the minimum time between two purchase receipts
+	// of a peer, beyond a burst of receiptBurst.
+	receiptInterval = time.Second
+	receiptBurst    = 20
+
+	// metaRate and metaBurst limit the metadata requests of every peer.
+	metaRate  = 5
+	metaBurst = 20
+
+	// banScoreHalfLife is the time in which the transient part of a ban
+	// score decays to half, and banScoreLifetime the age after which it is
+	// dropped.
+	banScoreHalfLife = 60 * time.Second
+	banScoreLifetime = 30 * time.Minute
+
+	// maxTrackedScores is the number of ban scores kept before those that
+	// decayed to zero are forgotten.
+	maxTrackedScores = 1000
+)
+
+var (
+	// errMessageTooLarge is returned when a peer sends more than the size
+	// limit of a message.
+	errMessageTooLarge = errors.New("message too large")
+
+	// errMalformedMessage is returned for a message that doesn't parse.
+	errMalformedMessage = errors.New("malformed message")
+
+	// errReplyTimeout is returned when a peer doesn't answer a request in
+	// time.
+	errReplyTimeout = errors.New("timed out waiting for reply")
+)
+
+// misbehavior is a kind of protocol violation and what it adds to the ban
+// score of the peer committing it.
+type misbehavior struct {
+	reason     string
+	persistent uint32
+	transient  uint32
+}
+
+var (
+	misbehaviorOversized   = misbehavior{"oversized", 25, 0}
+	misbehaviorMalformed   = misbehavior{"malformed", 10, 0}
+	misbehaviorUnsolicited = misbehavior{"unsolicited", 0, 20}
+	misbehaviorFlood       = misbehavior{"flood", 0, 5}
+	misbehaviorTimeout     = misbehavior{"timeout", 0, 10}
+	misbehaviorBadContent  = misbehavior{"bad_content", 50, 0}
+)
+
+// banScore is the sum of a persistent score and a transient one that decays
+// exponentially.  The zero value is a score of zero.
+type banScore struct {
+	persistent uint32
+	transient  float64
+	last       time.Time
+}
+
+// decayed returns the transient score at t.
+func (s *banScore) decayed(t time.Time) float64 {
+	dt := t.Sub(s.last)
+	if s.transient < 1 || dt > banScoreLifetime {
+		return 0
+	}
+	if dt <= 0 {
+		return s.transient
+	}
+	return s.transient * math.Exp(-math.Ln2*dt.Seconds()/banScoreHalfLife.Seconds())
+}
+
+// score returns the score at t.
+func (s *banScore) score(t time.Time) uint32 {
+	return s.persistent + uint32(s.decayed(t))
+}
+
+// increase adds to both parts of the score at t and returns the result.
+func (s *banScore) increase(persistent, transient uint32, t time.Time) uint32 {
+	s.persistent += persistent
+	if transient > 0 {
+		s.transient = s.decayed(t) + float64(transient)
+		s.last = t
+	}
+	return s.score(t)
+}
+
+var (
+	// abuseMtx protects banScores.
+	abuseMtx sync.Mutex
+
+	// banScores holds the ban score of every peer that misbehaved.
+	banScores = make(map[peer.ID]*banScore)
+
+	// requestLimiters limits the requests of every peer on the file
+	// transfer protocol, peerExchangeLimiters its peer exchange messages,
+	// receiptLimiters its purchase receipts and metaLimiters its metadata
+	// requests.
+	requestLimiters = newPeerLimiters(func() *rate.Limiter {
+		return rate.NewLimiter(requestRate, requestBurst)
+	})
+	peerExchangeLimiters = newPeerLimiters(func() *rate.Limiter {
+		return rate.NewLimiter(rate.Every(peerExchangeInterval), peerExchangeBurst)
+	})
+	receiptLimiters = newPeerLimiters(func() *rate.Limiter {
+		return rate.NewLimiter(rate.Every(receiptInterval), receiptBurst)
+	})
+	metaLimiters = newPeerLimiters(func() *rate.Limiter {
+		return rate.NewLimiter(metaRate, metaBurst)
+	})
+)
+
+// misbehave adds m to the ban score of p and bans p once the score reaches
+// the ban threshold.
+func misbehave(p peer.ID, m misbehavior, detail string) {
+	misbehaviorTotal.WithLabelValues(m.reason).Inc()
+
+	abuseMtx.Lock()
+	now := time.Now()
+	if len(banScores) >= maxTrackedScores {
+		for id, s := range banScores {
+			if s.score(now) == 0 {
+				delete(banScores, id)
+			}
+		}
+	}
+	s, ok := banScores[p]
+	if !ok {
+		s = &banScore{}
+		banScores[p] = s
+	}
+	score := s.increase(m.persistent, m.transient, now)
+	abuseMtx.Unlock()
+
+	peerLog.Debugf("Misbehaving peer %s (%s: %s), ban score %d", p, m.reason, detail, score)
+	if cfg.NoBanning || uint(score) < cfg.BanThreshold {
+		return
+	}
+	peersBannedTotal.Inc()
+	banPeer(p, time.Now().Add(cfg.BanDuration), fmt.Sprintf("ban score %d after %s", score, m.reason))
+	peerLog.Warnf("Banned peer %s for %v: ban score %d after %s", p, cfg.BanDuration, score, m.reason)
+}
+
+// misbehaveID is misbehave for the peer with the encoded ID id.
+func misbehaveID(id string, m misbehavior, detail string) {
+	if p, err := peer.Decode(id); err == nil {
+		misbehave(p, m, detail)
+	}
+}
+
+// banPeer bans p until until, or until it is unbanned if until is zero:
+// its connections are closed, and it can't connect again or open streams.
+func banPeer(p peer.ID, until time.Time, reason string) {
+	blocked.addPeer(p, until, reason)
+	abuseMtx.Lock()
+	delete(banScores, p)
+	abuseMtx.Unlock()
+	if err := blocked.save(); err != nil {
+		peerLog.Errorf("Failed to save blocklist: %v", err)
+	}
+
+	if node != nil {
+		if err := node.Network().ClosePeer(p); err != nil {
+			peerLog.Debugf("Failed to disconnect banned peer %s: %v", p, err)
+		}
+	}
+}
+
+// unbanPeer lifts the ban of p and reports whether it was banned.
+func unbanPeer(p peer.ID) bool {
+	if !blocked.removePeer(p) {
+		return false
+	}
+	if err := blocked.save(); err != nil {
+		peerLog.Errorf("Failed to save blocklist: %v", err)
+	}
+	return true
+}
+
+// banRange bans the IP range prefix and closes the connections from it.
+func banRange(prefix netip.Prefix, reason string) {
+	blocked.addRange(prefix, reason)
+	if err := blocked.save(); err != nil {
+		peerLog.Errorf("Failed to save blocklist: %v", err)
+	}
+
+	if node != nil {
+		for _, conn := range node.Network().Conns() {
+			if blocked.hasAddr(conn.RemoteMultiaddr()) {
+				if err := conn.Close(); err != nil {
+					peerLog.Debugf("Failed to close connection to %s: %v", conn.RemotePeer(), err)
+				}
+			}
+		}
+	}
+}
+
+// unbanRange lifts the ban of the IP range prefix and reports whether it
+// was banned.
+func unbanRange(prefix netip.Prefix) bool {
+	if !blocked.removeRange(prefix) {
+		return false
+	}
+	if err := blocked.save(); err != nil {
+		peerLog.Errorf("Failed to save blocklist: %v", err)
+	}
+	return true
+}
+
+// isBanned reports whether p is banned.
+func isBanned(p peer.ID) bool {
+	return blocked.hasPeer(p)
+}
+
+// allowMessage reports whether limiters let p send another message,
+// scoring p for flooding if not.
+func allowMessage(limiters *peerLimiters, p peer.ID) bool {
+	if limiters.get(p).Allow() {
+		return true
+	}
+	misbehave(p, misbehaviorFlood, "rate limit exceeded")
+	return false
+}
+
+// readMessage reads a message of at most limit bytes from r.
+func readMessage(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errMessageTooLarge, limit)
+	}
+	return data, nil
+}
+
+// isTimeout reports whether err is a read deadline running out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Requests of the file transfer protocol.  A peer a reply is awaited from
+// sends the reply on it, which is never parsed as a request.
+const (
+	msgRequest = "REQUEST"
+	msgName    = "NAME"
+	msgChunk   = "CHUNK"
+	msgExist   = "EXIST"
+	msgAccess  = "ACCESS"
+)
+
+// parseRequest splits a request of the file transfer protocol into its kind
+// and argument.  The kind is empty for messages that aren't requests.
+// Requests must name a valid hash, CHUNK requests a chunk index and ACCESS
+// requests a token.
+func parseRequest(data []byte) (string, string, error) {
+	kind, arg, ok := strings.Cut(string(data), ":")
+	switch {
+	case !ok:
+		return "", "", nil
+	case kind == msgChunk:
+		hash, _, err := parseChunkRequest(arg)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %v", errMalformedMessage, err)
+		}
+		if !validFileHash(hash) {
+			return "", "", fmt.Errorf("%w: bad hash in %s", errMalformedMessage, kind)
+		}
+	case kind == msgRequest || kind == msgName || kind == msgExist:
+		if !validFileHash(arg) {
+			return "", "", fmt.Errorf("%w: bad hash in %s", errMalformedMessage, kind)
+		}
+	case kind == msgAccess:
+		if _, err := base64.RawURLEncoding.DecodeString(arg); err != nil || arg == "" {
+			return "", "", fmt.Errorf("%w: bad token in %s", errMalformedMessage, kind)
+		}
+	default:
+		return "", "", nil
+	}
+	return kind, arg, nil
+}
+
+// validFileHash reports whether hash is a content ID in its canonical form
+// or a legacy hash.
+func validFileHash(hash string) bool {
+	if root, ok := parseContentID(hash); ok {
+		return rootCID(root).String() == hash
+	}
+	return isLegacyHash(hash)
+}
+
+// parsePeerExchange returns the peers listed in a peer exchange message.
+// Entries for self are left out.
+func parsePeerExchange(data []byte, self peer.ID) ([]peer.ID, error) {
+	var msg struct {
+		KnownPeers []struct {
+			PeerID string `json:"peer_id"`
+		} `json:"known_peers"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	peers := make([]peer.ID, 0, len(msg.KnownPeers))
+	seen := make(map[peer.ID]struct{}, len(msg.KnownPeers))
+	for _, known := range msg.KnownPeers {
+		id, err := peer.Decode(known.PeerID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad peer ID %q", errMalformedMessage, known.PeerID)
+		}
+		if _, ok := seen[id]; ok || id == self {
+			continue
+		}
+		seen[id] = struct{}{}
+		peers = append(peers, id)
+	}
+	return peers, nil
+}
+
+// replySlot is where the reply to the request in flight to a peer goes.
+// Replies don't say which request they answer, so requests to a peer take
+// turns: turn is held from sending a request until its reply arrives or, if
+// the request gives up, until the late reply arrives or replyTimeout passes,
+// so it is never taken for the reply to the next request.
+type replySlot struct {
+	turn    chan struct{}
+	reply   chan []byte
+	claimed bool
+	users   int
+}
+
+var (
+	// pendingMtx protects pendingReplies and the reply of every slot.
+	pendingMtx sync.Mutex
+
+	// pendingReplies holds the reply slot of every peer a request is
+	// waiting for or in flight to.  Replies from anyone else are
+	// unsolicited.
+	pendingReplies = make(map[peer.ID]*replySlot)
+)
+
+// claimReply returns the channel the reply from p is to be delivered on,
+// once, or nil if no reply from p is awaited or another stream of p already
+// claimed it.  The channel has room for the reply, so delivering it never
+// blocks.
+func claimReply(p peer.ID) chan<- []byte {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	slot := pendingReplies[p]
+	if slot == nil || slot.reply == nil || slot.claimed {
+		return nil
+	}
+	slot.claimed = true
+	return slot.reply
+}
+
+// beginRequest waits up to timeout for the turn to send p a request and
+// returns the channel its reply will be delivered on.  endRequest must be
+// called once the reply is no longer awaited.
+func beginRequest(p peer.ID, timeout <-chan time.Time) (*replySlot, chan []byte, error) {
+	pendingMtx.Lock()
+	slot := pendingReplies[p]
+	if slot == nil {
+		slot = &replySlot{turn: make(chan struct{}, 1)}
+		pendingReplies[p] = slot
+	}
+	slot.users++
+	pendingMtx.Unlock()
+
+	select {
+	case slot.turn <- struct{}{}:
+	case <-timeout:
+		releaseSlot(p, slot)
+		return nil, nil, fmt.Errorf("%w from %s: earlier request still in flight", errReplyTimeout, p)
+	}
+	reply := make(chan []byte, 1)
+	pendingMtx.Lock()
+	slot.reply, slot.claimed = reply, false
+	pendingMtx.Unlock()
+	return slot, reply, nil
+}
+
+// endRequest gives up the turn taken by beginRequest.
+func endRequest(p peer.ID, slot *replySlot) {
+	pendingMtx.Lock()
+	slot.reply = nil
+	pendingMtx.Unlock()
+	<-slot.turn
+	releaseSlot(p, slot)
+}
+
+// releaseSlot forgets the reply slot of p once nobody uses it.
+func releaseSlot(p peer.ID, slot *replySlot) {
+	pendingMtx.Lock()
+	defer pendingMtx.Unlock()
+	if slot.users--; slot.users == 0 && pendingReplies[p] == slot {
+		delete(pendingReplies, p)
+	}
+}
+
+// replyLimit returns the size limit of a reply from p.
+func replyLimit(p peer.ID) int64 {
+	if _, ok := downloads.Load(p.String()); ok {
+		return maxLegacyFileSize
+	}
+	return maxChunkReplySize
+}
+
+// requestFromPeer sends msg to peerID and waits up to timeout for the reply.
+func requestFromPeer(peerID, msg string, timeout time.Duration) ([]byte, error) {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID %q: %w", peerID, err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	slot, reply, err := beginRequest(p, timer.C)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sendDataToPeer(node, peerID, msg); err != nil {
+		endRequest(p, slot)
+		return nil, err
+	}
+	select {
+	case data := <-reply:
+		endRequest(p, slot)
+		return data, nil
+	case <-timer.C:
+		go func() {
+			select {
+			case <-reply:
+				xferLog.Debugf("Dropped late reply from %s", p)
+			case <-time.After(replyTimeout):
+			}
+			endRequest(p, slot)
+		}()
+		return nil, fmt.Errorf("%w from %s", errReplyTimeout, peerID)
+	}
+}
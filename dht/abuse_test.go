@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"lukechampine.com/blake3"
+)
+
+// withConfig runs the test with c as the active configuration.
+func withConfig(t *testing.T, c *config) {
+	t.Helper()
+	old := cfg
+	cfg = c
+	t.Cleanup(func() { cfg = old })
+}
+
+// resetAbuse forgets all ban scores and bans.
+func resetAbuse(t *testing.T) {
+	t.Helper()
+	abuseMtx.Lock()
+	banScores = make(map[peer.ID]*banScore)
+	abuseMtx.Unlock()
+	blocked = newBlocklist("")
+}
+
+// TestParseRequest checks that well-formed requests are recognized, that
+// malformed ones are rejected and that everything else is taken for a reply.
+func TestParseRequest(t *testing.T) {
+	contentID := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	sum := sha256.Sum256([]byte("orcanet"))
+	legacy := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		msg     string
+		kind    string
+		arg     string
+		invalid bool
+	}{
+		{name: "request content ID", msg: "REQUEST:" + contentID, kind: msgRequest, arg: contentID},
+		{name: "request legacy hash", msg: "REQUEST:" + legacy, kind: msgRequest, arg: legacy},
+		{name: "name", msg: "NAME:" + contentID, kind: msgName, arg: contentID},
+		{name: "exist", msg: "EXIST:" + legacy, kind: msgExist, arg: legacy},
+		{name: "chunk", msg: "CHUNK:" + contentID + ":3", kind: msgChunk, arg: contentID + ":3"},
+		{name: "access", msg: "ACCESS:b3JjYW5ldA", kind: msgAccess, arg: "b3JjYW5ldA"},
+
+		{name: "request without hash", msg: "REQUEST:", invalid: true},
+		{name: "request with short hash", msg: "REQUEST:" + legacy[:63], invalid: true},
+		{name: "request with non-hex hash", msg: "REQUEST:" + strings.Repeat("z", 64), invalid: true},
+		{name: "request with trailing newline", msg: "REQUEST:" + contentID + "\n", invalid: true},
+		{name: "request with path", msg: "REQUEST:../../etc/passwd", invalid: true},
+		{name: "name with NUL byte", msg: "NAME:" + contentID + "\x00", invalid: true},
+		{name: "exist with CIDv0", msg: "EXIST:QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", invalid: true},
+		{name: "chunk without index", msg: "CHUNK:" + contentID, invalid: true},
+		{name: "chunk with empty index", msg: "CHUNK:" + contentID + ":", invalid: true},
+		{name: "chunk with negative index", msg: "CHUNK:" + contentID + ":-1", invalid: true},
+		{name: "chunk with text index", msg: "CHUNK:" + contentID + ":one", invalid: true},
+		{name: "chunk with overflowing index", msg: "CHUNK:" + contentID + ":18446744073709551616", invalid: true},
+		{name: "chunk without hash", msg: "CHUNK::0", invalid: true},
+		{name: "chunk with bad hash", msg: "CHUNK:nothash:0", invalid: true},
+		{name: "access without token", msg: "ACCESS:", invalid: true},
+		{name: "access with padded token", msg: "ACCESS:b3JjYW5ldA==", invalid: true},
+		{name: "access with non-base64 token", msg: "ACCESS:not a token", invalid: true},
+
+		{name: "reply true", msg: "true"},
+		{name: "reply false", msg: "false"},
+		{name: "empty reply", msg: ""},
+		{name: "binary reply", msg: "\x00\x01\x02\xff"},
+		{name: "unknown kind", msg: "DELETE:" + contentID},
+		{name: "lower case kind", msg: "request:" + contentID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kind, arg, err := parseRequest([]byte(test.msg))
+			if test.invalid {
+				if !errors.Is(err, errMalformedMessage) {
+					t.Fatalf("want errMalformedMessage, got kind %q, err %v", kind, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if kind != test.kind || arg != test.arg {
+				t.Fatalf("got (%q, %q), want (%q, %q)", kind, arg, test.kind, test.arg)
+			}
+		})
+	}
+}
+
+// TestReadMessage checks the size limit of inbound messages.
+func TestReadMessage(t *testing.T) {
+	data, err := readMessage(strings.NewReader(strings.Repeat("a", maxRequestSize)), maxRequestSize)
+	if err != nil || len(data) != maxRequestSize {
+		t.Fatalf("message at the limit: got %d bytes, err %v", len(data), err)
+	}
+
+	_, err = readMessage(strings.NewReader(strings.Repeat("a", maxRequestSize+1)), maxRequestSize)
+	if !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("message over the limit: want errMessageTooLarge, got %v", err)
+	}
+
+	// An endless stream must stop at the limit rather than exhaust memory.
+	_, err = readMessage(io.MultiReader(strings.NewReader("REQUEST:"), zeroReader{}), maxRequestSize)
+	if !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("endless message: want errMessageTooLarge, got %v", err)
+	}
+
+	_, err = readMessage(iotest.ErrReader(io.ErrUnexpectedEOF), maxRequestSize)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("read error: want io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// TestParsePeerExchange checks the validation of peer exchange messages.
+func TestParsePeerExchange(t *testing.T) {
+	self, a, b := testPeerID(t), testPeerID(t), testPeerID(t)
+
+	peers, err := parsePeerExchange([]byte(`{"known_peers":[{"peer_id":"`+a.String()+`"},{"peer_id":"`+
+		b.String()+`"},{"peer_id":"`+a.String()+`"},{"peer_id":"`+self.String()+`"}]}`), self)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(peers) != 2 || peers[0] != a || peers[1] != b {
+		t.Fatalf("got %v, want [%s %s] without duplicates or self", peers, a, b)
+	}
+
+	peers, err = parsePeerExchange([]byte(`{"known_peers":[]}`), self)
+	if err != nil || len(peers) != 0 {
+		t.Fatalf("empty list: got %v, err %v", peers, err)
+	}
+	peers, err = parsePeerExchange([]byte(`{}`), self)
+	if err != nil || len(peers) != 0 {
+		t.Fatalf("missing list: got %v, err %v", peers, err)
+	}
+
+	malformed := []struct {
+		name string
+		msg  string
+	}{
+		{"empty", ``},
+		{"not JSON", `known_peers`},
+		{"truncated", `{"known_peers":[{"peer_id":"` + a.String()},
+		{"list is an object", `{"known_peers":{"peer_id":"` + a.String() + `"}}`},
+		{"peer ID is a number", `{"known_peers":[{"peer_id":42}]}`},
+		{"peer ID is garbage", `{"known_peers":[{"peer_id":"not-a-peer"}]}`},
+		{"peer ID is empty", `{"known_peers":[{"peer_id":""}]}`},
+		{"peer ID is a multiaddr", `{"known_peers":[{"peer_id":"/ip4/1.2.3.4/tcp/1/p2p/` + a.String() + `"}]}`},
+		{"top level array", `[{"peer_id":"` + a.String() + `"}]`},
+	}
+	for _, test := range malformed {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parsePeerExchange([]byte(test.msg), self); !errors.Is(err, errMalformedMessage) {
+				t.Fatalf("want errMalformedMessage, got %v", err)
+			}
+		})
+	}
+}
+
+// TestIsBootstrapPeer checks that only the bootstrap nodes may send legacy
+// peer lists.
+func TestIsBootstrapPeer(t *testing.T) {
+	for _, addr := range []string{native_bootstrap, bootstrap_node_addr_1, bootstrap_node_addr_2} {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			t.Fatalf("invalid bootstrap address %s: %v", addr, err)
+		}
+		if !isBootstrapPeer(info.ID) {
+			t.Errorf("%s isn't taken for a bootstrap node", info.ID)
+		}
+	}
+	relay, err := peer.AddrInfoFromString(relay_node_addr)
+	if err != nil {
+		t.Fatalf("invalid relay address: %v", err)
+	}
+	for _, p := range []peer.ID{testPeerID(t), relay.ID} {
+		if isBootstrapPeer(p) {
+			t.Errorf("%s is taken for a bootstrap node", p)
+		}
+	}
+}
+
+// TestBanScore checks that the persistent part of a ban score stays and the
+// transient part decays.
+func TestBanScore(t *testing.T) {
+	var s banScore
+	now := time.Unix(1700000000, 0)
+
+	if got := s.increase(10, 0, now); got != 10 {
+		t.Fatalf("persistent increase: got %d, want 10", got)
+	}
+	if got := s.increase(0, 40, now); got != 50 {
+		t.Fatalf("transient increase: got %d, want 50", got)
+	}
+	if got := s.score(now.Add(banScoreHalfLife)); got != 30 {
+		t.Fatalf("after one half-life: got %d, want 30", got)
+	}
+	if got := s.increase(0, 20, now.Add(banScoreHalfLife)); got != 50 {
+		t.Fatalf("increase after decay: got %d, want 50", got)
+	}
+	if got := s.score(now.Add(banScoreHalfLife + banScoreLifetime + time.Second)); got != 10 {
+		t.Fatalf("after lifetime: got %d, want 10", got)
+	}
+	if got := s.score(now); got != 50 {
+		t.Fatalf("clock going backwards: got %d, want 50", got)
+	}
+}
+
+// TestMisbehaveBans checks that peers are banned once their score reaches
+// the threshold, and not at all with banning disabled.
+func TestMisbehaveBans(t *testing.T) {
+	withConfig(t, &config{BanThreshold: 100, BanDuration: time.Hour})
+	resetAbuse(t)
+
+	p := testPeerID(t)
+	for i := 0; i < 9; i++ {
+		misbehave(p, misbehaviorMalformed, "test")
+		if isBanned(p) {
+			t.Fatalf("banned after %d malformed messages", i+1)
+		}
+	}
+	misbehave(p, misbehaviorMalformed, "test")
+	if !isBanned(p) {
+		t.Fatal("not banned after reaching the threshold")
+	}
+
+	other := testPeerID(t)
+	if isBanned(other) {
+		t.Fatal("ban applied to another peer")
+	}
+
+	cfg.NoBanning = true
+	for i := 0; i < 20; i++ {
+		misbehave(other, misbehaviorOversized, "test")
+	}
+	if isBanned(other) {
+		t.Fatal("banned with banning disabled")
+	}
+}
+
+// TestBanExpires checks that bans end after their duration.
+func TestBanExpires(t *testing.T) {
+	resetAbuse(t)
+	p := testPeerID(t)
+	banPeer(p, time.Now().Add(-time.Second), "test")
+	if isBanned(p) {
+		t.Fatal("expired ban still applies")
+	}
+	banPeer(p, time.Now().Add(time.Hour), "test")
+	if !isBanned(p) {
+		t.Fatal("ban doesn't apply")
+	}
+}
+
+// TestFloodBans checks that a peer sending requests faster than the rate
+// limit is refused and eventually banned.
+func TestFloodBans(t *testing.T) {
+	withConfig(t, &config{BanThreshold: 100, BanDuration: time.Hour})
+	resetAbuse(t)
+
+	p := testPeerID(t)
+	allowed := 0
+	for i := 0; i < requestBurst+100 && !isBanned(p); i++ {
+		if allowMessage(requestLimiters, p) {
+			allowed++
+		}
+	}
+	if allowed < requestBurst || allowed > requestBurst+requestRate {
+		t.Fatalf("%d requests allowed, want about the burst of %d", allowed, requestBurst)
+	}
+	if !isBanned(p) {
+		t.Fatal("flooding peer not banned")
+	}
+}
+
+// TestReadRequest checks that messages outside of replies are read as
+// requests, and that replies nobody asked for and malformed requests are
+// dropped and count against the sender.
+func TestReadRequest(t *testing.T) {
+	withConfig(t, &config{BanThreshold: 100, BanDuration: time.Hour})
+	resetAbuse(t)
+
+	contentID := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	p := testPeerID(t)
+	kind, arg, ok := readRequest(p, strings.NewReader("EXIST:"+contentID))
+	if !ok || kind != msgExist || arg != contentID {
+		t.Fatalf("got (%q, %q, %v), want (%q, %q, true)", kind, arg, ok, msgExist, contentID)
+	}
+	abuseMtx.Lock()
+	_, scored := banScores[p]
+	abuseMtx.Unlock()
+	if scored {
+		t.Fatal("valid request scored")
+	}
+
+	for _, msg := range []string{"false", "EXIST:nothash", strings.Repeat("a", maxRequestSize+1)} {
+		p := testPeerID(t)
+		if _, _, ok := readRequest(p, strings.NewReader(msg)); ok {
+			t.Fatalf("%.20q read as a request", msg)
+		}
+		abuseMtx.Lock()
+		s, ok := banScores[p]
+		abuseMtx.Unlock()
+		if !ok || s.score(time.Now()) == 0 {
+			t.Fatalf("%.20q not scored", msg)
+		}
+	}
+}
+
+// TestReplyRouting checks that replies go to the request made to their
+// sender whatever they hold, that a peer gets one reply per request, and
+// that requests to the same peer take turns.
+func TestReplyRouting(t *testing.T) {
+	withConfig(t, &config{BanThreshold: 100, BanDuration: time.Hour})
+	resetAbuse(t)
+
+	p, q := testPeerID(t), testPeerID(t)
+	never := make(chan time.Time)
+	pSlot, pReply, err := beginRequest(p, never)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	qSlot, qReply, err := beginRequest(q, never)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	contentID := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	replies := map[peer.ID]string{q: "from q", p: "EXIST:" + contentID}
+	for _, id := range []peer.ID{q, p} {
+		reply := claimReply(id)
+		if reply == nil {
+			t.Fatalf("reply from %s not awaited", id)
+		}
+		reply <- []byte(replies[id])
+		if claimReply(id) != nil {
+			t.Fatalf("second reply from %s awaited", id)
+		}
+	}
+	if got := string(<-pReply); got != replies[p] {
+		t.Fatalf("request to p got %q", got)
+	}
+	if got := string(<-qReply); got != replies[q] {
+		t.Fatalf("request to q got %q", got)
+	}
+
+	expired := make(chan time.Time, 1)
+	expired <- time.Now()
+	if _, _, err := beginRequest(p, expired); !errors.Is(err, errReplyTimeout) {
+		t.Fatalf("second request to p while one is in flight: want errReplyTimeout, got %v", err)
+	}
+	endRequest(p, pSlot)
+	endRequest(q, qSlot)
+
+	if claimReply(p) != nil {
+		t.Fatal("reply awaited after the request ended")
+	}
+	pendingMtx.Lock()
+	left := len(pendingReplies)
+	pendingMtx.Unlock()
+	if left != 0 {
+		t.Fatalf("%d reply slots left after all requests ended", left)
+	}
+}
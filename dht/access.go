@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Every stored file has a visibility.  Public files are priced and provided
+// in the DHT.  Unlisted files are kept out of the DHT but served to any peer
+// that knows their hash.  Private files are kept out of the DHT too and are
+// only served to the peers on their allowlist and to holders of an access
+// token the node signed for them, which present it with an ACCESS request
+// before asking for the file.  Other peers are answered as if the node
+// didn't have the file.
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted"
+	visibilityPrivate  = "private"
+)
+
+// visibilities lists the supported visibilities.
+var visibilities = []string{visibilityPublic, visibilityUnlisted, visibilityPrivate}
+
+const (
+	// accessTokenDomain is the signature domain of access tokens.
+	accessTokenDomain = "orcanet-access-token"
+
+	// defaultTokenTTL is how long an access token is valid unless asked
+	// otherwise.
+	defaultTokenTTL = 7 * 24 * time.Hour
+
+	// maxAccessGrants is the most tokens presented by peers that are
+	// remembered at once.
+	maxAccessGrants = 4096
+)
+
+// accessTokenCodec is the payload type of access tokens.
+var accessTokenCodec = []byte("/orcanet/access-token")
+
+func init() {
+	record.RegisterType(&accessTokenRecord{})
+}
+
+var (
+	// errAccessDenied is returned when a provider refuses an access token.
+	errAccessDenied = errors.New("access denied")
+
+	// errBadToken is returned for an access token that wasn't issued by
+	// this node for the peer presenting it, or has expired.
+	errBadToken = errors.New("invalid access token")
+)
+
+// fileAccess is who may fetch a stored file.  Allow and TokensSince only
+// apply to private files: tokens issued before TokensSince are refused.
+type fileAccess struct {
+	Visibility  string
+	Allow       []peer.ID
+	TokensSince time.Time
+}
+
+var (
+	// publicAccess is the access of published files.
+	publicAccess = fileAccess{Visibility: visibilityPublic}
+
+	// unlistedAccess is the access of files only served by hash.
+	unlistedAccess = fileAccess{Visibility: visibilityUnlisted}
+)
+
+// accessTokenRecord allows Grantee, or anyone holding the token if it is
+// empty, to fetch Hash from Issuer until Expires.
+type accessTokenRecord struct {
+	Issuer  peer.ID   `json:"issuer"`
+	Hash    string    `json:"hash"`
+	Grantee peer.ID   `json:"grantee,omitempty"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+}
+
+func (r *accessTokenRecord) Domain() string { return accessTokenDomain }
+
+func (r *accessTokenRecord) Codec() []byte { return accessTokenCodec }
+
+func (r *accessTokenRecord) MarshalRecord() ([]byte, error) { return json.Marshal(r) }
+
+func (r *accessTokenRecord) UnmarshalRecord(data []byte) error { return json.Unmarshal(data, r) }
+
+// accessGrant is a peer's access to a private file through a token.
+type accessGrant struct {
+	peer peer.ID
+	hash string
+}
+
+var (
+	// accessMtx protects privateFiles and grants.
+	accessMtx sync.RWMutex
+
+	// privateFiles maps the hashes of private files to their access.
+	privateFiles = make(map[string]fileAccess)
+
+	// grants maps a peer and a private file to the token the peer
+	// presented for it.
+	grants = make(map[accessGrant]*accessTokenRecord)
+)
+
+// recordAccess returns the access of a stored file record.  Records
+// without a visibility are public unless they are unlisted.
+func recordAccess(record map[string]interface{}) fileAccess {
+	access := publicAccess
+	if unlisted, _ := record["unlisted"].(bool); unlisted {
+		access = unlistedAccess
+	}
+	if visibility, ok := record["visibility"].(string); ok && visibility != "" {
+		access.Visibility = visibility
+	}
+	if allow, ok := record["allow"].(primitive.A); ok {
+		for _, id := range allow {
+			if s, _ := id.(string); s != "" {
+				if p, err := peer.Decode(s); err == nil {
+					access.Allow = append(access.Allow, p)
+				}
+			}
+		}
+	}
+	if since, ok := record["tokens_since"].(primitive.DateTime); ok {
+		access.TokensSince = since.Time()
+	}
+	return access
+}
+
+// trackAccess makes the stream handler enforce access for hash.
+func trackAccess(hash string, access fileAccess) {
+	accessMtx.Lock()
+	defer accessMtx.Unlock()
+	if access.Visibility == visibilityPrivate {
+		privateFiles[hash] = access
+		return
+	}
+	delete(privateFiles, hash)
+	for g := range grants {
+		if g.hash == hash {
+			delete(grants, g)
+		}
+	}
+}
+
+// loadAccess loads the access of the stored private files.
+func loadAccess() error {
+	records, err := FetchAllFileRecords()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		hash, _ := record["hash"].(string)
+		if access := recordAccess(record); access.Visibility == visibilityPrivate && hash != "" {
+			trackAccess(hash, access)
+		}
+	}
+	return nil
+}
+
+// mayAccess reports whether remote may fetch hash.
+func mayAccess(remote peer.ID, hash string) bool {
+	accessMtx.RLock()
+	defer accessMtx.RUnlock()
+	access, private := privateFiles[hash]
+	if !private || slices.Contains(access.Allow, remote) {
+		return true
+	}
+	token, ok := grants[accessGrant{remote, hash}]
+	return ok && time.Now().Before(token.Expires) && !token.Issued.Before(access.TokensSince)
+}
+
+// isPrivate reports whether hash is a private file.
+func isPrivate(hash string) bool {
+	accessMtx.RLock()
+	defer accessMtx.RUnlock()
+	_, private := privateFiles[hash]
+	return private
+}
+
+// setFileAccess changes who may fetch the stored file hash, publishing it to
+// the DHT or withdrawing it as its visibility requires.
+func setFileAccess(hash string, access fileAccess) error {
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve record: %w", err)
+	}
+	if record == nil {
+		return errFileNotFound
+	}
+	old := recordAccess(record)
+
+	// Restrict access before withdrawing the file and only widen it once
+	// it is stored, so it is never served more widely than either setting.
+	if access.Visibility == visibilityPrivate {
+		trackAccess(hash, access)
+	}
+	if err := SetFileAccess(hash, access); err != nil {
+		trackAccess(hash, old)
+		return err
+	}
+	trackAccess(hash, access)
+
+	switch {
+	case old.Visibility == visibilityPublic && access.Visibility != visibilityPublic:
+		if err := dhtRoute.PutValue(ctx, fileKey(hash), []byte("null")); err != nil {
+			return fmt.Errorf("failed to put record for key %v and value null: %w", hash, err)
+		}
+		if err := provideKey(ctx, dhtRoute, hash, false); err != nil {
+			return fmt.Errorf("failed to stop providing record for key %v: %w", hash, err)
+		}
+	case old.Visibility != visibilityPublic && access.Visibility == visibilityPublic:
+		cost := recordAmount(record, "cost")
+		if err := dhtRoute.PutValue(ctx, fileKey(hash), []byte(formatCost(cost))); err != nil {
+			return fmt.Errorf("failed to put record for key %v and value %v: %w", hash, formatCost(cost), err)
+		}
+		if err := provideKey(ctx, dhtRoute, hash, true); err != nil {
+			return fmt.Errorf("failed to provide record for key %v: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// issueAccessToken returns a token allowing grantee, or whoever holds it if
+// grantee is empty, to fetch hash from this node until expires.
+func issueAccessToken(hash string, grantee peer.ID, expires time.Time) (string, error) {
+	key := node.Peerstore().PrivKey(node.ID())
+	if key == nil {
+		return "", errors.New("no private key for the local peer")
+	}
+	env, err := record.Seal(&accessTokenRecord{
+		Issuer:  node.ID(),
+		Hash:    hash,
+		Grantee: grantee,
+		Issued:  time.Now().UTC(),
+		Expires: expires.UTC(),
+	}, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign access token: %w", err)
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// openAccessToken checks that token was issued by this node for remote and
+// is still valid, and returns it.
+func openAccessToken(remote peer.ID, token string) (*accessTokenRecord, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadToken, err)
+	}
+	env, rec, err := record.ConsumeEnvelope(data, accessTokenDomain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadToken, err)
+	}
+	tok, ok := rec.(*accessTokenRecord)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an access token", errBadToken)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	switch {
+	case err != nil || signer != node.ID() || tok.Issuer != node.ID():
+		return nil, fmt.Errorf("%w: not issued by this node", errBadToken)
+	case tok.Grantee != "" && tok.Grantee != remote:
+		return nil, fmt.Errorf("%w: issued to %s", errBadToken, tok.Grantee)
+	case !time.Now().Before(tok.Expires):
+		return nil, fmt.Errorf("%w: expired at %v", errBadToken, tok.Expires)
+	}
+	return tok, nil
+}
+
+// serveAccess answers an ACCESS request: remote presents a token and is
+// told whether it was accepted.  Accepted tokens let remote fetch the file
+// until they expire.
+func serveAccess(remote peer.ID, token string) {
+	tok, err := openAccessToken(remote, token)
+	if err == nil {
+		accessMtx.Lock()
+		if len(grants) >= maxAccessGrants {
+			pruneGrants()
+		}
+		if len(grants) < maxAccessGrants {
+			grants[accessGrant{remote, tok.Hash}] = tok
+		} else {
+			err = errors.New("too many access grants")
+		}
+		accessMtx.Unlock()
+	}
+
+	reply := "true"
+	if err != nil {
+		xferLog.Debugf("Refused access token of %s: %v", remote, err)
+		reply = "false"
+	}
+	if err := sendDataToPeer(node, remote.String(), reply); err != nil {
+		xferLog.Errorf("Failed to answer ACCESS of %s: %v", remote, err)
+	}
+}
+
+// pruneGrants forgets expired grants.  accessMtx must be held.
+func pruneGrants() {
+	now := time.Now()
+	for g, tok := range grants {
+		if !now.Before(tok.Expires) {
+			delete(grants, g)
+		}
+	}
+}
+
+// presentToken sends peerID an access token, so it serves a private file.
+func presentToken(peerID, token string) error {
+	reply, err := requestFromPeer(peerID, msgAccess+":"+token, replyTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to present access token to %s: %w", peerID, err)
+	}
+	if string(reply) != "true" {
+		return fmt.Errorf("%w: %s refused the access token", errAccessDenied, peerID)
+	}
+	return nil
+}
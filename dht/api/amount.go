@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// atomsPerDC is the number of atoms in one DC.
+var atomsPerDC = big.NewRat(btcutil.SatoshiPerBitcoin, 1)
+
+// ErrInvalidAmount is returned for amounts that aren't a non-negative number
+// of DC with at most eight decimals.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// maxAmountExponent bounds the exponent of a parsed amount, keeping absurd
+// ones like 1e-999999999 from taking long to parse.
+const maxAmountExponent = 32
+
+// ParseAmount parses a decimal number of DC, such as "1.5" or "2e-3", into
+// an exact amount.  Negative amounts, NaN, infinities, amounts finer than an
+// atom and amounts above the coin supply are rejected.
+func ParseAmount(s string) (btcutil.Amount, error) {
+	s = strings.TrimSpace(s)
+	if !isDecimal(s) {
+		return 0, fmt.Errorf("%w %q", ErrInvalidAmount, s)
+	}
+	dc, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrInvalidAmount, s)
+	}
+	if dc.Sign() < 0 {
+		return 0, fmt.Errorf("%w %q: must not be negative", ErrInvalidAmount, s)
+	}
+	atoms := dc.Mul(dc, atomsPerDC)
+	if !atoms.IsInt() {
+		return 0, fmt.Errorf("%w %q: more than 8 decimals", ErrInvalidAmount, s)
+	}
+	if !atoms.Num().IsInt64() || atoms.Num().Int64() > btcutil.MaxSatoshi {
+		return 0, fmt.Errorf("%w %q: exceeds the coin supply", ErrInvalidAmount, s)
+	}
+	return btcutil.Amount(atoms.Num().Int64()), nil
+}
+
+// isDecimal reports whether s is a plain decimal number with an optional,
+// small exponent.  It keeps out the fractions and base prefixes big.Rat
+// also accepts.
+func isDecimal(s string) bool {
+	mantissa, exponent, hasExponent := strings.Cut(strings.ToLower(s), "e")
+	if hasExponent {
+		exp, err := strconv.Atoi(exponent)
+		if err != nil || exp < -maxAmountExponent || exp > maxAmountExponent {
+			return false
+		}
+	}
+	mantissa = strings.TrimLeft(mantissa, "+-")
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	if whole == "" && frac == "" {
+		return false
+	}
+	return strings.Trim(whole+frac, "0123456789") == ""
+}
+
+// FormatAmount renders a as a number of DC without trailing zeros or a
+// unit, such as "1.5".  It is the inverse of ParseAmount.
+func FormatAmount(a btcutil.Amount) string {
+	sign := ""
+	atoms := int64(a)
+	if atoms < 0 {
+		sign, atoms = "-", -atoms
+	}
+	whole := strconv.FormatInt(atoms/btcutil.SatoshiPerBitcoin, 10)
+	frac := atoms % btcutil.SatoshiPerBitcoin
+	if frac == 0 {
+		return sign + whole
+	}
+	decimals := strings.TrimRight(fmt.Sprintf("%08d", frac), "0")
+	return sign + whole + "." + decimals
+}
+
+// Amount is an amount of DC in the API.  It counts atoms like the
+// btcutil.Amount it converts to, so prices add up exactly, and is written in
+// JSON as a number of DC, e.g. 1.5.  Quoted numbers are accepted as well.
+type Amount btcutil.Amount
+
+// String returns the amount with its unit, e.g. "1.5 DC".
+func (a Amount) String() string {
+	return FormatAmount(btcutil.Amount(a)) + " DC"
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(FormatAmount(btcutil.Amount(a))), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	amount, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = Amount(amount)
+	return nil
+}
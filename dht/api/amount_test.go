@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// TestParseAmount checks that amounts are parsed exactly and that amounts
+// which can't be represented are rejected rather than rounded.
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want btcutil.Amount
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1", 100_000_000, true},
+		{"1.5", 150_000_000, true},
+		{"0.1", 10_000_000, true},
+		{"0.3", 30_000_000, true},
+		{"0.00000001", 1, true},
+		{"1.10000000", 110_000_000, true},
+		{"+2", 200_000_000, true},
+		{".5", 50_000_000, true},
+		{"5.", 500_000_000, true},
+		{" 3 ", 300_000_000, true},
+		{"1e-8", 1, true},
+		{"2.5E3", 250_000_000_000, true},
+		{"1e+2", 10_000_000_000, true},
+		{"21e6", btcutil.MaxSatoshi, true},
+		{"20999999.99999999", 2_099_999_999_999_999, true},
+		{"21000000", btcutil.MaxSatoshi, true},
+		{"-0", 0, true},
+
+		{"-1", 0, false},
+		{"-0.00000001", 0, false},
+		{"0.000000001", 0, false},
+		{"1e-9", 0, false},
+		{"21000000.00000001", 0, false},
+		{"1e33", 0, false},
+		{"1e-33", 0, false},
+		{"1e999999999", 0, false},
+		{"99999999999999999999999", 0, false},
+		{"1/2", 0, false},
+		{"0x10", 0, false},
+		{"0b1", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"-Inf", 0, false},
+		{"1,5", 0, false},
+		{"1.5 DC", 0, false},
+		{"", 0, false},
+		{".", 0, false},
+		{"e5", 0, false},
+		{"1e", 0, false},
+	}
+	for _, test := range tests {
+		got, err := ParseAmount(test.in)
+		if test.ok {
+			if err != nil || got != test.want {
+				t.Errorf("ParseAmount(%q) = %d, %v, want %d", test.in, got, err, test.want)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %v", test.in, got, err, ErrInvalidAmount)
+		}
+	}
+}
+
+// TestFormatAmount checks that formatted amounts are exact, minimal and
+// parse back to the same amount.
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		in   btcutil.Amount
+		want string
+	}{
+		{0, "0"},
+		{1, "0.00000001"},
+		{10_000_000, "0.1"},
+		{30_000_000, "0.3"},
+		{100_000_000, "1"},
+		{150_000_000, "1.5"},
+		{123_456_789, "1.23456789"},
+		{2_099_999_999_999_999, "20999999.99999999"},
+		{btcutil.MaxSatoshi, "21000000"},
+		{-150_000_000, "-1.5"},
+		{-1, "-0.00000001"},
+	}
+	for _, test := range tests {
+		got := FormatAmount(test.in)
+		if got != test.want {
+			t.Errorf("FormatAmount(%d) = %q, want %q", test.in, got, test.want)
+		}
+		if test.in < 0 {
+			continue
+		}
+		if back, err := ParseAmount(got); err != nil || back != test.in {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", got, back, err, test.in)
+		}
+	}
+}
+
+// TestAmountJSON checks the JSON codec of Amount: numbers of DC out,
+// numbers or quoted numbers in.
+func TestAmountJSON(t *testing.T) {
+	type priced struct {
+		Cost Amount `json:"cost"`
+	}
+
+	out, err := json.Marshal(priced{Cost: Amount(2_099_999_999_999_999)})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if string(out) != `{"cost":20999999.99999999}` {
+		t.Errorf("Marshal = %s", out)
+	}
+
+	tests := []struct {
+		in   string
+		want Amount
+		ok   bool
+	}{
+		{`{"cost":1.5}`, 150_000_000, true},
+		{`{"cost":"1.5"}`, 150_000_000, true},
+		{`{"cost":1e-8}`, 1, true},
+		{`{"cost":20999999.99999999}`, 2_099_999_999_999_999, true},
+		{`{"cost":null}`, 0, true},
+		{`{}`, 0, true},
+
+		{`{"cost":-1}`, 0, false},
+		{`{"cost":0.000000001}`, 0, false},
+		{`{"cost":21000001}`, 0, false},
+		{`{"cost":"NaN"}`, 0, false},
+		{`{"cost":"1.5 DC"}`, 0, false},
+		{`{"cost":true}`, 0, false},
+		{`{"cost":[1]}`, 0, false},
+		{`{"cost":"1.5`, 0, false},
+	}
+	for _, test := range tests {
+		var p priced
+		err := json.Unmarshal([]byte(test.in), &p)
+		if test.ok && (err != nil || p.Cost != test.want) {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d", test.in, p.Cost, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Unmarshal(%s) = %d, want an error", test.in, p.Cost)
+		}
+	}
+}
@@ -0,0 +1,668 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// Client is a typed client for the version 1 HTTP API of a DHT node.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the node listening at baseURL, for example
+// "http://127.0.0.1:8080", authenticating with token.
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// ReadCookieFile returns the token stored in the auth cookie file the node
+// writes at startup.
+func ReadCookieFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(scanner.Text(), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed cookie file")
+	}
+	return parts[1], nil
+}
+
+// newRequest builds an authenticated request for path below BasePath.
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+BasePath+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends req and returns the response if it was successful.  Error
+// responses are decoded into an *Error.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var errResp ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code == "" {
+		errResp.Error = Error{Code: ErrInternal, Message: resp.Status}
+	}
+	errResp.Error.StatusCode = resp.StatusCode
+	return nil, &errResp.Error
+}
+
+// doJSON sends in (if not nil) as the JSON body of a request and decodes the
+// JSON response into out (if not nil).
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ListFiles returns one page of the files stored by the node.  A limit of
+// zero uses the server default.
+func (c *Client) ListFiles(ctx context.Context, offset, limit int64) (*FileList, error) {
+	q := url.Values{}
+	q.Set("offset", strconv.FormatInt(offset, 10))
+	if limit > 0 {
+		q.Set("limit", strconv.FormatInt(limit, 10))
+	}
+	var list FileList
+	if err := c.doJSON(ctx, http.MethodGet, "/files?"+q.Encode(), nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// UploadFile stores the contents of r on the node as filename and offers it
+// at the given price.  A nil access makes the file public.
+func (c *Client) UploadFile(ctx context.Context, filename string, r io.Reader, price Amount, access *FileAccess) (*File, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("price", FormatAmount(btcutil.Amount(price)))
+		if err == nil && access != nil {
+			err = mw.WriteField("visibility", access.Visibility)
+			if err == nil && len(access.Allow) > 0 {
+				err = mw.WriteField("allow", strings.Join(access.Allow, ","))
+			}
+		}
+		if err == nil {
+			var part io.Writer
+			part, err = mw.CreateFormFile("file", filename)
+			if err == nil {
+				_, err = io.Copy(part, r)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/files", pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var file File
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// DeleteFile removes the file with the given hash from the node and stops
+// providing it.
+func (c *Client) DeleteFile(ctx context.Context, hash string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/files/"+url.PathEscape(hash), nil, nil)
+}
+
+// FileAccess returns who may fetch the stored file with the given hash.
+func (c *Client) FileAccess(ctx context.Context, hash string) (*FileAccess, error) {
+	var access FileAccess
+	if err := c.doJSON(ctx, http.MethodGet, "/files/"+url.PathEscape(hash)+"/access", nil, &access); err != nil {
+		return nil, err
+	}
+	return &access, nil
+}
+
+// SetFileAccess changes who may find and fetch the stored file with the
+// given hash.
+func (c *Client) SetFileAccess(ctx context.Context, hash string, update *FileAccessUpdate) (*FileAccess, error) {
+	var access FileAccess
+	if err := c.doJSON(ctx, http.MethodPut, "/files/"+url.PathEscape(hash)+"/access", update, &access); err != nil {
+		return nil, err
+	}
+	return &access, nil
+}
+
+// IssueAccessToken returns a token granting access to the private file with
+// the given hash.
+func (c *Client) IssueAccessToken(ctx context.Context, hash string, req *AccessTokenRequest) (*AccessToken, error) {
+	var token AccessToken
+	if err := c.doJSON(ctx, http.MethodPost, "/files/"+url.PathEscape(hash)+"/tokens", req, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Providers returns the peers currently providing the file with the given
+// hash.
+func (c *Client) Providers(ctx context.Context, hash string) (*ProviderList, error) {
+	var list ProviderList
+	if err := c.doJSON(ctx, http.MethodGet, "/files/"+url.PathEscape(hash)+"/providers", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ProvidersWithMeta returns the peers currently providing the file with the
+// given hash, each with what it told about the file if it answered.
+func (c *Client) ProvidersWithMeta(ctx context.Context, hash string) (*ProviderList, error) {
+	var list ProviderList
+	if err := c.doJSON(ctx, http.MethodGet, "/files/"+url.PathEscape(hash)+"/providers?meta=true", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// FileMeta asks the peer with the given ID about the file with the given
+// hash before buying it.
+func (c *Client) FileMeta(ctx context.Context, peerID, hash string) (*FileMeta, error) {
+	var meta FileMeta
+	path := "/peers/" + url.PathEscape(peerID) + "/files/" + url.PathEscape(hash) + "/meta"
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Purchase downloads a file from a provider through the node, pays for it
+// and writes the contents to w.  It returns the file name the provider
+// reported.
+func (c *Client) Purchase(ctx context.Context, purchase *PurchaseRequest, w io.Writer) (string, error) {
+	b, err := json.Marshal(purchase)
+	if err != nil {
+		return "", err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/purchases", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var filename string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		filename = params["filename"]
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return filename, err
+	}
+	return filename, nil
+}
+
+// Storage reports the node's storage usage, pinned files and recent garbage
+// collections.
+func (c *Client) Storage(ctx context.Context) (*StorageReport, error) {
+	var report StorageReport
+	if err := c.doJSON(ctx, http.MethodGet, "/storage", nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CollectGarbage has the node evict cached files until its store fits the
+// quota.
+func (c *Client) CollectGarbage(ctx context.Context) (*GCRun, error) {
+	var run GCRun
+	if err := c.doJSON(ctx, http.MethodPost, "/storage/gc", nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Pin keeps the stored file with the given hash from being evicted.
+func (c *Client) Pin(ctx context.Context, hash string) error {
+	return c.doJSON(ctx, http.MethodPut, "/storage/pins/"+url.PathEscape(hash), nil, nil)
+}
+
+// Unpin lets the node evict the stored file with the given hash when short
+// of space.
+func (c *Client) Unpin(ctx context.Context, hash string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/storage/pins/"+url.PathEscape(hash), nil, nil)
+}
+
+// Denylist returns the node's denylist and the state of its subscriptions.
+func (c *Client) Denylist(ctx context.Context) (*Denylist, error) {
+	var list Denylist
+	if err := c.doJSON(ctx, http.MethodGet, "/denylist", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Deny adds a file to the node's local denylist, by hash or digest.
+func (c *Client) Deny(ctx context.Context, entry *DenylistEntry) (*DenylistEntry, error) {
+	var added DenylistEntry
+	if err := c.doJSON(ctx, http.MethodPost, "/denylist", entry, &added); err != nil {
+		return nil, err
+	}
+	return &added, nil
+}
+
+// Undeny removes a digest from the node's local denylist.
+func (c *Client) Undeny(ctx context.Context, digest string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/denylist/"+url.PathEscape(digest), nil, nil)
+}
+
+// ExportDenylist writes the node's local denylist, signed by its key, to w.
+func (c *Client) ExportDenylist(ctx context.Context, w io.Writer) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/denylist/signed", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Proxies returns the connected peers registered as proxies.
+func (c *Client) Proxies(ctx context.Context) (*ProxyList, error) {
+	var list ProxyList
+	if err := c.doJSON(ctx, http.MethodGet, "/proxies", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ProxyStatus reports whether the node is registered as a proxy.
+func (c *Client) ProxyStatus(ctx context.Context) (*ProxyStatus, error) {
+	var status ProxyStatus
+	if err := c.doJSON(ctx, http.MethodGet, "/proxies/self", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// RegisterProxy registers the node as a proxy.
+func (c *Client) RegisterProxy(ctx context.Context, reg *ProxyRegistration) (*ProxyStatus, error) {
+	var status ProxyStatus
+	if err := c.doJSON(ctx, http.MethodPut, "/proxies/self", reg, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// DeregisterProxy withdraws the node's proxy registration.
+func (c *Client) DeregisterProxy(ctx context.Context) error {
+	return c.doJSON(ctx, http.MethodDelete, "/proxies/self", nil, nil)
+}
+
+// SetWallet publishes address as the wallet the node is paid at.
+func (c *Client) SetWallet(ctx context.Context, address string) (*WalletMapping, error) {
+	var mapping WalletMapping
+	in := WalletMapping{Address: address}
+	if err := c.doJSON(ctx, http.MethodPut, "/wallet", &in, &mapping); err != nil {
+		return nil, err
+	}
+	return &mapping, nil
+}
+
+// Peers returns the peers the node is connected to.
+func (c *Client) Peers(ctx context.Context) (*PeerList, error) {
+	var list PeerList
+	if err := c.doJSON(ctx, http.MethodGet, "/peers", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// PeerBook returns the peers the node learned through peer exchange.
+func (c *Client) PeerBook(ctx context.Context) (*PeerBook, error) {
+	var book PeerBook
+	if err := c.doJSON(ctx, http.MethodGet, "/peers/book", nil, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// DHTStatus reports the node's DHT mode, routing table and reachability.  If
+// probe is set the node also checks whether its records can be found.
+func (c *Client) DHTStatus(ctx context.Context, probe bool) (*DHTStatus, error) {
+	var status DHTStatus
+	path := "/dht/status?probe=" + strconv.FormatBool(probe)
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Connectivity runs a connectivity self-test of the node.  If peerID isn't
+// empty the node also dials that peer directly, through the relay and by
+// hole punching, closing its existing connections to it first.
+func (c *Client) Connectivity(ctx context.Context, peerID string) (*ConnectivityReport, error) {
+	var report ConnectivityReport
+	path := "/diagnostics/connectivity"
+	if peerID != "" {
+		path += "?peer=" + url.QueryEscape(peerID)
+	}
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Bans returns the peers and IP ranges the node has banned.
+func (c *Client) Bans(ctx context.Context) (*Blocklist, error) {
+	var list Blocklist
+	if err := c.doJSON(ctx, http.MethodGet, "/peers/bans", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Ban bans a peer or an IP range and returns the updated blocklist.
+func (c *Client) Ban(ctx context.Context, req *BanRequest) (*Blocklist, error) {
+	var list Blocklist
+	if err := c.doJSON(ctx, http.MethodPost, "/peers/ban", req, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Unban lifts the ban of a peer or an IP range and returns the updated
+// blocklist.
+func (c *Client) Unban(ctx context.Context, req *UnbanRequest) (*Blocklist, error) {
+	var list Blocklist
+	if err := c.doJSON(ctx, http.MethodPost, "/peers/unban", req, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// PeerWallet returns the wallet address published by peerID.
+func (c *Client) PeerWallet(ctx context.Context, peerID string) (*WalletMapping, error) {
+	var mapping WalletMapping
+	if err := c.doJSON(ctx, http.MethodGet, "/peers/"+url.PathEscape(peerID)+"/wallet", nil, &mapping); err != nil {
+		return nil, err
+	}
+	return &mapping, nil
+}
+
+// ListNames returns the latest version of every name the node published.
+func (c *Client) ListNames(ctx context.Context) (*NameList, error) {
+	var list NameList
+	if err := c.doJSON(ctx, http.MethodGet, "/names", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// PublishName points the node's name at hash and returns the signed record.
+func (c *Client) PublishName(ctx context.Context, name, hash string) (*NameRecord, error) {
+	var rec NameRecord
+	in := NamePublication{Hash: hash}
+	if err := c.doJSON(ctx, http.MethodPut, "/names/"+url.PathEscape(name), &in, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// NameVersions returns every version of name the node published, newest
+// first.
+func (c *Client) NameVersions(ctx context.Context, name string) (*NameHistory, error) {
+	var history NameHistory
+	if err := c.doJSON(ctx, http.MethodGet, "/names/"+url.PathEscape(name)+"/versions", nil, &history); err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+// ResolveName returns the current record of name published by peerID.
+func (c *Client) ResolveName(ctx context.Context, peerID, name string) (*NameRecord, error) {
+	var rec NameRecord
+	path := "/peers/" + url.PathEscape(peerID) + "/names/" + url.PathEscape(name)
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// CollectionFile is a file to publish as part of a collection.  Price is set
+// to also sell the file on its own.
+type CollectionFile struct {
+	Path   string
+	Reader io.Reader
+	Price  *Amount
+}
+
+// CreateCollection publishes files as a collection called name, sold as a
+// bundle at price.
+func (c *Client) CreateCollection(ctx context.Context, name string, price Amount, files []CollectionFile) (*Collection, error) {
+	prices := make(map[string]Amount)
+	for _, f := range files {
+		if f.Price != nil {
+			prices[f.Path] = *f.Price
+		}
+	}
+	pricesJSON, err := json.Marshal(prices)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("name", name)
+		if err == nil {
+			err = mw.WriteField("price", FormatAmount(btcutil.Amount(price)))
+		}
+		if err == nil {
+			err = mw.WriteField("prices", string(pricesJSON))
+		}
+		for _, f := range files {
+			if err != nil {
+				break
+			}
+			var part io.Writer
+			part, err = mw.CreateFormFile("file", f.Path)
+			if err == nil {
+				_, err = io.Copy(part, f.Reader)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/collections", pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var collection Collection
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// ListCollections returns the collections the node published.
+func (c *Client) ListCollections(ctx context.Context) (*CollectionList, error) {
+	var list CollectionList
+	if err := c.doJSON(ctx, http.MethodGet, "/collections", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Collection describes the collection with the given root hash published by
+// the node.
+func (c *Client) Collection(ctx context.Context, root string) (*Collection, error) {
+	var collection Collection
+	if err := c.doJSON(ctx, http.MethodGet, "/collections/"+url.PathEscape(root), nil, &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// DeleteCollection removes a collection from the node and stops providing
+// it.
+func (c *Client) DeleteCollection(ctx context.Context, root string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/collections/"+url.PathEscape(root), nil, nil)
+}
+
+// PurchaseCollection downloads a collection, or the selected entries of it,
+// from a provider through the node, pays for it and writes it to w as a tar
+// archive.
+func (c *Client) PurchaseCollection(ctx context.Context, purchase *CollectionPurchaseRequest, w io.Writer) error {
+	b, err := json.Marshal(purchase)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/collections/purchases", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// LedgerQuery selects ledger entries.  An empty Kind selects purchases and
+// sales, and zero times leave that end of the time range open.
+type LedgerQuery struct {
+	Kind  string
+	Since time.Time
+	Until time.Time
+}
+
+// encode returns q as the query string of a ledger request.
+func (q *LedgerQuery) encode() string {
+	v := url.Values{}
+	if q.Kind != "" {
+		v.Set("kind", q.Kind)
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339Nano))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339Nano))
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
+
+// Ledger returns the purchases and sales of the node selected by q.
+func (c *Client) Ledger(ctx context.Context, q LedgerQuery) (*Ledger, error) {
+	var ledger Ledger
+	if err := c.doJSON(ctx, http.MethodGet, "/ledger"+q.encode(), nil, &ledger); err != nil {
+		return nil, err
+	}
+	return &ledger, nil
+}
+
+// ExportLedgerCSV writes the purchases and sales of the node selected by q
+// to w as CSV.
+func (c *Client) ExportLedgerCSV(ctx context.Context, q LedgerQuery, w io.Writer) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/ledger.csv"+q.encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,69 @@
+package api
+
+import "fmt"
+
+// ErrorCode identifies a kind of API error.
+type ErrorCode string
+
+// These constants are used to identify a specific Error.
+const (
+	// ErrInvalidRequest indicates the request body, path or query was
+	// malformed or failed validation.
+	ErrInvalidRequest ErrorCode = "invalid_request"
+
+	// ErrUnauthorized indicates missing or invalid credentials.
+	ErrUnauthorized ErrorCode = "unauthorized"
+
+	// ErrForbidden indicates the credentials lack the needed permission.
+	ErrForbidden ErrorCode = "forbidden"
+
+	// ErrNotFound indicates the requested resource does not exist.
+	ErrNotFound ErrorCode = "not_found"
+
+	// ErrConflict indicates the resource already exists.
+	ErrConflict ErrorCode = "conflict"
+
+	// ErrMethodNotAllowed indicates the path does not support the method.
+	ErrMethodNotAllowed ErrorCode = "method_not_allowed"
+
+	// ErrPeerUnreachable indicates a remote peer could not be reached or
+	// did not answer.
+	ErrPeerUnreachable ErrorCode = "peer_unreachable"
+
+	// ErrInvalidContent indicates a provider sent data that does not
+	// match the hash it was asked for.
+	ErrInvalidContent ErrorCode = "invalid_content"
+
+	// ErrPaymentFailed indicates the wallet refused or failed a payment.
+	ErrPaymentFailed ErrorCode = "payment_failed"
+
+	// ErrInsufficientStorage indicates the node's storage quota leaves no
+	// room for the file.
+	ErrInsufficientStorage ErrorCode = "insufficient_storage"
+
+	// ErrDenied indicates the content is on the node's denylist.
+	ErrDenied ErrorCode = "denied"
+
+	// ErrInternal indicates an unexpected failure on the node.
+	ErrInternal ErrorCode = "internal"
+)
+
+// Error is the body of every non-2xx response of the API.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+
+	// StatusCode is the HTTP status the error was returned with.  It is
+	// filled in by the client and not part of the response body.
+	StatusCode int `json:"-"`
+}
+
+// ErrorResponse wraps an Error in the response body.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// EventType identifies a kind of event pushed over the event stream.
+type EventType string
+
+// These constants are the events a node notifies its event stream clients
+// about.
+const (
+	// EventPeerConnected is sent when the first connection to a peer is
+	// established.  Data is a PeerEvent.
+	EventPeerConnected EventType = "peer_connected"
+
+	// EventPeerDisconnected is sent when the last connection to a peer is
+	// closed.  Data is a PeerEvent.
+	EventPeerDisconnected EventType = "peer_disconnected"
+
+	// EventFileRequested is sent when a peer asks the node about a file it
+	// stores.  Data is a FileRequestEvent.
+	EventFileRequested EventType = "file_requested"
+
+	// EventUploadCompleted is sent when a file was stored and published.
+	// Data is an UploadEvent.
+	EventUploadCompleted EventType = "upload_completed"
+
+	// EventProvideCompleted is sent when a provide or unprovide operation
+	// finished.  Data is a ProvideEvent.
+	EventProvideCompleted EventType = "provide_completed"
+
+	// EventDownloadProgress is sent while a file is received from a
+	// provider and once more when the transfer is done.  Data is a
+	// DownloadProgressEvent.
+	EventDownloadProgress EventType = "download_progress"
+
+	// EventPaymentSent is sent when the wallet server accepted a payment
+	// made by the node.  Data is a PaymentEvent.
+	EventPaymentSent EventType = "payment_sent"
+
+	// EventPaymentReceived is sent when a new incoming transaction shows up
+	// in the wallet.  Data is a PaymentEvent.
+	EventPaymentReceived EventType = "payment_received"
+
+	// EventProxyChanged is sent when the node registers or withdraws as a
+	// proxy.  Data is a ProxyStatus.
+	EventProxyChanged EventType = "proxy_changed"
+)
+
+// EventTypes lists every event type a node may send.
+var EventTypes = []EventType{
+	EventPeerConnected,
+	EventPeerDisconnected,
+	EventFileRequested,
+	EventUploadCompleted,
+	EventProvideCompleted,
+	EventDownloadProgress,
+	EventPaymentSent,
+	EventPaymentReceived,
+	EventProxyChanged,
+}
+
+// ValidEventType reports whether t is a known event type.
+func ValidEventType(t EventType) bool {
+	for _, known := range EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a notification pushed over the event stream.  Data holds one of
+// the *Event types below, depending on Type.
+type Event struct {
+	Type EventType       `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// PeerEvent is the data of peer connection events.
+type PeerEvent struct {
+	PeerID string `json:"peer_id"`
+	Addr   string `json:"addr"`
+}
+
+// FileRequestEvent is the data of EventFileRequested.  Kind is "exist",
+// "name", "request" or "chunk", the last two meaning the whole contents or
+// one chunk of them were asked for.
+type FileRequestEvent struct {
+	PeerID string `json:"peer_id"`
+	Hash   string `json:"hash"`
+	Kind   string `json:"kind"`
+	Found  bool   `json:"found"`
+}
+
+// UploadEvent is the data of EventUploadCompleted.
+type UploadEvent struct {
+	Hash     string `json:"hash"`
+	Filename string `json:"filename"`
+	Cost     Amount `json:"cost"`
+}
+
+// ProvideEvent is the data of EventProvideCompleted.  Error is set if the
+// operation failed.
+type ProvideEvent struct {
+	Key     string `json:"key"`
+	Provide bool   `json:"provide"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DownloadProgressEvent is the data of EventDownloadProgress.
+type DownloadProgressEvent struct {
+	PeerID string `json:"peer_id"`
+	Hash   string `json:"hash"`
+	Bytes  int64  `json:"bytes"`
+	Done   bool   `json:"done"`
+}
+
+// PaymentEvent is the data of the payment events.
+type PaymentEvent struct {
+	Address string `json:"address"`
+	Amount  Amount `json:"amount"`
+	TxID    string `json:"txid,omitempty"`
+}
+
+// EventRequest is sent by a client over the event stream to change the set
+// of events it receives.  Method is "subscribe" or "unsubscribe".
+type EventRequest struct {
+	ID     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params []EventType `json:"params"`
+}
+
+// EventResponse answers an EventRequest with the same ID.  Result is the set
+// of event types the client now receives.
+type EventResponse struct {
+	ID     interface{} `json:"id"`
+	Result []EventType `json:"result"`
+	Error  *Error      `json:"error"`
+}
+
+// EventStream is a connection to a node's event stream.
+type EventStream struct {
+	conn *websocket.Conn
+}
+
+// Events opens the node's event stream.  If types is empty every event is
+// delivered.
+func (c *Client) Events(ctx context.Context, types ...EventType) (*EventStream, error) {
+	u, err := url.Parse(c.baseURL + BasePath + "/events")
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	if len(types) > 0 {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = string(t)
+		}
+		u.RawQuery = url.Values{"events": {strings.Join(names, ",")}}.Encode()
+	}
+
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			defer resp.Body.Close()
+			var errResp ErrorResponse
+			if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error.Code != "" {
+				errResp.Error.StatusCode = resp.StatusCode
+				return nil, &errResp.Error
+			}
+		}
+		return nil, err
+	}
+	return &EventStream{conn: conn}, nil
+}
+
+// Next blocks until the next event arrives.  Replies to Subscribe and
+// Unsubscribe are skipped.
+func (s *EventStream) Next() (*Event, error) {
+	for {
+		_, msg, err := s.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		var probe struct {
+			Type EventType `json:"type"`
+		}
+		if err := json.Unmarshal(msg, &probe); err != nil {
+			return nil, err
+		}
+		if probe.Type == "" {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(msg, &ev); err != nil {
+			return nil, err
+		}
+		return &ev, nil
+	}
+}
+
+// Subscribe adds types to the events delivered on the stream.
+func (s *EventStream) Subscribe(types ...EventType) error {
+	return s.conn.WriteJSON(&EventRequest{Method: "subscribe", Params: types})
+}
+
+// Unsubscribe removes types from the events delivered on the stream.
+func (s *EventStream) Unsubscribe(types ...EventType) error {
+	return s.conn.WriteJSON(&EventRequest{Method: "unsubscribe", Params: types})
+}
+
+// Close closes the stream.
+func (s *EventStream) Close() error {
+	return s.conn.Close()
+}
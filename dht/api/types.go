@@ -0,0 +1,516 @@
+// Package api defines the request and response types of the DHT node's
+// versioned HTTP API and a typed client for it.
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// BasePath is the prefix every version 1 endpoint is served under.
+const BasePath = "/api/v1"
+
+// File is a file stored and provided by the node.  Hash is its content ID,
+// a CIDv1 (raw codec, blake3 multihash) of the BLAKE3 tree root, or the hex
+// SHA-256 of files added by older nodes.  Cached files are downloads kept
+// by the node, which may evict them when short of space.  Re-seeded files
+// name their original Publisher, the Royalty percentage of each sale owed to
+// it and the royalties paid so far.  Description is shown to peers before they
+// buy the file.
+type File struct {
+	Hash        string    `json:"hash"`
+	Filename    string    `json:"filename"`
+	Cost        Amount    `json:"cost"`
+	Size        int64     `json:"size,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Cached      bool      `json:"cached"`
+	Publisher   string    `json:"publisher,omitempty"`
+	Royalty     float64   `json:"royalty,omitempty"`
+	RoyaltyPaid Amount    `json:"royalty_paid,omitempty"`
+	Visibility  string    `json:"visibility"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// FileList is one page of the files stored by the node.
+type FileList struct {
+	Files  []File `json:"files"`
+	Total  int64  `json:"total"`
+	Offset int64  `json:"offset"`
+	Limit  int64  `json:"limit"`
+}
+
+// Provider is a peer offering a file and the price it asks.  Meta is what
+// the provider told about the file, when asked for and answered.
+type Provider struct {
+	PeerID string    `json:"peer_id"`
+	Cost   Amount    `json:"cost"`
+	Self   bool      `json:"self"`
+	Meta   *FileMeta `json:"meta,omitempty"`
+}
+
+// Kinds of file previews.  A thumbnail is an image the publisher uploaded
+// with the file, a head the start of the file itself.
+const (
+	PreviewThumbnail = "thumbnail"
+	PreviewHead      = "head"
+)
+
+// FileMeta is what a provider tells about a file before it is bought.
+// Chunks is the number of chunks a download fetches, zero for legacy files.
+// Preview is a free sample of PreviewKind and of MIME type PreviewType; it
+// comes from the provider and isn't checked against the hash.  Publisher is
+// the original publisher of the file, who signed its publication record.
+type FileMeta struct {
+	Hash        string `json:"hash"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	MIMEType    string `json:"mime_type"`
+	Chunks      int64  `json:"chunks,omitempty"`
+	Description string `json:"description,omitempty"`
+	Cost        Amount `json:"cost"`
+	PreviewKind string `json:"preview_kind,omitempty"`
+	PreviewType string `json:"preview_type,omitempty"`
+	Preview     []byte `json:"preview,omitempty"`
+	Publisher   string `json:"publisher,omitempty"`
+}
+
+// ProviderList is the set of peers currently providing a file.
+type ProviderList struct {
+	Hash      string     `json:"hash"`
+	Providers []Provider `json:"providers"`
+}
+
+// Visibilities of stored files.  Public files are provided to the network,
+// unlisted ones only served to peers that know their hash and private ones
+// only to allowed peers and holders of an access token.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// FileAccess is who may fetch a stored file.  Allow lists the peers that
+// may fetch a private file without a token.  Tokens issued before
+// TokensSince are no longer accepted.
+type FileAccess struct {
+	Visibility  string     `json:"visibility"`
+	Allow       []string   `json:"allow"`
+	TokensSince *time.Time `json:"tokens_since,omitempty"`
+}
+
+// FileAccessUpdate changes who may fetch a stored file.  RevokeTokens
+// invalidates every access token issued for it so far.
+type FileAccessUpdate struct {
+	Visibility   string   `json:"visibility"`
+	Allow        []string `json:"allow,omitempty"`
+	RevokeTokens bool     `json:"revoke_tokens,omitempty"`
+}
+
+// AccessTokenRequest asks for an access token to a private file, valid for
+// TTLSeconds (default a week).  A token with a Grantee is only accepted from
+// that peer; one without is accepted from anyone holding it.
+type AccessTokenRequest struct {
+	Grantee    string `json:"grantee,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
+
+// AccessToken is a signed token granting access to a private file, to be
+// passed as the token of a PurchaseRequest.
+type AccessToken struct {
+	Token   string    `json:"token"`
+	Hash    string    `json:"hash"`
+	Grantee string    `json:"grantee,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// PurchaseRequest asks the node to download a file from a provider and pay
+// the provider's wallet for it.  Reseed, ResalePrice and Royalty override the
+// node's configured re-seeding of the file: whether it is provided again,
+// the price asked for it and the percentage of each sale paid to its
+// original publisher.
+// Token is an access token the provider issued for a private file; files
+// bought with one are kept private and never re-seeded.
+type PurchaseRequest struct {
+	PeerID      string   `json:"peer_id"`
+	Hash        string   `json:"hash"`
+	Cost        Amount   `json:"cost"`
+	Address     string   `json:"address"`
+	Reseed      *bool    `json:"reseed,omitempty"`
+	ResalePrice *Amount  `json:"resale_price,omitempty"`
+	Royalty     *float64 `json:"royalty,omitempty"`
+	Token       string   `json:"token,omitempty"`
+}
+
+// Proxy is a peer advertising itself as an HTTP proxy.
+type Proxy struct {
+	PeerID     string `json:"peer_id"`
+	Name       string `json:"name"`
+	Location   string `json:"location"`
+	IPAddress  string `json:"ip_address"`
+	InitialFee string `json:"initial_fee"`
+	Price      string `json:"price"`
+	Port       int    `json:"port"`
+}
+
+// ProxyList is the set of connected peers acting as proxies.
+type ProxyList struct {
+	Proxies []Proxy `json:"proxies"`
+}
+
+// ProxyStatus reports whether this node is registered as a proxy.
+type ProxyStatus struct {
+	IsProxy bool   `json:"is_proxy"`
+	Proxy   *Proxy `json:"proxy,omitempty"`
+}
+
+// ConnectedPeer is a peer the node has a connection to.  Latency is the
+// average round trip time measured to it, if any.
+type ConnectedPeer struct {
+	PeerID    string        `json:"peer_id"`
+	Addr      string        `json:"addr"`
+	Direction string        `json:"direction"`
+	Relayed   bool          `json:"relayed"`
+	Opened    time.Time     `json:"opened"`
+	Latency   time.Duration `json:"latency_ns,omitempty"`
+}
+
+// PeerList lists the peers the node is connected to.
+type PeerList struct {
+	Peers []ConnectedPeer `json:"peers"`
+}
+
+// KnownPeer is an entry of the node's peer book: a peer learned through
+// peer exchange, with the addresses and capabilities it signed.  Source is
+// the peer it was learned from, if not from itself.
+type KnownPeer struct {
+	PeerID       string     `json:"peer_id"`
+	Addrs        []string   `json:"addrs"`
+	Capabilities []string   `json:"capabilities"`
+	Source       string     `json:"source,omitempty"`
+	Added        time.Time  `json:"added"`
+	LastSeen     time.Time  `json:"last_seen"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	Attempts     int        `json:"attempts"`
+}
+
+// PeerBook lists the peers the node knows.
+type PeerBook struct {
+	Peers []KnownPeer `json:"peers"`
+}
+
+// ProxyRegistration registers this node as a proxy.
+type ProxyRegistration struct {
+	Name       string `json:"name"`
+	InitialFee string `json:"initial_fee"`
+	Price      string `json:"price"`
+}
+
+// WalletMapping associates a peer with the wallet address it is paid at.
+type WalletMapping struct {
+	PeerID  string `json:"peer_id"`
+	Address string `json:"address"`
+}
+
+// NamePublication points one of the node's names at a content hash.
+type NamePublication struct {
+	Hash string `json:"hash"`
+}
+
+// NameRecord is the current target of a mutable name, as signed by the
+// publishing peer.
+type NameRecord struct {
+	PeerID   string    `json:"peer_id"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Sequence uint64    `json:"sequence"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NameVersion is one version of a name published by the node.
+type NameVersion struct {
+	Name      string    `json:"name"`
+	Sequence  uint64    `json:"sequence"`
+	Hash      string    `json:"hash"`
+	Published time.Time `json:"published"`
+}
+
+// NameList holds the latest version of every name the node published.
+type NameList struct {
+	PeerID string        `json:"peer_id"`
+	Names  []NameVersion `json:"names"`
+}
+
+// NameHistory holds every version of a name the node published, newest
+// first.
+type NameHistory struct {
+	PeerID   string        `json:"peer_id"`
+	Name     string        `json:"name"`
+	Versions []NameVersion `json:"versions"`
+}
+
+// ManifestVersion is the version of the collection manifest format.
+const ManifestVersion = 1
+
+// Manifest lists the files of a collection.  Its SHA-256 is the
+// collection's root hash, under which it is provided like any other file,
+// so a buyer can check the manifest and then every entry against it.
+type Manifest struct {
+	Version int             `json:"version"`
+	Name    string          `json:"name"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is one file of a collection.  Path is slash separated and
+// relative to the collection.
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// CollectionEntry is one file of a collection published by the node.  Price
+// is set if the file is also sold on its own.
+type CollectionEntry struct {
+	Path  string  `json:"path"`
+	Size  int64   `json:"size"`
+	Hash  string  `json:"hash"`
+	Price *Amount `json:"price,omitempty"`
+}
+
+// Collection is a set of files published together under a root hash.  Price
+// is the price of the whole bundle.
+type Collection struct {
+	Root      string            `json:"root"`
+	Name      string            `json:"name"`
+	Price     Amount            `json:"price"`
+	Entries   []CollectionEntry `json:"entries"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// CollectionList is the set of collections published by the node.
+type CollectionList struct {
+	Collections []Collection `json:"collections"`
+}
+
+// CollectionPurchaseRequest asks the node to download a collection, or the
+// entries of it listed in Paths, from a provider and pay for it.  A full
+// collection, or a selection containing entries not sold on their own, costs
+// the bundle price; otherwise the entries' own prices are paid.
+type CollectionPurchaseRequest struct {
+	PeerID  string   `json:"peer_id"`
+	Root    string   `json:"root"`
+	Paths   []string `json:"paths,omitempty"`
+	Address string   `json:"address"`
+}
+
+// StorageUsage is the space used by one kind of stored file.
+type StorageUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// StoredFile is a file in the node's store.
+type StoredFile struct {
+	Hash       string    `json:"hash"`
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// EvictedFile is a cached file removed by a garbage collection.
+type EvictedFile struct {
+	Hash     string `json:"hash"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// GCRun is a garbage collection of the store.  Trigger is "upload", "cache",
+// "periodic" or "manual".
+type GCRun struct {
+	Time       time.Time     `json:"time"`
+	Trigger    string        `json:"trigger"`
+	Quota      int64         `json:"quota"`
+	UsedBefore int64         `json:"used_before"`
+	UsedAfter  int64         `json:"used_after"`
+	Evicted    []EvictedFile `json:"evicted"`
+}
+
+// StorageReport describes the node's file store.  A Quota of zero means
+// there is no limit.
+type StorageReport struct {
+	Quota       int64        `json:"quota"`
+	Used        int64        `json:"used"`
+	Pinned      StorageUsage `json:"pinned"`
+	Cached      StorageUsage `json:"cached"`
+	PinnedFiles []StoredFile `json:"pinned_files"`
+	GCRuns      []GCRun      `json:"gc_runs"`
+}
+
+// Kinds of ledger entries.
+const (
+	LedgerPurchase = "purchase"
+	LedgerSale     = "sale"
+)
+
+// LedgerEntry is a paid purchase or sale of the node.  Peer is the provider
+// of a purchase and the buyer of a sale.  ID is the same in the ledgers of
+// buyer and provider.  Receipt is the receipt the node signed and
+// PeerReceipt the one its counterparty signed, both as libp2p envelopes;
+// PeerReceipt is missing until the counterparty answered.
+type LedgerEntry struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Hash        string    `json:"hash"`
+	Filename    string    `json:"filename,omitempty"`
+	Peer        string    `json:"peer"`
+	Address     string    `json:"address,omitempty"`
+	Amount      Amount    `json:"amount"`
+	TxID        string    `json:"txid"`
+	Time        time.Time `json:"time"`
+	Receipt     []byte    `json:"receipt,omitempty"`
+	PeerReceipt []byte    `json:"peer_receipt,omitempty"`
+}
+
+// Ledger lists purchases and sales, oldest first, with their totals.
+type Ledger struct {
+	Entries   []LedgerEntry `json:"entries"`
+	Purchases Amount        `json:"purchases"`
+	Sales     Amount        `json:"sales"`
+}
+
+// RoutingBucket counts the peers in the routing table whose IDs share
+// CommonPrefixLen leading bits with the node's.
+type RoutingBucket struct {
+	CommonPrefixLen int `json:"cpl"`
+	Peers           int `json:"peers"`
+}
+
+// RoutingTable summarizes the node's DHT routing table.
+type RoutingTable struct {
+	Size    int             `json:"size"`
+	Buckets []RoutingBucket `json:"buckets"`
+}
+
+// DHTRecordStatus tells whether a record the node put in the DHT can be
+// found.  Kind is "wallet" or "provider"; Checked counts the peers closest
+// to the record that answered and Holders those that hold it.
+type DHTRecordStatus struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	Findable bool   `json:"findable"`
+	Checked  int    `json:"checked"`
+	Holders  int    `json:"holders"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DHTStatus describes the node's part in the DHT.  ConfiguredMode is
+// "auto", "server" or "client" and Mode the one in effect.  Reachability is
+// "unknown", "public" or "private" as found by AutoNAT, and NATTypes maps
+// "tcp" and "udp" to "cone" or "symmetric" once known.  Records is only set
+// when probed.
+type DHTStatus struct {
+	ConfiguredMode string            `json:"configured_mode"`
+	Mode           string            `json:"mode"`
+	Reachability   string            `json:"reachability"`
+	NATTypes       map[string]string `json:"nat_types"`
+	RelayAddrs     []string          `json:"relay_addrs"`
+	RoutingTable   RoutingTable      `json:"routing_table"`
+	Records        []DHTRecordStatus `json:"records,omitempty"`
+}
+
+// ConnectivityStep is the result of a step of a connectivity self-test.
+// Latency is how long the step took, or the round trip time it measured.
+// Detail describes what was found, such as the address a peer was reached
+// on.
+type ConnectivityStep struct {
+	Name    string        `json:"name"`
+	OK      bool          `json:"ok"`
+	Latency time.Duration `json:"latency_ns"`
+	Detail  string        `json:"detail,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// ConnectivityReport is the result of a connectivity self-test of the node
+// and, if Target is set, of the direct, relayed and hole-punched paths to
+// that peer.
+type ConnectivityReport struct {
+	PeerID       string             `json:"peer_id"`
+	Reachability string             `json:"reachability"`
+	NATTypes     map[string]string  `json:"nat_types"`
+	ListenAddrs  []string           `json:"listen_addrs"`
+	Target       string             `json:"target,omitempty"`
+	Steps        []ConnectivityStep `json:"steps"`
+}
+
+// BannedPeer is a peer on the node's blocklist.  Until is when the ban
+// ends, if it isn't permanent.
+type BannedPeer struct {
+	PeerID string     `json:"peer_id"`
+	Reason string     `json:"reason,omitempty"`
+	Added  time.Time  `json:"added"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// BannedRange is an IP range on the node's blocklist.
+type BannedRange struct {
+	CIDR   string    `json:"cidr"`
+	Reason string    `json:"reason,omitempty"`
+	Added  time.Time `json:"added"`
+}
+
+// Blocklist lists the peers and IP ranges the node refuses to connect to.
+type Blocklist struct {
+	Peers  []BannedPeer  `json:"peers"`
+	Ranges []BannedRange `json:"ranges"`
+}
+
+// BanRequest bans a peer or an IP range: exactly one of PeerID and CIDR is
+// set.  A peer is banned for DurationSeconds, or until it is unbanned if
+// that is zero; IP ranges are banned until they are unbanned.
+type BanRequest struct {
+	PeerID          string `json:"peer_id,omitempty"`
+	CIDR            string `json:"cidr,omitempty"`
+	DurationSeconds int64  `json:"duration_seconds,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+// UnbanRequest lifts the ban of a peer or an IP range: exactly one of
+// PeerID and CIDR is set.
+type UnbanRequest struct {
+	PeerID string `json:"peer_id,omitempty"`
+	CIDR   string `json:"cidr,omitempty"`
+}
+
+// DenyDigest returns the denylist entry of the file with the given hash:
+// the hex SHA-256 of the hash, so lists can be shared without naming the
+// content they deny.
+func DenyDigest(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:])
+}
+
+// DenylistEntry adds a file to the node's denylist, by Hash or by the
+// Digest DenyDigest returns for it.
+type DenylistEntry struct {
+	Hash   string `json:"hash,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// DenylistSubscription is a denylist the node follows.  Issuer is the peer
+// whose key must sign it and Sequence the version last accepted.
+type DenylistSubscription struct {
+	URL      string     `json:"url"`
+	Issuer   string     `json:"issuer"`
+	Sequence uint64     `json:"sequence"`
+	Entries  int        `json:"entries"`
+	Updated  *time.Time `json:"updated,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// Denylist is the content the node refuses to store, serve or fetch: the
+// digests of its local list and the lists it subscribes to.
+type Denylist struct {
+	Local         []string               `json:"local"`
+	Subscriptions []DenylistSubscription `json:"subscriptions"`
+}
@@ -0,0 +1,1715 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht/api"
+	"dht/names"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// defaultPageLimit is the page size used when a list request does not
+	// specify a limit.
+	defaultPageLimit = 50
+
+	// maxPageLimit is the largest page size a list request may ask for.
+	maxPageLimit = 500
+
+	// maxUploadMemory is how much of a multipart upload is held in memory
+	// before spilling to temporary files.
+	maxUploadMemory = 10 << 20
+)
+
+// apiParam describes a query parameter or multipart form field of an API
+// route.  Form fields of kind "file" are file uploads, "files" repeated ones.
+type apiParam struct {
+	name        string
+	kind        string
+	description string
+	required    bool
+}
+
+// apiRoute describes one endpoint of the versioned API.  The same table is
+// used to register handlers, assign permissions and generate the OpenAPI
+// document, so the three can't drift apart.
+type apiRoute struct {
+	method      string
+	path        string
+	perm        permission
+	summary     string
+	query       []apiParam
+	request     interface{}
+	form        []apiParam
+	response    interface{}
+	contentType string
+	status      int
+	handler     func(s *apiServer, w http.ResponseWriter, r *http.Request)
+}
+
+// apiServer serves the version 1 HTTP API.
+type apiServer struct {
+	ip       string
+	location string
+
+	// openAPIDoc is generated from the route table at registration.
+	openAPIDoc map[string]interface{}
+}
+
+var apiV1Routes = []apiRoute{
+	{
+		method: http.MethodGet, path: "/files", perm: permRead,
+		summary: "List stored files",
+		query: []apiParam{
+			{"offset", "integer", "Number of files to skip.", false},
+			{"limit", "integer", fmt.Sprintf("Maximum number of files to return (default %d, max %d).", defaultPageLimit, maxPageLimit), false},
+		},
+		response: api.FileList{}, status: http.StatusOK,
+		handler: (*apiServer).listFiles,
+	},
+	{
+		method: http.MethodPost, path: "/files", perm: permWrite,
+		summary: "Upload and provide a file",
+		form: []apiParam{
+			{"file", "file", "The file to upload.", true},
+			{"price", "number", "Price asked for the file.", true},
+			{"visibility", "string", "Who may find and fetch the file: public (default), unlisted or private.", false},
+			{"allow", "string", "Comma separated IDs of the peers that may fetch a private file.", false},
+			{"description", "string", fmt.Sprintf("Description shown to peers before they buy the file, at most %d bytes.", maxDescriptionLength), false},
+			{"thumbnail", "file", fmt.Sprintf("Image of at most %d bytes sent to peers as a free preview.", maxPreviewSize), false},
+		},
+		response: api.File{}, status: http.StatusCreated,
+		handler: (*apiServer).uploadFile,
+	},
+	{
+		method: http.MethodDelete, path: "/files/{hash}", perm: permWrite,
+		summary: "Delete a stored file and stop providing it",
+		status:  http.StatusNoContent,
+		handler: (*apiServer).deleteFile,
+	},
+	{
+		method: http.MethodGet, path: "/files/{hash}/access", perm: permRead,
+		summary:  "Show who may fetch a stored file",
+		response: api.FileAccess{}, status: http.StatusOK,
+		handler: (*apiServer).fileAccess,
+	},
+	{
+		method: http.MethodPut, path: "/files/{hash}/access", perm: permWrite,
+		summary:  "Change who may find and fetch a stored file",
+		request:  api.FileAccessUpdate{},
+		response: api.FileAccess{}, status: http.StatusOK,
+		handler: (*apiServer).setFileAccess,
+	},
+	{
+		method: http.MethodPost, path: "/files/{hash}/tokens", perm: permWrite,
+		summary:  "Issue an access token to a private file",
+		request:  api.AccessTokenRequest{},
+		response: api.AccessToken{}, status: http.StatusCreated,
+		handler: (*apiServer).issueAccessToken,
+	},
+	{
+		method: http.MethodGet, path: "/files/{hash}/providers", perm: permRead,
+		summary: "Find the peers providing a file",
+		query: []apiParam{
+			{"meta", "boolean", "Ask every provider about the file and include what it tells (default false).", false},
+		},
+		response: api.ProviderList{}, status: http.StatusOK,
+		handler: (*apiServer).providers,
+	},
+	{
+		method: http.MethodPost, path: "/purchases", perm: permSpend,
+		summary:  "Download a file from a provider and pay for it",
+		request:  api.PurchaseRequest{},
+		response: []byte(nil), contentType: "application/octet-stream", status: http.StatusOK,
+		handler: (*apiServer).purchase,
+	},
+	{
+		method: http.MethodGet, path: "/collections", perm: permRead,
+		summary:  "List the collections this node published",
+		response: api.CollectionList{}, status: http.StatusOK,
+		handler: (*apiServer).listCollections,
+	},
+	{
+		method: http.MethodPost, path: "/collections", perm: permWrite,
+		summary: "Publish a set of files as a collection",
+		form: []apiParam{
+			{"name", "string", "Name of the collection.", true},
+			{"price", "number", "Price asked for the whole collection.", true},
+			{"prices", "string", "JSON object mapping entry paths to their price when sold on their own.", false},
+			{"file", "files", "The files of the collection; each part's file name is its path in the collection.", true},
+		},
+		response: api.Collection{}, status: http.StatusCreated,
+		handler: (*apiServer).createCollection,
+	},
+	{
+		method: http.MethodGet, path: "/collections/{root}", perm: permRead,
+		summary:  "Describe a collection this node published",
+		response: api.Collection{}, status: http.StatusOK,
+		handler: (*apiServer).getCollection,
+	},
+	{
+		method: http.MethodDelete, path: "/collections/{root}", perm: permWrite,
+		summary: "Delete a collection and stop providing it",
+		status:  http.StatusNoContent,
+		handler: (*apiServer).deleteCollection,
+	},
+	{
+		method: http.MethodPost, path: "/collections/purchases", perm: permSpend,
+		summary:  "Download a collection, or some of its entries, from a provider as a tar archive and pay for it",
+		request:  api.CollectionPurchaseRequest{},
+		response: []byte(nil), contentType: "application/x-tar", status: http.StatusOK,
+		handler: (*apiServer).purchaseCollection,
+	},
+	{
+		method: http.MethodGet, path: "/storage", perm: permRead,
+		summary:  "Report storage usage, the pinned files and recent garbage collections",
+		response: api.StorageReport{}, status: http.StatusOK,
+		handler: (*apiServer).storage,
+	},
+	{
+		method: http.MethodPost, path: "/storage/gc", perm: permWrite,
+		summary:  "Evict cached files until the store fits its quota",
+		response: api.GCRun{}, status: http.StatusOK,
+		handler: (*apiServer).collectGarbage,
+	},
+	{
+		method: http.MethodPut, path: "/storage/pins/{hash}", perm: permWrite,
+		summary: "Pin a stored file so it is never evicted",
+		status:  http.StatusNoContent,
+		handler: (*apiServer).pinFile,
+	},
+	{
+		method: http.MethodDelete, path: "/storage/pins/{hash}", perm: permWrite,
+		summary: "Unpin a stored file, making it a cached file that may be evicted",
+		status:  http.StatusNoContent,
+		handler: (*apiServer).unpinFile,
+	},
+	{
+		method: http.MethodGet, path: "/denylist", perm: permRead,
+		summary:  "List the denylist and the state of its subscriptions",
+		response: api.Denylist{}, status: http.StatusOK,
+		handler: (*apiServer).denylist,
+	},
+	{
+		method: http.MethodPost, path: "/denylist", perm: permAdmin,
+		summary:  "Add a file to the local denylist, by hash or digest",
+		request:  api.DenylistEntry{},
+		response: api.DenylistEntry{}, status: http.StatusOK,
+		handler: (*apiServer).denyContent,
+	},
+	{
+		method: http.MethodDelete, path: "/denylist/{digest}", perm: permAdmin,
+		summary: "Remove a digest from the local denylist",
+		status:  http.StatusNoContent,
+		handler: (*apiServer).undenyContent,
+	},
+	{
+		method: http.MethodGet, path: "/denylist/signed", perm: permRead,
+		summary:  "Export the local denylist signed by the node's key, for others to subscribe to",
+		response: []byte(nil), contentType: "application/octet-stream", status: http.StatusOK,
+		handler: (*apiServer).signedDenylist,
+	},
+	{
+		method: http.MethodGet, path: "/proxies", perm: permRead,
+		summary:  "List connected peers registered as proxies",
+		response: api.ProxyList{}, status: http.StatusOK,
+		handler: (*apiServer).listProxies,
+	},
+	{
+		method: http.MethodGet, path: "/proxies/self", perm: permRead,
+		summary:  "Report whether this node is registered as a proxy",
+		response: api.ProxyStatus{}, status: http.StatusOK,
+		handler: (*apiServer).proxyStatus,
+	},
+	{
+		method: http.MethodPut, path: "/proxies/self", perm: permWrite,
+		summary:  "Register this node as a proxy",
+		request:  api.ProxyRegistration{},
+		response: api.ProxyStatus{}, status: http.StatusOK,
+		handler: (*apiServer).registerProxy,
+	},
+	{
+		method: http.MethodDelete, path: "/proxies/self", perm: permWrite,
+		summary: "Withdraw this node's proxy registration",
+		status:  http.StatusNoContent,
+		handler: (*apiServer).deregisterProxy,
+	},
+	{
+		method: http.MethodPut, path: "/wallet", perm: permWrite,
+		summary:  "Publish the wallet address this node is paid at",
+		request:  api.WalletMapping{},
+		response: api.WalletMapping{}, status: http.StatusOK,
+		handler: (*apiServer).setWallet,
+	},
+	{
+		method: http.MethodGet, path: "/ledger", perm: permRead,
+		summary:  "List this node's paid purchases and sales with their signed receipts",
+		query:    ledgerQueryParams,
+		response: api.Ledger{}, status: http.StatusOK,
+		handler: (*apiServer).ledger,
+	},
+	{
+		method: http.MethodGet, path: "/ledger.csv", perm: permRead,
+		summary:  "Export this node's paid purchases and sales as CSV",
+		query:    ledgerQueryParams,
+		response: []byte(nil), contentType: "text/csv", status: http.StatusOK,
+		handler: (*apiServer).exportLedgerCSV,
+	},
+	{
+		method: http.MethodGet, path: "/dht/status", perm: permRead,
+		summary: "Report the DHT mode, routing table, reachability and whether the node's records can be found",
+		query: []apiParam{
+			{"probe", "boolean", "Ask the peers closest to the node's records whether they hold them (default true).", false},
+		},
+		response: api.DHTStatus{}, status: http.StatusOK,
+		handler: (*apiServer).dhtStatus,
+	},
+	{
+		method: http.MethodGet, path: "/diagnostics/connectivity", perm: permAdmin,
+		summary: "Run AutoNAT, check the relay reservation and test the direct, relayed and hole-punched paths to a peer",
+		query: []apiParam{
+			{"peer", "string", "Peer to dial; its existing connections are closed first.", false},
+		},
+		response: api.ConnectivityReport{}, status: http.StatusOK,
+		handler: (*apiServer).connectivity,
+	},
+	{
+		method: http.MethodGet, path: "/peers", perm: permRead,
+		summary:  "List the peers the node is connected to",
+		response: api.PeerList{}, status: http.StatusOK,
+		handler: (*apiServer).connectedPeers,
+	},
+	{
+		method: http.MethodGet, path: "/peers/book", perm: permRead,
+		summary:  "List the peers learned through peer exchange",
+		response: api.PeerBook{}, status: http.StatusOK,
+		handler: (*apiServer).peerBook,
+	},
+	{
+		method: http.MethodGet, path: "/peers/bans", perm: permRead,
+		summary:  "List the banned peers and IP ranges",
+		response: api.Blocklist{}, status: http.StatusOK,
+		handler: (*apiServer).bans,
+	},
+	{
+		method: http.MethodPost, path: "/peers/ban", perm: permAdmin,
+		summary:  "Ban a peer or an IP range, closing its connections and refusing new ones",
+		request:  api.BanRequest{},
+		response: api.Blocklist{}, status: http.StatusOK,
+		handler: (*apiServer).ban,
+	},
+	{
+		method: http.MethodPost, path: "/peers/unban", perm: permAdmin,
+		summary:  "Lift the ban of a peer or an IP range",
+		request:  api.UnbanRequest{},
+		response: api.Blocklist{}, status: http.StatusOK,
+		handler: (*apiServer).unban,
+	},
+	{
+		method: http.MethodGet, path: "/peers/{id}/wallet", perm: permRead,
+		summary:  "Look up the wallet address a peer published",
+		response: api.WalletMapping{}, status: http.StatusOK,
+		handler: (*apiServer).peerWallet,
+	},
+	{
+		method: http.MethodGet, path: "/peers/{id}/files/{hash}/meta", perm: permRead,
+		summary:  "Ask a peer about a file it provides, with a free preview if it has one",
+		response: api.FileMeta{}, status: http.StatusOK,
+		handler: (*apiServer).peerFileMeta,
+	},
+	{
+		method: http.MethodGet, path: "/names", perm: permRead,
+		summary:  "List the names this node published with their latest version",
+		response: api.NameList{}, status: http.StatusOK,
+		handler: (*apiServer).listNames,
+	},
+	{
+		method: http.MethodPut, path: "/names/{name}", perm: permWrite,
+		summary:  "Point one of this node's names at a content hash",
+		request:  api.NamePublication{},
+		response: api.NameRecord{}, status: http.StatusOK,
+		handler: (*apiServer).publishName,
+	},
+	{
+		method: http.MethodGet, path: "/names/{name}/versions", perm: permRead,
+		summary:  "List every version of a name this node published",
+		response: api.NameHistory{}, status: http.StatusOK,
+		handler: (*apiServer).nameVersions,
+	},
+	{
+		method: http.MethodGet, path: "/peers/{id}/names/{name}", perm: permRead,
+		summary:  "Resolve a name published by a peer to its current content hash",
+		response: api.NameRecord{}, status: http.StatusOK,
+		handler: (*apiServer).resolveName,
+	},
+	{
+		method: http.MethodGet, path: "/events", perm: permRead,
+		summary: "Open a websocket stream of node events",
+		query: []apiParam{
+			{"events", "string", "Comma separated event types to receive (default all).", false},
+		},
+		status:  http.StatusSwitchingProtocols,
+		handler: (*apiServer).events,
+	},
+	{
+		method: http.MethodGet, path: "/openapi.json", perm: permRead,
+		summary:  "This API's OpenAPI document",
+		response: map[string]interface{}{}, status: http.StatusOK,
+		handler: (*apiServer).openAPI,
+	},
+}
+
+// registerAPIv1 adds every version 1 route to mux and records the
+// permission each requires.
+func registerAPIv1(mux *http.ServeMux, ip, location string) {
+	s := &apiServer{ip: ip, location: location}
+	s.openAPIDoc = openAPIDocument(apiV1Routes)
+	for _, route := range apiV1Routes {
+		route := route
+		pattern := route.method + " " + api.BasePath + route.path
+		endpointPermissions[pattern] = route.perm
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			route.handler(s, w, r)
+		})
+	}
+
+	// Anything else below the base path gets a JSON error rather than the
+	// plain text one of the default mux.  knownPaths tells a wrong method on
+	// a known path apart from an unknown path.
+	knownPaths := http.NewServeMux()
+	seen := make(map[string]bool)
+	for _, route := range apiV1Routes {
+		if !seen[route.path] {
+			knownPaths.Handle(api.BasePath+route.path, http.NotFoundHandler())
+			seen[route.path] = true
+		}
+	}
+	endpointPermissions[api.BasePath+"/"] = permRead
+	mux.HandleFunc(api.BasePath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := knownPaths.Handler(r); pattern != "" {
+			writeAPIError(w, http.StatusMethodNotAllowed, api.ErrMethodNotAllowed,
+				fmt.Sprintf("%s is not supported on %s", r.Method, r.URL.Path))
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, "no such endpoint")
+	})
+}
+
+// writeJSON writes v as the JSON body of a response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		httpLog.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// writeAPIError writes an api.Error response.
+func writeAPIError(w http.ResponseWriter, status int, code api.ErrorCode, message string) {
+	writeJSON(w, status, api.ErrorResponse{Error: api.Error{Code: code, Message: message}})
+}
+
+// writeInternalError logs err and writes a generic internal error response.
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	httpLog.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+	writeAPIError(w, http.StatusInternalServerError, api.ErrInternal, err.Error())
+}
+
+// decodeJSONBody strictly decodes the request body into v.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// validateHash checks that hash is a content ID or a legacy hex encoded
+// SHA-256 digest.
+func validateHash(hash string) error {
+	if _, ok := parseContentID(hash); !ok && !isLegacyHash(hash) {
+		return fmt.Errorf("hash must be a CIDv1 (raw, blake3) or 64 hex characters")
+	}
+	return nil
+}
+
+// validatePeerID checks that id is a valid libp2p peer ID.
+func validatePeerID(id string) error {
+	if _, err := peer.Decode(id); err != nil {
+		return fmt.Errorf("invalid peer ID %q", id)
+	}
+	return nil
+}
+
+// parsePrice parses a price in DC.
+func parsePrice(name, value string) (btcutil.Amount, error) {
+	if value == "" {
+		return 0, fmt.Errorf("%s is required", name)
+	}
+	price, err := api.ParseAmount(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a non-negative number of DC with at most 8 decimals", name)
+	}
+	return price, nil
+}
+
+// parseAccess validates a visibility and the allowlist of a private file.
+func parseAccess(visibility string, allow []string) (fileAccess, error) {
+	if visibility == "" {
+		visibility = visibilityPublic
+	}
+	if !slices.Contains(visibilities, visibility) {
+		return fileAccess{}, fmt.Errorf("visibility must be one of %s", strings.Join(visibilities, ", "))
+	}
+	access := fileAccess{Visibility: visibility}
+	if len(allow) > 0 && visibility != visibilityPrivate {
+		return fileAccess{}, fmt.Errorf("allow only applies to private files")
+	}
+	for _, id := range allow {
+		p, err := peer.Decode(strings.TrimSpace(id))
+		if err != nil {
+			return fileAccess{}, fmt.Errorf("invalid peer ID %q in allow", id)
+		}
+		if !slices.Contains(access.Allow, p) {
+			access.Allow = append(access.Allow, p)
+		}
+	}
+	return access, nil
+}
+
+// fileAccessToAPI converts the access of a file to its API representation.
+func fileAccessToAPI(access fileAccess) api.FileAccess {
+	a := api.FileAccess{Visibility: access.Visibility, Allow: []string{}}
+	for _, p := range access.Allow {
+		a.Allow = append(a.Allow, p.String())
+	}
+	if !access.TokensSince.IsZero() {
+		since := access.TokensSince.UTC()
+		a.TokensSince = &since
+	}
+	return a
+}
+
+// parsePage reads the offset and limit query parameters.
+func parsePage(r *http.Request) (int64, int64, error) {
+	offset, limit := int64(0), int64(defaultPageLimit)
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be an integer between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	return offset, limit, nil
+}
+
+// fileFromRecord converts a store record to its API representation.
+func fileFromRecord(record map[string]interface{}) api.File {
+	var f api.File
+	f.Hash, _ = record["hash"].(string)
+	f.Filename, _ = record["filename"].(string)
+	f.Cost = api.Amount(recordAmount(record, "cost"))
+	f.Size, _ = record["size"].(int64)
+	f.Description, _ = record["description"].(string)
+	f.Cached, _ = record["cached"].(bool)
+	f.Publisher, _ = record["publisher"].(string)
+	f.Royalty, _ = record["royalty"].(float64)
+	f.RoyaltyPaid = api.Amount(recordAmount(record, "royalty_paid"))
+	f.Visibility = recordAccess(record).Visibility
+	if ts, ok := record["timestamp"].(primitive.DateTime); ok {
+		f.Timestamp = ts.Time().UTC()
+	}
+	return f
+}
+
+func (s *apiServer) listFiles(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	records, total, err := FetchFileRecordsPage(offset, limit)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	list := api.FileList{
+		Files:  make([]api.File, 0, len(records)),
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+	}
+	for _, record := range records {
+		list.Files = append(list.Files, fileFromRecord(record))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) uploadFile(w http.ResponseWriter, r *http.Request) {
+	result := "error"
+	defer func() {
+		uploadsTotal.WithLabelValues(result).Inc()
+	}()
+
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid multipart form: %v", err))
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "file is required")
+		return
+	}
+	defer file.Close()
+
+	filename := filepath.Base(header.Filename)
+	if filename == "." || filename == string(filepath.Separator) || strings.HasPrefix(filename, ".") {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "invalid file name")
+		return
+	}
+	price, err := parsePrice("price", r.FormValue("price"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	var allow []string
+	if v := r.FormValue("allow"); v != "" {
+		allow = strings.Split(v, ",")
+	}
+	access, err := parseAccess(r.FormValue("visibility"), allow)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	description := r.FormValue("description")
+	var thumbnail []byte
+	if f, _, err := r.FormFile("thumbnail"); err == nil {
+		thumbnail, err = readMessage(f, maxPreviewSize)
+		f.Close()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid thumbnail: %v", err))
+			return
+		}
+	}
+	if err := validateDetails(description, thumbnail); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+
+	hash, err := uploadFile(file, filename, price, access)
+	if err == errFileExists {
+		writeAPIError(w, http.StatusConflict, api.ErrConflict, fmt.Sprintf("file %s already exists", hash))
+		return
+	}
+	if err == errDenied {
+		writeAPIError(w, http.StatusUnavailableForLegalReasons, api.ErrDenied, fmt.Sprintf("file %s is on the denylist", hash))
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeAPIError(w, http.StatusInsufficientStorage, api.ErrInsufficientStorage, err.Error())
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	if err := SetFileDetails(hash, description, thumbnail); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	result = "ok"
+	writeJSON(w, http.StatusCreated, api.File{
+		Hash:        hash,
+		Filename:    filename,
+		Cost:        api.Amount(price),
+		Size:        header.Size,
+		Description: description,
+		Visibility:  access.Visibility,
+		Timestamp:   time.Now().UTC(),
+	})
+}
+
+func (s *apiServer) fileAccess(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if record == nil {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("file %s not found", hash))
+		return
+	}
+	writeJSON(w, http.StatusOK, fileAccessToAPI(recordAccess(record)))
+}
+
+func (s *apiServer) setFileAccess(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	var req api.FileAccessUpdate
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	access, err := parseAccess(req.Visibility, req.Allow)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if record == nil {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("file %s not found", hash))
+		return
+	}
+	access.TokensSince = recordAccess(record).TokensSince
+	if req.RevokeTokens {
+		access.TokensSince = time.Now()
+	}
+
+	err = setFileAccess(hash, access)
+	if err == errFileNotFound {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("file %s not found", hash))
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fileAccessToAPI(access))
+}
+
+func (s *apiServer) issueAccessToken(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	var req api.AccessTokenRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	var grantee peer.ID
+	if req.Grantee != "" {
+		var err error
+		if grantee, err = peer.Decode(req.Grantee); err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid peer ID %q", req.Grantee))
+			return
+		}
+	}
+	if req.TTLSeconds < 0 {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "ttl_seconds must not be negative")
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if record == nil {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("file %s not found", hash))
+		return
+	}
+	expires := time.Now().Add(ttl).UTC()
+	token, err := issueAccessToken(hash, grantee, expires)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, api.AccessToken{Token: token, Hash: hash, Grantee: req.Grantee, Expires: expires})
+}
+
+func (s *apiServer) deleteFile(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	err := deleteFile(hash)
+	if err == errFileNotFound {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("file %s not found", hash))
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) providers(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	withMeta := false
+	if v := r.URL.Query().Get("meta"); v != "" {
+		var err error
+		if withMeta, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "meta must be true or false")
+			return
+		}
+	}
+	providers, err := findProviders(hash)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if withMeta {
+		fetchProvidersMeta(node, hash, providers)
+	}
+	writeJSON(w, http.StatusOK, api.ProviderList{Hash: hash, Providers: providers})
+}
+
+func (s *apiServer) purchase(w http.ResponseWriter, r *http.Request) {
+	var req api.PurchaseRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validatePeerID(req.PeerID); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validateHash(req.Hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if req.Address == "" {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "address is required")
+		return
+	}
+	if r := req.Royalty; r != nil && (*r < 0 || *r > 100 || math.IsNaN(*r)) {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "royalty must be a percentage between 0 and 100")
+		return
+	}
+	if req.Token != "" {
+		if _, _, err := parseRequest([]byte(msgAccess + ":" + req.Token)); err != nil || len(msgAccess)+1+len(req.Token) > maxRequestSize {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "malformed access token")
+			return
+		}
+	}
+	if deniedContent(req.Hash, "purchase") {
+		writeAPIError(w, http.StatusUnavailableForLegalReasons, api.ErrDenied, errDenied.Error())
+		return
+	}
+	if p, _ := peer.Decode(req.PeerID); isBanned(p) {
+		writeAPIError(w, http.StatusForbidden, api.ErrForbidden, fmt.Sprintf("peer %s is banned", req.PeerID))
+		return
+	}
+
+	if req.Token != "" {
+		err := presentToken(req.PeerID, req.Token)
+		if errors.Is(err, errAccessDenied) {
+			writeAPIError(w, http.StatusForbidden, api.ErrForbidden, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, api.ErrPeerUnreachable, err.Error())
+			return
+		}
+	}
+
+	filename, data, err := fetchFromPeer(req.PeerID, req.Hash)
+	if err == errNotProvided {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		xferLog.Errorf("%v", err)
+		writeAPIError(w, http.StatusBadGateway, api.ErrPeerUnreachable, err.Error())
+		return
+	}
+
+	// Pay before answering so the status reflects the payment outcome.
+	if req.Cost > 0 {
+		txid, err := sendPayment(req.Address, btcutil.Amount(req.Cost))
+		if err != nil {
+			xferLog.Errorf("Payment to %s failed: %v", req.Address, err)
+			writeAPIError(w, http.StatusBadGateway, api.ErrPaymentFailed, err.Error())
+			return
+		}
+		go recordPurchase(req.PeerID, req.Hash, filename, req.Address, btcutil.Amount(req.Cost), txid)
+	}
+	go keepPurchase(&req, filename, data)
+
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		httpLog.Warnf("Failed to write purchased file to client: %v", err)
+	}
+}
+
+func (s *apiServer) storage(w http.ResponseWriter, r *http.Request) {
+	report, err := storageReport()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *apiServer) collectGarbage(w http.ResponseWriter, r *http.Request) {
+	run, err := collectGarbage("manual", 0)
+	if err != nil && !errors.Is(err, errQuotaExceeded) {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, gcRunToAPI(run))
+}
+
+func (s *apiServer) pinFile(w http.ResponseWriter, r *http.Request) {
+	s.setPinned(w, r, true)
+}
+
+func (s *apiServer) unpinFile(w http.ResponseWriter, r *http.Request) {
+	s.setPinned(w, r, false)
+}
+
+// setPinned pins or unpins the file named by the request path.
+func (s *apiServer) setPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	hash := r.PathValue("hash")
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	err := SetFileCached(hash, !pinned)
+	if err == errFileNotFound {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("file %s not found", hash))
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) denylist(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, denied.status())
+}
+
+func (s *apiServer) denyContent(w http.ResponseWriter, r *http.Request) {
+	var entry api.DenylistEntry
+	if err := decodeJSONBody(r, &entry); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	switch {
+	case (entry.Hash == "") == (entry.Digest == ""):
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "exactly one of hash and digest is required")
+		return
+	case entry.Hash != "":
+		if err := validateHash(entry.Hash); err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+			return
+		}
+		entry.Digest = api.DenyDigest(entry.Hash)
+	case !validDigest(entry.Digest):
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "digest must be a lower case hex SHA-256 digest")
+		return
+	}
+	added, err := denied.add(entry.Digest)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if added {
+		storLog.Infof("Added %s to the denylist", entry.Digest)
+		go withdrawDeniedFiles()
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *apiServer) undenyContent(w http.ResponseWriter, r *http.Request) {
+	digest := r.PathValue("digest")
+	if !validDigest(digest) {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "digest must be a lower case hex SHA-256 digest")
+		return
+	}
+	removed, err := denied.remove(digest)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if !removed {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("%s is not on the local denylist", digest))
+		return
+	}
+	storLog.Infof("Removed %s from the denylist", digest)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) signedDenylist(w http.ResponseWriter, r *http.Request) {
+	data, err := denied.sign()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="denylist.signed"`)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		httpLog.Warnf("Failed to write signed denylist to client: %v", err)
+	}
+}
+
+// multipartPath returns the file name of an uploaded part as sent.  Unlike
+// FileHeader.Filename it keeps the directories.
+func multipartPath(fh *multipart.FileHeader) string {
+	_, params, err := mime.ParseMediaType(fh.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return fh.Filename
+}
+
+func (s *apiServer) listCollections(w http.ResponseWriter, r *http.Request) {
+	records, err := FetchCollectionRecords()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	list := api.CollectionList{Collections: make([]api.Collection, 0, len(records))}
+	for i := range records {
+		list.Collections = append(list.Collections, collectionFromRecord(&records[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) createCollection(w http.ResponseWriter, r *http.Request) {
+	result := "error"
+	defer func() {
+		uploadsTotal.WithLabelValues(result).Inc()
+	}()
+
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid multipart form: %v", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	name := r.FormValue("name")
+	if err := names.ValidateName(name); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	price, err := parsePrice("price", r.FormValue("price"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	prices := make(map[string]api.Amount)
+	if v := r.FormValue("prices"); v != "" {
+		if err := json.Unmarshal([]byte(v), &prices); err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid prices: %v", err))
+			return
+		}
+	}
+
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "at least one file is required")
+		return
+	}
+	if len(headers) > maxCollectionEntries {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("a collection holds at most %d files", maxCollectionEntries))
+		return
+	}
+	files := make([]collectionFile, 0, len(headers))
+	seen := make(map[string]bool, len(headers))
+	for _, fh := range headers {
+		path, err := cleanEntryPath(multipartPath(fh))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+			return
+		}
+		if seen[path] {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("duplicate entry path %q", path))
+			return
+		}
+		seen[path] = true
+
+		f := collectionFile{
+			Path: path,
+			Open: func() (io.ReadSeekCloser, error) { return fh.Open() },
+		}
+		if p, ok := prices[path]; ok {
+			price := btcutil.Amount(p)
+			f.Price = &price
+		}
+		files = append(files, f)
+	}
+	for path := range prices {
+		if clean, err := cleanEntryPath(path); err != nil || !seen[clean] || clean != path {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("price given for unknown entry %q", path))
+			return
+		}
+	}
+
+	rec, err := createCollection(name, price, files)
+	if err == errFileExists {
+		writeAPIError(w, http.StatusConflict, api.ErrConflict, fmt.Sprintf("collection %s already exists", rec.Root))
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeAPIError(w, http.StatusInsufficientStorage, api.ErrInsufficientStorage, err.Error())
+		return
+	}
+	if errors.Is(err, errDenied) {
+		writeAPIError(w, http.StatusUnavailableForLegalReasons, api.ErrDenied, err.Error())
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	result = "ok"
+	writeJSON(w, http.StatusCreated, collectionFromRecord(rec))
+}
+
+func (s *apiServer) getCollection(w http.ResponseWriter, r *http.Request) {
+	root := r.PathValue("root")
+	if err := validateHash(root); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	rec, err := GetCollectionRecord(root)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if rec == nil {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("collection %s not found", root))
+		return
+	}
+	writeJSON(w, http.StatusOK, collectionFromRecord(rec))
+}
+
+func (s *apiServer) deleteCollection(w http.ResponseWriter, r *http.Request) {
+	root := r.PathValue("root")
+	if err := validateHash(root); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	err := deleteCollection(root)
+	if err == errFileNotFound {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("collection %s not found", root))
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) purchaseCollection(w http.ResponseWriter, r *http.Request) {
+	var req api.CollectionPurchaseRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validatePeerID(req.PeerID); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validateHash(req.Root); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if req.Address == "" {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "address is required")
+		return
+	}
+
+	manifest, files, err := purchaseCollection(req.PeerID, req.Root, req.Paths, req.Address)
+	switch {
+	case err == nil:
+	case errors.Is(err, errUnknownEntry):
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	case errors.Is(err, errNotProvided):
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, err.Error())
+		return
+	case errors.Is(err, errInvalidManifest), errors.Is(err, errContentMismatch):
+		xferLog.Warnf("%v", err)
+		writeAPIError(w, http.StatusBadGateway, api.ErrInvalidContent, err.Error())
+		return
+	case errors.Is(err, errPaymentFailed):
+		xferLog.Errorf("Payment to %s failed: %v", req.Address, err)
+		writeAPIError(w, http.StatusBadGateway, api.ErrPaymentFailed, err.Error())
+		return
+	default:
+		xferLog.Errorf("%v", err)
+		writeAPIError(w, http.StatusBadGateway, api.ErrPeerUnreachable, err.Error())
+		return
+	}
+
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", manifest.Name+".tar"))
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    manifest.Name + "/" + f.Entry.Path,
+			Mode:    0644,
+			Size:    int64(len(f.Data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			httpLog.Warnf("Failed to write purchased collection to client: %v", err)
+			return
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			httpLog.Warnf("Failed to write purchased collection to client: %v", err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		httpLog.Warnf("Failed to write purchased collection to client: %v", err)
+	}
+}
+
+// proxyFromInfo converts a DHT proxy record to its API representation.
+func proxyFromInfo(info *ProxyInfo) api.Proxy {
+	return api.Proxy{
+		PeerID:     info.PeerID,
+		Name:       info.Name,
+		Location:   info.Location,
+		IPAddress:  info.IPAddress,
+		InitialFee: info.InitialFee,
+		Price:      info.Price,
+		Port:       info.Port,
+	}
+}
+
+func (s *apiServer) listProxies(w http.ResponseWriter, r *http.Request) {
+	list := api.ProxyList{Proxies: []api.Proxy{}}
+	for peerID := range connectedPeers {
+		info, err := getProxyInfo(ctx, dhtRoute, peerID)
+		if err != nil {
+			prxyLog.Tracef("Failed to get proxy info for peer %s: %v", peerID, err)
+			continue
+		}
+		if info != nil {
+			list.Proxies = append(list.Proxies, proxyFromInfo(info))
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// selfProxyStatus looks up this node's own proxy registration.
+func selfProxyStatus() (api.ProxyStatus, error) {
+	info, err := getProxyInfo(ctx, dhtRoute, node.ID().String())
+	if errors.Is(err, routing.ErrNotFound) || (err == nil && info == nil) {
+		return api.ProxyStatus{IsProxy: false}, nil
+	}
+	if err != nil {
+		return api.ProxyStatus{}, err
+	}
+	proxy := proxyFromInfo(info)
+	return api.ProxyStatus{IsProxy: true, Proxy: &proxy}, nil
+}
+
+func (s *apiServer) proxyStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := selfProxyStatus()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *apiServer) registerProxy(w http.ResponseWriter, r *http.Request) {
+	var req api.ProxyRegistration
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "name is required")
+		return
+	}
+	initialFee, err := parsePrice("initial_fee", req.InitialFee)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	price, err := parsePrice("price", req.Price)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	req.InitialFee, req.Price = formatCost(initialFee), formatCost(price)
+	if s.ip == "" {
+		writeAPIError(w, http.StatusConflict, api.ErrConflict, "node has no local IPv4 address to serve as a proxy on")
+		return
+	}
+
+	err = registerProxyAsService(ctx, dhtRoute, s.location, s.ip, req.Name, req.InitialFee, req.Price, node)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	proxy := api.Proxy{
+		PeerID:     node.ID().String(),
+		Name:       req.Name,
+		Location:   s.location,
+		IPAddress:  s.ip,
+		InitialFee: req.InitialFee,
+		Price:      req.Price,
+		Port:       50000,
+	}
+	writeJSON(w, http.StatusOK, api.ProxyStatus{IsProxy: true, Proxy: &proxy})
+}
+
+func (s *apiServer) deregisterProxy(w http.ResponseWriter, r *http.Request) {
+	if err := registerProxyAsService(ctx, dhtRoute, "", "", "", "", "", node); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) setWallet(w http.ResponseWriter, r *http.Request) {
+	var req api.WalletMapping
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if req.Address == "" {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "address is required")
+		return
+	}
+	if req.PeerID != "" && req.PeerID != node.ID().String() {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "peer_id must be omitted or this node's ID")
+		return
+	}
+	if err := mapPeerIDtoWallet(ctx, dhtRoute, req.Address, node); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.WalletMapping{PeerID: node.ID().String(), Address: req.Address})
+}
+
+// ledgerQueryParams are the query parameters selecting ledger entries.
+var ledgerQueryParams = []apiParam{
+	{"kind", "string", `"purchase" or "sale" (default both).`, false},
+	{"since", "string", "RFC 3339 time of the oldest entry to include.", false},
+	{"until", "string", "RFC 3339 time before which entries are included.", false},
+}
+
+// ledgerRecords returns the ledger records selected by the query of r.
+func ledgerRecords(r *http.Request) ([]ledgerRecord, error) {
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	if kind != "" && kind != api.LedgerPurchase && kind != api.LedgerSale {
+		return nil, fmt.Errorf("kind must be %q or %q", api.LedgerPurchase, api.LedgerSale)
+	}
+	var since, until time.Time
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		v := q.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time", bound.name)
+		}
+		*bound.t = t
+	}
+	return FetchLedgerRecords(kind, since, until)
+}
+
+func (s *apiServer) ledger(w http.ResponseWriter, r *http.Request) {
+	records, err := ledgerRecords(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	ledger := api.Ledger{Entries: make([]api.LedgerEntry, 0, len(records))}
+	for i := range records {
+		entry := ledgerEntryFromRecord(&records[i])
+		if entry.Kind == api.LedgerSale {
+			ledger.Sales += entry.Amount
+		} else {
+			ledger.Purchases += entry.Amount
+		}
+		ledger.Entries = append(ledger.Entries, entry)
+	}
+	writeJSON(w, http.StatusOK, ledger)
+}
+
+// ledgerCSVHeader names the columns of a ledger export.
+var ledgerCSVHeader = []string{"time", "kind", "hash", "filename", "peer", "address", "amount", "txid", "id", "countersigned"}
+
+func (s *apiServer) exportLedgerCSV(w http.ResponseWriter, r *http.Request) {
+	records, err := ledgerRecords(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="ledger.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(ledgerCSVHeader)
+	for _, rec := range records {
+		cw.Write([]string{
+			rec.Time.UTC().Format(time.RFC3339),
+			rec.Kind,
+			rec.Hash,
+			rec.Filename,
+			rec.Peer,
+			rec.Address,
+			formatCost(rec.Amount),
+			rec.TxID,
+			rec.ID,
+			strconv.FormatBool(rec.PeerReceipt != nil),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		httpLog.Warnf("Failed to write ledger export to client: %v", err)
+	}
+}
+
+func (s *apiServer) dhtStatus(w http.ResponseWriter, r *http.Request) {
+	probe := true
+	if v := r.URL.Query().Get("probe"); v != "" {
+		var err error
+		if probe, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "probe must be true or false")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, dhtStatus(node, probe))
+}
+
+func (s *apiServer) connectivity(w http.ResponseWriter, r *http.Request) {
+	var target peer.ID
+	if id := r.URL.Query().Get("peer"); id != "" {
+		var err error
+		if target, err = peer.Decode(id); err != nil {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid peer ID %q", id))
+			return
+		}
+		if target == node.ID() {
+			writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "peer must not be this node")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, checkConnectivity(node, target))
+}
+
+func (s *apiServer) bans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, blocked.list())
+}
+
+// parseBanTarget parses the peer ID or the CIDR range of a ban or unban
+// request, exactly one of which must be given.
+func parseBanTarget(id, cidr string) (peer.ID, netip.Prefix, error) {
+	if (id == "") == (cidr == "") {
+		return "", netip.Prefix{}, errors.New("exactly one of peer_id and cidr is required")
+	}
+	if cidr != "" {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return "", netip.Prefix{}, fmt.Errorf("invalid cidr %q", cidr)
+		}
+		return "", prefix, nil
+	}
+	p, err := peer.Decode(id)
+	if err != nil {
+		return "", netip.Prefix{}, fmt.Errorf("invalid peer ID %q", id)
+	}
+	return p, netip.Prefix{}, nil
+}
+
+func (s *apiServer) ban(w http.ResponseWriter, r *http.Request) {
+	var req api.BanRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	p, prefix, err := parseBanTarget(req.PeerID, req.CIDR)
+	switch {
+	case err != nil:
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	case req.DurationSeconds < 0:
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "duration_seconds must not be negative")
+		return
+	case req.DurationSeconds > 0 && p == "":
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "duration_seconds only applies to peers")
+		return
+	case p != "" && p == node.ID():
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "peer must not be this node")
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "banned by operator"
+	}
+	if p == "" {
+		banRange(prefix, reason)
+		peerLog.Infof("Banned IP range %s: %s", prefix.Masked(), reason)
+	} else {
+		var until time.Time
+		if req.DurationSeconds > 0 {
+			until = time.Now().Add(time.Duration(req.DurationSeconds) * time.Second).UTC()
+		}
+		banPeer(p, until, reason)
+		peerLog.Infof("Banned peer %s: %s", p, reason)
+	}
+	writeJSON(w, http.StatusOK, blocked.list())
+}
+
+func (s *apiServer) unban(w http.ResponseWriter, r *http.Request) {
+	var req api.UnbanRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	p, prefix, err := parseBanTarget(req.PeerID, req.CIDR)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if p == "" {
+		if !unbanRange(prefix) {
+			writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("%s is not banned", prefix.Masked()))
+			return
+		}
+		peerLog.Infof("Unbanned IP range %s", prefix.Masked())
+	} else {
+		if !unbanPeer(p) {
+			writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("%s is not banned", p))
+			return
+		}
+		peerLog.Infof("Unbanned peer %s", p)
+	}
+	writeJSON(w, http.StatusOK, blocked.list())
+}
+
+func (s *apiServer) connectedPeers(w http.ResponseWriter, r *http.Request) {
+	list := api.PeerList{Peers: []api.ConnectedPeer{}}
+	for _, conn := range node.Network().Conns() {
+		stat := conn.Stat()
+		list.Peers = append(list.Peers, api.ConnectedPeer{
+			PeerID:    conn.RemotePeer().String(),
+			Addr:      conn.RemoteMultiaddr().String(),
+			Direction: strings.ToLower(stat.Direction.String()),
+			Relayed:   stat.Limited,
+			Opened:    stat.Opened,
+			Latency:   node.Peerstore().LatencyEWMA(conn.RemotePeer()),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) peerBook(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.PeerBook{Peers: peers.list()})
+}
+
+func (s *apiServer) peerFileMeta(w http.ResponseWriter, r *http.Request) {
+	id, hash := r.PathValue("id"), r.PathValue("hash")
+	p, err := peer.Decode(id)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, fmt.Sprintf("invalid peer ID %q", id))
+		return
+	}
+	if err := validateHash(hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	meta, err := fetchMeta(node, p, hash)
+	switch {
+	case errors.Is(err, errNoMeta):
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("peer %s does not provide %s", id, hash))
+	case errors.Is(err, errMalformedMessage):
+		writeAPIError(w, http.StatusBadGateway, api.ErrInvalidContent, err.Error())
+	case err != nil && p != node.ID():
+		writeAPIError(w, http.StatusBadGateway, api.ErrPeerUnreachable, err.Error())
+	case err != nil:
+		writeInternalError(w, r, err)
+	default:
+		writeJSON(w, http.StatusOK, meta)
+	}
+}
+
+func (s *apiServer) peerWallet(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := validatePeerID(id); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	address, err := getWalletAddress(ctx, dhtRoute, id)
+	if errors.Is(err, routing.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("peer %s has not published a wallet address", id))
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.WalletMapping{PeerID: id, Address: address})
+}
+
+// nameVersionFromStore converts a stored name version into its API form.
+func nameVersionFromStore(v *nameVersion) api.NameVersion {
+	return api.NameVersion{
+		Name:      v.Name,
+		Sequence:  v.Sequence,
+		Hash:      v.Hash,
+		Published: v.Published.UTC(),
+	}
+}
+
+func (s *apiServer) listNames(w http.ResponseWriter, r *http.Request) {
+	latest, err := FetchLatestNameVersions()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	list := api.NameList{PeerID: node.ID().String(), Names: make([]api.NameVersion, 0, len(latest))}
+	for i := range latest {
+		list.Names = append(list.Names, nameVersionFromStore(&latest[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) publishName(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := names.ValidateName(name); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	var req api.NamePublication
+	if err := decodeJSONBody(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validateHash(req.Hash); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+
+	rec, err := publishName(name, req.Hash)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+func (s *apiServer) nameVersions(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := names.ValidateName(name); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	versions, err := FetchNameVersions(name)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if len(versions) == 0 {
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("name %s was never published", name))
+		return
+	}
+	history := api.NameHistory{
+		PeerID:   node.ID().String(),
+		Name:     name,
+		Versions: make([]api.NameVersion, 0, len(versions)),
+	}
+	for i := range versions {
+		history.Versions = append(history.Versions, nameVersionFromStore(&versions[i]))
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (s *apiServer) resolveName(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := validatePeerID(id); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	name := r.PathValue("name")
+	if err := names.ValidateName(name); err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+
+	publisher, _ := peer.Decode(id)
+	rec, err := resolveName(publisher, name)
+	switch {
+	case errors.Is(err, errNameNotFound), errors.Is(err, names.ErrExpired):
+		writeAPIError(w, http.StatusNotFound, api.ErrNotFound, fmt.Sprintf("peer %s has no current record for name %s", id, name))
+	case err != nil:
+		writeInternalError(w, r, err)
+	default:
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+func (s *apiServer) openAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openAPIDoc)
+}
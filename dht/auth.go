@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// permission is a class of HTTP API endpoints a credential may call.
+type permission string
+
+const (
+	// permRead allows endpoints that only report state.
+	permRead permission = "read"
+
+	// permWrite allows endpoints that change what the node stores, provides
+	// or advertises.
+	permWrite permission = "write"
+
+	// permSpend allows endpoints that send payments from the wallet.
+	permSpend permission = "spend"
+
+	// permAdmin allows endpoints that change how the node itself runs.
+	permAdmin permission = "admin"
+)
+
+var allPermissions = []permission{permRead, permWrite, permSpend, permAdmin}
+
+// validPermission returns whether p is a known permission.
+func validPermission(p permission) bool {
+	return slices.Contains(allPermissions, p)
+}
+
+// endpointPermissions maps each HTTP API path to the permission required to
+// call it.  Paths missing from the map require permAdmin so new endpoints are
+// closed until they are classified here.
+var endpointPermissions = map[string]permission{
+	"/getproviders":      permRead,
+	"/files":             permRead,
+	"/isProxy":           permRead,
+	"/fetchProxyList":    permRead,
+	"/getWalletAddress":  permRead,
+	"/metrics":           permRead,
+	"/upload":            permWrite,
+	"/delete":            permWrite,
+	"/registerProxy":     permWrite,
+	"/mapPeerIDtoWallet": permWrite,
+	"/purchase":          permSpend,
+	"/debuglevel":        permAdmin,
+}
+
+const (
+	// cookieUsername is the user name written to the cookie file so it can
+	// also be used for HTTP basic auth, as with bitcoind style cookies.
+	cookieUsername = "__cookie__"
+
+	// authCookieName is the browser cookie a token may be sent in.
+	authCookieName = "orcanet_auth"
+)
+
+// apiAuth authenticates HTTP API requests against a set of tokens, each
+// granting a set of permissions.  Tokens are kept only as SHA-256 digests.
+type apiAuth struct {
+	tokens     map[[sha256.Size]byte][]permission
+	cookiePath string
+}
+
+// newAPIAuth generates a random token with every permission, writes it to
+// cookiePath and returns an apiAuth accepting it plus the extra tokens.
+func newAPIAuth(cookiePath string, extra apiTokenFlag) (*apiAuth, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate auth token: %w", err)
+	}
+	token := hex.EncodeToString(buf[:])
+
+	cookie := cookieUsername + ":" + token + "\n"
+	if err := os.WriteFile(cookiePath, []byte(cookie), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write auth cookie: %w", err)
+	}
+
+	a := &apiAuth{
+		tokens:     make(map[[sha256.Size]byte][]permission),
+		cookiePath: cookiePath,
+	}
+	a.tokens[sha256.Sum256([]byte(token))] = allPermissions
+	for t, perms := range extra {
+		a.tokens[sha256.Sum256([]byte(t))] = perms
+	}
+	return a, nil
+}
+
+// removeCookie deletes the cookie file so stale credentials don't outlive
+// the process.
+func (a *apiAuth) removeCookie() {
+	if err := os.Remove(a.cookiePath); err != nil && !os.IsNotExist(err) {
+		httpLog.Warnf("Failed to remove auth cookie %s: %v", a.cookiePath, err)
+	}
+}
+
+// tokenFromRequest extracts the token from a bearer Authorization header,
+// the password of a basic Authorization header, or the auth cookie.
+func tokenFromRequest(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	if c, err := r.Cookie(authCookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// permissions returns the permissions granted to token, if any.  Every known
+// token is compared in constant time.
+func (a *apiAuth) permissions(token string) ([]permission, bool) {
+	digest := sha256.Sum256([]byte(token))
+	var granted []permission
+	found := false
+	for known, perms := range a.tokens {
+		if subtle.ConstantTimeCompare(digest[:], known[:]) == 1 {
+			granted, found = perms, true
+		}
+	}
+	return granted, found
+}
+
+// requiredPermission returns the permission needed to call the handler
+// registered under pattern.
+func requiredPermission(pattern string) permission {
+	if perm, ok := endpointPermissions[pattern]; ok {
+		return perm
+	}
+	return permAdmin
+}
+
+// middleware rejects requests that lack a valid token or whose token does
+// not grant the permission the endpoint requires.  The endpoint is the mux
+// pattern the request matches, so wildcard routes share one entry.
+func (a *apiAuth) middleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="orcanet"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		perms, ok := a.permissions(token)
+		if !ok {
+			httpLog.Warnf("Rejected request to %s from %s: invalid token", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="orcanet"`)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		_, pattern := mux.Handler(r)
+		need := requiredPermission(pattern)
+		if !slices.Contains(perms, need) {
+			httpLog.Warnf("Rejected request to %s from %s: missing %s permission", r.URL.Path, r.RemoteAddr, need)
+			http.Error(w, fmt.Sprintf("Token lacks %s permission", need), http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
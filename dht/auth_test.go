@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"dht/api"
+)
+
+// testAuth returns an apiAuth accepting the extra tokens and the token it
+// wrote to its cookie file.
+func testAuth(t *testing.T, extra apiTokenFlag) (*apiAuth, string) {
+	t.Helper()
+	cookiePath := filepath.Join(t.TempDir(), "orcanet.cookie")
+	a, err := newAPIAuth(cookiePath, extra)
+	if err != nil {
+		t.Fatalf("newAPIAuth: %v", err)
+	}
+	data, err := os.ReadFile(cookiePath)
+	if err != nil {
+		t.Fatalf("failed to read cookie: %v", err)
+	}
+	token, ok := strings.CutPrefix(strings.TrimSpace(string(data)), cookieUsername+":")
+	if !ok || token == "" {
+		t.Fatalf("cookie %q doesn't have the form %s:<token>", data, cookieUsername)
+	}
+	return a, token
+}
+
+// withEndpointPermissions runs the test with perms as the permission table.
+func withEndpointPermissions(t *testing.T, perms map[string]permission) {
+	t.Helper()
+	old := endpointPermissions
+	endpointPermissions = perms
+	t.Cleanup(func() { endpointPermissions = old })
+}
+
+// TestTokenFromRequest checks every way a token may be sent.
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  string
+	}{
+		{"none", func(r *http.Request) {}, ""},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, "secret"},
+		{"basic", func(r *http.Request) { r.SetBasicAuth(cookieUsername, "secret") }, "secret"},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: authCookieName, Value: "secret"}) }, "secret"},
+		{"other cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "secret"}) }, ""},
+		{"other scheme", func(r *http.Request) { r.Header.Set("Authorization", "Token secret") }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files", nil)
+			tt.setup(r)
+			if got := tokenFromRequest(r); got != tt.want {
+				t.Errorf("got token %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAuthMiddleware checks that requests are only passed on with a token
+// granting the permission of their endpoint.
+func TestAuthMiddleware(t *testing.T) {
+	withEndpointPermissions(t, map[string]permission{
+		"/files":    permRead,
+		"/upload":   permWrite,
+		"/purchase": permSpend,
+	})
+	a, cookieToken := testAuth(t, apiTokenFlag{
+		"reader": {permRead},
+		"writer": {permRead, permWrite},
+	})
+
+	mux := http.NewServeMux()
+	for _, path := range []string{"/files", "/upload", "/purchase", "/debuglevel"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {})
+	}
+	handler := a.middleware(mux)
+
+	tests := []struct {
+		token string
+		path  string
+		want  int
+	}{
+		{"", "/files", http.StatusUnauthorized},
+		{"wrong", "/files", http.StatusUnauthorized},
+		{"reader", "/files", http.StatusOK},
+		{"reader", "/upload", http.StatusForbidden},
+		{"writer", "/upload", http.StatusOK},
+		{"writer", "/purchase", http.StatusForbidden},
+		{"writer", "/debuglevel", http.StatusForbidden},
+		{"writer", "/unclassified", http.StatusForbidden},
+		{cookieToken, "/purchase", http.StatusOK},
+		{cookieToken, "/debuglevel", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q on %s: got status %d, want %d", tt.token, tt.path, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q on %s: 401 without WWW-Authenticate", tt.token, tt.path)
+		}
+	}
+}
+
+// TestEndpointPermissions checks the permission table of the version 1 API:
+// every route is classified, only reads are open to read tokens, and paying
+// or running the node take their own permissions.
+func TestEndpointPermissions(t *testing.T) {
+	perms := make(map[string]permission)
+	for path, perm := range endpointPermissions {
+		perms[path] = perm
+	}
+	withEndpointPermissions(t, perms)
+	registerAPIv1(http.NewServeMux(), "", "")
+
+	for path, perm := range endpointPermissions {
+		if !validPermission(perm) {
+			t.Errorf("%s requires unknown permission %q", path, perm)
+		}
+	}
+	for _, route := range apiV1Routes {
+		pattern := route.method + " " + api.BasePath + route.path
+		if got := requiredPermission(pattern); got != route.perm {
+			t.Errorf("%s requires %s, want %s", pattern, got, route.perm)
+		}
+		if route.method != http.MethodGet && route.perm == permRead {
+			t.Errorf("%s changes state but only requires %s", pattern, permRead)
+		}
+	}
+
+	want := map[string]permission{
+		"GET /api/v1/files":                    permRead,
+		"POST /api/v1/files":                   permWrite,
+		"POST /api/v1/purchases":               permSpend,
+		"POST /api/v1/collections/purchases":   permSpend,
+		"POST /api/v1/denylist":                permAdmin,
+		"POST /api/v1/peers/ban":               permAdmin,
+		"POST /api/v1/peers/unban":             permAdmin,
+		"GET /api/v1/diagnostics/connectivity": permAdmin,
+		"/purchase":                            permSpend,
+		"/upload":                              permWrite,
+		"/debuglevel":                          permAdmin,
+		"GET /api/v1/unclassified":             permAdmin,
+	}
+	for pattern, perm := range want {
+		if got := requiredPermission(pattern); got != perm {
+			t.Errorf("%s requires %s, want %s", pattern, got, perm)
+		}
+	}
+}
+
+// TestCORS checks that the UI's origin may call the API, preflights
+// included, and that other origins are refused.
+func TestCORS(t *testing.T) {
+	allowed := strings.Split(defaultAllowedOrigins, ",")
+	called := false
+	handler := enableCORS(allowed, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	r := httptest.NewRequest(http.MethodOptions, "/files", nil)
+	r.Header.Set("Origin", "http://localhost:5173")
+	r.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || called {
+		t.Fatalf("preflight: got status %d, handler called %v", w.Code, called)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:5173" {
+		t.Errorf("preflight: Access-Control-Allow-Origin is %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !slices.Contains(strings.Split(got, ", "), "Authorization") {
+		t.Errorf("preflight: Access-Control-Allow-Headers %q lacks Authorization", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/files", nil)
+	r.Header.Set("Origin", "http://localhost:5173")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if !called {
+		t.Error("request from the UI's origin wasn't passed on")
+	}
+
+	for _, origin := range []string{"http://evil.example", "null", "http://localhost:5174"} {
+		called = false
+		r = httptest.NewRequest(http.MethodPost, "/purchase", nil)
+		r.Header.Set("Origin", origin)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden || called {
+			t.Errorf("origin %s: got status %d, handler called %v", origin, w.Code, called)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxRateBurst bounds the burst of a rate limiter, so a high limit
+	// still spreads a large transfer over time.
+	maxRateBurst = 256 << 10
+
+	// minRateBurst is the smallest burst of a rate limiter.  Limits below
+	// it are enforced on average only.
+	minRateBurst = 4 << 10
+
+	// peerLimiterIdle is how long a per-peer rate limiter is kept after
+	// its last use.
+	peerLimiterIdle = 10 * time.Minute
+)
+
+// newRateLimiter returns a limiter for bytesPerSec, or nil if the rate is
+// not limited.
+func newRateLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := min(max(bytesPerSec, minRateBurst), maxRateBurst)
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// byteRate returns a constructor of limiters for bytesPerSec, or nil if the
+// rate is not limited.
+func byteRate(bytesPerSec int64) func() *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return func() *rate.Limiter { return newRateLimiter(bytesPerSec) }
+}
+
+// peerLimiters hands out one rate limiter per peer and forgets those not
+// used for peerLimiterIdle.
+type peerLimiters struct {
+	newLimiter func() *rate.Limiter
+
+	mtx       sync.Mutex
+	limiters  map[peer.ID]*peerLimiter
+	lastPrune time.Time
+}
+
+type peerLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// newPeerLimiters returns peer limiters made by newLimiter.  A nil
+// newLimiter means no limit.
+func newPeerLimiters(newLimiter func() *rate.Limiter) *peerLimiters {
+	return &peerLimiters{
+		newLimiter: newLimiter,
+		limiters:   make(map[peer.ID]*peerLimiter),
+	}
+}
+
+// get returns the limiter of p, or nil if the rate is not limited.
+func (l *peerLimiters) get(p peer.ID) *rate.Limiter {
+	if l == nil || l.newLimiter == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		for id, pl := range l.limiters {
+			if now.Sub(pl.lastUsed) > peerLimiterIdle {
+				delete(l.limiters, id)
+			}
+		}
+		l.lastPrune = now
+	}
+	pl, ok := l.limiters[p]
+	if !ok {
+		pl = &peerLimiter{limiter: l.newLimiter()}
+		l.limiters[p] = pl
+	}
+	pl.lastUsed = now
+	return pl.limiter
+}
+
+var (
+	// uploadLimiter and downloadLimiter bound the total transfer rate of
+	// file data.  They are nil if the rate is not limited.
+	uploadLimiter   *rate.Limiter
+	downloadLimiter *rate.Limiter
+
+	// peerUploadLimiters and peerDownloadLimiters bound the transfer rate
+	// to and from each peer.
+	peerUploadLimiters   *peerLimiters
+	peerDownloadLimiters *peerLimiters
+
+	// transferSlots holds a token for every file transfer being served;
+	// its capacity is the maximum number of concurrent transfers.
+	transferSlots chan struct{}
+)
+
+// initBandwidth sets up the transfer limits of c.
+func initBandwidth(c *config) {
+	uploadLimiter = newRateLimiter(c.UploadLimit)
+	downloadLimiter = newRateLimiter(c.DownloadLimit)
+	peerUploadLimiters = newPeerLimiters(byteRate(c.PeerUploadLimit))
+	peerDownloadLimiters = newPeerLimiters(byteRate(c.PeerDownloadLimit))
+	if c.MaxTransfers > 0 {
+		transferSlots = make(chan struct{}, c.MaxTransfers)
+	}
+}
+
+// acquireTransfer waits for a free transfer slot.  It returns false if ctx
+// is done first.
+func acquireTransfer(ctx context.Context) bool {
+	if transferSlots == nil {
+		return true
+	}
+	select {
+	case transferSlots <- struct{}{}:
+		activeTransfers.Inc()
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseTransfer frees a slot taken by acquireTransfer.
+func releaseTransfer() {
+	if transferSlots == nil {
+		return
+	}
+	<-transferSlots
+	activeTransfers.Dec()
+}
+
+// waitLimiters blocks until every limiter allows n more bytes.
+func waitLimiters(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimitedWriter writes through a set of rate limiters.
+type rateLimitedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// uploadWriter limits writes of file data to p.
+func uploadWriter(ctx context.Context, p peer.ID, w io.Writer) io.Writer {
+	if uploadLimiter == nil && peerUploadLimiters.get(p) == nil {
+		return w
+	}
+	return &rateLimitedWriter{ctx: ctx, w: w, limiters: []*rate.Limiter{uploadLimiter, peerUploadLimiters.get(p)}}
+}
+
+func (w *rateLimitedWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := min(len(b), maxRateBurst, minBurst(w.limiters))
+		if err := waitLimiters(w.ctx, w.limiters, n); err != nil {
+			return written, err
+		}
+		m, err := w.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// rateLimitedReader reads through a set of rate limiters.
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+}
+
+// downloadReader limits reads of data sent by p.
+func downloadReader(ctx context.Context, p peer.ID, r io.Reader) io.Reader {
+	if downloadLimiter == nil && peerDownloadLimiters.get(p) == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: []*rate.Limiter{downloadLimiter, peerDownloadLimiters.get(p)}}
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > minBurst(r.limiters) {
+		b = b[:minBurst(r.limiters)]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		if werr := waitLimiters(r.ctx, r.limiters, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// minBurst returns the smallest burst of limiters.
+func minBurst(limiters []*rate.Limiter) int {
+	burst := maxRateBurst
+	for _, l := range limiters {
+		if l != nil {
+			burst = min(burst, l.Burst())
+		}
+	}
+	return burst
+}
+
+// newResourceManager returns the libp2p resource manager of the node.  On
+// top of the default limits it bounds the streams of the file transfer and
+// peer exchange protocols, overall and per peer, so a flood of requests
+// can't use up the node's memory and file descriptors.
+func newResourceManager(c *config) (network.ResourceManager, error) {
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+
+	limits.AddProtocolLimit(sendDataProtocol,
+		rcmgr.BaseLimit{StreamsInbound: 64, StreamsOutbound: 64, Streams: 128, Memory: 64 << 20},
+		rcmgr.BaseLimitIncrease{StreamsInbound: 32, StreamsOutbound: 32, Streams: 64, Memory: 32 << 20},
+	)
+	limits.AddProtocolPeerLimit(sendDataProtocol,
+		rcmgr.BaseLimit{StreamsInbound: 8, StreamsOutbound: 8, Streams: 16, Memory: 16 << 20},
+		rcmgr.BaseLimitIncrease{},
+	)
+	limits.AddProtocolLimit(peerExchangeProtocol,
+		rcmgr.BaseLimit{StreamsInbound: 16, StreamsOutbound: 16, Streams: 32, Memory: 4 << 20},
+		rcmgr.BaseLimitIncrease{},
+	)
+	limits.AddProtocolPeerLimit(peerExchangeProtocol,
+		rcmgr.BaseLimit{StreamsInbound: 1, StreamsOutbound: 1, Streams: 2, Memory: 1 << 20},
+		rcmgr.BaseLimitIncrease{},
+	)
+
+	// Explicit system limits replace the scaled ones; zero keeps them.
+	override := rcmgr.PartialLimitConfig{
+		System: rcmgr.ResourceLimits{
+			Memory: rcmgr.LimitVal64(c.MaxMemory),
+			FD:     rcmgr.LimitVal(c.MaxFDs),
+		},
+	}
+	return rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(override.Build(limits.AutoScale())))
+}
+
+// newConnManager returns the connection manager of the node, which trims
+// connections once there are more than maxPeers.
+func newConnManager(maxPeers int) (*connmgr.BasicConnMgr, error) {
+	return connmgr.NewConnManager(maxPeers*3/4, maxPeers, connmgr.WithGracePeriod(time.Minute))
+}
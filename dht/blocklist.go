@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// The blocklist holds the banned peers and IP ranges and is written to disk
+// on every change, so bans outlive restarts.  Peers are banned automatically
+// when their ban score reaches the threshold, for -banduration, or by the
+// operator, for a while or until unbanned.  IP ranges are only banned by the
+// operator.  The connection gater refuses to dial or accept connections of
+// anything on the list, and banning closes the connections already open.
+const (
+	// blocklistVersion is the version of the blocklist file format.
+	blocklistVersion = 1
+)
+
+// blockedPeer is a banned peer.  A zero until bans it until it is unbanned.
+type blockedPeer struct {
+	reason string
+	added  time.Time
+	until  time.Time
+}
+
+// blockedRange is a banned IP range.
+type blockedRange struct {
+	reason string
+	added  time.Time
+}
+
+// serializedBlockedPeer is the form a blockedPeer is saved in.
+type serializedBlockedPeer struct {
+	PeerID string     `json:"peer_id"`
+	Reason string     `json:"reason,omitempty"`
+	Added  time.Time  `json:"added"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// serializedBlockedRange is the form a blockedRange is saved in.
+type serializedBlockedRange struct {
+	CIDR   string    `json:"cidr"`
+	Reason string    `json:"reason,omitempty"`
+	Added  time.Time `json:"added"`
+}
+
+// serializedBlocklist is the blocklist file.
+type serializedBlocklist struct {
+	Version int                      `json:"version"`
+	Peers   []serializedBlockedPeer  `json:"peers"`
+	Ranges  []serializedBlockedRange `json:"ranges"`
+}
+
+// blocklist is the set of banned peers and IP ranges.
+type blocklist struct {
+	mtx    sync.Mutex
+	path   string
+	peers  map[peer.ID]blockedPeer
+	ranges map[netip.Prefix]blockedRange
+}
+
+// blocked is the node's blocklist.  Until loadBlocklist replaces it, it
+// isn't saved anywhere.
+var blocked = newBlocklist("")
+
+// newBlocklist returns an empty blocklist saved to path, or nowhere if path
+// is empty.
+func newBlocklist(path string) *blocklist {
+	return &blocklist{
+		path:   path,
+		peers:  make(map[peer.ID]blockedPeer),
+		ranges: make(map[netip.Prefix]blockedRange),
+	}
+}
+
+// loadBlocklist reads the blocklist saved at path, dropping expired bans.
+// A missing file is an empty blocklist.
+func loadBlocklist(path string) (*blocklist, error) {
+	b := newBlocklist(path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sb serializedBlocklist
+	if err := json.Unmarshal(data, &sb); err != nil {
+		return nil, fmt.Errorf("failed to parse blocklist %s: %w", path, err)
+	}
+	if sb.Version != blocklistVersion {
+		return nil, fmt.Errorf("blocklist %s has unknown version %d", path, sb.Version)
+	}
+	now := time.Now()
+	for _, sp := range sb.Peers {
+		p, err := peer.Decode(sp.PeerID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q in blocklist %s: %w", sp.PeerID, path, err)
+		}
+		bp := blockedPeer{reason: sp.Reason, added: sp.Added}
+		if sp.Until != nil {
+			if !now.Before(*sp.Until) {
+				continue
+			}
+			bp.until = *sp.Until
+		}
+		b.peers[p] = bp
+	}
+	for _, sr := range sb.Ranges {
+		prefix, err := netip.ParsePrefix(sr.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q in blocklist %s: %w", sr.CIDR, path, err)
+		}
+		b.ranges[prefix.Masked()] = blockedRange{reason: sr.Reason, added: sr.Added}
+	}
+	b.updateMetrics()
+	return b, nil
+}
+
+// save writes the blocklist to its file.
+func (b *blocklist) save() error {
+	if b.path == "" {
+		return nil
+	}
+	b.mtx.Lock()
+	sb := serializedBlocklist{
+		Version: blocklistVersion,
+		Peers:   make([]serializedBlockedPeer, 0, len(b.peers)),
+		Ranges:  make([]serializedBlockedRange, 0, len(b.ranges)),
+	}
+	now := time.Now()
+	for p, bp := range b.peers {
+		sp := serializedBlockedPeer{PeerID: p.String(), Reason: bp.reason, Added: bp.added}
+		if !bp.until.IsZero() {
+			if !now.Before(bp.until) {
+				continue
+			}
+			until := bp.until
+			sp.Until = &until
+		}
+		sb.Peers = append(sb.Peers, sp)
+	}
+	for prefix, br := range b.ranges {
+		sb.Ranges = append(sb.Ranges, serializedBlockedRange{CIDR: prefix.String(), Reason: br.reason, Added: br.added})
+	}
+	b.mtx.Unlock()
+
+	data, err := json.MarshalIndent(&sb, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// addPeer bans p until until, or until it is unbanned if until is zero.
+func (b *blocklist) addPeer(p peer.ID, until time.Time, reason string) {
+	b.mtx.Lock()
+	b.peers[p] = blockedPeer{reason: reason, added: time.Now().UTC(), until: until}
+	b.mtx.Unlock()
+	b.updateMetrics()
+}
+
+// removePeer unbans p and reports whether it was banned.
+func (b *blocklist) removePeer(p peer.ID) bool {
+	b.mtx.Lock()
+	bp, ok := b.peers[p]
+	delete(b.peers, p)
+	b.mtx.Unlock()
+	b.updateMetrics()
+	return ok && (bp.until.IsZero() || time.Now().Before(bp.until))
+}
+
+// addRange bans the IP range prefix.
+func (b *blocklist) addRange(prefix netip.Prefix, reason string) {
+	b.mtx.Lock()
+	b.ranges[prefix.Masked()] = blockedRange{reason: reason, added: time.Now().UTC()}
+	b.mtx.Unlock()
+	b.updateMetrics()
+}
+
+// removeRange unbans the IP range prefix and reports whether it was banned.
+func (b *blocklist) removeRange(prefix netip.Prefix) bool {
+	b.mtx.Lock()
+	_, ok := b.ranges[prefix.Masked()]
+	delete(b.ranges, prefix.Masked())
+	b.mtx.Unlock()
+	b.updateMetrics()
+	return ok
+}
+
+// hasPeer reports whether p is banned, forgetting its ban if it expired.
+func (b *blocklist) hasPeer(p peer.ID) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	bp, ok := b.peers[p]
+	if !ok {
+		return false
+	}
+	if !bp.until.IsZero() && !time.Now().Before(bp.until) {
+		delete(b.peers, p)
+		return false
+	}
+	return true
+}
+
+// hasAddr reports whether addr is in a banned IP range.  Relayed addresses
+// are checked by the address of the relay.
+func (b *blocklist) hasAddr(addr multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	a = a.Unmap()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for prefix := range b.ranges {
+		if prefix.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the banned peers and IP ranges.
+func (b *blocklist) list() api.Blocklist {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	list := api.Blocklist{Peers: []api.BannedPeer{}, Ranges: []api.BannedRange{}}
+	now := time.Now()
+	for p, bp := range b.peers {
+		banned := api.BannedPeer{PeerID: p.String(), Reason: bp.reason, Added: bp.added}
+		if !bp.until.IsZero() {
+			if !now.Before(bp.until) {
+				continue
+			}
+			until := bp.until
+			banned.Until = &until
+		}
+		list.Peers = append(list.Peers, banned)
+	}
+	for prefix, br := range b.ranges {
+		list.Ranges = append(list.Ranges, api.BannedRange{CIDR: prefix.String(), Reason: br.reason, Added: br.added})
+	}
+	sort.Slice(list.Peers, func(i, j int) bool { return list.Peers[i].Added.Before(list.Peers[j].Added) })
+	sort.Slice(list.Ranges, func(i, j int) bool { return list.Ranges[i].CIDR < list.Ranges[j].CIDR })
+	return list
+}
+
+// updateMetrics sets the blocklist gauges.
+func (b *blocklist) updateMetrics() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	blocklistEntries.WithLabelValues("peer").Set(float64(len(b.peers)))
+	blocklistEntries.WithLabelValues("range").Set(float64(len(b.ranges)))
+}
+
+// blockGater is the connection gater of the node.  It refuses connections
+// to and from the peers and addresses on the blocklist.
+type blockGater struct {
+	list *blocklist
+}
+
+func (g *blockGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.list.hasPeer(p)
+}
+
+func (g *blockGater) InterceptAddrDial(p peer.ID, addr multiaddr.Multiaddr) bool {
+	return !g.list.hasAddr(addr)
+}
+
+func (g *blockGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return !g.list.hasAddr(addrs.RemoteMultiaddr())
+}
+
+func (g *blockGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return !g.list.hasPeer(p)
+}
+
+func (g *blockGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// TestBlocklist checks that bans outlive a restart, that expired ones are
+// dropped, and that IP ranges block the addresses in them.
+func TestBlocklist(t *testing.T) {
+	resetAbuse(t)
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+	blocked = newBlocklist(path)
+
+	forever, expired, unbanned := testPeerID(t), testPeerID(t), testPeerID(t)
+	banPeer(forever, time.Time{}, "test")
+	banPeer(expired, time.Now().Add(-time.Second), "test")
+	banPeer(unbanned, time.Now().Add(time.Hour), "test")
+	if !unbanPeer(unbanned) || unbanPeer(unbanned) {
+		t.Fatal("unbanning should succeed once")
+	}
+	banRange(netip.MustParsePrefix("10.1.2.0/24"), "test")
+
+	b, err := loadBlocklist(path)
+	if err != nil {
+		t.Fatalf("failed to load blocklist: %v", err)
+	}
+	if !b.hasPeer(forever) || b.hasPeer(expired) || b.hasPeer(unbanned) {
+		t.Fatalf("loaded peers %v, want only %s", b.list().Peers, forever)
+	}
+	for addr, want := range map[string]bool{
+		"/ip4/10.1.2.3/tcp/60000":            true,
+		"/ip6/::ffff:10.1.2.3/udp/1/quic-v1": true,
+		"/ip4/10.1.3.1/tcp/60000":            false,
+		"/dns4/example.com/tcp/60000":        false,
+	} {
+		if got := b.hasAddr(multiaddr.StringCast(addr)); got != want {
+			t.Errorf("%s blocked: got %t, want %t", addr, got, want)
+		}
+	}
+}
+
+// TestBlockGater checks that the connection gater refuses banned peers and
+// addresses in banned ranges, and lets them in again once unbanned.
+func TestBlockGater(t *testing.T) {
+	resetAbuse(t)
+	blocked = newBlocklist(filepath.Join(t.TempDir(), "blocklist.json"))
+	gater := &blockGater{list: blocked}
+
+	banned, other := testPeerID(t), testPeerID(t)
+	prefix := netip.MustParsePrefix("10.1.2.0/24")
+	inRange := multiaddr.StringCast("/ip4/10.1.2.3/tcp/60000")
+	outOfRange := multiaddr.StringCast("/ip4/10.1.3.1/tcp/60000")
+	banPeer(banned, time.Time{}, "test")
+	banRange(prefix, "test")
+
+	if gater.InterceptPeerDial(banned) || !gater.InterceptPeerDial(other) {
+		t.Error("dial: want only the banned peer refused")
+	}
+	if gater.InterceptAddrDial(other, inRange) || !gater.InterceptAddrDial(other, outOfRange) {
+		t.Error("address dial: want only the banned range refused")
+	}
+
+	if !unbanPeer(banned) || !unbanRange(prefix) {
+		t.Fatal("unbanning should succeed")
+	}
+	if unbanRange(prefix) {
+		t.Error("unbanning a range twice should fail")
+	}
+	if !gater.InterceptPeerDial(banned) || !gater.InterceptAddrDial(banned, inRange) {
+		t.Error("unbanned peer and range are still refused")
+	}
+}
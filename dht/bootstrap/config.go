@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	defaultIdentityFile   = "bootstrap.key"
+	defaultPeerID         = "12D3KooWQtwuAfGY2LKHjN7nK4xjbvCYUTt3sUyxj4cwyR2bg31e"
+	defaultListenAddrs    = "/ip4/0.0.0.0/tcp/61000,/ip6/::/tcp/61000"
+	defaultHTTPListen     = "127.0.0.1:9100"
+	defaultDebugLevel     = "info"
+	defaultMaxPeers       = 2000
+	defaultHealthyAge     = time.Hour
+	defaultReservations   = 128
+	defaultCircuits       = 16
+	defaultCircuitTime    = 2 * time.Minute
+	defaultCircuitData    = 1 << 20
+	defaultReservationTTL = time.Hour
+)
+
+// config defines the configuration options of the bootstrap node.
+type config struct {
+	IdentityFile string
+	Seed         string
+	PeerID       peer.ID
+	ListenAddrs  []multiaddr.Multiaddr
+	Announce     []multiaddr.Multiaddr
+	HTTPListen   string
+	DebugLevel   string
+	MaxPeers     int
+	HealthyAge   time.Duration
+
+	RelayReservations   int
+	RelayCircuits       int
+	RelayCircuitTime    time.Duration
+	RelayCircuitData    int64
+	RelayReservationTTL time.Duration
+}
+
+// parseAddrs parses a comma separated list of multiaddresses.
+func parseAddrs(flagName, list string) ([]multiaddr.Multiaddr, error) {
+	var addrs []multiaddr.Multiaddr
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s address %q: %w", flagName, s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// loadConfig parses the command line into a config and validates it.
+func loadConfig() (*config, error) {
+	var c config
+	var listen, announce, peerID string
+
+	flag.StringVar(&c.IdentityFile, "identity", defaultIdentityFile, "File the node's private key is kept in -- created with a new key if missing")
+	flag.StringVar(&c.Seed, "seed", "", "Derive the key from this seed when the identity file is created, to keep the peer ID of a node that used one")
+	flag.StringVar(&peerID, "peerid", defaultPeerID, "Peer ID the DHT nodes dial this node at -- refuse to start under any other; empty accepts any")
+	flag.StringVar(&listen, "listen", defaultListenAddrs, "Comma separated multiaddresses to listen on")
+	flag.StringVar(&announce, "announce", "", "Comma separated multiaddresses to advertise instead of the detected ones")
+	flag.StringVar(&c.HTTPListen, "httplisten", defaultHTTPListen, "Interface/port for the /healthz and /metrics endpoints -- empty disables them")
+	flag.StringVar(&c.DebugLevel, "debuglevel", defaultDebugLevel, "Logging level for all subsystems {trace, debug, info, warn, error, critical} "+
+		"-- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems")
+	flag.IntVar(&c.MaxPeers, "maxpeers", defaultMaxPeers, "Number of connections above which the least useful ones are closed")
+	flag.DurationVar(&c.HealthyAge, "healthyage", defaultHealthyAge, "How recently a peer must have been seen to be handed out in peer exchanges")
+	flag.IntVar(&c.RelayReservations, "relayreservations", defaultReservations, "Maximum number of active relay reservations")
+	flag.IntVar(&c.RelayCircuits, "relaycircuits", defaultCircuits, "Maximum number of relayed connections per peer")
+	flag.DurationVar(&c.RelayCircuitTime, "relaycircuittime", defaultCircuitTime, "How long a relayed connection may last")
+	flag.Int64Var(&c.RelayCircuitData, "relaycircuitdata", defaultCircuitData, "Bytes a relayed connection may carry in each direction")
+	flag.DurationVar(&c.RelayReservationTTL, "relayreservationttl", defaultReservationTTL, "How long a relay reservation lasts before it must be refreshed")
+	flag.Parse()
+
+	if err := parseAndSetDebugLevels(c.DebugLevel); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if peerID != "" {
+		if c.PeerID, err = peer.Decode(peerID); err != nil {
+			return nil, fmt.Errorf("invalid -peerid %q: %w", peerID, err)
+		}
+	}
+	if c.ListenAddrs, err = parseAddrs("listen", listen); err != nil {
+		return nil, err
+	}
+	if len(c.ListenAddrs) == 0 {
+		return nil, fmt.Errorf("invalid -listen %q: no addresses", listen)
+	}
+	if c.Announce, err = parseAddrs("announce", announce); err != nil {
+		return nil, err
+	}
+	if c.HTTPListen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPListen); err != nil {
+			return nil, fmt.Errorf("invalid -httplisten %q: %w", c.HTTPListen, err)
+		}
+	}
+	if c.MaxPeers <= 0 {
+		return nil, fmt.Errorf("invalid -maxpeers %d: must be positive", c.MaxPeers)
+	}
+	if c.HealthyAge <= 0 {
+		return nil, fmt.Errorf("invalid -healthyage %v: must be positive", c.HealthyAge)
+	}
+	if c.RelayReservations < 0 || c.RelayCircuits < 0 || c.RelayCircuitData < 0 {
+		return nil, fmt.Errorf("relay limits must not be negative")
+	}
+	if c.RelayCircuitTime <= 0 || c.RelayReservationTTL <= 0 {
+		return nil, fmt.Errorf("relay durations must be positive")
+	}
+	return &c, nil
+}
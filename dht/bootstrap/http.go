@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthStatus is the body of /healthz.
+type healthStatus struct {
+	Status       string    `json:"status"`
+	PeerID       string    `json:"peer_id"`
+	Addrs        []string  `json:"addrs"`
+	Connected    int       `json:"connected_peers"`
+	RoutingTable int       `json:"routing_table_peers"`
+	KnownPeers   int       `json:"known_peers"`
+	HealthyPeers int       `json:"healthy_peers"`
+	Started      time.Time `json:"started"`
+}
+
+// handleHealth reports whether the node is up, with the state a monitor
+// may want to alert on.  It answers 503 while the node has no listen
+// address.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{
+		Status:       "ok",
+		PeerID:       node.ID().String(),
+		Addrs:        []string{},
+		Connected:    len(node.Network().Peers()),
+		RoutingTable: dhtRoute.RoutingTable().Size(),
+		Started:      startTime,
+	}
+	for _, addr := range node.Addrs() {
+		status.Addrs = append(status.Addrs, addr.String())
+	}
+	status.KnownPeers, status.HealthyPeers = peers.size()
+
+	code := http.StatusOK
+	if len(node.Network().ListenAddresses()) == 0 {
+		status.Status = "not listening"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		httpLog.Debugf("Failed to write health status: %v", err)
+	}
+}
+
+// newHTTPServer returns the server of the /healthz and /metrics endpoints.
+func newHTTPServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", handleHealth)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
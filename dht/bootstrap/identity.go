@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// loadIdentity returns the private key kept in path.  If there is no such
+// file a key is generated, from seed if one is given and at random
+// otherwise, and saved there readable by the owner only.  Unless want is
+// empty, the key must be that of peer ID want, so the node doesn't run
+// under an ID nobody dials; a generated key that isn't is not saved.
+func loadIdentity(path, seed string, want peer.ID) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %w", path, err)
+		}
+		if seed != "" {
+			bootLog.Warnf("Ignoring -seed: the key in %s is used", path)
+		}
+		if err := checkIdentity(key, want); err != nil {
+			return nil, fmt.Errorf("identity file %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+
+	var source io.Reader = rand.Reader
+	if seed != "" {
+		sum := sha256.Sum256([]byte(seed))
+		source = bytes.NewReader(sum[:])
+	}
+	key, _, err := crypto.GenerateEd25519Key(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if err := checkIdentity(key, want); err != nil {
+		return nil, fmt.Errorf("not creating %s: %w", path, err)
+	}
+	data, err = crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+	bootLog.Infof("Created identity file %s", path)
+	return key, nil
+}
+
+// checkIdentity checks that key is that of peer ID want, if want isn't
+// empty.
+func checkIdentity(key crypto.PrivKey, want peer.ID) error {
+	if want == "" {
+		return nil
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+	if id != want {
+		return fmt.Errorf("the key is that of peer ID %s, not %s -- create it with the "+
+			"-seed of %s, or pass -peerid to run under another ID", id, want, want)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to path through a temporary file, so a crash
+// never leaves a partial file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
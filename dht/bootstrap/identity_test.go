@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TestLoadIdentity checks that the seed of the existing bootstrap node
+// gives the peer ID the DHT nodes dial, and that a key of another ID is
+// refused rather than saved or used.
+func TestLoadIdentity(t *testing.T) {
+	want, err := peer.Decode(defaultPeerID)
+	if err != nil {
+		t.Fatalf("invalid default peer ID: %v", err)
+	}
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "random.key")
+	if _, err := loadIdentity(path, "", want); err == nil {
+		t.Fatal("random key accepted for the default peer ID")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("refused key was saved: %v", err)
+	}
+
+	path = filepath.Join(dir, "seeded.key")
+	key, err := loadIdentity(path, "PHAJAM", want)
+	if err != nil {
+		t.Fatalf("seeded key: %v", err)
+	}
+	if id, _ := peer.IDFromPrivateKey(key); id != want {
+		t.Fatalf("seeded key has peer ID %s, want %s", id, want)
+	}
+	if _, err := loadIdentity(path, "", want); err != nil {
+		t.Fatalf("reloading the seeded key: %v", err)
+	}
+
+	path = filepath.Join(dir, "other.key")
+	if _, err := loadIdentity(path, "", ""); err != nil {
+		t.Fatalf("random key without a peer ID to match: %v", err)
+	}
+	if _, err := loadIdentity(path, "", want); err == nil {
+		t.Fatal("saved key of another peer ID accepted")
+	}
+}
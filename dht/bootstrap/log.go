@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btclog"
+)
+
+// Loggers per subsystem, all writing to one backend.
+var (
+	// backendLog is the logging backend used to create all subsystem loggers.
+	backendLog = btclog.NewBackend(logWriter())
+
+	bootLog = backendLog.Logger("BOOT")
+	peerLog = backendLog.Logger("PEER")
+	httpLog = backendLog.Logger("HTTP")
+)
+
+// subsystemLoggers maps each subsystem identifier to its associated logger.
+var subsystemLoggers = map[string]btclog.Logger{
+	"BOOT": bootLog,
+	"PEER": peerLog,
+	"HTTP": httpLog,
+}
+
+// logWriter returns the writer log lines go to: stdout, rewritten for the
+// journal when the process runs under systemd.
+func logWriter() io.Writer {
+	if os.Getenv("JOURNAL_STREAM") != "" {
+		return &journalWriter{w: os.Stdout}
+	}
+	return os.Stdout
+}
+
+// journalPriorities maps btclog levels to syslog priorities.
+var journalPriorities = map[string]string{
+	"TRC": "<7>",
+	"DBG": "<7>",
+	"INF": "<6>",
+	"WRN": "<4>",
+	"ERR": "<3>",
+	"CRT": "<2>",
+}
+
+// journalWriter rewrites btclog lines of the form
+// "2006-01-02 15:04:05.000 [LVL] TAG: message" for systemd: the journal
+// timestamps lines itself, so the time is dropped, and the level becomes a
+// sd-daemon priority prefix so the journal can filter on it.
+type journalWriter struct {
+	w io.Writer
+}
+
+func (j *journalWriter) Write(p []byte) (int, error) {
+	line := p
+	if _, rest, ok := bytes.Cut(p, []byte(" [")); ok && len(rest) > 5 && rest[3] == ']' {
+		if prio, ok := journalPriorities[string(rest[:3])]; ok {
+			line = append([]byte(prio), rest[5:]...)
+		}
+	}
+	if _, err := j.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// supportedSubsystems returns the sorted subsystem identifiers.
+func supportedSubsystems() []string {
+	subsystems := make([]string, 0, len(subsystemLoggers))
+	for subsysID := range subsystemLoggers {
+		subsystems = append(subsystems, subsysID)
+	}
+	sort.Strings(subsystems)
+	return subsystems
+}
+
+// parseAndSetDebugLevels sets the log levels from debugLevel, either a
+// single level for every subsystem or a comma separated list of
+// subsystem=level pairs.
+func parseAndSetDebugLevels(debugLevel string) error {
+	if !strings.Contains(debugLevel, ",") && !strings.Contains(debugLevel, "=") {
+		level, ok := btclog.LevelFromString(debugLevel)
+		if !ok {
+			return fmt.Errorf("the specified debug level [%v] is invalid", debugLevel)
+		}
+		for _, logger := range subsystemLoggers {
+			logger.SetLevel(level)
+		}
+		return nil
+	}
+
+	levels := make(map[string]btclog.Level)
+	for _, logLevelPair := range strings.Split(debugLevel, ",") {
+		subsysID, logLevel, ok := strings.Cut(logLevelPair, "=")
+		if !ok {
+			return fmt.Errorf("the specified debug level contains an "+
+				"invalid subsystem/level pair [%v]", logLevelPair)
+		}
+		if _, exists := subsystemLoggers[subsysID]; !exists {
+			return fmt.Errorf("the specified subsystem [%v] is invalid -- "+
+				"supported subsystems %v", subsysID, supportedSubsystems())
+		}
+		level, ok := btclog.LevelFromString(logLevel)
+		if !ok {
+			return fmt.Errorf("the specified debug level [%v] is invalid", logLevel)
+		}
+		levels[subsysID] = level
+	}
+	for subsysID, level := range levels {
+		subsystemLoggers[subsysID].SetLevel(level)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "orcanet_bootstrap"
+
+// Metrics of the bootstrap node.  libp2p registers its own host, relay and
+// resource manager metrics with the same default registry.
+var (
+	pexRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pex_requests_total",
+		Help:      "Number of peer exchange requests answered, by result.",
+	}, []string{"result"})
+
+	legacyPeerListsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "legacy_peer_lists_total",
+		Help:      "Number of peer lists sent to nodes without peer exchange, by result.",
+	}, []string{"result"})
+)
+
+// registerStateMetrics exports the node's connections, routing table and
+// peer set as gauges read on every scrape.
+func registerStateMetrics() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connected_peers",
+		Help:      "Number of peers currently connected.",
+	}, func() float64 { return float64(len(node.Network().Peers())) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "routing_table_peers",
+		Help:      "Number of peers in the DHT routing table.",
+	}, func() float64 { return float64(dhtRoute.RoutingTable().Size()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "healthy_peers",
+		Help:      "Number of peers handed out in peer exchanges.",
+	}, func() float64 {
+		_, healthy := peers.size()
+		return float64(healthy)
+	})
+}
+
+// resultLabel returns the result label of an operation that returned err.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"dht/pex"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"golang.org/x/time/rate"
+)
+
+// The bootstrap node answers the peer exchange of the DHT node (see the pex
+// package for the records and how they are checked).  It only hands out
+// peers that sent it their own signed records and were connected within the
+// healthy age, so the peers it spreads are known to be alive and their
+// records can't be forged.  Nodes of older versions, which don't speak pex.Protocol, are sent
+// the IDs of those peers on legacyPexProtocol instead.
+const (
+	// legacyPexProtocol is the unauthenticated peer list older nodes
+	// accept from bootstrap nodes.
+	legacyPexProtocol = "/orcanet/p2p"
+
+	// maxPexRequestSize is the largest peer exchange request accepted.
+	maxPexRequestSize = 64 << 10
+
+	// pexTimeout bounds a whole exchange.
+	pexTimeout = 30 * time.Second
+
+	// pexInterval is the minimum time between two exchanges of a peer,
+	// beyond a burst of pexBurst.
+	pexInterval = 10 * time.Second
+	pexBurst    = 3
+
+	// maxKnownPeers is the most peers kept for handing out.
+	maxKnownPeers = 4096
+)
+
+// knownPeer is a peer that sent its own records.
+type knownPeer struct {
+	entry    pex.Entry
+	seq      uint64
+	lastSeen time.Time
+}
+
+// peerSet holds the peers that sent their records, for handing out.
+type peerSet struct {
+	mtx        sync.Mutex
+	peers      map[peer.ID]*knownPeer
+	limiters   map[peer.ID]*rate.Limiter
+	healthyAge time.Duration
+	max        int
+}
+
+// newPeerSet returns an empty peer set of at most max peers, handing out
+// those seen within healthyAge.
+func newPeerSet(max int, healthyAge time.Duration) *peerSet {
+	return &peerSet{
+		peers:      make(map[peer.ID]*knownPeer),
+		limiters:   make(map[peer.ID]*rate.Limiter),
+		healthyAge: healthyAge,
+		max:        max,
+	}
+}
+
+// allow reports whether p may run another exchange.
+func (s *peerSet) allow(p peer.ID) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, ok := s.limiters[p]
+	if !ok {
+		l = rate.NewLimiter(rate.Every(pexInterval), pexBurst)
+		s.limiters[p] = l
+	}
+	return l.Allow()
+}
+
+// add records the entry p sent about itself, unless an entry with a later
+// sequence number is known.
+func (s *peerSet) add(p peer.ID, e pex.Entry, seq uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if known, ok := s.peers[p]; ok {
+		known.lastSeen = time.Now()
+		if seq >= known.seq {
+			known.entry, known.seq = e, seq
+		}
+		return
+	}
+	if len(s.peers) >= s.max {
+		s.evictOldest()
+	}
+	s.peers[p] = &knownPeer{entry: e, seq: seq, lastSeen: time.Now()}
+}
+
+// evictOldest drops the peer seen longest ago.  s.mtx must be held.
+func (s *peerSet) evictOldest() {
+	var oldest peer.ID
+	var oldestSeen time.Time
+	for id, known := range s.peers {
+		if oldest == "" || known.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = id, known.lastSeen
+		}
+	}
+	delete(s.peers, oldest)
+}
+
+// seen marks p as alive now.
+func (s *peerSet) seen(p peer.ID) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if known, ok := s.peers[p]; ok {
+		known.lastSeen = time.Now()
+	}
+}
+
+// healthy returns the IDs of the peers seen within the healthy age, apart
+// from exclude, in random order.
+func (s *peerSet) healthy(exclude peer.ID) []peer.ID {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	cutoff := time.Now().Add(-s.healthyAge)
+	ids := make([]peer.ID, 0, len(s.peers))
+	for id, known := range s.peers {
+		if id != exclude && known.lastSeen.After(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	return ids
+}
+
+// sample returns the entries of up to n healthy peers other than exclude.
+func (s *peerSet) sample(n int, exclude peer.ID) []pex.Entry {
+	ids := s.healthy(exclude)
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entries := make([]pex.Entry, 0, len(ids))
+	for _, id := range ids {
+		if known, ok := s.peers[id]; ok {
+			entries = append(entries, known.entry)
+		}
+	}
+	return entries
+}
+
+// prune forgets the peers not seen for ten times the healthy age and the
+// rate limiters of peers that are no longer connected.
+func (s *peerSet) prune(node host.Host) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	cutoff := time.Now().Add(-10 * s.healthyAge)
+	for id, known := range s.peers {
+		if known.lastSeen.Before(cutoff) {
+			delete(s.peers, id)
+		}
+	}
+	for id := range s.limiters {
+		if node.Network().Connectedness(id) != network.Connected {
+			delete(s.limiters, id)
+		}
+	}
+}
+
+// size returns the number of peers in the set and how many are healthy.
+func (s *peerSet) size() (int, int) {
+	s.mtx.Lock()
+	total := len(s.peers)
+	s.mtx.Unlock()
+	return total, len(s.healthy(""))
+}
+
+// handlePex answers peer exchange requests with a sample of healthy peers.
+func handlePex(node host.Host, peers *peerSet) {
+	node.SetStreamHandler(pex.Protocol, func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		if !peers.allow(remote) {
+			pexRequestsTotal.WithLabelValues("limited").Inc()
+			s.Reset()
+			return
+		}
+		if err := s.SetDeadline(time.Now().Add(pexTimeout)); err != nil {
+			peerLog.Debugf("Failed to set deadline on stream of %s: %v", remote, err)
+		}
+
+		data, err := io.ReadAll(io.LimitReader(s, maxPexRequestSize+1))
+		if err == nil && len(data) > maxPexRequestSize {
+			err = fmt.Errorf("request of more than %d bytes", maxPexRequestSize)
+		}
+		var req pex.Request
+		if err == nil {
+			err = json.Unmarshal(data, &req)
+		}
+		var v *pex.Peer
+		if err == nil {
+			v, err = pex.Verify(req.Self)
+		}
+		if err == nil && v.ID != remote {
+			err = fmt.Errorf("%w: %s sent the record of %s as its own", pex.ErrBadSignature, remote, v.ID)
+		}
+		if err != nil {
+			pexRequestsTotal.WithLabelValues("invalid").Inc()
+			peerLog.Debugf("Invalid peer exchange request from %s: %v", remote, err)
+			s.Reset()
+			return
+		}
+
+		if cab, ok := peerstore.GetCertifiedAddrBook(node.Peerstore()); ok {
+			if _, err := cab.ConsumePeerRecord(v.Envelope, peerstore.RecentlyConnectedAddrTTL); err != nil {
+				peerLog.Debugf("Failed to store record of %s: %v", remote, err)
+			}
+		}
+		peers.add(remote, req.Self, v.Seq)
+
+		self, err := pex.LocalEntry(node, []string{pex.CapRelay})
+		if err != nil {
+			peerLog.Errorf("Failed to answer peer exchange: %v", err)
+			return
+		}
+		resp := pex.Response{Self: self, Peers: peers.sample(min(max(req.Want, 0), pex.MaxPeers), remote)}
+		if err := json.NewEncoder(s).Encode(&resp); err != nil {
+			pexRequestsTotal.WithLabelValues("error").Inc()
+			peerLog.Debugf("Failed to send peers to %s: %v", remote, err)
+			return
+		}
+		pexRequestsTotal.WithLabelValues("ok").Inc()
+		peerLog.Debugf("Sent %d peers to %s", len(resp.Peers), remote)
+	})
+}
+
+// sendLegacyPeers sends p, a node that doesn't speak pex.Protocol, the IDs
+// of healthy peers on legacyPexProtocol.
+func sendLegacyPeers(node host.Host, peers *peerSet, p peer.ID) error {
+	ids := peers.healthy(p)
+	if len(ids) > pex.MaxPeers {
+		ids = ids[:pex.MaxPeers]
+	}
+	type knownPeerID struct {
+		PeerID string `json:"peer_id"`
+	}
+	msg := struct {
+		KnownPeers []knownPeerID `json:"known_peers"`
+	}{KnownPeers: make([]knownPeerID, 0, len(ids))}
+	for _, id := range ids {
+		msg.KnownPeers = append(msg.KnownPeers, knownPeerID{id.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(globalCtx, pexTimeout)
+	defer cancel()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, legacyPexProtocol), p, legacyPexProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to open peer list stream to %s: %w", p, err)
+	}
+	defer s.Close()
+	if err := s.SetDeadline(time.Now().Add(pexTimeout)); err != nil {
+		peerLog.Debugf("Failed to set deadline on stream of %s: %v", p, err)
+	}
+	if err := json.NewEncoder(s).Encode(&msg); err != nil {
+		return fmt.Errorf("failed to send peer list to %s: %w", p, err)
+	}
+	peerLog.Debugf("Sent %d peer IDs to legacy node %s", len(msg.KnownPeers), p)
+	return nil
+}
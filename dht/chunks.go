@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"dht/api"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"lukechampine.com/blake3"
+	"lukechampine.com/blake3/bao"
+)
+
+// Files are addressed by the root of their BLAKE3 Merkle tree, published as
+// a CIDv1 with the raw codec and a blake3 multihash.  Next to every file the
+// node keeps the inner nodes of its tree (a Bao outboard encoding), which is
+// enough to prove any chunk of the file against the root.  Downloads ask for
+// one chunk at a time and check each one on arrival, so chunks can come from
+// different providers and a bad provider is caught after at most one chunk.
+//
+// Files added before content IDs existed keep their hex SHA-256 hash and can
+// only be fetched whole.
+const (
+	// chunkGroup is the number of 1 KiB BLAKE3 chunks in a transfer chunk,
+	// as a power of two.
+	chunkGroup = 8
+
+	// chunkSize is the size of a transfer chunk: 256 KiB.
+	chunkSize = 1024 << chunkGroup
+
+	// outboardDir is the directory the Bao outboard trees of stored files
+	// are kept in, one per content ID.
+	outboardDir = "outboard"
+)
+
+var (
+	// errContentMismatch is returned when data received from a provider
+	// doesn't hash to what was asked for.
+	errContentMismatch = errors.New("content does not match its hash")
+
+	// errInvalidChunk is returned for a malformed chunk request.
+	errInvalidChunk = errors.New("invalid chunk request")
+)
+
+// outboardBuffer is an in-memory io.WriterAt for bao.Encode.
+type outboardBuffer []byte
+
+func (b outboardBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(b[off:], p), nil
+}
+
+// rootCID returns the content ID of a BLAKE3 tree root.
+func rootCID(root [32]byte) cid.Cid {
+	mh, err := multihash.Encode(root[:], multihash.BLAKE3)
+	if err != nil {
+		// Only fails for unknown codes or mismatched lengths.
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+// parseContentID returns the BLAKE3 root of a content ID.  It reports false
+// for anything else, including legacy SHA-256 hashes.
+func parseContentID(hash string) ([32]byte, bool) {
+	var root [32]byte
+	c, err := cid.Decode(hash)
+	if err != nil || c.Version() != 1 || c.Type() != cid.Raw {
+		return root, false
+	}
+	dec, err := multihash.Decode(c.Hash())
+	if err != nil || dec.Code != multihash.BLAKE3 || len(dec.Digest) != len(root) {
+		return root, false
+	}
+	copy(root[:], dec.Digest)
+	return root, true
+}
+
+// isLegacyHash reports whether hash is the hex SHA-256 of a file added
+// before content IDs.
+func isLegacyHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// providerCID returns the CID that providers of hash announce in the DHT.
+// Content IDs are provided as they are; legacy hashes keep the CID of the
+// SHA-256 of the hex string so older nodes still find each other.
+func providerCID(hash string) (cid.Cid, error) {
+	if root, ok := parseContentID(hash); ok {
+		return rootCID(root), nil
+	}
+	sum := sha256.Sum256([]byte(hash))
+	mh, err := multihash.EncodeName(sum[:], "sha2-256")
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error encoding multihash: %w", err)
+	}
+	return cid.NewCidV1(cid.Raw, mh), nil
+}
+
+// contentTree reads size bytes from r and returns their content ID and the
+// outboard encoding of their tree.
+func contentTree(r io.Reader, size int64) (string, []byte, error) {
+	outboard := make(outboardBuffer, bao.EncodedSize(int(size), chunkGroup, true))
+	root, err := bao.Encode(outboard, r, size, chunkGroup, true)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to hash contents: %w", err)
+	}
+	return rootCID(root).String(), outboard, nil
+}
+
+// hashContent returns the content ID and size of the contents of r.
+func hashContent(r io.ReadSeeker) (string, int64, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	hash, _, err := contentTree(r, size)
+	return hash, size, err
+}
+
+// outboardPath returns where the outboard tree of hash is stored.
+func outboardPath(hash string) string {
+	return filepath.Join(outboardDir, hash)
+}
+
+// writeOutboard stores the outboard tree of hash.
+func writeOutboard(hash string, outboard []byte) error {
+	if err := os.MkdirAll(outboardDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return os.WriteFile(outboardPath(hash), outboard, 0644)
+}
+
+// removeOutboard deletes the outboard tree of hash, if there is one.
+func removeOutboard(hash string) {
+	if err := os.Remove(outboardPath(hash)); err != nil && !os.IsNotExist(err) {
+		storLog.Warnf("Failed to delete outboard tree of %s: %v", hash, err)
+	}
+}
+
+// loadOutboard returns the outboard tree of hash, rebuilding it from the
+// stored file if it went missing.
+func loadOutboard(hash string, file *os.File, size int64) ([]byte, error) {
+	outboard, err := os.ReadFile(outboardPath(hash))
+	if err == nil {
+		return outboard, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	storLog.Infof("Rebuilding outboard tree of %s", hash)
+	rebuilt, outboard, err := contentTree(io.NewSectionReader(file, 0, size), size)
+	if err != nil {
+		return nil, err
+	}
+	if rebuilt != hash {
+		return nil, fmt.Errorf("%w: stored file for %s hashes to %s", errContentMismatch, hash, rebuilt)
+	}
+	if err := writeOutboard(hash, outboard); err != nil {
+		storLog.Warnf("Failed to store outboard tree of %s: %v", hash, err)
+	}
+	return outboard, nil
+}
+
+// chunkBounds returns the offset and length of chunk index of a file of
+// size bytes.  Chunk 0 of an empty file is empty.
+func chunkBounds(index, size uint64) (uint64, uint64, error) {
+	if index > size/chunkSize || (index > 0 && index*chunkSize >= size) {
+		return 0, 0, fmt.Errorf("%w: chunk %d is past the end", errInvalidChunk, index)
+	}
+	offset := index * chunkSize
+	return offset, min(chunkSize, size-offset), nil
+}
+
+// parseChunkRequest parses the "<hash>:<index>" argument of a CHUNK
+// message.
+func parseChunkRequest(arg string) (string, uint64, error) {
+	hash, indexStr, ok := strings.Cut(arg, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("%w: %q", errInvalidChunk, arg)
+	}
+	index, err := strconv.ParseUint(indexStr, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: bad index %q", errInvalidChunk, indexStr)
+	}
+	return hash, index, nil
+}
+
+// readChunk returns the Bao slice proving chunk index of the stored file
+// hash against its root.
+func readChunk(hash string, index uint64) ([]byte, error) {
+	if _, ok := parseContentID(hash); !ok {
+		return nil, fmt.Errorf("%w: %s has no chunk tree", errInvalidChunk, hash)
+	}
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errFileNotFound
+	}
+	filename, ok := record["filename"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid record format - filename not found")
+	}
+
+	file, err := os.Open(filepath.Join("files", filename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset, length, err := chunkBounds(index, uint64(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	outboard, err := loadOutboard(hash, file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	slice, err := extractChunk(file, outboard, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract chunk %d of %s: %w", index, hash, err)
+	}
+	return slice, nil
+}
+
+// extractChunk returns the Bao slice of the length bytes at offset of file,
+// whose tree is outboard.
+func extractChunk(file io.ReaderAt, outboard []byte, offset, length uint64) ([]byte, error) {
+	var slice bytes.Buffer
+	data := io.NewSectionReader(file, int64(offset), int64(length))
+	if err := bao.ExtractSlice(&slice, data, bytes.NewReader(outboard), chunkGroup, offset, length); err != nil {
+		return nil, err
+	}
+	return slice.Bytes(), nil
+}
+
+// fetchChunk asks peerID for chunk index of hash and verifies it against
+// root.  It returns the chunk and the size of the whole file.
+func fetchChunk(peerID, hash string, root [32]byte, index uint64) ([]byte, uint64, error) {
+	slice, err := requestFromPeer(peerID, "CHUNK:"+hash+":"+strconv.FormatUint(index, 10), replyTimeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to request chunk %d of %s from %s: %w", index, hash, peerID, err)
+	}
+	if len(slice) < 8 {
+		return nil, 0, errNotProvided
+	}
+	chunk, size, err := verifyChunk(slice, root, index)
+	if err != nil {
+		return nil, 0, fmt.Errorf("chunk %d of %s from %s: %w", index, hash, peerID, err)
+	}
+	return chunk, size, nil
+}
+
+// verifyChunk checks that slice is the Bao slice of chunk index of the file
+// with tree root.  It returns the chunk and the size of the whole file.
+func verifyChunk(slice []byte, root [32]byte, index uint64) ([]byte, uint64, error) {
+	if len(slice) < 8 {
+		return nil, 0, fmt.Errorf("%w: truncated slice", errContentMismatch)
+	}
+	size := binary.LittleEndian.Uint64(slice[:8])
+	offset, length, err := chunkBounds(index, size)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: claimed size %d", errContentMismatch, size)
+	}
+	if size == 0 {
+		// An empty slice carries no tree to check; the root itself has
+		// to be that of no data.
+		if blake3.Sum256(nil) != root {
+			return nil, 0, errContentMismatch
+		}
+		return nil, 0, nil
+	}
+	chunk, ok := bao.VerifySlice(slice, chunkGroup, offset, length, root)
+	if !ok {
+		return nil, 0, errContentMismatch
+	}
+	return chunk, size, nil
+}
+
+// fetchChunks downloads the file with content ID hash chunk by chunk,
+// taking turns among peers and verifying every chunk as it arrives.  A
+// chunk that can't be had from one peer is asked for from the next.
+func fetchChunks(peers []string, hash string) ([]byte, error) {
+	root, ok := parseContentID(hash)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a content ID", hash)
+	}
+	if len(peers) == 0 {
+		return nil, errNotProvided
+	}
+
+	var data []byte
+	var size uint64
+	next := 0
+	for index := uint64(0); index == 0 || index*chunkSize < size; index++ {
+		var chunk []byte
+		var chunkFileSize uint64
+		var err error
+		for range peers {
+			peerID := peers[next%len(peers)]
+			next++
+			chunk, chunkFileSize, err = fetchChunk(peerID, hash, root, index)
+			if err == nil && index > 0 && chunkFileSize != size {
+				err = fmt.Errorf("%w: %s from %s changed size", errContentMismatch, hash, peerID)
+			}
+			chunksReceivedTotal.WithLabelValues(resultLabel(err)).Inc()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errContentMismatch) {
+				misbehaveID(peerID, misbehaviorBadContent, err.Error())
+			}
+			xferLog.Warnf("Chunk %d of %s from %s: %v", index, hash, peerID, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if index == 0 {
+			size = chunkFileSize
+			data = make([]byte, 0, size)
+		}
+		data = append(data, chunk...)
+		notifyEvent(api.EventDownloadProgress, api.DownloadProgressEvent{
+			PeerID: peers[(next-1)%len(peers)],
+			Hash:   hash,
+			Bytes:  int64(len(data)),
+		})
+	}
+	return data, nil
+}
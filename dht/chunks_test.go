@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// testChunkFile returns a file of size bytes, its tree root and its
+// outboard tree.
+func testChunkFile(t *testing.T, size int) ([]byte, [32]byte, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("failed to generate file: %v", err)
+	}
+	hash, outboard, err := contentTree(bytes.NewReader(data), int64(size))
+	if err != nil {
+		t.Fatalf("contentTree: %v", err)
+	}
+	root, ok := parseContentID(hash)
+	if !ok {
+		t.Fatalf("contentTree returned %q, not a content ID", hash)
+	}
+	return data, root, outboard
+}
+
+// testChunkSlice returns the slice proving chunk index of data.
+func testChunkSlice(t *testing.T, data, outboard []byte, index uint64) []byte {
+	t.Helper()
+	offset, length, err := chunkBounds(index, uint64(len(data)))
+	if err != nil {
+		t.Fatalf("chunkBounds: %v", err)
+	}
+	slice, err := extractChunk(bytes.NewReader(data), outboard, offset, length)
+	if err != nil {
+		t.Fatalf("extractChunk: %v", err)
+	}
+	return slice
+}
+
+// TestVerifyChunk checks that every chunk of a file is accepted against its
+// root and comes back intact.
+func TestVerifyChunk(t *testing.T) {
+	for _, size := range []int{1, chunkSize - 1, chunkSize, 2*chunkSize + 1} {
+		data, root, outboard := testChunkFile(t, size)
+		for index := uint64(0); index*chunkSize < uint64(size); index++ {
+			chunk, gotSize, err := verifyChunk(testChunkSlice(t, data, outboard, index), root, index)
+			if err != nil {
+				t.Fatalf("size %d, chunk %d: %v", size, index, err)
+			}
+			offset, length, _ := chunkBounds(index, uint64(size))
+			if gotSize != uint64(size) || !bytes.Equal(chunk, data[offset:offset+length]) {
+				t.Fatalf("size %d, chunk %d: got %d bytes of a %d byte file, want %d of %d", size, index, len(chunk), gotSize, length, size)
+			}
+		}
+	}
+
+	_, root, _ := testChunkFile(t, 0)
+	if chunk, size, err := verifyChunk(make([]byte, 8), root, 0); err != nil || len(chunk) != 0 || size != 0 {
+		t.Errorf("empty file: got %d bytes of %d, err %v", len(chunk), size, err)
+	}
+}
+
+// TestVerifyChunkRejects checks that tampered chunks, chunks for another
+// index or file and truncated proofs are rejected.
+func TestVerifyChunkRejects(t *testing.T) {
+	data, root, outboard := testChunkFile(t, 2*chunkSize+1)
+	_, otherRoot, _ := testChunkFile(t, 2*chunkSize+2)
+	slice := testChunkSlice(t, data, outboard, 1)
+
+	tamperedData := append([]byte(nil), slice...)
+	tamperedData[len(tamperedData)-1] ^= 1
+	tamperedProof := append([]byte(nil), slice...)
+	tamperedProof[8] ^= 1
+	tamperedSize := append([]byte(nil), slice...)
+	tamperedSize[0] ^= 1
+
+	tests := []struct {
+		name  string
+		slice []byte
+		root  [32]byte
+		index uint64
+	}{
+		{"tampered chunk", tamperedData, root, 1},
+		{"tampered proof", tamperedProof, root, 1},
+		{"tampered size", tamperedSize, root, 1},
+		{"wrong index", slice, root, 0},
+		{"past the end", slice, root, 3},
+		{"other file", slice, otherRoot, 1},
+		{"truncated proof", slice[:len(slice)/2], root, 1},
+		{"no proof", slice[:8], root, 1},
+		{"truncated size", slice[:7], root, 1},
+		{"empty file claimed", make([]byte, 8), root, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := verifyChunk(tt.slice, tt.root, tt.index); !errors.Is(err, errContentMismatch) {
+				t.Errorf("verifyChunk returned %v, want %v", err, errContentMismatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// listPageLimit is the page size used to list all files.
+const listPageLimit = 500
+
+// command is an orcactl command.  Its name may have two words, as in
+// "proxy list".
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, c *api.Client, p *printer, args []string) error
+}
+
+// commands lists the orcactl commands in the order usage shows them.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"add", "<path> [-price DC] [-visibility V] [-allow peers]", "Publish a file", runAdd},
+		{"ls", "[-offset N] [-limit N]", "List the published files", runList},
+		{"rm", "<hash>", "Remove a file and stop providing it", runRemove},
+		{"providers", "<hash> [-meta]", "List the peers providing a file", runProviders},
+		{"meta", "<peer> <hash> [-preview path]", "Ask a provider about a file before buying it", runMeta},
+		{"get", "<hash> [-from peer] [-o path] [-maxprice DC] [-token T -price DC]", "Buy a file from a provider", runGet},
+		{"access", "<hash> [-visibility V] [-allow peers] [-revoke]", "Show or change who may fetch a file", runAccess},
+		{"token", "<hash> [-peer ID] [-ttl D]", "Issue an access token to a private file", runToken},
+		{"proxy list", "", "List the peers registered as proxies", runProxyList},
+		{"proxy status", "", "Show whether the node is registered as a proxy", runProxyStatus},
+		{"proxy register", "-name NAME [-fee FEE] [-price PRICE]", "Register the node as a proxy", runProxyRegister},
+		{"proxy deregister", "", "Withdraw the node's proxy registration", runProxyDeregister},
+		{"peers", "[-book]", "List the connected peers, or the peer book", runPeers},
+		{"bans", "", "List the banned peers and IP ranges", runBans},
+		{"ban", "<peer|cidr> [-for D] [-reason R]", "Ban a peer or an IP range", runBan},
+		{"unban", "<peer|cidr>", "Lift the ban of a peer or an IP range", runUnban},
+		{"diag", "[-peer ID]", "Test the node's reachability and the paths to a peer", runDiag},
+		{"denylist list", "", "List the denylist and its subscriptions", runDenylistList},
+		{"denylist add", "<hash> [-digest]", "Refuse to store, serve or fetch a file", runDenylistAdd},
+		{"denylist rm", "<hash> [-digest]", "Remove a file from the local denylist", runDenylistRemove},
+		{"denylist export", "[-o path]", "Write the local denylist signed by the node's key", runDenylistExport},
+	}
+}
+
+// findCommand returns the command named by the start of args and the
+// arguments that follow its name, or nil if there is none.
+func findCommand(args []string) (*command, []string) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):]
+		}
+	}
+	return nil, args
+}
+
+// newFlagSet returns the flag set of cmd, which prints the command's usage
+// on errors.
+func newFlagSet(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet("orcactl "+cmd, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.name == cmd {
+				fmt.Fprintf(fs.Output(), "Usage: orcactl %s %s\n\n%s.\n", c.name, c.args, c.summary)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of fs wherever they appear in args and
+// returns the remaining positional arguments, checking there are want of
+// them.
+func parseArgs(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != want {
+		fmt.Fprintf(fs.Output(), "expected %d arguments, got %d\n", want, len(positional))
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// amountFlag is a flag holding an amount of DC.
+type amountFlag struct {
+	amount btcutil.Amount
+	set    bool
+}
+
+func (f *amountFlag) String() string {
+	return api.FormatAmount(f.amount)
+}
+
+func (f *amountFlag) Set(s string) error {
+	amount, err := api.ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	f.amount, f.set = amount, true
+	return nil
+}
+
+// formatSize renders a size in bytes with a binary unit.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatTime renders t for tables.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func runAdd(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("add")
+	var price amountFlag
+	fs.Var(&price, "price", "Price of the file in DC")
+	visibility := fs.String("visibility", api.VisibilityPublic, "Who may find and fetch the file: public, unlisted or private")
+	allow := fs.String("allow", "", "Comma separated IDs of the peers that may fetch a private file")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	access := &api.FileAccess{Visibility: *visibility, Allow: splitList(*allow)}
+	file, err := c.UploadFile(ctx, filepath.Base(args[0]), f, api.Amount(price.amount), access)
+	if err != nil {
+		return err
+	}
+	return p.print(file, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", file.Hash, file.Filename, file.Cost, file.Visibility)
+	})
+}
+
+func runList(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("ls")
+	offset := fs.Int64("offset", 0, "Number of files to skip")
+	limit := fs.Int64("limit", 0, "Most files to list (0 for all)")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	files := []api.File{}
+	for next := *offset; ; {
+		pageLimit := int64(listPageLimit)
+		if *limit > 0 {
+			pageLimit = min(pageLimit, *offset+*limit-next)
+		}
+		page, err := c.ListFiles(ctx, next, pageLimit)
+		if err != nil {
+			return err
+		}
+		files = append(files, page.Files...)
+		next += int64(len(page.Files))
+		if len(page.Files) == 0 || next >= page.Total || (*limit > 0 && next >= *offset+*limit) {
+			break
+		}
+	}
+	return p.print(files, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "HASH\tNAME\tSIZE\tPRICE\tVISIBILITY\tADDED")
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", f.Hash, f.Filename, formatSize(f.Size), f.Cost, f.Visibility, formatTime(f.Timestamp))
+		}
+	})
+}
+
+func runRemove(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	args, err := parseArgs(newFlagSet("rm"), args, 1)
+	if err != nil {
+		return err
+	}
+	return c.DeleteFile(ctx, args[0])
+}
+
+func runProviders(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("providers")
+	withMeta := fs.Bool("meta", false, "Ask every provider about the file")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	list, err := c.Providers(ctx, args[0])
+	if *withMeta {
+		list, err = c.ProvidersWithMeta(ctx, args[0])
+	}
+	if err != nil {
+		return err
+	}
+	return p.print(list, func(w *tabwriter.Writer) {
+		if !*withMeta {
+			fmt.Fprintln(w, "PEER\tPRICE\tSELF")
+			for _, provider := range list.Providers {
+				fmt.Fprintf(w, "%s\t%s\t%t\n", provider.PeerID, provider.Cost, provider.Self)
+			}
+			return
+		}
+		fmt.Fprintln(w, "PEER\tPRICE\tSELF\tNAME\tSIZE\tTYPE\tPREVIEW")
+		for _, provider := range list.Providers {
+			name, size, mimeType, preview := "-", "-", "-", "-"
+			if m := provider.Meta; m != nil {
+				name, size, mimeType = m.Filename, formatSize(m.Size), m.MIMEType
+				if m.PreviewKind != "" {
+					preview = m.PreviewKind
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\t%s\n", provider.PeerID, provider.Cost, provider.Self, name, size, mimeType, preview)
+		}
+	})
+}
+
+func runMeta(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("meta")
+	previewPath := fs.String("preview", "", "Write the free preview, if any, to this file")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	meta, err := c.FileMeta(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if *previewPath != "" && len(meta.Preview) > 0 {
+		if err := os.WriteFile(*previewPath, meta.Preview, 0o644); err != nil {
+			return err
+		}
+	}
+	return p.print(meta, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Hash:\t%s\n", meta.Hash)
+		fmt.Fprintf(w, "Name:\t%s\n", meta.Filename)
+		fmt.Fprintf(w, "Size:\t%s\n", formatSize(meta.Size))
+		fmt.Fprintf(w, "Type:\t%s\n", meta.MIMEType)
+		fmt.Fprintf(w, "Chunks:\t%d\n", meta.Chunks)
+		fmt.Fprintf(w, "Price:\t%s\n", meta.Cost)
+		if meta.Description != "" {
+			fmt.Fprintf(w, "Description:\t%s\n", meta.Description)
+		}
+		if meta.PreviewKind != "" {
+			fmt.Fprintf(w, "Preview:\t%s, %s, %s\n", meta.PreviewKind, meta.PreviewType, formatSize(int64(len(meta.Preview))))
+		}
+	})
+}
+
+// download is the result of the get command.
+type download struct {
+	Hash     string     `json:"hash"`
+	Filename string     `json:"filename"`
+	Path     string     `json:"path"`
+	PeerID   string     `json:"peer_id"`
+	Cost     api.Amount `json:"cost"`
+}
+
+// chooseProvider returns the provider of list to buy from: from if given,
+// and the cheapest other peer otherwise.
+func chooseProvider(list *api.ProviderList, from string) (*api.Provider, error) {
+	var chosen *api.Provider
+	for i := range list.Providers {
+		provider := &list.Providers[i]
+		switch {
+		case from != "":
+			if provider.PeerID == from {
+				return provider, nil
+			}
+		case provider.Self:
+		case chosen == nil || provider.Cost < chosen.Cost:
+			chosen = provider
+		}
+	}
+	if chosen == nil {
+		if from != "" {
+			return nil, &api.Error{Code: api.ErrNotFound, Message: fmt.Sprintf("peer %s does not provide %s", from, list.Hash)}
+		}
+		return nil, &api.Error{Code: api.ErrNotFound, Message: fmt.Sprintf("no other peer provides %s", list.Hash)}
+	}
+	return chosen, nil
+}
+
+func runGet(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("get")
+	from := fs.String("from", "", "Peer to buy from (default the cheapest provider)")
+	out := fs.String("o", "", "File to save to (default the file's name in the current directory)")
+	var maxPrice, price amountFlag
+	fs.Var(&maxPrice, "maxprice", "Refuse to pay more than this many DC")
+	token := fs.String("token", "", "Access token to a private file, which must be bought -from its owner")
+	fs.Var(&price, "price", "Price of the private file in DC, which isn't published")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	hash := args[0]
+
+	// Private files aren't provided, so their owner and price must be
+	// given.
+	provider := &api.Provider{PeerID: *from, Cost: api.Amount(price.amount)}
+	if *token != "" && *from == "" {
+		fmt.Fprintln(fs.Output(), "-token requires -from")
+		fs.Usage()
+		return errUsage
+	}
+	if *token == "" {
+		list, err := c.Providers(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if provider, err = chooseProvider(list, *from); err != nil {
+			return err
+		}
+	}
+	if maxPrice.set && btcutil.Amount(provider.Cost) > maxPrice.amount {
+		return &api.Error{Code: api.ErrPaymentFailed, Message: fmt.Sprintf("%s asks %s, more than -maxprice", provider.PeerID, provider.Cost)}
+	}
+	var address string
+	if provider.Cost > 0 {
+		wallet, err := c.PeerWallet(ctx, provider.PeerID)
+		if err != nil {
+			return fmt.Errorf("failed to find the wallet of %s: %w", provider.PeerID, err)
+		}
+		address = wallet.Address
+	}
+
+	dir := "."
+	if *out != "" {
+		dir = filepath.Dir(*out)
+	}
+	tmp, err := os.CreateTemp(dir, ".orcactl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	filename, err := c.Purchase(ctx, &api.PurchaseRequest{
+		PeerID:  provider.PeerID,
+		Hash:    hash,
+		Cost:    provider.Cost,
+		Address: address,
+		Token:   *token,
+	}, tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	path := *out
+	if path == "" {
+		path = filepath.Base(filename)
+		if path == "." || path == "/" || path == "" {
+			path = hash
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	result := download{Hash: hash, Filename: filename, Path: path, PeerID: provider.PeerID, Cost: provider.Cost}
+	return p.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Saved %s from %s for %s\n", path, provider.PeerID, provider.Cost)
+	})
+}
+
+func runAccess(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("access")
+	visibility := fs.String("visibility", "", "Make the file public, unlisted or private")
+	allow := fs.String("allow", "", "Comma separated IDs of the peers that may fetch the private file")
+	revoke := fs.Bool("revoke", false, "Invalidate every access token issued for the file so far")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var access *api.FileAccess
+	if *visibility == "" && *allow == "" && !*revoke {
+		access, err = c.FileAccess(ctx, args[0])
+	} else {
+		update := api.FileAccessUpdate{Visibility: *visibility, Allow: splitList(*allow), RevokeTokens: *revoke}
+		if update.Visibility == "" {
+			current, err := c.FileAccess(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			update.Visibility = current.Visibility
+			if *allow == "" {
+				update.Allow = current.Allow
+			}
+		}
+		access, err = c.SetFileAccess(ctx, args[0], &update)
+	}
+	if err != nil {
+		return err
+	}
+	return p.print(access, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Visibility:\t%s\n", access.Visibility)
+		if access.Visibility == api.VisibilityPrivate {
+			fmt.Fprintf(w, "Allowed peers:\t%s\n", strings.Join(access.Allow, ", "))
+		}
+		if access.TokensSince != nil {
+			fmt.Fprintf(w, "Tokens valid since:\t%s\n", formatTime(*access.TokensSince))
+		}
+	})
+}
+
+func runToken(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("token")
+	grantee := fs.String("peer", "", "Only accept the token from this peer (default anyone holding it)")
+	ttl := fs.Duration("ttl", 0, "How long the token is valid (default a week)")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	token, err := c.IssueAccessToken(ctx, args[0], &api.AccessTokenRequest{
+		Grantee:    *grantee,
+		TTLSeconds: int64(ttl.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+	return p.print(token, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, token.Token)
+	})
+}
+
+func runProxyList(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	if _, err := parseArgs(newFlagSet("proxy list"), args, 0); err != nil {
+		return err
+	}
+	list, err := c.Proxies(ctx)
+	if err != nil {
+		return err
+	}
+	return p.print(list, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "PEER\tNAME\tLOCATION\tADDRESS\tFEE\tPRICE")
+		for _, proxy := range list.Proxies {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s:%d\t%s\t%s\n", proxy.PeerID, proxy.Name, proxy.Location,
+				proxy.IPAddress, proxy.Port, proxy.InitialFee, proxy.Price)
+		}
+	})
+}
+
+// printProxyStatus prints whether the node is registered as a proxy.
+func printProxyStatus(p *printer, status *api.ProxyStatus) error {
+	return p.print(status, func(w *tabwriter.Writer) {
+		if !status.IsProxy || status.Proxy == nil {
+			fmt.Fprintln(w, "Not registered as a proxy")
+			return
+		}
+		fmt.Fprintf(w, "Name:\t%s\n", status.Proxy.Name)
+		fmt.Fprintf(w, "Location:\t%s\n", status.Proxy.Location)
+		fmt.Fprintf(w, "Address:\t%s:%d\n", status.Proxy.IPAddress, status.Proxy.Port)
+		fmt.Fprintf(w, "Initial fee:\t%s\n", status.Proxy.InitialFee)
+		fmt.Fprintf(w, "Price:\t%s\n", status.Proxy.Price)
+	})
+}
+
+func runProxyStatus(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	if _, err := parseArgs(newFlagSet("proxy status"), args, 0); err != nil {
+		return err
+	}
+	status, err := c.ProxyStatus(ctx)
+	if err != nil {
+		return err
+	}
+	return printProxyStatus(p, status)
+}
+
+func runProxyRegister(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("proxy register")
+	var reg api.ProxyRegistration
+	fs.StringVar(&reg.Name, "name", "", "Name to list the proxy under")
+	fs.StringVar(&reg.InitialFee, "fee", "0", "Fee charged when a client starts using the proxy, in DC")
+	fs.StringVar(&reg.Price, "price", "0", "Price charged for the use of the proxy, in DC")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if reg.Name == "" {
+		fmt.Fprintln(fs.Output(), "-name is required")
+		fs.Usage()
+		return errUsage
+	}
+	status, err := c.RegisterProxy(ctx, &reg)
+	if err != nil {
+		return err
+	}
+	return printProxyStatus(p, status)
+}
+
+func runProxyDeregister(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	if _, err := parseArgs(newFlagSet("proxy deregister"), args, 0); err != nil {
+		return err
+	}
+	return c.DeregisterProxy(ctx)
+}
+
+func runPeers(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("peers")
+	book := fs.Bool("book", false, "List the peer book instead of the connected peers")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	if *book {
+		list, err := c.PeerBook(ctx)
+		if err != nil {
+			return err
+		}
+		return p.print(list, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "PEER\tCAPABILITIES\tLAST SEEN\tLAST CONNECTED\tADDRS")
+			for _, known := range list.Peers {
+				lastSuccess := "-"
+				if known.LastSuccess != nil {
+					lastSuccess = formatTime(*known.LastSuccess)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", known.PeerID, strings.Join(known.Capabilities, ","),
+					formatTime(known.LastSeen), lastSuccess, strings.Join(known.Addrs, " "))
+			}
+		})
+	}
+
+	list, err := c.Peers(ctx)
+	if err != nil {
+		return err
+	}
+	return p.print(list, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "PEER\tDIRECTION\tRELAYED\tLATENCY\tSINCE\tADDR")
+		for _, peer := range list.Peers {
+			latency := "-"
+			if peer.Latency > 0 {
+				latency = peer.Latency.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n", peer.PeerID, peer.Direction, peer.Relayed,
+				latency, formatTime(peer.Opened), peer.Addr)
+		}
+	})
+}
+
+// printBlocklist prints the banned peers and IP ranges.
+func printBlocklist(p *printer, list *api.Blocklist) error {
+	return p.print(list, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "BANNED\tSINCE\tUNTIL\tREASON")
+		for _, banned := range list.Peers {
+			until := "-"
+			if banned.Until != nil {
+				until = formatTime(*banned.Until)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", banned.PeerID, formatTime(banned.Added), until, banned.Reason)
+		}
+		for _, banned := range list.Ranges {
+			fmt.Fprintf(w, "%s\t%s\t-\t%s\n", banned.CIDR, formatTime(banned.Added), banned.Reason)
+		}
+	})
+}
+
+// isCIDR reports whether the argument of ban or unban names an IP range
+// rather than a peer.
+func isCIDR(arg string) bool {
+	return strings.Contains(arg, "/")
+}
+
+func runBans(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	if _, err := parseArgs(newFlagSet("bans"), args, 0); err != nil {
+		return err
+	}
+	list, err := c.Bans(ctx)
+	if err != nil {
+		return err
+	}
+	return printBlocklist(p, list)
+}
+
+func runBan(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("ban")
+	duration := fs.Duration("for", 0, "How long to ban a peer (default until unbanned)")
+	reason := fs.String("reason", "", "Why the peer or range is banned")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	req := &api.BanRequest{PeerID: args[0], DurationSeconds: int64(duration.Seconds()), Reason: *reason}
+	if isCIDR(args[0]) {
+		req = &api.BanRequest{CIDR: args[0], Reason: *reason}
+	}
+	list, err := c.Ban(ctx, req)
+	if err != nil {
+		return err
+	}
+	return printBlocklist(p, list)
+}
+
+func runUnban(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	args, err := parseArgs(newFlagSet("unban"), args, 1)
+	if err != nil {
+		return err
+	}
+	req := &api.UnbanRequest{PeerID: args[0]}
+	if isCIDR(args[0]) {
+		req = &api.UnbanRequest{CIDR: args[0]}
+	}
+	list, err := c.Unban(ctx, req)
+	if err != nil {
+		return err
+	}
+	return printBlocklist(p, list)
+}
+
+func runDiag(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("diag")
+	target := fs.String("peer", "", "Also dial this peer directly, through the relay and by hole punching")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	report, err := c.Connectivity(ctx, *target)
+	if err != nil {
+		return err
+	}
+	return p.print(report, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Reachability:\t%s\n", report.Reachability)
+		for _, addr := range report.ListenAddrs {
+			fmt.Fprintf(w, "Address:\t%s\n", addr)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "STEP\tRESULT\tLATENCY\tDETAIL")
+		for _, step := range report.Steps {
+			result, detail := "ok", step.Detail
+			if !step.OK {
+				result = "failed"
+				if detail != "" {
+					detail += ": "
+				}
+				detail += step.Error
+			}
+			latency := "-"
+			if step.Latency > 0 {
+				latency = step.Latency.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", step.Name, result, latency, detail)
+		}
+	})
+}
+
+func runDenylistList(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	if _, err := parseArgs(newFlagSet("denylist list"), args, 0); err != nil {
+		return err
+	}
+	list, err := c.Denylist(ctx)
+	if err != nil {
+		return err
+	}
+	return p.print(list, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "DIGEST\tLIST")
+		for _, digest := range list.Local {
+			fmt.Fprintf(w, "%s\tlocal\n", digest)
+		}
+		if len(list.Subscriptions) == 0 {
+			return
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "SUBSCRIPTION\tISSUER\tSEQUENCE\tENTRIES\tUPDATED\tERROR")
+		for _, sub := range list.Subscriptions {
+			updated, errMsg := "-", "-"
+			if sub.Updated != nil {
+				updated = formatTime(*sub.Updated)
+			}
+			if sub.Error != "" {
+				errMsg = sub.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", sub.URL, sub.Issuer, sub.Sequence, sub.Entries, updated, errMsg)
+		}
+	})
+}
+
+func runDenylistAdd(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("denylist add")
+	isDigest := fs.Bool("digest", false, "The argument is the digest of a hash rather than the hash")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	entry := &api.DenylistEntry{Hash: args[0]}
+	if *isDigest {
+		entry = &api.DenylistEntry{Digest: args[0]}
+	}
+	added, err := c.Deny(ctx, entry)
+	if err != nil {
+		return err
+	}
+	return p.print(added, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, added.Digest)
+	})
+}
+
+func runDenylistRemove(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("denylist rm")
+	isDigest := fs.Bool("digest", false, "The argument is the digest of a hash rather than the hash")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	digest := args[0]
+	if !*isDigest {
+		digest = api.DenyDigest(digest)
+	}
+	return c.Undeny(ctx, digest)
+}
+
+func runDenylistExport(ctx context.Context, c *api.Client, p *printer, args []string) error {
+	fs := newFlagSet("denylist export")
+	out := fs.String("o", "", "File to write the signed denylist to (default standard output)")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *out == "" {
+		return c.ExportDenylist(ctx, os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := c.ExportDenylist(ctx, f); err != nil {
+		f.Close()
+		os.Remove(*out)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"dht/api"
+)
+
+const (
+	defaultServer     = "http://127.0.0.1:8080"
+	defaultAuthCookie = "orcanet.cookie"
+)
+
+// config defines the global options of orcactl, given before the command.
+type config struct {
+	Server     string
+	AuthCookie string
+	Token      string
+	JSON       bool
+	Timeout    time.Duration
+}
+
+// usage prints the global options and the commands.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: orcactl [options] <command> [arguments]\n\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(w, "\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun 'orcactl <command> -h' for the options of a command.\n")
+	fmt.Fprintf(w, "\nExit status:\n"+
+		"  %d  success\n  %d  other failure\n  %d  invalid command line or request\n"+
+		"  %d  not found\n  %d  node or peer unreachable\n  %d  not authorized\n  %d  payment failed\n",
+		exitOK, exitFailure, exitUsage, exitNotFound, exitUnreachable, exitUnauthorized, exitPayment)
+}
+
+// loadConfig parses the global options and returns them with the command
+// line that follows.
+func loadConfig() (*config, []string) {
+	var c config
+	flag.StringVar(&c.Server, "server", defaultServer, "URL of the DHT node's HTTP API")
+	flag.StringVar(&c.AuthCookie, "authcookie", defaultAuthCookie, "Cookie file the node writes its API credentials to")
+	flag.StringVar(&c.Token, "token", "", "API token to authenticate with instead of the cookie (default $ORCACTL_TOKEN)")
+	flag.BoolVar(&c.JSON, "json", false, "Print results as JSON instead of tables")
+	flag.DurationVar(&c.Timeout, "timeout", 0, "Give up on a command after this long (0 for no limit)")
+	flag.Usage = usage
+	flag.Parse()
+	return &c, flag.Args()
+}
+
+// newClient returns an API client authenticated with the token from
+// -token, $ORCACTL_TOKEN or the cookie file, in that order.  A missing
+// cookie file at the default path is not an error, since the node may not
+// require authentication.
+func newClient(c *config) (*api.Client, error) {
+	token := c.Token
+	if token == "" {
+		token = os.Getenv("ORCACTL_TOKEN")
+	}
+	if token == "" && c.AuthCookie != "" {
+		var err error
+		token, err = api.ReadCookieFile(c.AuthCookie)
+		if err != nil && !(errors.Is(err, fs.ErrNotExist) && c.AuthCookie == defaultAuthCookie) {
+			return nil, fmt.Errorf("failed to read auth cookie: %w", err)
+		}
+	}
+	return api.NewClient(c.Server, token), nil
+}
@@ -0,0 +1,117 @@
+// Command orcactl manages a DHT node through its HTTP API: it publishes,
+// lists and removes files, finds and buys files from providers, manages the
+// node's proxy registration and lists its peers.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"dht/api"
+)
+
+// Exit statuses, so scripts can tell failures apart.
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitNotFound     = 3
+	exitUnreachable  = 4
+	exitUnauthorized = 5
+	exitPayment      = 6
+)
+
+// errUsage is returned by commands called with invalid arguments, after
+// printing their usage.
+var errUsage = errors.New("invalid arguments")
+
+// exitStatus returns the exit status for err.
+func exitStatus(err error) int {
+	var apiErr *api.Error
+	var netErr net.Error
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.As(err, &apiErr):
+		switch apiErr.Code {
+		case api.ErrInvalidRequest:
+			return exitUsage
+		case api.ErrNotFound:
+			return exitNotFound
+		case api.ErrPeerUnreachable:
+			return exitUnreachable
+		case api.ErrUnauthorized, api.ErrForbidden:
+			return exitUnauthorized
+		case api.ErrPaymentFailed:
+			return exitPayment
+		}
+		return exitFailure
+	case errors.As(err, &netErr):
+		return exitUnreachable
+	}
+	return exitFailure
+}
+
+// printer writes command results as tables or, with -json, as JSON.
+type printer struct {
+	json bool
+}
+
+// print writes v as indented JSON, or calls table to write it as a table.
+func (p *printer) print(v interface{}, table func(w *tabwriter.Writer)) error {
+	if p.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	if table == nil {
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func main() {
+	cfg, args := loadConfig()
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	cmd, args := findCommand(args)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "orcactl: unknown command %q\n", args[0])
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	client, err := newClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "orcactl: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	err = cmd.run(ctx, client, &printer{json: cfg.JSON}, args)
+	if err != nil && !errors.Is(err, errUsage) && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "orcactl %s: %v\n", cmd.name, err)
+	}
+	os.Exit(exitStatus(err))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+const (
+	// maxCollectionEntries bounds the number of files in a collection.
+	maxCollectionEntries = 1000
+
+	// collectionsDir is the directory below the files directory that
+	// collection entries and manifests are stored in.
+	collectionsDir = "collections"
+)
+
+var (
+	// errInvalidManifest is returned for a manifest that can't be parsed
+	// or doesn't match its root hash.
+	errInvalidManifest = errors.New("invalid collection manifest")
+
+	// errUnknownEntry is returned when a purchase selects a path that is
+	// not in the collection.
+	errUnknownEntry = errors.New("no such entry in collection")
+)
+
+// collectionFile is a file uploaded as part of a new collection.
+type collectionFile struct {
+	Path  string
+	Open  func() (io.ReadSeekCloser, error)
+	Price *btcutil.Amount
+}
+
+// cleanEntryPath validates a collection entry path and returns it in clean,
+// slash separated form.
+func cleanEntryPath(p string) (string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	clean := path.Clean(p)
+	if p == "" || clean == "." || !filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "", fmt.Errorf("invalid entry path %q", p)
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid entry path %q", p)
+		}
+	}
+	return clean, nil
+}
+
+// hashFile hashes the collection file f.
+func hashFile(f *collectionFile) (string, int64, error) {
+	src, err := f.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	return hashContent(src)
+}
+
+// createCollection stores files as a collection called name, sold as a
+// bundle at price.  Files with their own price are also published on their
+// own; the others are stored unlisted.  The manifest is stored and provided
+// like a file under the collection's root hash.
+func createCollection(name string, price btcutil.Amount, files []collectionFile) (*collectionRecord, error) {
+	manifest := api.Manifest{Version: api.ManifestVersion, Name: name}
+	prices := make(map[string]*btcutil.Amount, len(files))
+	for i := range files {
+		hash, size, err := hashFile(&files[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", files[i].Path, err)
+		}
+		manifest.Entries = append(manifest.Entries, api.ManifestEntry{
+			Path: files[i].Path,
+			Size: size,
+			Hash: hash,
+		})
+		prices[files[i].Path] = files[i].Price
+	}
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Path < manifest.Entries[j].Path
+	})
+
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	root, _, err := hashContent(bytes.NewReader(manifestBytes))
+	if err != nil {
+		return nil, err
+	}
+	existing, err := GetCollectionRecord(root)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, errFileExists
+	}
+
+	rec := collectionRecord{Root: root, Name: name, Price: price, Timestamp: time.Now()}
+	byPath := make(map[string]*collectionFile, len(files))
+	for i := range files {
+		byPath[files[i].Path] = &files[i]
+	}
+	for _, entry := range manifest.Entries {
+		entryPrice := prices[entry.Path]
+		owned, err := storeCollectionFile(root, byPath[entry.Path], entryPrice)
+		if err != nil {
+			deleteCollectionEntries(&rec)
+			return nil, fmt.Errorf("failed to store %s: %w", entry.Path, err)
+		}
+		rec.Entries = append(rec.Entries, collectionEntryRecord{
+			Path:  entry.Path,
+			Size:  entry.Size,
+			Hash:  entry.Hash,
+			Price: entryPrice,
+			Owned: owned,
+		})
+	}
+
+	manifestName := filepath.Join(collectionsDir, root+".manifest.json")
+	_, err = storeFile(bytes.NewReader(manifestBytes), manifestName, price, publicAccess, false)
+	if err != nil && err != errFileExists {
+		deleteCollectionEntries(&rec)
+		return nil, fmt.Errorf("failed to store manifest: %w", err)
+	}
+	if err := StoreCollectionRecord(&rec); err != nil {
+		return nil, err
+	}
+
+	nodeLog.Infof("Published collection %s (%s) with %d files", name, root, len(rec.Entries))
+	notifyEvent(api.EventUploadCompleted, api.UploadEvent{Hash: root, Filename: name, Cost: api.Amount(price)})
+	return &rec, nil
+}
+
+// storeCollectionFile stores one entry of the collection with the given
+// root.  It reports whether the file was newly stored, as opposed to being
+// in the store already.
+func storeCollectionFile(root string, f *collectionFile, price *btcutil.Amount) (bool, error) {
+	src, err := f.Open()
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	filename := filepath.Join(collectionsDir, root, filepath.FromSlash(f.Path))
+	var p btcutil.Amount
+	access := unlistedAccess
+	if price != nil {
+		p, access = *price, publicAccess
+	}
+	_, err = storeFile(src, filename, p, access, false)
+	if err == errFileExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteCollectionEntries removes the files stored for a collection.
+func deleteCollectionEntries(rec *collectionRecord) {
+	for _, entry := range rec.Entries {
+		if !entry.Owned {
+			continue
+		}
+		if err := deleteFile(entry.Hash); err != nil && err != errFileNotFound {
+			storLog.Warnf("Failed to delete %s of collection %s: %v", entry.Path, rec.Root, err)
+		}
+	}
+}
+
+// deleteCollection removes the collection with the given root, its manifest
+// and the files stored for it.
+func deleteCollection(root string) error {
+	rec, err := GetCollectionRecord(root)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return errFileNotFound
+	}
+	if err := deleteFile(root); err != nil && err != errFileNotFound {
+		return fmt.Errorf("failed to delete manifest: %w", err)
+	}
+	deleteCollectionEntries(rec)
+	return DeleteCollectionRecord(root)
+}
+
+// peerPrice returns the price peerID asks for hash.
+func peerPrice(peerID, hash string) (btcutil.Amount, error) {
+	value, err := dhtRoute.GetValue(ctx, peerFileKey(peerID, hash))
+	if errors.Is(err, routing.ErrNotFound) || (err == nil && string(value) == "null") {
+		return 0, errNotProvided
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get price of %s from %s: %w", hash, peerID, err)
+	}
+	price, err := parseCost(value)
+	if err != nil {
+		return 0, fmt.Errorf("bad price for %s from %s: %w", hash, peerID, err)
+	}
+	return price, nil
+}
+
+// fetchVerified fetches hash from peerID, checks the contents against it and
+// returns the name and contents of the file.  Content IDs are checked chunk
+// by chunk while fetching.
+func fetchVerified(peerID, hash string) (string, []byte, error) {
+	filename, data, err := fetchFromPeer(peerID, hash)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, ok := parseContentID(hash); ok {
+		return filename, data, nil
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		err := fmt.Errorf("%w: %s from %s", errContentMismatch, hash, peerID)
+		misbehaveID(peerID, misbehaviorBadContent, err.Error())
+		return "", nil, err
+	}
+	return filename, data, nil
+}
+
+// fetchManifest fetches and verifies the manifest of the collection with
+// the given root from peerID.
+func fetchManifest(peerID, root string) (*api.Manifest, error) {
+	_, data, err := fetchVerified(peerID, root)
+	if err != nil {
+		return nil, err
+	}
+	var manifest api.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidManifest, err)
+	}
+	if manifest.Version != api.ManifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidManifest, manifest.Version)
+	}
+	for _, entry := range manifest.Entries {
+		if _, err := cleanEntryPath(entry.Path); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidManifest, err)
+		}
+		if err := validateHash(entry.Hash); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidManifest, err)
+		}
+	}
+	return &manifest, nil
+}
+
+// collectionFileData is one fetched entry of a purchased collection.
+type collectionFileData struct {
+	Entry api.ManifestEntry
+	Data  []byte
+}
+
+// purchaseCollection fetches the collection with the given root, or the
+// entries of it at paths, from peerID, verifies every file against the
+// manifest and pays for them.
+func purchaseCollection(peerID, root string, paths []string, address string) (*api.Manifest, []collectionFileData, error) {
+	manifest, err := fetchManifest(peerID, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := manifest.Entries
+	if len(paths) > 0 {
+		byPath := make(map[string]api.ManifestEntry, len(manifest.Entries))
+		for _, entry := range manifest.Entries {
+			byPath[entry.Path] = entry
+		}
+		selected = nil
+		for _, p := range paths {
+			entry, ok := byPath[p]
+			if !ok {
+				return nil, nil, fmt.Errorf("%w: %s", errUnknownEntry, p)
+			}
+			selected = append(selected, entry)
+		}
+	}
+
+	cost, err := collectionCost(peerID, root, manifest, selected)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make([]collectionFileData, 0, len(selected))
+	for _, entry := range selected {
+		_, data, err := fetchVerified(peerID, entry.Hash)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch %s: %w", entry.Path, err)
+		}
+		if int64(len(data)) != entry.Size {
+			return nil, nil, fmt.Errorf("%w: %s has %d bytes, manifest says %d", errContentMismatch, entry.Path, len(data), entry.Size)
+		}
+		files = append(files, collectionFileData{Entry: entry, Data: data})
+	}
+
+	if cost > 0 {
+		txid, err := sendPayment(address, cost)
+		if err != nil {
+			if !errors.Is(err, errPaymentFailed) {
+				err = fmt.Errorf("%w: %v", errPaymentFailed, err)
+			}
+			return nil, nil, err
+		}
+		go recordPurchase(peerID, root, manifest.Name, address, cost, txid)
+	}
+	go func() {
+		for _, f := range files {
+			cacheDownload(f.Entry.Hash, path.Base(f.Entry.Path), f.Data, unlistedAccess)
+		}
+	}()
+	return manifest, files, nil
+}
+
+// collectionCost returns what peerID asks for the selected entries of a
+// collection: the sum of their own prices if the selection is partial and
+// every selected entry is sold on its own, the bundle price otherwise.
+func collectionCost(peerID, root string, manifest *api.Manifest, selected []api.ManifestEntry) (btcutil.Amount, error) {
+	if len(selected) < len(manifest.Entries) {
+		var sum btcutil.Amount
+		perFile := true
+		for _, entry := range selected {
+			price, err := peerPrice(peerID, entry.Hash)
+			if err != nil {
+				perFile = false
+				break
+			}
+			sum += price
+		}
+		if perFile {
+			return sum, nil
+		}
+	}
+	return peerPrice(peerID, root)
+}
+
+// collectionFromRecord converts a stored collection to its API form.
+func collectionFromRecord(rec *collectionRecord) api.Collection {
+	c := api.Collection{
+		Root:      rec.Root,
+		Name:      rec.Name,
+		Price:     api.Amount(rec.Price),
+		Entries:   make([]api.CollectionEntry, 0, len(rec.Entries)),
+		Timestamp: rec.Timestamp.UTC(),
+	}
+	for _, entry := range rec.Entries {
+		c.Entries = append(c.Entries, api.CollectionEntry{
+			Path:  entry.Path,
+			Size:  entry.Size,
+			Hash:  entry.Hash,
+			Price: (*api.Amount)(entry.Price),
+		})
+	}
+	return c
+}
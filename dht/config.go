@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	defaultHTTPListen     = "127.0.0.1:8080"
+	defaultAuthCookie     = "orcanet.cookie"
+	defaultAllowedOrigins = "http://localhost:5173"
+	defaultDebugLevel     = "info"
+	defaultPaymentPoll    = 30 * time.Second
+	defaultCacheDownloads = true
+	defaultResalePrice    = -1
+	defaultMaxTransfers   = 8
+	defaultMaxPeers       = 400
+	defaultBanThreshold   = 100
+	defaultBanDuration    = 24 * time.Hour
+	defaultPeerBook       = "peers.json"
+	defaultBlocklist      = "blocklist.json"
+	defaultDHTMode        = dhtModeAuto
+	defaultDenylist       = "denylist.txt"
+	defaultListenAddrs    = "/ip4/0.0.0.0/tcp/60000,/ip6/::/tcp/60000," +
+		"/ip4/0.0.0.0/udp/60000/quic-v1,/ip6/::/udp/60000/quic-v1," +
+		"/ip4/0.0.0.0/udp/60000/quic-v1/webtransport,/ip6/::/udp/60000/quic-v1/webtransport"
+	defaultTransports = "quic,tcp,webtransport,websocket,webrtc"
+)
+
+// config defines the configuration options for the DHT node.
+type config struct {
+	DebugLevel     string
+	HTTPListen     string
+	AuthCookie     string
+	AllowedOrigins []string
+	APITokens      apiTokenFlag
+	PaymentPoll    time.Duration
+	StorageQuota   int64
+	CacheDownloads bool
+	Reseed         bool
+	ResalePrice    btcutil.Amount
+	Royalty        float64
+
+	UploadLimit       int64
+	DownloadLimit     int64
+	PeerUploadLimit   int64
+	PeerDownloadLimit int64
+	MaxTransfers      int
+	MaxPeers          int
+	MaxMemory         int64
+	MaxFDs            int
+
+	NoBanning    bool
+	BanThreshold uint
+	BanDuration  time.Duration
+	Blocklist    string
+
+	PeerBook string
+	DHTMode  string
+
+	GatewayListen     string
+	GatewaySpendLimit btcutil.Amount
+
+	PreviewSize int64
+
+	Denylist     string
+	DenylistSubs denylistSubFlag
+
+	ListenAddrs []multiaddr.Multiaddr
+	Transports  []string
+}
+
+// apiTokenFlag collects the repeatable -apitoken flag.  Each value has the
+// form <token>=<permission>[,<permission>...].
+type apiTokenFlag map[string][]permission
+
+func (f apiTokenFlag) String() string {
+	return fmt.Sprintf("%d tokens", len(f))
+}
+
+func (f apiTokenFlag) Set(value string) error {
+	token, perms, ok := strings.Cut(value, "=")
+	if !ok || token == "" || perms == "" {
+		return fmt.Errorf("api token %q must have the form <token>=<permission>[,<permission>...]", value)
+	}
+	for _, p := range strings.Split(perms, ",") {
+		perm := permission(strings.TrimSpace(p))
+		if !validPermission(perm) {
+			return fmt.Errorf("unknown permission %q -- supported permissions %v", p, allPermissions)
+		}
+		f[token] = append(f[token], perm)
+	}
+	return nil
+}
+
+// denylistSubFlag collects the repeatable -denylistsub flag.  Each value has
+// the form <issuer peer ID>@<URL>.
+type denylistSubFlag []denylistSource
+
+func (f *denylistSubFlag) String() string {
+	return fmt.Sprintf("%d subscriptions", len(*f))
+}
+
+func (f *denylistSubFlag) Set(value string) error {
+	issuer, rawURL, ok := strings.Cut(value, "@")
+	if !ok || issuer == "" || rawURL == "" {
+		return fmt.Errorf("denylist subscription %q must have the form <issuer peer ID>@<URL>", value)
+	}
+	id, err := peer.Decode(issuer)
+	if err != nil {
+		return fmt.Errorf("invalid issuer %q of denylist subscription: %w", issuer, err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("denylist subscription URL %q must be an http or https URL", rawURL)
+	}
+	*f = append(*f, denylistSource{issuer: id, url: rawURL})
+	return nil
+}
+
+// byteSizeFlag is a size flag such as 512MiB or 20GB.  Zero means no limit.
+type byteSizeFlag struct {
+	size *int64
+}
+
+func (f byteSizeFlag) String() string {
+	if f.size == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*f.size, 10)
+}
+
+func (f byteSizeFlag) Set(value string) error {
+	size, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*f.size = size
+	return nil
+}
+
+// amountFlag is an amount of DC such as 1.5.  A negative amount, which can
+// only be a default, means the flag is unset.
+type amountFlag struct {
+	amount *btcutil.Amount
+}
+
+func (f amountFlag) String() string {
+	if f.amount == nil || *f.amount < 0 {
+		return ""
+	}
+	return api.FormatAmount(*f.amount)
+}
+
+func (f amountFlag) Set(value string) error {
+	amount, err := api.ParseAmount(value)
+	if err != nil {
+		return err
+	}
+	*f.amount = amount
+	return nil
+}
+
+// byteSizeUnits are the suffixes parseByteSize accepts, longest first so
+// "MiB" isn't taken for "B".
+var byteSizeUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseByteSize parses a non-negative size with an optional unit suffix.
+func parseByteSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	unit := 1.0
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s, unit = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || n*unit > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * unit), nil
+}
+
+// parseAddrs parses a comma separated list of multiaddresses.
+func parseAddrs(flagName, list string) ([]multiaddr.Multiaddr, error) {
+	var addrs []multiaddr.Multiaddr
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s address %q: %w", flagName, s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// cfg is the active configuration, set once by loadConfig during startup.
+var cfg *config
+
+// loadConfig parses the command line into a config and validates it.
+func loadConfig() (*config, error) {
+	c := config{APITokens: make(apiTokenFlag), ResalePrice: defaultResalePrice}
+	var allowedOrigins, listen, transports string
+
+	flag.StringVar(&c.DebugLevel, "debuglevel", defaultDebugLevel, "Logging level for all subsystems {trace, debug, info, warn, error, critical} "+
+		"-- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems")
+	flag.StringVar(&c.HTTPListen, "httplisten", defaultHTTPListen, "Interface/port for the local HTTP API")
+	flag.StringVar(&c.AuthCookie, "authcookie", defaultAuthCookie, "File the generated HTTP API credentials are written to")
+	flag.StringVar(&allowedOrigins, "allowedorigins", defaultAllowedOrigins, "Comma separated list of browser origins allowed to call the HTTP API")
+	flag.Var(c.APITokens, "apitoken", "Additional HTTP API token as <token>=<permission>[,<permission>...] (may be repeated)")
+	flag.DurationVar(&c.PaymentPoll, "paymentpoll", defaultPaymentPoll, "How often the wallet is polled for incoming payments to notify -- 0 disables polling")
+	flag.Var(byteSizeFlag{&c.StorageQuota}, "storagequota", "Disk space the file store may use, e.g. 20GiB -- cached downloads are evicted to stay within it; 0 means no limit")
+	flag.BoolVar(&c.CacheDownloads, "cachedownloads", defaultCacheDownloads, "Keep verified downloads in the file store as cached files")
+	flag.BoolVar(&c.Reseed, "reseed", false, "Provide verified purchases to the network again at the resale price")
+	flag.Var(amountFlag{&c.ResalePrice}, "resaleprice", "Price asked for re-seeded files, in DC -- by default the price paid for them")
+	flag.Float64Var(&c.Royalty, "royalty", 0, "Percentage of each sale of a re-seeded file that is paid to its original publisher")
+	flag.Var(byteSizeFlag{&c.UploadLimit}, "uploadlimit", "Total rate files are sent to peers at, in bytes per second, e.g. 2MiB -- 0 means no limit")
+	flag.Var(byteSizeFlag{&c.DownloadLimit}, "downloadlimit", "Total rate data is received from peers at, in bytes per second -- 0 means no limit")
+	flag.Var(byteSizeFlag{&c.PeerUploadLimit}, "peeruploadlimit", "Rate files are sent to any one peer at, in bytes per second -- 0 means no limit")
+	flag.Var(byteSizeFlag{&c.PeerDownloadLimit}, "peerdownloadlimit", "Rate data is received from any one peer at, in bytes per second -- 0 means no limit")
+	flag.IntVar(&c.MaxTransfers, "maxtransfers", defaultMaxTransfers, "Maximum number of file transfers served at once -- further requests wait; 0 means no limit")
+	flag.IntVar(&c.MaxPeers, "maxpeers", defaultMaxPeers, "Number of connections above which the least useful ones are closed")
+	flag.Var(byteSizeFlag{&c.MaxMemory}, "maxmemory", "Memory libp2p may reserve for connections and streams -- 0 scales with the system memory")
+	flag.IntVar(&c.MaxFDs, "maxfds", 0, "File descriptors libp2p may use -- 0 scales with the process limit")
+	flag.BoolVar(&c.NoBanning, "nobanning", false, "Disable banning of misbehaving peers")
+	flag.UintVar(&c.BanThreshold, "banthreshold", defaultBanThreshold, "Maximum allowed ban score before disconnecting and banning misbehaving peers")
+	flag.DurationVar(&c.BanDuration, "banduration", defaultBanDuration, "How long to ban misbehaving peers -- valid time units are {s, m, h}; minimum 1 second")
+	flag.StringVar(&c.Blocklist, "blocklist", defaultBlocklist, "File the banned peers and IP ranges are kept in across restarts")
+	flag.StringVar(&c.PeerBook, "peerbook", defaultPeerBook, "File the peers learned through peer exchange are kept in across restarts")
+	flag.StringVar(&c.DHTMode, "dhtmode", defaultDHTMode, "DHT mode {auto, server, client} -- auto serves the DHT while the node is publicly reachable")
+	flag.StringVar(&c.GatewayListen, "gatewaylisten", "", "Interface/port for the read-only HTTP content gateway -- empty disables the gateway")
+	flag.Var(amountFlag{&c.GatewaySpendLimit}, "gatewayspendlimit", "Most the content gateway may spend on remote files in 24 hours, in DC -- 0 serves only local and free files")
+	flag.Var(byteSizeFlag{&c.PreviewSize}, "previewsize", fmt.Sprintf("Bytes of the head of a file sent as a free preview to peers asking about it, at most %d -- 0 sends only uploaded thumbnails", maxPreviewSize))
+	flag.StringVar(&c.Denylist, "denylist", defaultDenylist, "File of the digests of the content the node refuses to store, serve or fetch")
+	flag.Var(&c.DenylistSubs, "denylistsub", "Signed denylist to follow as <issuer peer ID>@<URL> (may be repeated)")
+	flag.StringVar(&listen, "listen", defaultListenAddrs, "Comma separated multiaddresses to listen on")
+	flag.StringVar(&transports, "transports", defaultTransports, fmt.Sprintf("Comma separated transports to enable, in the order they are preferred when dialing -- supported transports %v", allTransports))
+	flag.Parse()
+
+	if err := parseAndSetDebugLevels(c.DebugLevel); err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(c.HTTPListen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -httplisten %q: %w", c.HTTPListen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		httpLog.Warnf("HTTP API is listening on non-loopback address %s", c.HTTPListen)
+	}
+
+	if c.Royalty < 0 || c.Royalty > 100 || math.IsNaN(c.Royalty) {
+		return nil, fmt.Errorf("invalid -royalty %v: must be a percentage between 0 and 100", c.Royalty)
+	}
+
+	if c.MaxTransfers < 0 {
+		return nil, fmt.Errorf("invalid -maxtransfers %d: must not be negative", c.MaxTransfers)
+	}
+	if c.MaxPeers <= 0 {
+		return nil, fmt.Errorf("invalid -maxpeers %d: must be positive", c.MaxPeers)
+	}
+	if c.BanDuration < time.Second {
+		return nil, fmt.Errorf("invalid -banduration %v: must be at least 1 second", c.BanDuration)
+	}
+	if !slices.Contains(dhtModes, c.DHTMode) {
+		return nil, fmt.Errorf("invalid -dhtmode %q -- supported modes %v", c.DHTMode, dhtModes)
+	}
+	if c.GatewayListen != "" {
+		if _, _, err := net.SplitHostPort(c.GatewayListen); err != nil {
+			return nil, fmt.Errorf("invalid -gatewaylisten %q: %w", c.GatewayListen, err)
+		}
+	}
+	if c.PreviewSize > maxPreviewSize {
+		return nil, fmt.Errorf("invalid -previewsize %d: must be at most %d bytes", c.PreviewSize, maxPreviewSize)
+	}
+	if c.MaxFDs < 0 {
+		return nil, fmt.Errorf("invalid -maxfds %d: must not be negative", c.MaxFDs)
+	}
+
+	for _, t := range strings.Split(transports, ",") {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "":
+			continue
+		case !slices.Contains(allTransports, t):
+			return nil, fmt.Errorf("invalid -transports %q: unknown transport %q -- supported transports %v", transports, t, allTransports)
+		case slices.Contains(c.Transports, t):
+			return nil, fmt.Errorf("invalid -transports %q: %s is listed twice", transports, t)
+		}
+		c.Transports = append(c.Transports, t)
+	}
+	if len(c.Transports) == 0 {
+		return nil, fmt.Errorf("invalid -transports %q: no transports", transports)
+	}
+	if c.ListenAddrs, err = parseAddrs("listen", listen); err != nil {
+		return nil, err
+	}
+	if len(c.ListenAddrs) == 0 {
+		return nil, fmt.Errorf("invalid -listen %q: no addresses", listen)
+	}
+	if err := checkListenAddrs(c.ListenAddrs, c.Transports); err != nil {
+		return nil, err
+	}
+
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			c.AllowedOrigins = append(c.AllowedOrigins, origin)
+		}
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+// Operators can refuse to store, serve or fetch content on a denylist.  The
+// list holds the digest of every denied hash (api.DenyDigest) rather than
+// the hash, so it can be shared without advertising the content it denies.
+// It combines the local list kept in -denylist, which the API edits, with
+// the lists of the -denylistsub subscriptions: signed records fetched over
+// HTTP every denylistRefreshInterval, accepted only if signed by the
+// subscription's issuer and not older than the one held.  The lists last
+// accepted are kept in the state file next to -denylist, so they apply from
+// startup and an older list can't be replayed after a restart.  Uploads,
+// re-seeded purchases, purchases, inbound requests and the gateway all
+// check it, and denied files are neither provided nor advertised.
+const (
+	// denylistDomain is the signature domain of published denylists.
+	denylistDomain = "orcanet-denylist"
+
+	// denylistRefreshInterval is how often subscribed denylists are
+	// fetched.
+	denylistRefreshInterval = time.Hour
+
+	// denylistFetchTimeout bounds fetching one subscribed denylist.
+	denylistFetchTimeout = 30 * time.Second
+
+	// maxDenylistSize is the largest signed denylist accepted.
+	maxDenylistSize = 16 << 20
+)
+
+// denylistCodec is the payload type of published denylists.
+var denylistCodec = []byte("/orcanet/denylist")
+
+func init() {
+	record.RegisterType(&denylistRecord{})
+}
+
+var (
+	// errDenied is returned for content on the denylist.
+	errDenied = errors.New("content is on the denylist")
+
+	// errBadDenylist is returned for a subscribed denylist that isn't
+	// signed by its issuer, is older than the one held or doesn't parse.
+	errBadDenylist = errors.New("invalid denylist")
+)
+
+// denylistRecord is a denylist Issuer published.  Lists with a higher
+// Sequence replace those with a lower one.
+type denylistRecord struct {
+	Issuer    peer.ID   `json:"issuer"`
+	Sequence  uint64    `json:"sequence"`
+	Published time.Time `json:"published"`
+	Entries   []string  `json:"entries"`
+}
+
+func (r *denylistRecord) Domain() string { return denylistDomain }
+
+func (r *denylistRecord) Codec() []byte { return denylistCodec }
+
+func (r *denylistRecord) MarshalRecord() ([]byte, error) { return json.Marshal(r) }
+
+func (r *denylistRecord) UnmarshalRecord(data []byte) error { return json.Unmarshal(data, r) }
+
+// denylistSource is a denylist to subscribe to: the URL it is fetched from
+// and the peer whose key must sign it.
+type denylistSource struct {
+	issuer peer.ID
+	url    string
+}
+
+// denylistSubscription is the state of a subscribed denylist.  signed is
+// the list as its issuer signed it, kept to be saved in the state file.
+type denylistSubscription struct {
+	denylistSource
+	sequence uint64
+	entries  map[string]struct{}
+	signed   []byte
+	updated  time.Time
+	err      error
+}
+
+// denylistState is what the state file keeps of the lists of an issuer: the
+// highest sequence seen and the signed list last accepted.
+type denylistState struct {
+	Sequence uint64 `json:"sequence"`
+	List     []byte `json:"list"`
+}
+
+// denylist is the content the node refuses to store, serve or fetch.
+type denylist struct {
+	mtx     sync.RWMutex
+	path    string
+	local   map[string]struct{}
+	changed time.Time
+	subs    []*denylistSubscription
+}
+
+// denied is the node's denylist, set once during startup.
+var denied *denylist
+
+// validDigest reports whether s is a denylist entry: a lower case hex
+// SHA-256 digest.
+func validDigest(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// parseDenylist parses a local denylist: one digest per line, with
+// everything after a # ignored.
+func parseDenylist(data []byte) (map[string]struct{}, error) {
+	entries := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if !validDigest(line) {
+			return nil, fmt.Errorf("line %d: %q is not a hex SHA-256 digest", n, line)
+		}
+		entries[line] = struct{}{}
+	}
+	return entries, scanner.Err()
+}
+
+// denylistStatePath returns the path of the state file of the subscribed
+// denylists of the local denylist in path.
+func denylistStatePath(path string) string {
+	return path + ".state"
+}
+
+// loadDenylist loads the local denylist in path, which need not exist, and
+// subscribes to sources.  The subscribed lists start out as the ones saved
+// in the state file, if any, until refreshed.
+func loadDenylist(path string, sources []denylistSource) (*denylist, error) {
+	d := &denylist{path: path, local: make(map[string]struct{})}
+	for _, src := range sources {
+		d.subs = append(d.subs, &denylistSubscription{denylistSource: src, entries: make(map[string]struct{})})
+	}
+	if err := d.loadState(); err != nil {
+		return nil, fmt.Errorf("failed to load denylist state %s: %w", denylistStatePath(path), err)
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		d.updateMetrics()
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.local, err = parseDenylist(data); err != nil {
+		return nil, fmt.Errorf("failed to parse denylist %s: %w", path, err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		d.changed = info.ModTime()
+	}
+	d.updateMetrics()
+	return d, nil
+}
+
+// loadState restores the subscribed lists saved in the state file, which
+// need not exist.  Every subscription of an issuer keeps at least the
+// highest sequence seen from it, even if the saved list no longer verifies.
+func (d *denylist) loadState() error {
+	path := denylistStatePath(d.path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state map[peer.ID]denylistState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	var saved time.Time
+	if info, err := os.Stat(path); err == nil {
+		saved = info.ModTime()
+	}
+	for _, sub := range d.subs {
+		st, ok := state[sub.issuer]
+		if !ok {
+			continue
+		}
+		sub.sequence = st.Sequence
+		sub.updated = saved
+		list, err := openDenylist(st.List, sub.issuer)
+		if err != nil {
+			storLog.Warnf("Dropping saved denylist of %s: %v", sub.issuer, err)
+			continue
+		}
+		sub.entries = make(map[string]struct{}, len(list.Entries))
+		for _, digest := range list.Entries {
+			sub.entries[digest] = struct{}{}
+		}
+		sub.signed = st.List
+		sub.sequence = max(sub.sequence, list.Sequence)
+	}
+	return nil
+}
+
+// saveState writes the subscribed lists to the state file, keeping the one
+// with the highest sequence for each issuer.
+func (d *denylist) saveState() error {
+	state := make(map[peer.ID]denylistState)
+	d.mtx.RLock()
+	for _, sub := range d.subs {
+		if st, ok := state[sub.issuer]; sub.updated.IsZero() || (ok && st.Sequence >= sub.sequence) {
+			continue
+		}
+		state[sub.issuer] = denylistState{Sequence: sub.sequence, List: sub.signed}
+	}
+	d.mtx.RUnlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeDenylistFile(denylistStatePath(d.path), data)
+}
+
+// has reports whether hash is denied.
+func (d *denylist) has(hash string) bool {
+	digest := api.DenyDigest(hash)
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	if _, ok := d.local[digest]; ok {
+		return true
+	}
+	for _, sub := range d.subs {
+		if _, ok := sub.entries[digest]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds digest to the local list and saves it.  It reports whether the
+// digest wasn't on the list yet.
+func (d *denylist) add(digest string) (bool, error) {
+	d.mtx.Lock()
+	if _, ok := d.local[digest]; ok {
+		d.mtx.Unlock()
+		return false, nil
+	}
+	d.local[digest] = struct{}{}
+	d.changed = time.Now()
+	d.mtx.Unlock()
+	d.updateMetrics()
+	return true, d.save()
+}
+
+// remove removes digest from the local list and saves it.  It reports
+// whether the digest was on the list.
+func (d *denylist) remove(digest string) (bool, error) {
+	d.mtx.Lock()
+	if _, ok := d.local[digest]; !ok {
+		d.mtx.Unlock()
+		return false, nil
+	}
+	delete(d.local, digest)
+	d.changed = time.Now()
+	d.mtx.Unlock()
+	d.updateMetrics()
+	return true, d.save()
+}
+
+// localEntries returns the digests of the local list, sorted.
+func (d *denylist) localEntries() []string {
+	d.mtx.RLock()
+	entries := make([]string, 0, len(d.local))
+	for digest := range d.local {
+		entries = append(entries, digest)
+	}
+	d.mtx.RUnlock()
+	sort.Strings(entries)
+	return entries
+}
+
+// save writes the local list to its file.
+func (d *denylist) save() error {
+	var buf bytes.Buffer
+	buf.WriteString("# orcanet denylist: one hex SHA-256 digest of a denied hash per line\n")
+	for _, digest := range d.localEntries() {
+		buf.WriteString(digest + "\n")
+	}
+	return writeDenylistFile(d.path, buf.Bytes())
+}
+
+// writeDenylistFile replaces the file in path with data.
+func writeDenylistFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sign returns the local list as a denylist record signed by the node's
+// key, for others to subscribe to.  Its sequence is the time the list last
+// changed.
+func (d *denylist) sign() ([]byte, error) {
+	key := node.Peerstore().PrivKey(node.ID())
+	if key == nil {
+		return nil, errors.New("no private key for the local peer")
+	}
+	d.mtx.RLock()
+	changed := d.changed
+	d.mtx.RUnlock()
+	rec := &denylistRecord{
+		Issuer:    node.ID(),
+		Published: time.Now().UTC(),
+		Entries:   d.localEntries(),
+	}
+	if !changed.IsZero() {
+		rec.Sequence = uint64(changed.UnixNano())
+	}
+	env, err := record.Seal(rec, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign denylist: %w", err)
+	}
+	return env.Marshal()
+}
+
+// openDenylist verifies a signed denylist of issuer and returns it.
+func openDenylist(data []byte, issuer peer.ID) (*denylistRecord, error) {
+	env, rec, err := record.ConsumeEnvelope(data, denylistDomain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadDenylist, err)
+	}
+	list, ok := rec.(*denylistRecord)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a denylist", errBadDenylist)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil || signer != issuer || list.Issuer != issuer {
+		return nil, fmt.Errorf("%w: not signed by %s", errBadDenylist, issuer)
+	}
+	for _, digest := range list.Entries {
+		if !validDigest(digest) {
+			return nil, fmt.Errorf("%w: %q is not a hex SHA-256 digest", errBadDenylist, digest)
+		}
+	}
+	return list, nil
+}
+
+// fetchDenylist downloads the signed denylist of src, returning it both
+// verified and as signed.
+func fetchDenylist(src denylistSource) (*denylistRecord, []byte, error) {
+	ctx, cancel := context.WithTimeout(globalCtx, denylistFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned %s", src.url, resp.Status)
+	}
+	data, err := readMessage(resp.Body, maxDenylistSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := openDenylist(data, src.issuer)
+	return list, data, err
+}
+
+// refresh fetches every subscribed denylist, keeping the lists held for
+// those that fail, and saves the state of those that changed.  It reports
+// whether any list changed.
+func (d *denylist) refresh() bool {
+	changed := false
+	for _, sub := range d.subs {
+		list, signed, err := fetchDenylist(sub.denylistSource)
+		if err == nil {
+			var updated bool
+			updated, err = d.update(sub, list, signed)
+			changed = changed || updated
+		} else {
+			d.mtx.Lock()
+			sub.err = err
+			d.mtx.Unlock()
+		}
+
+		denylistFetchesTotal.WithLabelValues(resultLabel(err)).Inc()
+		if err != nil {
+			storLog.Warnf("Failed to refresh denylist %s: %v", sub.url, err)
+		} else {
+			storLog.Debugf("Denylist %s at sequence %d", sub.url, list.Sequence)
+		}
+	}
+	if changed {
+		d.updateMetrics()
+		if err := d.saveState(); err != nil {
+			storLog.Errorf("Failed to save denylist state: %v", err)
+		}
+	}
+	return changed
+}
+
+// update replaces the list held for sub with list, signed as signed,
+// unless it is older than the one held.  It reports whether the list
+// changed.
+func (d *denylist) update(sub *denylistSubscription, list *denylistRecord, signed []byte) (bool, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	sub.err = nil
+	switch {
+	case !sub.updated.IsZero() && list.Sequence < sub.sequence:
+		sub.err = fmt.Errorf("%w: sequence %d is older than %d", errBadDenylist, list.Sequence, sub.sequence)
+		return false, sub.err
+	case sub.updated.IsZero() || list.Sequence > sub.sequence:
+		sub.entries = make(map[string]struct{}, len(list.Entries))
+		for _, digest := range list.Entries {
+			sub.entries[digest] = struct{}{}
+		}
+		sub.signed = signed
+		sub.sequence = list.Sequence
+		sub.updated = time.Now()
+		return true, nil
+	}
+	return false, nil
+}
+
+// status returns the API representation of the denylist.
+func (d *denylist) status() api.Denylist {
+	status := api.Denylist{Local: d.localEntries(), Subscriptions: []api.DenylistSubscription{}}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	for _, sub := range d.subs {
+		s := api.DenylistSubscription{
+			URL:      sub.url,
+			Issuer:   sub.issuer.String(),
+			Sequence: sub.sequence,
+			Entries:  len(sub.entries),
+		}
+		if !sub.updated.IsZero() {
+			updated := sub.updated.UTC()
+			s.Updated = &updated
+		}
+		if sub.err != nil {
+			s.Error = sub.err.Error()
+		}
+		status.Subscriptions = append(status.Subscriptions, s)
+	}
+	return status
+}
+
+// updateMetrics reports the size of the lists.
+func (d *denylist) updateMetrics() {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	subscribed := 0
+	for _, sub := range d.subs {
+		subscribed += len(sub.entries)
+	}
+	denylistEntries.WithLabelValues("local").Set(float64(len(d.local)))
+	denylistEntries.WithLabelValues("subscribed").Set(float64(subscribed))
+}
+
+// watchDenylists refreshes the subscribed denylists now and every interval.
+func watchDenylists(d *denylist, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if d.refresh() {
+			withdrawDeniedFiles()
+		}
+		select {
+		case <-ticker.C:
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
+
+// withdrawDeniedFiles stops providing the stored files that are denied.
+// They are kept, but no longer served.
+func withdrawDeniedFiles() {
+	records, err := FetchAllFileRecords()
+	if err != nil {
+		storLog.Errorf("Failed to load files to check the denylist: %v", err)
+		return
+	}
+	for _, record := range records {
+		hash, _ := record["hash"].(string)
+		if hash == "" || !denied.has(hash) {
+			continue
+		}
+		filename, _ := record["filename"].(string)
+		storLog.Warnf("Stored file %s (%s) is on the denylist and is no longer served", hash, filename)
+		if unlisted, _ := record["unlisted"].(bool); unlisted {
+			continue
+		}
+		if err := withdrawFile(hash); err != nil {
+			storLog.Errorf("Failed to withdraw denied file %s: %v", hash, err)
+		}
+	}
+}
+
+// deniedContent reports whether hash is on the denylist, counting the
+// refusal under check.
+func deniedContent(hash, check string) bool {
+	if denied == nil || !denied.has(hash) {
+		return false
+	}
+	deniedTotal.WithLabelValues(check).Inc()
+	storLog.Debugf("Refused %s of denied content %s", check, hash)
+	return true
+}
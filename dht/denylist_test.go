@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"lukechampine.com/blake3"
+)
+
+// TestDenylist checks the parsing of local denylists and that subscribed
+// ones are only accepted from their issuer.
+func TestDenylist(t *testing.T) {
+	contentID := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	digest := api.DenyDigest(contentID)
+
+	entries, err := parseDenylist([]byte("# comment\n\n" + digest + "  # reason\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := entries[digest]; !ok || len(entries) != 1 {
+		t.Fatalf("got entries %v, want only %s", entries, digest)
+	}
+	for _, bad := range []string{contentID, strings.ToUpper(digest), digest[:63]} {
+		if _, err := parseDenylist([]byte(bad + "\n")); err == nil {
+			t.Fatalf("entry %q: want error", bad)
+		}
+	}
+
+	priv, issuer := testPeerKey(t)
+	list, err := openDenylist(sealTestRecord(t, &denylistRecord{Issuer: issuer, Sequence: 1, Entries: []string{digest}}, priv), issuer)
+	if err != nil || len(list.Entries) != 1 {
+		t.Fatalf("valid list: got %v, err %v", list, err)
+	}
+	if _, err := openDenylist(sealTestRecord(t, &denylistRecord{Issuer: issuer, Entries: []string{digest}}, priv), testPeerID(t)); !errors.Is(err, errBadDenylist) {
+		t.Fatalf("list of another issuer: want errBadDenylist, got %v", err)
+	}
+	if _, err := openDenylist(sealTestRecord(t, &denylistRecord{Issuer: issuer, Entries: []string{contentID}}, priv), issuer); !errors.Is(err, errBadDenylist) {
+		t.Fatalf("list naming a hash: want errBadDenylist, got %v", err)
+	}
+}
+
+// TestDenylistState checks that subscribed lists only move forward, and
+// that the list held, with its sequence, survives a restart so an older one
+// can't be replayed.
+func TestDenylistState(t *testing.T) {
+	priv, issuer := testPeerKey(t)
+	oldHash := rootCID(blake3.Sum256([]byte("old"))).String()
+	newHash := rootCID(blake3.Sum256([]byte("new"))).String()
+	older := &denylistRecord{Issuer: issuer, Sequence: 1, Entries: []string{api.DenyDigest(oldHash)}}
+	newer := &denylistRecord{Issuer: issuer, Sequence: 2, Entries: []string{api.DenyDigest(newHash)}}
+	olderSigned := sealTestRecord(t, older, priv)
+	newerSigned := sealTestRecord(t, newer, priv)
+
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	sources := []denylistSource{{issuer: issuer, url: "http://127.0.0.1/denylist"}}
+	d, err := loadDenylist(path, sources)
+	if err != nil {
+		t.Fatalf("loadDenylist: %v", err)
+	}
+	if changed, err := d.update(d.subs[0], newer, newerSigned); !changed || err != nil {
+		t.Fatalf("first list: changed %v, err %v", changed, err)
+	}
+	if changed, err := d.update(d.subs[0], newer, newerSigned); changed || err != nil {
+		t.Fatalf("same list again: changed %v, err %v", changed, err)
+	}
+	if changed, err := d.update(d.subs[0], older, olderSigned); changed || !errors.Is(err, errBadDenylist) {
+		t.Fatalf("older list: changed %v, err %v, want %v", changed, err, errBadDenylist)
+	}
+	if err := d.saveState(); err != nil {
+		t.Fatalf("saveState: %v", err)
+	}
+
+	d, err = loadDenylist(path, sources)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if !d.has(newHash) || d.has(oldHash) {
+		t.Fatalf("after restart: denies new %v, old %v, want only new", d.has(newHash), d.has(oldHash))
+	}
+	if changed, err := d.update(d.subs[0], older, olderSigned); changed || !errors.Is(err, errBadDenylist) {
+		t.Fatalf("older list after restart: changed %v, err %v, want %v", changed, err, errBadDenylist)
+	}
+
+	// A saved list that doesn't verify is dropped, but the sequence seen
+	// from its issuer is still held.
+	other, _ := testPeerKey(t)
+	forged, err := json.Marshal(map[peer.ID]denylistState{
+		issuer: {Sequence: 2, List: sealTestRecord(t, newer, other)},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal state: %v", err)
+	}
+	if err := os.WriteFile(denylistStatePath(path), forged, 0o600); err != nil {
+		t.Fatalf("failed to write state: %v", err)
+	}
+	d, err = loadDenylist(path, sources)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if d.has(newHash) {
+		t.Fatal("list signed by another key was restored")
+	}
+	if changed, err := d.update(d.subs[0], older, olderSigned); changed || !errors.Is(err, errBadDenylist) {
+		t.Fatalf("older list after forged state: changed %v, err %v, want %v", changed, err, errBadDenylist)
+	}
+}
+
+// TestStoreDenied checks that denied content is refused before anything is
+// written, let alone provided.
+func TestStoreDenied(t *testing.T) {
+	content := []byte("orcanet")
+	hash, _, err := hashContent(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("hashContent: %v", err)
+	}
+	withDenylist(t, hash)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, cached := range []bool{false, true} {
+		got, err := storeFile(bytes.NewReader(content), "file.txt", btcutil.Amount(1000), publicAccess, cached)
+		if !errors.Is(err, errDenied) || got != hash {
+			t.Fatalf("cached %v: storeFile returned %q, %v, want %q, %v", cached, got, err, hash, errDenied)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("files", "file.txt")); !os.IsNotExist(err) {
+		t.Fatalf("denied file was written: %v", err)
+	}
+}
+
+// TestLegacyUploadDenied checks that the legacy upload endpoint answers 451
+// for denied content.
+func TestLegacyUploadDenied(t *testing.T) {
+	content := []byte("orcanet")
+	hash, _, err := hashContent(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("hashContent: %v", err)
+	}
+	withDenylist(t, hash)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "file.txt")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	fw.Write(content)
+	mw.WriteField("price", "1")
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handleFileUpload(w, r)
+	if w.Code != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUnavailableForLegalReasons)
+	}
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strings"
 	"time"
 
+	"dht/api"
+	"dht/names"
+
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -35,7 +37,14 @@ var (
 	bootstrap_node_addr_2 = "/ip4/130.245.173.222/tcp/61020/p2p/12D3KooWM8uovScE5NPihSCKhXe8sbgdJAi88i2aXT2MmwjGWoSX"
 	native_bootstrap      = "/ip4/172.25.235.200/tcp/61000/p2p/12D3KooWQtwuAfGY2LKHjN7nK4xjbvCYUTt3sUyxj4cwyR2bg31e"
 	globalCtx             context.Context
-	dataChannel           = make(chan []byte)
+)
+
+const (
+	// sendDataProtocol carries file requests and their replies.
+	sendDataProtocol = "/senddata/p2p"
+
+	// peerExchangeProtocol carries lists of known peers.
+	peerExchangeProtocol = "/orcanet/p2p"
 )
 
 func generatePrivateKeyFromSeed(seed []byte) (crypto.PrivKey, error) {
@@ -53,49 +62,58 @@ func generatePrivateKeyFromSeed(seed []byte) (crypto.PrivKey, error) {
 func createNode() (host.Host, *dht.IpfsDHT, error) {
 	ctx := context.Background()
 	seed := []byte(node_id)
-	customAddr, err := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/60000")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse multiaddr: %w", err)
-	}
 	privKey, err := generatePrivateKeyFromSeed(seed)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
 	if err != nil {
-		log.Fatalf("Failed to create relay multiaddr: %v", err)
+		return nil, nil, fmt.Errorf("failed to create relay multiaddr: %w", err)
 	}
 
 	// Convert the relay multiaddress to AddrInfo
 	relayInfo, err := peer.AddrInfoFromP2pAddr(relayAddr)
 	if err != nil {
-		log.Fatalf("Failed to create AddrInfo from relay multiaddr: %v", err)
+		return nil, nil, fmt.Errorf("failed to create AddrInfo from relay multiaddr: %w", err)
+	}
+
+	rm, err := newResourceManager(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	cm, err := newConnManager(cfg.MaxPeers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create connection manager: %w", err)
 	}
 
-	node, err := libp2p.New(
-		libp2p.ListenAddrs(customAddr),
+	opts := []libp2p.Option{
+		libp2p.ListenAddrs(cfg.ListenAddrs...),
 		libp2p.Identity(privKey),
 		libp2p.NATPortMap(),
 		libp2p.EnableNATService(),
 		libp2p.EnableAutoRelayWithStaticRelays([]peer.AddrInfo{*relayInfo}),
 		libp2p.EnableRelayService(),
 		libp2p.EnableHolePunching(),
-	)
-
+		libp2p.BandwidthReporter(bandwidthCounter),
+		libp2p.ResourceManager(rm),
+		libp2p.ConnectionManager(cm),
+		libp2p.ConnectionGater(&blockGater{blocked}),
+	}
+	node, err := libp2p.New(append(opts, transportOptions(cfg.Transports)...)...)
 	if err != nil {
 		return nil, nil, err
 	}
 	_, err = relay.New(node)
 	if err != nil {
-		log.Printf("Failed to instantiate the relay: %v", err)
+		nodeLog.Warnf("Failed to instantiate the relay: %v", err)
 	}
 
-	dhtRouting, err := dht.New(ctx, node, dht.Mode(dht.ModeClient))
+	dhtRouting, err := dht.New(ctx, node, dht.Mode(dhtModeOption(cfg.DHTMode)))
 	if err != nil {
 		return nil, nil, err
 	}
 	namespacedValidator := record.NamespacedValidator{
-		"orcanet": &CustomValidator{}, // Add a custom validator for the "orcanet" namespace
+		"orcanet": names.Validator{}, // Name records must be signed by their publisher
 	}
 
 	dhtRouting.Validator = namespacedValidator // Configure the DHT to use the custom validator
@@ -104,7 +122,7 @@ func createNode() (host.Host, *dht.IpfsDHT, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	fmt.Println("DHT bootstrap complete.")
+	nodeLog.Info("DHT bootstrap complete")
 
 	// Set up notifications for new connections
 	node.Network().Notify(&network.NotifyBundle{
@@ -112,8 +130,23 @@ func createNode() (host.Host, *dht.IpfsDHT, error) {
 
 			peerID := conn.RemotePeer().String()
 
-			fmt.Printf("Notification: New peer connected %s\n", peerID)
+			peerLog.Debugf("New peer connected %s", peerID)
 			connectedPeers[peerID] = struct{}{}
+			if len(n.ConnsToPeer(conn.RemotePeer())) == 1 {
+				notifyEvent(api.EventPeerConnected, api.PeerEvent{
+					PeerID: peerID,
+					Addr:   conn.RemoteMultiaddr().String(),
+				})
+			}
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				peerLog.Debugf("Peer disconnected %s", conn.RemotePeer())
+				notifyEvent(api.EventPeerDisconnected, api.PeerEvent{
+					PeerID: conn.RemotePeer().String(),
+					Addr:   conn.RemoteMultiaddr().String(),
+				})
+			}
 		},
 	})
 
@@ -123,24 +156,24 @@ func createNode() (host.Host, *dht.IpfsDHT, error) {
 func connectToPeer(node host.Host, peerAddr string) {
 	addr, err := multiaddr.NewMultiaddr(peerAddr)
 	if err != nil {
-		log.Printf("Failed to parse peer address: %s", err)
+		peerLog.Errorf("Failed to parse peer address: %s", err)
 		return
 	}
 
 	info, err := peer.AddrInfoFromP2pAddr(addr)
 	if err != nil {
-		log.Printf("Failed to get AddrInfo from address: %s", err)
+		peerLog.Errorf("Failed to get AddrInfo from address: %s", err)
 		return
 	}
 
 	node.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
 	err = node.Connect(context.Background(), *info)
 	if err != nil {
-		log.Printf("Failed to connect to peer: %s", err)
+		peerLog.Warnf("Failed to connect to peer %s: %s", info.ID, err)
 		return
 	}
 
-	fmt.Println("Connected to:", info.ID)
+	peerLog.Infof("Connected to %s", info.ID)
 }
 
 func connectToPeerUsingRelay(node host.Host, targetPeerID string) {
@@ -148,183 +181,417 @@ func connectToPeerUsingRelay(node host.Host, targetPeerID string) {
 	targetPeerID = strings.TrimSpace(targetPeerID)
 	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
 	if err != nil {
-		log.Printf("Failed to create relay multiaddr: %v", err)
+		peerLog.Errorf("Failed to create relay multiaddr: %v", err)
+		return
+	}
+	peerMultiaddr, err := relayedAddr(relayAddr, targetPeerID)
+	if err != nil {
+		peerLog.Errorf("Failed to build relayed address for %s: %v", targetPeerID, err)
+		return
 	}
-	peerMultiaddr := relayAddr.Encapsulate(multiaddr.StringCast("/p2p-circuit/p2p/" + targetPeerID))
 
 	relayedAddrInfo, err := peer.AddrInfoFromP2pAddr(peerMultiaddr)
 	if err != nil {
-		log.Println("Failed to get relayed AddrInfo: %w", err)
+		peerLog.Errorf("Failed to get relayed AddrInfo: %v", err)
 		return
 	}
 	// Connect to the peer through the relay
 	err = node.Connect(ctx, *relayedAddrInfo)
 	if err != nil {
-		log.Println("Failed to connect to peer through relay: %w", err)
+		peerLog.Warnf("Failed to connect to peer %s through relay: %v", targetPeerID, err)
 		return
 	}
 
-	fmt.Printf("Connected to peer via relay: %s\n", targetPeerID)
+	peerLog.Debugf("Connected to peer via relay: %s", targetPeerID)
 }
 
 func receiveDataFromPeer(node host.Host) {
 	// Set a stream handler to listen for incoming streams on the "/senddata/p2p" protocol
-	node.SetStreamHandler("/senddata/p2p", func(s network.Stream) {
+	node.SetStreamHandler(sendDataProtocol, func(s network.Stream) {
 		defer s.Close()
-		data, err := io.ReadAll(s)
-		if err != nil {
-			if err == io.EOF {
-				log.Printf("Stream closed by peer: %s", s.Conn().RemotePeer())
-			} else {
-				log.Printf("Error reading from stream: %v", err)
-			}
+		remote := s.Conn().RemotePeer()
+		if isBanned(remote) {
+			s.Reset()
 			return
 		}
-		if strings.HasPrefix(string(data), "REQUEST:") {
-			hash := string(data)[8:]
-			record, err := GetFileRecord(hash)
-			if err != nil {
-				log.Printf("Failed to retrieve hash: %v", hash)
-			}
-			sendFile(node, s.Conn().RemotePeer().String(), "files/"+record["filename"].(string))
-		} else if strings.HasPrefix(string(data), "NAME:") {
-			hash := string(data)[5:]
-			record, err := GetFileRecord(hash)
-			if err != nil {
-				log.Printf("Failed to retrieve hash: %v", hash)
-			}
-			sendDataToPeer(node, s.Conn().RemotePeer().String(), record["filename"].(string))
-		} else if strings.HasPrefix(string(data), "EXIST:") {
-			hash := string(data)[6:]
-			record, err := GetFileRecord(hash)
-			if err != nil {
-				log.Printf("Failed to retrieve hash: %v", hash)
-			}
-			if record == nil {
-				sendDataToPeer(node, s.Conn().RemotePeer().String(), "false")
-			} else {
-				sendDataToPeer(node, s.Conn().RemotePeer().String(), "true")
-			}
-		} else {
-			dataChannel <- data
+
+		// A peer we asked something sends its reply, which may be a whole
+		// legacy file and take long.  Anything else is a request, which is
+		// small and quick.
+		if reply := claimReply(remote); reply != nil {
+			receiveReply(remote, s, reply)
+			return
+		}
+		if err := s.SetReadDeadline(time.Now().Add(requestReadTimeout)); err != nil {
+			xferLog.Debugf("Failed to set read deadline on stream of %s: %v", remote, err)
+		}
+		kind, arg, ok := readRequest(remote, s)
+		if !ok {
+			return
+		}
+		if !allowMessage(requestLimiters, remote) {
+			return
+		}
+		if kind != msgAccess && (!mayAccess(remote, requestHash(kind, arg)) || deniedContent(requestHash(kind, arg), "serve")) {
+			denyRequest(node, remote, kind, arg)
+			return
+		}
+		switch kind {
+		case msgRequest:
+			serveFile(node, remote, arg)
+		case msgName:
+			serveName(node, remote, arg)
+		case msgChunk:
+			serveChunk(node, remote, arg)
+		case msgExist:
+			serveExist(node, remote, arg)
+		case msgAccess:
+			serveAccess(remote, arg)
 		}
 	})
 }
 
-func sendDataToPeer(node host.Host, targetpeerid string, msg string) error {
-	var ctx = context.Background()
-	targetPeerID := strings.TrimSpace(targetpeerid)
-	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
+// readRequest reads a request of remote off r.  Requests that are too
+// large, too slow or malformed and messages that aren't requests count
+// against remote.
+func readRequest(remote peer.ID, r io.Reader) (string, string, bool) {
+	data, err := readMessage(r, maxRequestSize)
+	if !streamRead(remote, err) {
+		return "", "", false
+	}
+	kind, arg, err := parseRequest(data)
 	if err != nil {
-		log.Printf("Failed to create relay multiaddr: %v", err)
-		return err
+		misbehave(remote, misbehaviorMalformed, err.Error())
+		return "", "", false
 	}
-	peerMultiaddr := relayAddr.Encapsulate(multiaddr.StringCast("/p2p-circuit/p2p/" + targetPeerID))
+	if kind == "" {
+		misbehave(remote, misbehaviorUnsolicited, "reply to no request")
+		return "", "", false
+	}
+	return kind, arg, true
+}
 
-	peerinfo, err := peer.AddrInfoFromP2pAddr(peerMultiaddr)
+// receiveReply reads the reply of remote off s and delivers it on reply.
+// Replies may hold anything, so they aren't parsed; the request awaiting
+// one checks it.
+func receiveReply(remote peer.ID, s network.Stream, reply chan<- []byte) {
+	if err := s.SetReadDeadline(time.Now().Add(replyReadTimeout)); err != nil {
+		xferLog.Debugf("Failed to set read deadline on stream of %s: %v", remote, err)
+	}
+	r := downloadReader(globalCtx, remote, s)
+	if hash, ok := downloads.Load(remote.String()); ok {
+		r = &progressReader{r: r, peerID: remote.String(), hash: hash.(string)}
+	}
+	data, err := readMessage(r, replyLimit(remote))
+	if !streamRead(remote, err) {
+		return
+	}
+	reply <- data
+}
+
+// streamRead reports whether a message of remote was read without err,
+// scoring remote for messages that were too large or not closed in time.
+func streamRead(remote peer.ID, err error) bool {
+	switch {
+	case errors.Is(err, errMessageTooLarge):
+		misbehave(remote, misbehaviorOversized, err.Error())
+		return false
+	case isTimeout(err):
+		misbehave(remote, misbehaviorTimeout, "stream not closed in time")
+		return false
+	case err != nil:
+		xferLog.Warnf("Error reading from stream of %s: %v", remote, err)
+		return false
+	}
+	return true
+}
+
+// requestHash returns the hash a request of the given kind is about.
+func requestHash(kind, arg string) string {
+	if kind == msgChunk {
+		hash, _, _ := parseChunkRequest(arg)
+		return hash
+	}
+	return arg
+}
+
+// denyRequest answers a request about a private file remote may not fetch,
+// or about denied content, as if the file wasn't stored.
+func denyRequest(node host.Host, remote peer.ID, kind, arg string) {
+	hash := requestHash(kind, arg)
+	xferLog.Debugf("Denied %s for %v to %s", kind, hash, remote)
+	notifyFileRequested(remote, hash, strings.ToLower(kind), false)
+	if err := sendDataToPeer(node, remote.String(), "false"); err != nil {
+		xferLog.Errorf("Failed to answer %s for %v to %s: %v", kind, hash, remote, err)
+	}
+}
+
+// serveFile answers a REQUEST for the whole file hash.
+func serveFile(node host.Host, remote peer.ID, hash string) {
+	record, err := GetFileRecord(hash)
 	if err != nil {
-		log.Fatalf("Failed to parse peer address: %s", err)
-		return err
+		xferLog.Errorf("Failed to retrieve hash %v: %v", hash, err)
+		return
 	}
-	if err := node.Connect(ctx, *peerinfo); err != nil {
-		log.Printf("Failed to connect to peer %s via relay: %v", peerinfo.ID, err)
-		return err
+	notifyFileRequested(remote, hash, "request", record != nil)
+	filename, ok := record["filename"].(string)
+	if !ok {
+		if err := sendDataToPeer(node, remote.String(), "false"); err != nil {
+			xferLog.Errorf("Failed to answer REQUEST for %v to %s: %v", hash, remote, err)
+		}
+		return
+	}
+	touchFile(hash)
+	if !acquireTransfer(globalCtx) {
+		return
 	}
-	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), peerinfo.ID, "/senddata/p2p")
+	defer releaseTransfer()
+	if _, err := sendFile(node, remote.String(), "files/"+filename); err != nil {
+		xferLog.Errorf("Failed to send %v to %s: %v", hash, remote, err)
+	}
+}
+
+// serveName answers a NAME request with the filename of hash, or "false"
+// if it isn't stored.
+func serveName(node host.Host, remote peer.ID, hash string) {
+	record, err := GetFileRecord(hash)
 	if err != nil {
-		log.Printf("Failed to open stream to %s: %s", peerinfo.ID, err)
-		return err
+		xferLog.Errorf("Failed to retrieve hash %v: %v", hash, err)
+		return
+	}
+	notifyFileRequested(remote, hash, "name", record != nil)
+	filename, ok := record["filename"].(string)
+	if !ok {
+		filename = "false"
+	}
+	if err := sendDataToPeer(node, remote.String(), filename); err != nil {
+		xferLog.Errorf("Failed to send name of %v to %s: %v", hash, remote, err)
+	}
+}
+
+// serveChunk answers a CHUNK request with the chunk and its proof, or
+// "false" if it can't be had.
+func serveChunk(node host.Host, remote peer.ID, arg string) {
+	hash, index, err := parseChunkRequest(arg)
+	var slice []byte
+	if err == nil {
+		slice, err = readChunk(hash, index)
+	}
+	notifyFileRequested(remote, hash, "chunk", err == nil)
+	if err == nil && index == 0 {
+		touchFile(hash)
 	}
-	defer s.Close()
-	_, err = s.Write([]byte(msg))
 	if err != nil {
-		log.Fatalf("Failed to write to stream: %s", err)
-		return err
+		xferLog.Debugf("Not sending chunk to %s: %v", remote, err)
+		slice = []byte("false")
 	}
-	return nil
+	if !acquireTransfer(globalCtx) {
+		return
+	}
+	defer releaseTransfer()
+	if _, err := sendData(node, remote.String(), bytes.NewReader(slice)); err != nil {
+		xferLog.Errorf("Failed to send chunk %d of %v to %s: %v", index, hash, remote, err)
+	}
+}
+
+// serveExist answers an EXIST request with "true" or "false".
+func serveExist(node host.Host, remote peer.ID, hash string) {
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		xferLog.Errorf("Failed to retrieve hash %v: %v", hash, err)
+	}
+	exists := "true"
+	if record == nil {
+		exists = "false"
+	}
+	notifyFileRequested(remote, hash, "exist", record != nil)
+	if err := sendDataToPeer(node, remote.String(), exists); err != nil {
+		xferLog.Errorf("Failed to answer EXIST for %v to %s: %v", hash, remote, err)
+	}
+}
+
+// notifyFileRequested notifies EventFileRequested for a query about hash
+// received from remote.
+func notifyFileRequested(remote peer.ID, hash, kind string, found bool) {
+	notifyEvent(api.EventFileRequested, api.FileRequestEvent{
+		PeerID: remote.String(),
+		Hash:   hash,
+		Kind:   kind,
+		Found:  found,
+	})
+}
+
+// relayedAddr returns the circuit address of targetPeerID behind the relay.
+func relayedAddr(relayAddr multiaddr.Multiaddr, targetPeerID string) (multiaddr.Multiaddr, error) {
+	circuit, err := multiaddr.NewMultiaddr("/p2p-circuit/p2p/" + targetPeerID)
+	if err != nil {
+		return nil, err
+	}
+	return relayAddr.Encapsulate(circuit), nil
 }
 
-func sendFile(node host.Host, target string, filename string) {
-	var ctx = context.Background()
+// newRelayedStream connects to the target peer through the relay and opens a
+// "/senddata/p2p" stream to it.
+func newRelayedStream(ctx context.Context, node host.Host, target string) (network.Stream, error) {
 	targetPeerID := strings.TrimSpace(target)
 	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
 	if err != nil {
-		log.Printf("Failed to create relay multiaddr: %v", err)
+		return nil, fmt.Errorf("failed to create relay multiaddr: %w", err)
+	}
+	peerMultiaddr, err := relayedAddr(relayAddr, targetPeerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer address: %w", err)
 	}
-	peerMultiaddr := relayAddr.Encapsulate(multiaddr.StringCast("/p2p-circuit/p2p/" + targetPeerID))
-
 	peerinfo, err := peer.AddrInfoFromP2pAddr(peerMultiaddr)
 	if err != nil {
-		log.Fatalf("Failed to parse peer address: %s", err)
+		return nil, fmt.Errorf("failed to parse peer address: %w", err)
 	}
 	if err := node.Connect(ctx, *peerinfo); err != nil {
-		log.Printf("Failed to connect to peer %s via relay: %v", peerinfo.ID, err)
-		return
+		return nil, fmt.Errorf("failed to connect to peer %s via relay: %w", peerinfo.ID, err)
 	}
-	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), peerinfo.ID, "/senddata/p2p")
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, sendDataProtocol), peerinfo.ID, sendDataProtocol)
 	if err != nil {
-		log.Printf("Failed to open stream to %s: %s", peerinfo.ID, err)
-		return
+		return nil, fmt.Errorf("failed to open stream to %s: %w", peerinfo.ID, err)
+	}
+	return s, nil
+}
+
+func sendDataToPeer(node host.Host, targetpeerid string, msg string) error {
+	s, err := newRelayedStream(context.Background(), node, targetpeerid)
+	if err != nil {
+		return err
 	}
 	defer s.Close()
+	if _, err := s.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("failed to write to stream: %w", err)
+	}
+	return nil
+}
+
+// sendFile sends the contents of filename to target and returns the number
+// of bytes sent.
+func sendFile(node host.Host, target string, filename string) (int64, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatalf("Failed to open file: %s", err)
-		return
+		return 0, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	// Copy the file content to the stream
-	_, err = io.Copy(s, file)
+	n, err := sendData(node, target, file)
 	if err != nil {
-		log.Fatalf("Failed to send file: %s", err)
-		return
+		return n, err
+	}
+	xferLog.Debugf("Sent %d bytes of %s to %s", n, filename, target)
+	return n, nil
+}
+
+// sendData sends the contents of r to target within the upload limits and
+// returns the number of bytes sent.
+func sendData(node host.Host, target string, r io.Reader) (int64, error) {
+	s, err := newRelayedStream(context.Background(), node, target)
+	if err != nil {
+		return 0, err
 	}
+	defer s.Close()
+
+	// Copy the content to the stream
+	n, err := io.Copy(uploadWriter(globalCtx, s.Conn().RemotePeer(), s), r)
+	if err != nil {
+		return n, fmt.Errorf("failed to send file: %w", err)
+	}
+	return n, nil
+}
+
+// isBootstrapPeer reports whether p is one of the configured bootstrap
+// nodes.
+func isBootstrapPeer(p peer.ID) bool {
+	for _, addr := range []string{native_bootstrap, bootstrap_node_addr_1, bootstrap_node_addr_2} {
+		if info, err := peer.AddrInfoFromString(addr); err == nil && info.ID == p {
+			return true
+		}
+	}
+	return false
 }
 
+// handlePeerExchange answers the legacy peer lists of peerExchangeProtocol
+// by dialing a few of the peers listed.  Lists carry no signatures, so they
+// are only taken from the bootstrap nodes; everyone else exchanges signed
+// records over pex.Protocol.
 func handlePeerExchange(node host.Host) {
 	relayInfo, _ := peer.AddrInfoFromString(relay_node_addr)
-	node.SetStreamHandler("/orcanet/p2p", func(s network.Stream) {
+	node.SetStreamHandler(peerExchangeProtocol, func(s network.Stream) {
 		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		if isBanned(remote) {
+			s.Reset()
+			return
+		}
+		if !isBootstrapPeer(remote) {
+			peerLog.Debugf("Ignoring peer list of %s, which isn't a bootstrap node", remote)
+			s.Reset()
+			return
+		}
+		if !allowMessage(peerExchangeLimiters, remote) {
+			return
+		}
 
-		buf := bufio.NewReader(s)
-		peerAddr, err := buf.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				fmt.Printf("error reading from stream: %v", err)
-			}
+		if err := s.SetReadDeadline(time.Now().Add(requestReadTimeout)); err != nil {
+			peerLog.Debugf("Failed to set read deadline on stream of %s: %v", remote, err)
+		}
+		data, err := readMessage(s, maxPeerExchangeSize)
+		switch {
+		case errors.Is(err, errMessageTooLarge):
+			misbehave(remote, misbehaviorOversized, err.Error())
+			return
+		case isTimeout(err):
+			misbehave(remote, misbehaviorTimeout, "stream not closed in time")
+			return
+		case err != nil:
+			peerLog.Warnf("Error reading peer exchange stream: %v", err)
+			return
 		}
-		peerAddr = strings.TrimSpace(peerAddr)
-		var data map[string]interface{}
-		err = json.Unmarshal([]byte(peerAddr), &data)
+		line, _, _ := bytes.Cut(data, []byte("\n"))
+		knownPeers, err := parsePeerExchange(bytes.TrimSpace(line), node.ID())
 		if err != nil {
-			fmt.Printf("error unmarshaling JSON: %v", err)
+			misbehave(remote, misbehaviorMalformed, err.Error())
+			return
 		}
-		if knownPeers, ok := data["known_peers"].([]interface{}); ok {
-			for _, peer := range knownPeers {
-				fmt.Println("Peer:")
-				if peerMap, ok := peer.(map[string]interface{}); ok {
-					if peerID, ok := peerMap["peer_id"].(string); ok {
-						if string(peerID) != string(relayInfo.ID) {
-							connectToPeerUsingRelay(node, peerID)
-						}
-					}
-				}
+		peerLog.Debugf("Received %d peers from %s", len(knownPeers), remote)
+
+		// Only dial a few peers we aren't connected to yet, so a long list
+		// can't make the node dial the whole network.
+		dials := 0
+		for _, id := range knownPeers {
+			if dials == maxPeerExchangeDials {
+				break
+			}
+			if (relayInfo != nil && id == relayInfo.ID) || isBanned(id) ||
+				node.Network().Connectedness(id) == network.Connected {
+				continue
 			}
+			connectToPeerUsingRelay(node, id.String())
+			dials++
 		}
 	})
 }
 
 func provideKey(ctx context.Context, dht *dht.IpfsDHT, key string, provide bool) error {
-	data := []byte(key)
-	hash := sha256.Sum256(data)
-	mh, err := multihash.EncodeName(hash[:], "sha2-256")
+	c, err := providerCID(key)
 	if err != nil {
-		return fmt.Errorf("error encoding multihash: %v", err)
+		return err
 	}
-	c := cid.NewCidV1(cid.Raw, mh)
 	// Start providing the key
 	err = dht.Provide(ctx, c, provide)
+	op := "provide"
+	if !provide {
+		op = "unprovide"
+	}
+	providesTotal.WithLabelValues(op, resultLabel(err)).Inc()
+	event := api.ProvideEvent{Key: key, Provide: provide}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	notifyEvent(api.EventProvideCompleted, event)
 	if err != nil {
 		if provide {
 			return fmt.Errorf("failed to start providing key: %v", err)
@@ -335,17 +602,23 @@ func provideKey(ctx context.Context, dht *dht.IpfsDHT, key string, provide bool)
 	return nil
 }
 
-func makeReservation(node host.Host) {
+func makeReservation(node host.Host) error {
 	ctx := globalCtx
 	relayInfo, err := peer.AddrInfoFromString(relay_node_addr)
 	if err != nil {
-		log.Fatalf("Failed to create addrInfo from string representation of relay multiaddr: %v", err)
+		return fmt.Errorf("failed to create addrInfo from relay multiaddr: %w", err)
 	}
-	_, err = client.Reserve(ctx, node, *relayInfo)
+	reservation, err := client.Reserve(ctx, node, *relayInfo)
 	if err != nil {
-		log.Fatalf("Failed to make reservation on relay: %v", err)
+		setReservation(nil)
+		relayReservationActive.Set(0)
+		return fmt.Errorf("failed to make reservation on relay: %w", err)
 	}
-	fmt.Printf("Reservation successful \n")
+	setReservation(reservation)
+	relayReservationActive.Set(1)
+	relayReservationExpiry.Set(float64(reservation.Expiration.Unix()))
+	nodeLog.Infof("Reservation on relay %s successful, expires %v", relayInfo.ID, reservation.Expiration)
+	return nil
 }
 
 func refreshReservation(node host.Host, interval time.Duration) {
@@ -355,9 +628,11 @@ func refreshReservation(node host.Host, interval time.Duration) {
 	for {
 		select {
 		case <-ticker.C:
-			makeReservation(node)
+			if err := makeReservation(node); err != nil {
+				nodeLog.Errorf("Failed to refresh relay reservation: %v", err)
+			}
 		case <-globalCtx.Done():
-			fmt.Println("Context done, stopping reservation refresh.")
+			nodeLog.Debug("Context done, stopping reservation refresh")
 			return
 		}
 	}
@@ -374,7 +649,7 @@ type ProxyInfo struct {
 	Port       int    `json:"port"`
 }
 
-func registerProxyAsService(ctx context.Context, dht *dht.IpfsDHT, location string, ipAddress string, name string, initialFee string, price string, node host.Host) {
+func registerProxyAsService(ctx context.Context, dht *dht.IpfsDHT, location string, ipAddress string, name string, initialFee string, price string, node host.Host) error {
 	// 1. Create a unique proxy key
 	proxyKey := "/orcanet/proxy/" + node.ID().String()
 
@@ -402,8 +677,7 @@ func registerProxyAsService(ctx context.Context, dht *dht.IpfsDHT, location stri
 	if proxyInfo != nil {
 		proxyInfoJSON, err = json.Marshal(proxyInfo)
 		if err != nil {
-			fmt.Printf("Error marshalling proxy info: %v\n", err)
-			return
+			return fmt.Errorf("error marshalling proxy info: %w", err)
 		}
 	}
 
@@ -418,8 +692,7 @@ func registerProxyAsService(ctx context.Context, dht *dht.IpfsDHT, location stri
 	// 5. Store proxy info in the DHT
 	err = dht.PutValue(ctx, proxyKey, value)
 	if err != nil {
-		fmt.Printf("Error storing proxy info in DHT: %v\n", err)
-		return
+		return fmt.Errorf("error storing proxy info in DHT: %w", err)
 	}
 
 	// 6. Provide key to indicate the node is acting as a proxy
@@ -427,24 +700,31 @@ func registerProxyAsService(ctx context.Context, dht *dht.IpfsDHT, location stri
 		hash := sha256.Sum256(proxyInfoJSON)
 		mh, err := multihash.Encode(hash[:], multihash.SHA2_256)
 		if err != nil {
-			fmt.Printf("Error encoding multihash: %v\n", err)
-			return
+			return fmt.Errorf("error encoding multihash: %w", err)
 		}
 
 		c := cid.NewCidV1(cid.Raw, mh)
 
 		err = dht.Provide(ctx, c, true)
 		if err != nil {
-			fmt.Printf("Failed to provide proxy info in DHT: %v\n", err)
-			return
+			return fmt.Errorf("failed to provide proxy info in DHT: %w", err)
 		}
 	}
 
+	proxyCapable.Store(proxyInfo != nil)
+	status := api.ProxyStatus{IsProxy: proxyInfo != nil}
+	if proxyInfo != nil {
+		proxy := proxyFromInfo(proxyInfo)
+		status.Proxy = &proxy
+	}
+	notifyEvent(api.EventProxyChanged, status)
+
 	if proxyInfo != nil {
-		fmt.Printf("Proxy registered successfully!\n NodeID: %s\n Name: %s\n PeerID: %s\n IP Address: %s\n Initial Fee: %s DC\n Rate: %s DC/MB\n Port: %d", node_id, name, node.ID().String(), ipAddress, proxyInfo.InitialFee, proxyInfo.Price, proxyInfo.Port)
+		prxyLog.Infof("Proxy registered: node=%s name=%s peer=%s ip=%s initialFee=%s DC rate=%s DC/MB port=%d", node_id, name, node.ID().String(), ipAddress, proxyInfo.InitialFee, proxyInfo.Price, proxyInfo.Port)
 	} else {
-		fmt.Printf("Proxy deregistered successfully!\n NodeID: %s\n PeerID: %s\n", node_id, node.ID().String())
+		prxyLog.Infof("Proxy deregistered: node=%s peer=%s", node_id, node.ID().String())
 	}
+	return nil
 }
 
 func getProxyInfo(ctx context.Context, dht *dht.IpfsDHT, nodeID string) (*ProxyInfo, error) {
@@ -452,39 +732,41 @@ func getProxyInfo(ctx context.Context, dht *dht.IpfsDHT, nodeID string) (*ProxyI
 
 	value, err := dht.GetValue(ctx, proxyKey)
 	if err != nil {
-		// fmt.Printf("Failed retrieving proxy information: %v\n", err)
 		return nil, err
 	}
+	// Deregistered proxies store an empty record.
+	if len(value) == 0 {
+		return nil, nil
+	}
 
 	var proxyInfo ProxyInfo
 	err = json.Unmarshal(value, &proxyInfo)
 	if err != nil {
-		fmt.Printf("Error unmarshalling proxy info: %v\n", err)
+		prxyLog.Debugf("Error unmarshalling proxy info of %s: %v", nodeID, err)
 		return nil, err
 	}
 
 	return &proxyInfo, nil
 }
 
-func mapPeerIDtoWallet(ctx context.Context, dht *dht.IpfsDHT, walletAddress string, node host.Host) {
+func mapPeerIDtoWallet(ctx context.Context, dht *dht.IpfsDHT, walletAddress string, node host.Host) error {
 	// Key is peerID
 	key := "/orcanet/wallet/" + node.ID().String()
 
 	// Serialize wallet address
 	walletAddressJSON, err := json.Marshal(walletAddress)
 	if err != nil {
-		fmt.Printf("Error marshalling wallet address: %v\n", err)
-		return
+		return fmt.Errorf("error marshalling wallet address: %w", err)
 	}
 
 	// Store wallet address in DHT
 	err = dht.PutValue(ctx, key, walletAddressJSON)
 	if err != nil {
-		fmt.Printf("Error storing wallet address in DHT: %v\n", err)
-		return
+		return fmt.Errorf("error storing wallet address in DHT: %w", err)
 	}
 
-	fmt.Printf("Wallet address mapped successfully. PeerID: %s\n Wallet Address: %s\n", node.ID().String(), walletAddress)
+	nodeLog.Infof("Wallet address mapped: peer=%s wallet=%s", node.ID().String(), walletAddress)
+	return nil
 }
 
 func getWalletAddress(ctx context.Context, dht *dht.IpfsDHT, peerID string) (string, error) {
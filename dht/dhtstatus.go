@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtpb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// DHT modes that can be configured with -dhtmode.  In auto mode the node
+// serves the DHT while AutoNAT finds it publicly reachable and is only a
+// client otherwise.
+const (
+	dhtModeAuto   = "auto"
+	dhtModeServer = "server"
+	dhtModeClient = "client"
+)
+
+// dhtModes lists the supported DHT modes.
+var dhtModes = []string{dhtModeAuto, dhtModeServer, dhtModeClient}
+
+// dhtModeOption returns the DHT option of a configured DHT mode.
+func dhtModeOption(mode string) dht.ModeOpt {
+	switch mode {
+	case dhtModeServer:
+		return dht.ModeServer
+	case dhtModeClient:
+		return dht.ModeClient
+	default:
+		return dht.ModeAuto
+	}
+}
+
+const (
+	// dhtProbeFiles is the most provided files whose provider records are
+	// looked up by a status probe.
+	dhtProbeFiles = 3
+
+	// dhtProbePeers is the number of peers closest to a record that are
+	// asked for it.
+	dhtProbePeers = 5
+
+	// dhtProbeTimeout bounds all lookups of a status probe.
+	dhtProbeTimeout = 20 * time.Second
+
+	// maxKadMessageSize is the largest DHT reply read by a probe.
+	maxKadMessageSize = 4 << 20
+)
+
+var (
+	// natMtx protects reachability and natTypes.
+	natMtx sync.Mutex
+
+	// reachability is the node's reachability as last found by AutoNAT.
+	reachability network.Reachability
+
+	// natTypes maps a transport protocol to the type of NAT the node is
+	// behind for it, as far as it is known.
+	natTypes = make(map[network.NATTransportProtocol]network.NATDeviceType)
+)
+
+// trackReachability follows the node's reachability and NAT type as AutoNAT
+// and identify find them.
+func trackReachability(node host.Host) {
+	sub, err := node.EventBus().Subscribe([]interface{}{
+		new(event.EvtLocalReachabilityChanged),
+		new(event.EvtNATDeviceTypeChanged),
+	})
+	if err != nil {
+		nodeLog.Errorf("Failed to subscribe to reachability changes: %v", err)
+		return
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case e := <-sub.Out():
+			natMtx.Lock()
+			switch e := e.(type) {
+			case event.EvtLocalReachabilityChanged:
+				reachability = e.Reachability
+				publiclyReachable.Store(e.Reachability == network.ReachabilityPublic)
+				nodeLog.Infof("Reachability changed to %s", strings.ToLower(e.Reachability.String()))
+			case event.EvtNATDeviceTypeChanged:
+				natTypes[e.TransportProtocol] = e.NatDeviceType
+			}
+			natMtx.Unlock()
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
+
+// dhtServing reports whether the node currently answers DHT queries, which
+// the DHT only does in server mode.
+func dhtServing(node host.Host) bool {
+	return slices.Contains(node.Mux().Protocols(), dht.ProtocolDHT)
+}
+
+// dhtStatus reports the node's DHT mode, routing table and reachability.
+// With probe set it also asks the peers closest to the node's records
+// whether they hold them.
+func dhtStatus(node host.Host, probe bool) api.DHTStatus {
+	status := api.DHTStatus{
+		ConfiguredMode: cfg.DHTMode,
+		Mode:           dhtModeClient,
+		RelayAddrs:     []string{},
+		NATTypes:       make(map[string]string),
+	}
+	if dhtServing(node) {
+		status.Mode = dhtModeServer
+	}
+
+	natMtx.Lock()
+	status.Reachability = strings.ToLower(reachability.String())
+	for proto, t := range natTypes {
+		status.NATTypes[strings.ToLower(proto.String())] = strings.ToLower(t.String())
+	}
+	natMtx.Unlock()
+
+	for _, addr := range node.Addrs() {
+		if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+			status.RelayAddrs = append(status.RelayAddrs, addr.String())
+		}
+	}
+
+	rt := dhtRoute.RoutingTable()
+	status.RoutingTable.Size = rt.Size()
+	status.RoutingTable.Buckets = []api.RoutingBucket{}
+	for cpl, counted := 0, 0; counted < status.RoutingTable.Size && cpl < 256; cpl++ {
+		n := rt.NPeersForCpl(uint(cpl))
+		if n > 0 {
+			status.RoutingTable.Buckets = append(status.RoutingTable.Buckets, api.RoutingBucket{CommonPrefixLen: cpl, Peers: n})
+		}
+		counted += n
+	}
+
+	if probe {
+		status.Records = probeRecords(node)
+	}
+	return status
+}
+
+// probeRecords looks up the node's wallet record and the provider records
+// of a few of its files at the peers closest to them.
+func probeRecords(node host.Host) []api.DHTRecordStatus {
+	ctx, cancel := context.WithTimeout(globalCtx, dhtProbeTimeout)
+	defer cancel()
+
+	records := []api.DHTRecordStatus{{Kind: "wallet", Key: "/orcanet/wallet/" + node.ID().String()}}
+	files, _, err := FetchFileRecordsPage(0, defaultPageLimit)
+	if err != nil {
+		nodeLog.Warnf("Failed to list files to probe: %v", err)
+	}
+	for _, record := range files {
+		if len(records) > dhtProbeFiles {
+			break
+		}
+		hash, _ := record["hash"].(string)
+		if unlisted, _ := record["unlisted"].(bool); unlisted || hash == "" {
+			continue
+		}
+		records = append(records, api.DHTRecordStatus{Kind: "provider", Key: hash})
+	}
+
+	var wg sync.WaitGroup
+	for i := range records {
+		wg.Add(1)
+		go func(r *api.DHTRecordStatus) {
+			defer wg.Done()
+			if err := probeRecord(ctx, node, r); err != nil {
+				r.Error = err.Error()
+			}
+		}(&records[i])
+	}
+	wg.Wait()
+	return records
+}
+
+// probeRecord asks the peers closest to the key of r whether they hold it
+// and fills in the result.
+func probeRecord(ctx context.Context, node host.Host, r *api.DHTRecordStatus) error {
+	var key []byte
+	if r.Kind == "provider" {
+		c, err := providerCID(r.Key)
+		if err != nil {
+			return err
+		}
+		key = c.Hash()
+	} else {
+		key = []byte(r.Key)
+	}
+	closest, err := dhtRoute.GetClosestPeers(ctx, string(key))
+	if err != nil {
+		return fmt.Errorf("failed to find the closest peers: %w", err)
+	}
+
+	for _, p := range closest {
+		if r.Checked == dhtProbePeers {
+			break
+		}
+		if p == node.ID() {
+			continue
+		}
+		var held bool
+		if r.Kind == "provider" {
+			held, err = peerHasProvider(ctx, node, p, key)
+		} else {
+			held, err = peerHasValue(ctx, node, p, key)
+		}
+		if err != nil {
+			nodeLog.Debugf("Failed to probe %s for %s: %v", p, r.Key, err)
+			continue
+		}
+		r.Checked++
+		if held {
+			r.Holders++
+		}
+	}
+	r.Findable = r.Holders > 0
+	return nil
+}
+
+// peerHasProvider reports whether p lists the node as a provider of key.
+func peerHasProvider(ctx context.Context, node host.Host, p peer.ID, key []byte) (bool, error) {
+	resp, err := sendKadRequest(ctx, node, p, dhtpb.NewMessage(dhtpb.Message_GET_PROVIDERS, key, 0))
+	if err != nil {
+		return false, err
+	}
+	for _, info := range dhtpb.PBPeersToPeerInfos(resp.GetProviderPeers()) {
+		if info.ID == node.ID() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// peerHasValue reports whether p holds a value for key.
+func peerHasValue(ctx context.Context, node host.Host, p peer.ID, key []byte) (bool, error) {
+	resp, err := sendKadRequest(ctx, node, p, dhtpb.NewMessage(dhtpb.Message_GET_VALUE, key, 0))
+	if err != nil {
+		return false, err
+	}
+	return len(resp.GetRecord().GetValue()) > 0, nil
+}
+
+// sendKadRequest sends p a single DHT request and reads its reply.  Unlike
+// the DHT's own queries it never answers from the local store.
+func sendKadRequest(ctx context.Context, node host.Host, p peer.ID, req *dhtpb.Message) (*dhtpb.Message, error) {
+	s, err := node.NewStream(ctx, p, dht.ProtocolDHT)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetDeadline(deadline); err != nil {
+			nodeLog.Debugf("Failed to set deadline on stream of %s: %v", p, err)
+		}
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := msgio.NewVarintWriter(s).WriteMsg(data); err != nil {
+		return nil, err
+	}
+	r := msgio.NewVarintReaderSize(s, maxKadMessageSize)
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	defer r.ReleaseMsg(msg)
+	resp := new(dhtpb.Message)
+	if err := resp.Unmarshal(msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	return resp, nil
+}
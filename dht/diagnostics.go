@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/autonat"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// A connectivity self-test runs the steps below in turn and reports how
+// long each took and why it failed, so users can tell a firewall blocking
+// inbound connections from a relay that is down or a peer that is offline.
+// AutoNAT asks connected peers to dial the node back, and the relay
+// reservation is checked and renewed if it has lapsed.  Given a peer, the
+// node looks it up and dials it directly, then through the relay, and waits
+// for hole punching to turn the relayed connection into a direct one.  The
+// dials close the node's existing connections to that peer first.
+const (
+	// Steps of a connectivity self-test.
+	stepAutoNAT   = "autonat"
+	stepRelay     = "relay_reservation"
+	stepLookup    = "lookup"
+	stepDirect    = "direct"
+	stepRelayed   = "relayed"
+	stepHolePunch = "hole_punch"
+
+	// diagnosticsStepTimeout bounds each step of a self-test.
+	diagnosticsStepTimeout = 15 * time.Second
+
+	// autoNATProbePeers is the most connected peers asked to dial the
+	// node back.
+	autoNATProbePeers = 3
+
+	// holePunchPoll is how often the connections to a peer are checked for
+	// a direct one while waiting for hole punching.
+	holePunchPoll = 250 * time.Millisecond
+)
+
+var (
+	// reservationMtx protects reservation.
+	reservationMtx sync.Mutex
+
+	// reservation is the last reservation the node made on the relay.
+	reservation *client.Reservation
+
+	// diagnosticsMtx serializes self-tests, which would otherwise close
+	// each other's connections.
+	diagnosticsMtx sync.Mutex
+)
+
+// setReservation records the reservation the node holds on the relay.
+func setReservation(r *client.Reservation) {
+	reservationMtx.Lock()
+	reservation = r
+	reservationMtx.Unlock()
+}
+
+// currentReservation returns the reservation the node holds on the relay,
+// or nil if it holds none that is still valid.
+func currentReservation() *client.Reservation {
+	reservationMtx.Lock()
+	defer reservationMtx.Unlock()
+	if reservation == nil || !time.Now().Before(reservation.Expiration) {
+		return nil
+	}
+	return reservation
+}
+
+// runStep runs the step name of a self-test with a step timeout and returns
+// its result.  check returns a detail to report and how long the step took
+// if it measured that itself.
+func runStep(name string, check func(ctx context.Context) (string, time.Duration, error)) api.ConnectivityStep {
+	ctx, cancel := context.WithTimeout(globalCtx, diagnosticsStepTimeout)
+	defer cancel()
+
+	start := time.Now()
+	detail, latency, err := check(ctx)
+	if latency == 0 {
+		latency = time.Since(start)
+	}
+	connectivityStepsTotal.WithLabelValues(name, resultLabel(err)).Inc()
+	step := api.ConnectivityStep{Name: name, OK: err == nil, Latency: latency, Detail: detail}
+	if err != nil {
+		step.Error = err.Error()
+		nodeLog.Debugf("Connectivity step %s failed: %v", name, err)
+	}
+	return step
+}
+
+// skippedStep reports a step that wasn't run because one it needs failed.
+func skippedStep(name, reason string) api.ConnectivityStep {
+	return api.ConnectivityStep{Name: name, Error: "skipped: " + reason}
+}
+
+// checkConnectivity runs a connectivity self-test of the node and, if
+// target isn't empty, of the paths to target.
+func checkConnectivity(node host.Host, target peer.ID) api.ConnectivityReport {
+	diagnosticsMtx.Lock()
+	defer diagnosticsMtx.Unlock()
+
+	report := api.ConnectivityReport{
+		PeerID:      node.ID().String(),
+		ListenAddrs: []string{},
+		NATTypes:    make(map[string]string),
+	}
+	natMtx.Lock()
+	report.Reachability = strings.ToLower(reachability.String())
+	for proto, t := range natTypes {
+		report.NATTypes[strings.ToLower(proto.String())] = strings.ToLower(t.String())
+	}
+	natMtx.Unlock()
+	for _, addr := range node.Addrs() {
+		report.ListenAddrs = append(report.ListenAddrs, addr.String())
+	}
+
+	report.Steps = append(report.Steps,
+		runStep(stepAutoNAT, func(ctx context.Context) (string, time.Duration, error) {
+			return checkAutoNAT(ctx, node)
+		}),
+		runStep(stepRelay, func(ctx context.Context) (string, time.Duration, error) {
+			return checkRelay(ctx, node)
+		}),
+	)
+	if target == "" {
+		return report
+	}
+
+	report.Target = target.String()
+	lookup := runStep(stepLookup, func(ctx context.Context) (string, time.Duration, error) {
+		return lookupPeer(ctx, node, target)
+	})
+	report.Steps = append(report.Steps, lookup)
+	if lookup.OK {
+		report.Steps = append(report.Steps, runStep(stepDirect, func(ctx context.Context) (string, time.Duration, error) {
+			return dialDirect(ctx, node, target)
+		}))
+	} else {
+		report.Steps = append(report.Steps, skippedStep(stepDirect, "no known addresses"))
+	}
+	relayed := runStep(stepRelayed, func(ctx context.Context) (string, time.Duration, error) {
+		return dialRelayed(ctx, node, target)
+	})
+	report.Steps = append(report.Steps, relayed)
+	if relayed.OK {
+		report.Steps = append(report.Steps, runStep(stepHolePunch, func(ctx context.Context) (string, time.Duration, error) {
+			return awaitHolePunch(ctx, node, target)
+		}))
+	} else {
+		report.Steps = append(report.Steps, skippedStep(stepHolePunch, "no relayed connection"))
+	}
+	return report
+}
+
+// checkAutoNAT asks up to autoNATProbePeers connected peers offering
+// AutoNAT to dial the node back, until one answers.  A failed dial back
+// means the node isn't reachable from outside on its addresses.
+func checkAutoNAT(ctx context.Context, node host.Host) (string, time.Duration, error) {
+	nat := autonat.NewAutoNATClient(node, nil, nil)
+	var asked int
+	var lastErr error
+	for _, p := range node.Network().Peers() {
+		if asked == autoNATProbePeers {
+			break
+		}
+		if protos, err := node.Peerstore().SupportsProtocols(p, autonat.AutoNATProto); err != nil || len(protos) == 0 {
+			continue
+		}
+		asked++
+		err := nat.DialBack(ctx, p)
+		var natErr autonat.Error
+		switch {
+		case err == nil:
+			return fmt.Sprintf("dialed back by %s", p), 0, nil
+		case errors.As(err, &natErr) && natErr.IsDialError():
+			return fmt.Sprintf("%s failed to dial back", p), 0, fmt.Errorf("not reachable from outside: %w", err)
+		}
+		nodeLog.Debugf("AutoNAT dial back by %s failed: %v", p, err)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if asked == 0 {
+		return "", 0, errors.New("no connected peer offers AutoNAT")
+	}
+	return fmt.Sprintf("asked %d peers", asked), 0, fmt.Errorf("no peer dialed back: %w", lastErr)
+}
+
+// checkRelay checks that the node holds a reservation on the relay, making
+// one if it doesn't, and measures the round trip time to the relay.
+func checkRelay(ctx context.Context, node host.Host) (string, time.Duration, error) {
+	relayInfo, err := peer.AddrInfoFromString(relay_node_addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create addrInfo from relay multiaddr: %w", err)
+	}
+	renewed := ""
+	r := currentReservation()
+	if r == nil {
+		if err := makeReservation(node); err != nil {
+			return "no valid reservation", 0, err
+		}
+		renewed = ", renewed"
+		if r = currentReservation(); r == nil {
+			return "", 0, errors.New("relay granted an expired reservation")
+		}
+	}
+	detail := fmt.Sprintf("expires %s%s", r.Expiration.UTC().Format(time.RFC3339), renewed)
+
+	res := <-ping.Ping(ctx, node, relayInfo.ID)
+	if res.Error != nil {
+		return detail, 0, fmt.Errorf("failed to ping relay %s: %w", relayInfo.ID, res.Error)
+	}
+	return detail, res.RTT, nil
+}
+
+// lookupPeer finds the addresses of target, from the peerstore or else the
+// DHT.
+func lookupPeer(ctx context.Context, node host.Host, target peer.ID) (string, time.Duration, error) {
+	if addrs := directAddrs(node.Peerstore().Addrs(target)); len(addrs) > 0 {
+		return fmt.Sprintf("%d known addresses", len(addrs)), 0, nil
+	}
+	info, err := dhtRoute.FindPeer(ctx, target)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to find peer in the DHT: %w", err)
+	}
+	addrs := directAddrs(info.Addrs)
+	if len(addrs) == 0 {
+		return "", 0, errors.New("peer has only relay addresses")
+	}
+	node.Peerstore().AddAddrs(target, info.Addrs, peerstore.TempAddrTTL)
+	return fmt.Sprintf("%d addresses found in the DHT", len(addrs)), 0, nil
+}
+
+// directAddrs returns the addresses in addrs that don't go through a relay.
+func directAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	var direct []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err != nil {
+			direct = append(direct, addr)
+		}
+	}
+	return direct
+}
+
+// dialDirect closes the connections to target and dials it on its direct
+// addresses only.
+func dialDirect(ctx context.Context, node host.Host, target peer.ID) (string, time.Duration, error) {
+	if err := node.Network().ClosePeer(target); err != nil {
+		nodeLog.Debugf("Failed to close connections to %s: %v", target, err)
+	}
+	ctx = network.WithForceDirectDial(ctx, "connectivity self-test")
+	conn, err := node.Network().DialPeer(ctx, target)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to dial peer directly: %w", err)
+	}
+	return conn.RemoteMultiaddr().String(), 0, nil
+}
+
+// dialRelayed closes the connections to target and connects to it through
+// the relay.  The peerstore only holds the relayed address during the dial
+// so the node can't use a direct one.
+func dialRelayed(ctx context.Context, node host.Host, target peer.ID) (string, time.Duration, error) {
+	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create relay multiaddr: %w", err)
+	}
+	circuit, err := relayedAddr(relayAddr, target.String())
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to build relayed address: %w", err)
+	}
+	info, err := peer.AddrInfoFromP2pAddr(circuit)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get relayed AddrInfo: %w", err)
+	}
+
+	if err := node.Network().ClosePeer(target); err != nil {
+		nodeLog.Debugf("Failed to close connections to %s: %v", target, err)
+	}
+	ps := node.Peerstore()
+	saved := ps.Addrs(target)
+	ps.ClearAddrs(target)
+	ps.AddAddrs(target, info.Addrs, peerstore.TempAddrTTL)
+	_, err = node.Network().DialPeer(ctx, target)
+	ps.AddAddrs(target, saved, peerstore.RecentlyConnectedAddrTTL)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to connect to peer through relay: %w", err)
+	}
+	for _, conn := range node.Network().ConnsToPeer(target) {
+		if conn.Stat().Limited {
+			return conn.RemoteMultiaddr().String(), 0, nil
+		}
+	}
+	return "", 0, errors.New("relayed connection was replaced by a direct one")
+}
+
+// awaitHolePunch waits for a direct connection to target to appear next to
+// the relayed one, which hole punching opens.
+func awaitHolePunch(ctx context.Context, node host.Host, target peer.ID) (string, time.Duration, error) {
+	ticker := time.NewTicker(holePunchPoll)
+	defer ticker.Stop()
+	for {
+		for _, conn := range node.Network().ConnsToPeer(target) {
+			if !conn.Stat().Limited {
+				return conn.RemoteMultiaddr().String(), 0, nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", 0, fmt.Errorf("no direct connection after %v: %w", diagnosticsStepTimeout, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// walletServerURL is the address of the wallet server payments are made
+// through.
+const walletServerURL = "http://localhost:18080"
+
+var (
+	// errFileExists is returned when uploading a file whose hash is
+	// already in the store.
+	errFileExists = errors.New("file already exists")
+
+	// errFileNotFound is returned when a hash has no record in the store.
+	errFileNotFound = errors.New("file not found")
+
+	// errNotProvided is returned when a provider no longer has a file.
+	errNotProvided = errors.New("file is no longer provided")
+
+	// errPaymentFailed is returned when the wallet server refused a payment.
+	errPaymentFailed = errors.New("payment failed")
+)
+
+// fileKey returns the DHT record key holding our price for hash.
+func fileKey(hash string) string {
+	return peerFileKey(node.ID().String(), hash)
+}
+
+// peerFileKey returns the DHT record key holding the price peerID asks for
+// hash.
+func peerFileKey(peerID, hash string) string {
+	return "/orcanet/files/" + peerID + "/" + hash
+}
+
+// formatCost renders a price the way it is stored in the DHT file record: a
+// number of DC such as "1.5".
+func formatCost(cost btcutil.Amount) string {
+	return api.FormatAmount(cost)
+}
+
+// parseCost parses a price stored in a DHT file record.
+func parseCost(value []byte) (btcutil.Amount, error) {
+	return api.ParseAmount(string(value))
+}
+
+// uploadFile saves src to the files directory as filename and records it in
+// the store with the given price and access, providing it to the DHT if it
+// is public.  It returns the content ID of the file.
+func uploadFile(src io.ReadSeeker, filename string, price btcutil.Amount, access fileAccess) (string, error) {
+	hash, err := storeFile(src, filename, price, access, false)
+	if err != nil {
+		return hash, err
+	}
+	notifyEvent(api.EventUploadCompleted, api.UploadEvent{Hash: hash, Filename: filename, Cost: api.Amount(price)})
+	return hash, nil
+}
+
+// storeFile does the work of uploadFile.  Only public files have their price
+// put in the DHT and are provided; the others are served to peers that know
+// their hash, as far as their access allows.  Cached files may be evicted to
+// make room for others.  filename may name a file in a subdirectory of the
+// files directory.
+func storeFile(src io.ReadSeeker, filename string, price btcutil.Amount, access fileAccess, cached bool) (string, error) {
+	// Compute the chunk tree directly from the uploaded file
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("failed to size file: %w", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind file reader: %w", err)
+	}
+	fileHash, outboard, err := contentTree(src, size)
+	if err != nil {
+		return "", err
+	}
+	check := "upload"
+	if cached {
+		check = "cache"
+	}
+	if deniedContent(fileHash, check) {
+		return fileHash, errDenied
+	}
+
+	// Check if the file hash already exists in the database
+	existingFile, err := GetFileRecord(fileHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to check existing file: %w", err)
+	}
+	if existingFile != nil {
+		return fileHash, errFileExists
+	}
+
+	if err := ensureSpace(size, check); err != nil {
+		return "", err
+	}
+
+	// Rewind the file reader to save the file
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind file reader: %w", err)
+	}
+
+	// Create the 'files' directory if it doesn't exist
+	filePath := filepath.Join("files", filename)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Save the file to the 'files' directory
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file in directory: %w", err)
+	}
+	defer func() {
+		dst.Close()
+		// Ensure the file is deleted if an error occurs
+		if err != nil {
+			httpLog.Warnf("Encountered error, deleting file: %s", filePath)
+			os.Remove(filePath)
+			removeOutboard(fileHash)
+		}
+	}()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+	if err = writeOutboard(fileHash, outboard); err != nil {
+		return "", fmt.Errorf("failed to save chunk tree: %w", err)
+	}
+
+	// The denylist may have changed while the file was saved.
+	if deniedContent(fileHash, check) {
+		err = errDenied
+		return fileHash, err
+	}
+
+	// Store file metadata in the database, enforcing access before the
+	// record makes the file available.
+	trackAccess(fileHash, access)
+	if err = StoreFileRecord(fileHash, filename, price, size, access, cached); err != nil {
+		trackAccess(fileHash, publicAccess)
+		return "", fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	if access.Visibility != visibilityPublic {
+		return fileHash, nil
+	}
+
+	if err = dhtRoute.PutValue(ctx, fileKey(fileHash), []byte(formatCost(price))); err != nil {
+		return "", fmt.Errorf("failed to put record for key %v and value %v: %w", fileHash, formatCost(price), err)
+	}
+	if err = provideKey(ctx, dhtRoute, fileHash, true); err != nil {
+		return "", fmt.Errorf("failed to provide record for key %v: %w", fileHash, err)
+	}
+	return fileHash, nil
+}
+
+// deleteFile removes the file for hash from disk and the store and stops
+// providing it.
+func deleteFile(hash string) error {
+	// Retrieve the file record from the database
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve record: %w", err)
+	}
+	if record == nil {
+		return errFileNotFound
+	}
+
+	// Get the filename from the record
+	filename, ok := record["filename"].(string)
+	if !ok {
+		return fmt.Errorf("invalid record format - filename not found")
+	}
+
+	// Delete the file from the filesystem
+	filePath := filepath.Join("files", filename)
+	if err := os.Remove(filePath); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+		httpLog.Warnf("File not found on disk, skipping deletion: %s", filePath)
+	}
+	removeOutboard(hash)
+
+	// Delete the record from the database
+	if err := DeleteFileRecord(hash); err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	trackAccess(hash, publicAccess)
+	if unlisted, _ := record["unlisted"].(bool); unlisted {
+		return nil
+	}
+	return withdrawFile(hash)
+}
+
+// withdrawFile stops providing hash and withdraws its price from the DHT.
+func withdrawFile(hash string) error {
+	if err := dhtRoute.PutValue(ctx, fileKey(hash), []byte("null")); err != nil {
+		return fmt.Errorf("failed to put record for key %v and value null: %w", hash, err)
+	}
+	if err := provideKey(ctx, dhtRoute, hash, false); err != nil {
+		return fmt.Errorf("failed to stop providing record for key %v: %w", hash, err)
+	}
+	return nil
+}
+
+// findProviders looks up the peers providing hash together with the price
+// each of them asks.  Providers that withdrew the file, or ask a price that
+// isn't a valid amount, are left out.
+func findProviders(hash string) ([]api.Provider, error) {
+	c, err := providerCID(hash)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	providers, err := dhtRoute.FindProviders(ctx, c)
+	findProvidersSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error finding providers: %w", err)
+	}
+	httpLog.Debugf("Found %d providers for %s", len(providers), hash)
+
+	result := make([]api.Provider, 0, len(providers))
+	for _, provider := range providers {
+		value, err := dhtRoute.GetValue(ctx, peerFileKey(provider.ID.String(), hash))
+		if err != nil || string(value) == "null" {
+			continue
+		}
+		cost, err := parseCost(value)
+		if err != nil {
+			httpLog.Debugf("Ignoring provider %s of %s: %v", provider.ID, hash, err)
+			continue
+		}
+		result = append(result, api.Provider{
+			PeerID: provider.ID.String(),
+			Cost:   api.Amount(cost),
+			Self:   provider.ID == node.ID(),
+		})
+	}
+	return result, nil
+}
+
+// fetchFromPeer asks peerID for the file with the given hash and returns its
+// name and contents.  Files with a content ID are fetched chunk by chunk and
+// verified; legacy files are fetched whole and unchecked.
+func fetchFromPeer(peerID, hash string) (string, []byte, error) {
+	exist, err := requestFromPeer(peerID, "EXIST:"+hash, replyTimeout)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to query %s for %s: %w", peerID, hash, err)
+	}
+	if string(exist) == "false" {
+		return "", nil, errNotProvided
+	}
+
+	filename, err := requestFromPeer(peerID, "NAME:"+hash, replyTimeout)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to query %s for %s: %w", peerID, hash, err)
+	}
+	if string(filename) == "false" {
+		return "", nil, errNotProvided
+	}
+
+	var data []byte
+	if _, ok := parseContentID(hash); ok {
+		if data, err = fetchChunks([]string{peerID}, hash); err != nil {
+			return "", nil, err
+		}
+	} else {
+		downloads.Store(peerID, hash)
+		defer downloads.Delete(peerID)
+		if data, err = requestFromPeer(peerID, "REQUEST:"+hash, fileReplyTimeout); err != nil {
+			return "", nil, fmt.Errorf("failed to request %s from %s: %w", hash, peerID, err)
+		}
+	}
+	notifyEvent(api.EventDownloadProgress, api.DownloadProgressEvent{
+		PeerID: peerID,
+		Hash:   hash,
+		Bytes:  int64(len(data)),
+		Done:   true,
+	})
+	return string(filename), data, nil
+}
+
+// downloads maps the peer ID of a provider we are receiving a file from to
+// the hash of that file, so the stream handler can report progress.
+var downloads sync.Map
+
+// downloadProgressInterval is the minimum time between two progress events
+// for the same download.
+const downloadProgressInterval = 500 * time.Millisecond
+
+// progressReader counts the bytes read through it and notifies
+// EventDownloadProgress at most every downloadProgressInterval.
+type progressReader struct {
+	r      io.Reader
+	peerID string
+	hash   string
+	n      int64
+	last   time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); n > 0 && now.Sub(p.last) >= downloadProgressInterval {
+		p.last = now
+		notifyEvent(api.EventDownloadProgress, api.DownloadProgressEvent{
+			PeerID: p.peerID,
+			Hash:   p.hash,
+			Bytes:  p.n,
+		})
+	}
+	return n, err
+}
+
+// sendPayment asks the wallet server to pay amount to address and returns
+// the ID of the payment's transaction.
+func sendPayment(address string, amount btcutil.Amount) (string, error) {
+	if amount <= 0 {
+		return "", fmt.Errorf("%w: amount %s is not positive", errPaymentFailed, formatCost(amount))
+	}
+	paymentRequest, err := json.Marshal(struct {
+		Address string `json:"address"`
+		Amount  string `json:"amount"`
+	}{address, formatCost(amount)})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.Post(walletServerURL+"/wallet/send", "application/json", bytes.NewReader(paymentRequest))
+	if err != nil {
+		paymentsTotal.WithLabelValues("error").Inc()
+		return "", fmt.Errorf("error sending payment request to btcwallet server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		paymentsTotal.WithLabelValues("failed").Inc()
+		return "", fmt.Errorf("%w with status: %s", errPaymentFailed, resp.Status)
+	}
+
+	var reply struct {
+		TxID string `json:"txid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		xferLog.Warnf("Failed to decode wallet server reply: %v", err)
+	}
+
+	paymentsTotal.WithLabelValues("success").Inc()
+	xferLog.Infof("Payment successful to wallet: %s Amount: %s", address, formatCost(amount))
+	notifyEvent(api.EventPaymentSent, api.PaymentEvent{Address: address, Amount: api.Amount(amount), TxID: reply.TxID})
+	return reply.TxID, nil
+}
+
+// watchPayments polls the wallet server for incoming transactions every
+// interval and notifies EventPaymentReceived for new ones.  Transactions
+// present at the first successful poll are not reported.
+func watchPayments(interval time.Duration) {
+	var seen map[string]struct{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		received, err := listReceivedPayments()
+		if err != nil {
+			xferLog.Debugf("Failed to poll wallet for payments: %v", err)
+		} else {
+			first := seen == nil
+			if first {
+				seen = make(map[string]struct{})
+			}
+			for _, p := range received {
+				key := p.TxID + ":" + p.Address
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				if !first {
+					xferLog.Infof("Received payment of %v to %s (%s)", p.Amount, p.Address, p.TxID)
+					notifyEvent(api.EventPaymentReceived, p)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
+
+// listReceivedPayments returns the most recent incoming transactions of the
+// wallet.
+func listReceivedPayments() ([]api.PaymentEvent, error) {
+	resp, err := http.Get(walletServerURL + "/wallet/getTransactionHistory?count=100")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("wallet server returned %s", resp.Status)
+	}
+
+	var history struct {
+		Transactions []struct {
+			Category string     `json:"category"`
+			Address  string     `json:"address"`
+			Amount   api.Amount `json:"amount"`
+			TxID     string     `json:"txid"`
+		} `json:"transactions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return nil, err
+	}
+	var received []api.PaymentEvent
+	for _, tx := range history.Transactions {
+		if tx.Category == "receive" {
+			received = append(received, api.PaymentEvent{Address: tx.Address, Amount: tx.Amount, TxID: tx.TxID})
+		}
+	}
+	return received, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"golang.org/x/sync/singleflight"
+)
+
+// The gateway serves published content over plain HTTP at /content/<hash>,
+// for browsers and tools outside the app.  Files the node has are served
+// straight from the store, so the gateway keeps working offline.  Other
+// files are bought from the cheapest provider the node can reach, paid for
+// with the node's wallet once they check out against their hash and as long
+// as the gateway stays within its daily spend limit, and cached for the next
+// request.  The gateway is read-only
+// and needs no credentials, which is why spending is capped, and why it
+// never serves private files: it can't tell who is asking.
+const (
+	// gatewayPrefix is the path content is served under.
+	gatewayPrefix = "/content/"
+
+	// gatewaySpendWindow is the period the gateway spend limit applies to.
+	gatewaySpendWindow = 24 * time.Hour
+
+	// gatewayFetchTimeout bounds finding providers for a remote file.
+	gatewayFetchTimeout = time.Minute
+)
+
+var (
+	// errSpendLimit is returned when buying a file would take the gateway
+	// over its spend limit.
+	errSpendLimit = errors.New("gateway spend limit reached")
+
+	// gatewayFetches merges concurrent requests for the same remote file,
+	// so it is bought once.
+	gatewayFetches singleflight.Group
+)
+
+// gatewaySpend tracks what the gateway spent within gatewaySpendWindow.
+type gatewaySpend struct {
+	mtx      sync.Mutex
+	limit    btcutil.Amount
+	payments []gatewayPayment
+}
+
+type gatewayPayment struct {
+	time   time.Time
+	amount btcutil.Amount
+}
+
+// spent returns the amount spent within the window.  The caller must hold
+// mtx.
+func (s *gatewaySpend) spent(now time.Time) btcutil.Amount {
+	cutoff := now.Add(-gatewaySpendWindow)
+	i := sort.Search(len(s.payments), func(i int) bool { return s.payments[i].time.After(cutoff) })
+	s.payments = s.payments[i:]
+	var total btcutil.Amount
+	for _, p := range s.payments {
+		total += p.amount
+	}
+	return total
+}
+
+// reserve sets aside amount if the limit allows it.
+func (s *gatewaySpend) reserve(amount btcutil.Amount) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	if s.spent(now)+amount > s.limit {
+		return false
+	}
+	s.payments = append(s.payments, gatewayPayment{time: now, amount: amount})
+	return true
+}
+
+// release returns an amount set aside by reserve that wasn't paid.
+func (s *gatewaySpend) release(amount btcutil.Amount) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i := len(s.payments) - 1; i >= 0; i-- {
+		if s.payments[i].amount == amount {
+			s.payments = append(s.payments[:i], s.payments[i+1:]...)
+			return
+		}
+	}
+}
+
+// gateway serves content over HTTP.
+type gateway struct {
+	spend *gatewaySpend
+}
+
+// newGateway returns a gateway spending at most spendLimit per day.
+func newGateway(spendLimit btcutil.Amount) *gateway {
+	return &gateway{spend: &gatewaySpend{limit: spendLimit}}
+}
+
+// runGateway serves the gateway on listen until the node shuts down.
+func runGateway(listen string, spendLimit btcutil.Amount) {
+	g := newGateway(spendLimit)
+	mux := http.NewServeMux()
+	mux.Handle(gatewayPrefix, g)
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-globalCtx.Done()
+		srv.Close()
+	}()
+
+	httpLog.Infof("Starting content gateway on %s, spending up to %s a day", listen, formatCost(spendLimit))
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		httpLog.Errorf("Content gateway failed: %v", err)
+	}
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, gatewayPrefix)
+	if !validFileHash(hash) {
+		http.Error(w, "not a content hash", http.StatusBadRequest)
+		return
+	}
+	if deniedContent(hash, "gateway") {
+		gatewayRequestsTotal.WithLabelValues("denied", "error").Inc()
+		http.Error(w, "content unavailable for legal reasons", http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	source := "local"
+	err := g.serveLocal(w, r, hash)
+	if err == errFileNotFound {
+		source = "remote"
+		err = g.serveRemote(w, r, hash)
+	}
+	gatewayRequestsTotal.WithLabelValues(source, resultLabel(err)).Inc()
+	switch {
+	case err == nil:
+	case err == errNotProvided:
+		http.Error(w, "content not found", http.StatusNotFound)
+	case errors.Is(err, errSpendLimit):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	default:
+		httpLog.Warnf("Gateway request for %s: %v", hash, err)
+		http.Error(w, "content unavailable", http.StatusBadGateway)
+	}
+}
+
+// serveLocal serves hash from the store.  It returns errFileNotFound if the
+// node doesn't have it, and errNotProvided if it is private.
+func (g *gateway) serveLocal(w http.ResponseWriter, r *http.Request, hash string) error {
+	if isPrivate(hash) {
+		return errNotProvided
+	}
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return errFileNotFound
+	}
+	if recordAccess(record).Visibility == visibilityPrivate {
+		return errNotProvided
+	}
+	filename, ok := record["filename"].(string)
+	if !ok {
+		return fmt.Errorf("invalid record format - filename not found")
+	}
+	file, err := os.Open(filepath.Join("files", filename))
+	if os.IsNotExist(err) {
+		return errFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	touchFile(hash)
+	setContentHeaders(w, hash, filename)
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+	return nil
+}
+
+// remoteContent is a file bought by the gateway.
+type remoteContent struct {
+	filename string
+	data     []byte
+}
+
+// serveRemote buys hash from a provider and serves it.
+func (g *gateway) serveRemote(w http.ResponseWriter, r *http.Request, hash string) error {
+	v, err, _ := gatewayFetches.Do(hash, func() (interface{}, error) {
+		return g.fetch(hash)
+	})
+	if err != nil {
+		return err
+	}
+	content := v.(*remoteContent)
+	setContentHeaders(w, hash, content.filename)
+	http.ServeContent(w, r, content.filename, time.Time{}, bytes.NewReader(content.data))
+	return nil
+}
+
+// fetch buys hash from the cheapest provider that delivers it and caches it.
+func (g *gateway) fetch(hash string) (*remoteContent, error) {
+	if dhtRoute == nil {
+		return nil, errNotProvided
+	}
+	providers, err := findProvidersTimeout(hash, gatewayFetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	type offer struct {
+		peerID string
+		cost   btcutil.Amount
+	}
+	var offers []offer
+	for _, p := range providers {
+		if !p.Self {
+			offers = append(offers, offer{p.PeerID, btcutil.Amount(p.Cost)})
+		}
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].cost < offers[j].cost })
+
+	err = errNotProvided
+	for _, o := range offers {
+		if !g.spend.reserve(o.cost) {
+			return nil, fmt.Errorf("%w: %s costs %s", errSpendLimit, hash, formatCost(o.cost))
+		}
+		var content *remoteContent
+		content, err = g.buy(o.peerID, hash, o.cost)
+		if err != nil {
+			g.spend.release(o.cost)
+			xferLog.Debugf("Gateway could not buy %s from %s: %v", hash, o.peerID, err)
+			continue
+		}
+		gatewaySpentAtomsTotal.Add(float64(o.cost))
+		go cacheDownload(hash, content.filename, content.data, unlistedAccess)
+		return content, nil
+	}
+	return nil, err
+}
+
+// buy downloads hash from peerID and pays cost for it once the content
+// checks out against hash.
+func (g *gateway) buy(peerID, hash string, cost btcutil.Amount) (*remoteContent, error) {
+	var address string
+	if cost > 0 {
+		var err error
+		address, err = getWalletAddress(globalCtx, dhtRoute, peerID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up wallet of %s: %w", peerID, err)
+		}
+	}
+	filename, data, err := fetchVerified(peerID, hash)
+	if err != nil {
+		return nil, err
+	}
+	if cost > 0 {
+		txid, err := sendPayment(address, cost)
+		if err != nil {
+			return nil, err
+		}
+		go recordPurchase(peerID, hash, filename, address, cost, txid)
+	}
+	xferLog.Infof("Gateway bought %s from %s for %s", hash, peerID, formatCost(cost))
+	return &remoteContent{filename: filename, data: data}, nil
+}
+
+// findProvidersTimeout is findProviders bounded by timeout.
+func findProvidersTimeout(hash string, timeout time.Duration) ([]api.Provider, error) {
+	type result struct {
+		providers []api.Provider
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		providers, err := findProviders(hash)
+		done <- result{providers, err}
+	}()
+	ctx, cancel := context.WithTimeout(globalCtx, timeout)
+	defer cancel()
+	select {
+	case res := <-done:
+		return res.providers, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("finding providers of %s: %w", hash, ctx.Err())
+	}
+}
+
+// setContentHeaders sets the headers every gateway response carries.
+// Content IDs name immutable content, so they may be cached for good.
+func setContentHeaders(w http.ResponseWriter, hash, filename string) {
+	h := w.Header()
+	h.Set("ETag", strconv.Quote(hash))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filepath.Base(filename)))
+	if _, ok := parseContentID(hash); ok {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"lukechampine.com/blake3"
+)
+
+// TestGatewayPrivateFile checks that the gateway answers requests for a
+// private file as if it didn't have it, without looking for providers.
+func TestGatewayPrivateFile(t *testing.T) {
+	hash := rootCID(blake3.Sum256([]byte("private"))).String()
+	trackAccess(hash, fileAccess{Visibility: visibilityPrivate, Allow: []peer.ID{testPeerID(t)}})
+	t.Cleanup(func() { trackAccess(hash, publicAccess) })
+
+	g := newGateway(0)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, gatewayPrefix+hash, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s of a private file: got status %d, want %d", method, w.Code, http.StatusNotFound)
+		}
+	}
+}
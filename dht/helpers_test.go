@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+// testPeerKey returns a new random private key and its peer ID.
+func testPeerKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to derive peer ID: %v", err)
+	}
+	return priv, id
+}
+
+// testPeerID returns a new random peer ID.
+func testPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, id := testPeerKey(t)
+	return id
+}
+
+// sealTestRecord signs rec with key and returns the marshalled envelope.
+func sealTestRecord(t *testing.T, rec record.Record, key crypto.PrivKey) []byte {
+	t.Helper()
+	env, err := record.Seal(rec, key)
+	if err != nil {
+		t.Fatalf("failed to seal %T: %v", rec, err)
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal %T: %v", rec, err)
+	}
+	return data
+}
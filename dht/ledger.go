@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+// Paid purchases are recorded in the ledgers of both sides.  Once paid, the
+// buyer records the purchase and sends the provider a receipt it signed on
+// receiptProtocol.  The provider checks it, waits for its wallet to receive
+// the payment, records the sale and answers with its own signature of the
+// same receipt, which the buyer keeps with the purchase.  A transaction pays
+// for one sale only.  Either side can so prove the other agreed to the trade.
+const (
+	// receiptProtocol is the purchase receipt exchange protocol.
+	receiptProtocol = "/orcanet/receipt/1.0.0"
+
+	// receiptDomain is the signature domain of purchase receipts.
+	receiptDomain = "orcanet-purchase-receipt"
+
+	// receiptTimeout bounds a whole receipt exchange.
+	receiptTimeout = time.Minute
+)
+
+// receiptCodec is the payload type of purchase receipts.
+var receiptCodec = []byte("/orcanet/purchase-receipt")
+
+func init() {
+	record.RegisterType(&receiptRecord{})
+}
+
+// receiptRecord says that Buyer paid Provider Amount for Hash in the
+// transaction TxID.
+type receiptRecord struct {
+	Buyer    peer.ID        `json:"buyer"`
+	Provider peer.ID        `json:"provider"`
+	Hash     string         `json:"hash"`
+	Amount   btcutil.Amount `json:"amount"`
+	TxID     string         `json:"txid"`
+	Time     time.Time      `json:"time"`
+}
+
+func (r *receiptRecord) Domain() string { return receiptDomain }
+
+func (r *receiptRecord) Codec() []byte { return receiptCodec }
+
+func (r *receiptRecord) MarshalRecord() ([]byte, error) { return json.Marshal(r) }
+
+func (r *receiptRecord) UnmarshalRecord(data []byte) error { return json.Unmarshal(data, r) }
+
+// equal reports whether r and o describe the same purchase.
+func (r *receiptRecord) equal(o *receiptRecord) bool {
+	return r.Buyer == o.Buyer && r.Provider == o.Provider && r.Hash == o.Hash &&
+		r.Amount == o.Amount && r.TxID == o.TxID && r.Time.Equal(o.Time)
+}
+
+// errBadReceipt is returned for a receipt that doesn't describe a purchase
+// from this node or isn't signed by the expected peer.
+var errBadReceipt = errors.New("bad purchase receipt")
+
+// sealReceipt signs rec with the key of this node.
+func sealReceipt(rec *receiptRecord) ([]byte, error) {
+	key := node.Peerstore().PrivKey(node.ID())
+	if key == nil {
+		return nil, errors.New("no private key for the local peer")
+	}
+	env, err := record.Seal(rec, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign receipt: %w", err)
+	}
+	return env.Marshal()
+}
+
+// openReceipt verifies the signature of a sealed receipt and returns it with
+// its signer.
+func openReceipt(data []byte) (*receiptRecord, peer.ID, error) {
+	env, rec, err := record.ConsumeEnvelope(data, receiptDomain)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	receipt, ok := rec.(*receiptRecord)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: not a purchase receipt", errMalformedMessage)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errBadReceipt, err)
+	}
+	return receipt, signer, nil
+}
+
+// receiptID returns the ledger ID of the trade the buyer's sealed receipt
+// describes.
+func receiptID(buyerReceipt []byte) string {
+	sum := sha256.Sum256(buyerReceipt)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordPurchase records that amount was paid to address of providerID for
+// hash in the transaction txid, and sends the provider a receipt.
+func recordPurchase(providerID, hash, filename, address string, amount btcutil.Amount, txid string) {
+	provider, err := peer.Decode(providerID)
+	if err != nil {
+		xferLog.Errorf("Not recording purchase of %s from invalid peer %s: %v", hash, providerID, err)
+		return
+	}
+	rec := receiptRecord{
+		Buyer:    node.ID(),
+		Provider: provider,
+		Hash:     hash,
+		Amount:   amount,
+		TxID:     txid,
+		Time:     time.Now().UTC(),
+	}
+	receipt, err := sealReceipt(&rec)
+	if err != nil {
+		xferLog.Errorf("Failed to sign receipt for %s: %v", hash, err)
+		return
+	}
+	id := receiptID(receipt)
+	err = StoreLedgerRecord(&ledgerRecord{
+		ID:       id,
+		Kind:     api.LedgerPurchase,
+		Hash:     hash,
+		Filename: filename,
+		Peer:     providerID,
+		Address:  address,
+		Amount:   amount,
+		TxID:     txid,
+		Time:     rec.Time,
+		Receipt:  receipt,
+	})
+	if err != nil {
+		xferLog.Errorf("Failed to record purchase of %s: %v", hash, err)
+		return
+	}
+	ledgerEntriesTotal.WithLabelValues(api.LedgerPurchase).Inc()
+
+	go func() {
+		err := exchangeReceipt(node, &rec, id, receipt)
+		receiptsTotal.WithLabelValues("outbound", resultLabel(err)).Inc()
+		if err != nil {
+			xferLog.Warnf("Failed to exchange receipt for %s with %s: %v", hash, providerID, err)
+		}
+	}()
+}
+
+// exchangeReceipt sends the provider of rec the buyer's sealed receipt and
+// stores the provider's signature of it with the purchase id.
+func exchangeReceipt(node host.Host, rec *receiptRecord, id string, receipt []byte) error {
+	ctx, cancel := context.WithTimeout(globalCtx, receiptTimeout)
+	defer cancel()
+
+	p := rec.Provider
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, receiptProtocol), p, receiptProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to open receipt stream to %s: %w", p, err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetDeadline(deadline); err != nil {
+			xferLog.Debugf("Failed to set deadline on stream of %s: %v", p, err)
+		}
+	}
+
+	if _, err := s.Write(receipt); err != nil {
+		return fmt.Errorf("failed to send receipt to %s: %w", p, err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return fmt.Errorf("failed to send receipt to %s: %w", p, err)
+	}
+	data, err := readMessage(s, maxReceiptSize)
+	if errors.Is(err, errMessageTooLarge) {
+		misbehave(p, misbehaviorOversized, err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read receipt from %s: %w", p, err)
+	}
+
+	counter, signer, err := openReceipt(data)
+	if err == nil && (signer != p || !counter.equal(rec)) {
+		err = fmt.Errorf("%w: %s countersigned a different purchase", errBadReceipt, p)
+	}
+	if err != nil {
+		misbehave(p, misbehaviorMalformed, err.Error())
+		return err
+	}
+	return SetPeerReceipt(api.LedgerPurchase, id, data)
+}
+
+// handleReceipts records the sales buyers send receipts for and answers
+// with the provider's signature of them.
+func handleReceipts(node host.Host) {
+	node.SetStreamHandler(receiptProtocol, func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		if isBanned(remote) {
+			s.Reset()
+			return
+		}
+		if !allowMessage(receiptLimiters, remote) {
+			s.Reset()
+			return
+		}
+
+		if err := s.SetDeadline(time.Now().Add(receiptTimeout)); err != nil {
+			xferLog.Debugf("Failed to set deadline on stream of %s: %v", remote, err)
+		}
+		data, err := readMessage(s, maxReceiptSize)
+		switch {
+		case errors.Is(err, errMessageTooLarge):
+			misbehave(remote, misbehaviorOversized, err.Error())
+			return
+		case isTimeout(err):
+			misbehave(remote, misbehaviorTimeout, "receipt not closed in time")
+			return
+		case err != nil:
+			xferLog.Debugf("Error reading receipt of %s: %v", remote, err)
+			return
+		}
+
+		counter, err := recordSale(node, remote, data)
+		receiptsTotal.WithLabelValues("inbound", resultLabel(err)).Inc()
+		if err != nil {
+			if errors.Is(err, errMalformedMessage) || errors.Is(err, errBadReceipt) {
+				misbehave(remote, misbehaviorMalformed, err.Error())
+			} else {
+				xferLog.Warnf("Failed to record sale to %s: %v", remote, err)
+			}
+			return
+		}
+		if _, err := s.Write(counter); err != nil {
+			xferLog.Debugf("Failed to send receipt to %s: %v", remote, err)
+		}
+	})
+}
+
+// checkReceipt verifies that receipt is a purchase receipt signed by buyer
+// for a purchase from provider, and returns it.
+func checkReceipt(provider, buyer peer.ID, receipt []byte) (*receiptRecord, error) {
+	rec, signer, err := openReceipt(receipt)
+	if err != nil {
+		return nil, err
+	}
+	if signer != buyer || rec.Buyer != buyer || rec.Provider != provider {
+		return nil, fmt.Errorf("%w: not a purchase of %s from this node", errBadReceipt, buyer)
+	}
+	if err := validateHash(rec.Hash); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadReceipt, err)
+	}
+	if rec.Amount <= 0 || rec.Amount > btcutil.MaxSatoshi {
+		return nil, fmt.Errorf("%w: amount %d out of range", errBadReceipt, rec.Amount)
+	}
+	if rec.TxID == "" {
+		return nil, fmt.Errorf("%w: no transaction", errBadReceipt)
+	}
+	return rec, nil
+}
+
+// errNotPaid is returned for a receipt whose transaction the wallet hasn't
+// received.
+var errNotPaid = errors.New("payment not received")
+
+// checkPayment returns the address the wallet received the payment rec
+// describes on, given the received transactions.  A transaction paying
+// less than rec.Amount is a bad receipt; one not received yet is
+// errNotPaid.
+func checkPayment(rec *receiptRecord, received []api.PaymentEvent) (string, error) {
+	var (
+		total   btcutil.Amount
+		address string
+	)
+	for _, p := range received {
+		if p.TxID == rec.TxID {
+			total += btcutil.Amount(p.Amount)
+			address = p.Address
+		}
+	}
+	switch {
+	case address == "":
+		return "", fmt.Errorf("%w: transaction %s", errNotPaid, rec.TxID)
+	case total < rec.Amount:
+		return "", fmt.Errorf("%w: transaction %s paid %s of %s", errBadReceipt,
+			rec.TxID, formatCost(total), formatCost(rec.Amount))
+	}
+	return address, nil
+}
+
+const (
+	// paymentWaitTimeout bounds how long a provider waits for the wallet to
+	// see the payment of a receipt.
+	paymentWaitTimeout = 30 * time.Second
+
+	// paymentPollInterval is how often the wallet is asked for it meanwhile.
+	paymentPollInterval = 2 * time.Second
+)
+
+// awaitPayment waits until the wallet received the payment rec describes
+// and returns the address it was received on.
+func awaitPayment(rec *receiptRecord) (string, error) {
+	ctx, cancel := context.WithTimeout(globalCtx, paymentWaitTimeout)
+	defer cancel()
+	ticker := time.NewTicker(paymentPollInterval)
+	defer ticker.Stop()
+
+	for {
+		received, err := listReceivedPayments()
+		if err != nil {
+			return "", fmt.Errorf("failed to list received payments: %w", err)
+		}
+		address, err := checkPayment(rec, received)
+		if !errors.Is(err, errNotPaid) {
+			return address, err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// recordSale checks the sealed receipt buyer sent and that the wallet
+// received its payment, records the sale it describes unless already
+// recorded and returns this node's signature of the receipt.
+func recordSale(node host.Host, buyer peer.ID, receipt []byte) ([]byte, error) {
+	rec, err := checkReceipt(node.ID(), buyer, receipt)
+	if err != nil {
+		return nil, err
+	}
+	file, err := GetFileRecord(rec.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%w: %s", errNotProvided, rec.Hash)
+	}
+
+	id := receiptID(receipt)
+	existing, err := GetLedgerRecord(api.LedgerSale, id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing.Receipt, nil
+	}
+	paid, err := GetLedgerRecordByTxID(api.LedgerSale, rec.TxID)
+	if err != nil {
+		return nil, err
+	}
+	if paid != nil {
+		return nil, fmt.Errorf("%w: transaction %s already paid for sale %s", errBadReceipt, rec.TxID, paid.ID)
+	}
+	address, err := awaitPayment(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	counter, err := sealReceipt(rec)
+	if err != nil {
+		return nil, err
+	}
+	filename, _ := file["filename"].(string)
+	err = StoreLedgerRecord(&ledgerRecord{
+		ID:          id,
+		Kind:        api.LedgerSale,
+		Hash:        rec.Hash,
+		Filename:    filename,
+		Peer:        buyer.String(),
+		Address:     address,
+		Amount:      rec.Amount,
+		TxID:        rec.TxID,
+		Time:        rec.Time,
+		Receipt:     counter,
+		PeerReceipt: receipt,
+	})
+	if errors.Is(err, errTxIDRecorded) {
+		// Another request recorded the transaction while the payment was
+		// awaited: the same receipt sent twice, or another one paid with it.
+		if existing, _ := GetLedgerRecord(api.LedgerSale, id); existing != nil {
+			return existing.Receipt, nil
+		}
+		return nil, fmt.Errorf("%w: transaction %s already paid for another sale", errBadReceipt, rec.TxID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ledgerEntriesTotal.WithLabelValues(api.LedgerSale).Inc()
+	accrueRoyalty(file, rec.Amount)
+	xferLog.Infof("Sold %s to %s for %s", rec.Hash, buyer, formatCost(rec.Amount))
+	return counter, nil
+}
+
+// ledgerEntryFromRecord converts a ledger record to its API form.
+func ledgerEntryFromRecord(rec *ledgerRecord) api.LedgerEntry {
+	return api.LedgerEntry{
+		ID:          rec.ID,
+		Kind:        rec.Kind,
+		Hash:        rec.Hash,
+		Filename:    rec.Filename,
+		Peer:        rec.Peer,
+		Address:     rec.Address,
+		Amount:      api.Amount(rec.Amount),
+		TxID:        rec.TxID,
+		Time:        rec.Time.UTC(),
+		Receipt:     rec.Receipt,
+		PeerReceipt: rec.PeerReceipt,
+	}
+}
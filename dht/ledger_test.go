@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"lukechampine.com/blake3"
+)
+
+// TestReceiptRoundTrip checks that a receipt signed by the buyer is accepted
+// by the provider, and that the provider's countersignature is recognized by
+// the buyer.
+func TestReceiptRoundTrip(t *testing.T) {
+	buyerKey, buyer := testPeerKey(t)
+	providerKey, provider := testPeerKey(t)
+	rec := receiptRecord{
+		Buyer:    buyer,
+		Provider: provider,
+		Hash:     rootCID(blake3.Sum256([]byte("orcanet"))).String(),
+		Amount:   150_000,
+		TxID:     "tx1",
+		Time:     time.Now().UTC(),
+	}
+
+	receipt := sealTestRecord(t, &rec, buyerKey)
+	got, err := checkReceipt(provider, buyer, receipt)
+	if err != nil {
+		t.Fatalf("checkReceipt: %v", err)
+	}
+	if !got.equal(&rec) {
+		t.Fatalf("checkReceipt returned %+v, want %+v", got, rec)
+	}
+
+	counter := sealTestRecord(t, got, providerKey)
+	back, signer, err := openReceipt(counter)
+	if err != nil {
+		t.Fatalf("openReceipt: %v", err)
+	}
+	if signer != provider || !back.equal(&rec) {
+		t.Fatalf("countersigned receipt is %+v by %s, want %+v by %s", back, signer, rec, provider)
+	}
+	if receiptID(receipt) == receiptID(counter) {
+		t.Error("receipt and countersignature have the same ID")
+	}
+}
+
+// TestForgedReceipt checks that receipts not signed by the buyer, not for
+// this provider or with invalid contents are rejected.
+func TestForgedReceipt(t *testing.T) {
+	buyerKey, buyer := testPeerKey(t)
+	otherKey, other := testPeerKey(t)
+	_, provider := testPeerKey(t)
+	valid := receiptRecord{
+		Buyer:    buyer,
+		Provider: provider,
+		Hash:     rootCID(blake3.Sum256([]byte("orcanet"))).String(),
+		Amount:   150_000,
+		TxID:     "tx1",
+		Time:     time.Now().UTC(),
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*receiptRecord)
+		key    crypto.PrivKey
+	}{
+		{"signed by another peer", nil, otherKey},
+		{"other buyer", func(r *receiptRecord) { r.Buyer = other }, buyerKey},
+		{"other provider", func(r *receiptRecord) { r.Provider = other }, buyerKey},
+		{"bad hash", func(r *receiptRecord) { r.Hash = "not-a-hash" }, buyerKey},
+		{"zero amount", func(r *receiptRecord) { r.Amount = 0 }, buyerKey},
+		{"negative amount", func(r *receiptRecord) { r.Amount = -1 }, buyerKey},
+		{"too large amount", func(r *receiptRecord) { r.Amount = btcutil.MaxSatoshi + 1 }, buyerKey},
+		{"no transaction", func(r *receiptRecord) { r.TxID = "" }, buyerKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := valid
+			if tt.modify != nil {
+				tt.modify(&rec)
+			}
+			receipt := sealTestRecord(t, &rec, tt.key)
+			if _, err := checkReceipt(provider, buyer, receipt); !errors.Is(err, errBadReceipt) {
+				t.Errorf("checkReceipt returned %v, want %v", err, errBadReceipt)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		receipt := sealTestRecord(t, &valid, buyerKey)
+		receipt[len(receipt)-1] ^= 1
+		if _, err := checkReceipt(provider, buyer, receipt); !errors.Is(err, errMalformedMessage) {
+			t.Errorf("checkReceipt returned %v, want %v", err, errMalformedMessage)
+		}
+	})
+}
+
+// TestCheckPayment checks that a receipt is only taken for paid once the
+// wallet received its transaction for at least its amount.
+func TestCheckPayment(t *testing.T) {
+	rec := &receiptRecord{Amount: 150_000, TxID: "tx1"}
+	tests := []struct {
+		name     string
+		received []api.PaymentEvent
+		address  string
+		err      error
+	}{
+		{"unpaid", nil, "", errNotPaid},
+		{"other transaction", []api.PaymentEvent{{Address: "a1", Amount: 150_000, TxID: "tx2"}}, "", errNotPaid},
+		{"paid", []api.PaymentEvent{{Address: "a1", Amount: 150_000, TxID: "tx1"}}, "a1", nil},
+		{"overpaid", []api.PaymentEvent{{Address: "a1", Amount: 200_000, TxID: "tx1"}}, "a1", nil},
+		{"underpaid", []api.PaymentEvent{{Address: "a1", Amount: 149_999, TxID: "tx1"}}, "", errBadReceipt},
+		{"split outputs", []api.PaymentEvent{
+			{Address: "a1", Amount: 100_000, TxID: "tx1"},
+			{Address: "a1", Amount: 50_000, TxID: "tx1"},
+		}, "a1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, err := checkPayment(rec, tt.received)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("checkPayment returned %v, want %v", err, tt.err)
+			}
+			if address != tt.address {
+				t.Errorf("checkPayment returned address %q, want %q", address, tt.address)
+			}
+		})
+	}
+}
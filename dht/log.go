@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btclog"
+)
+
+// Loggers per subsystem.  A single backend logger is created and all subsystem
+// loggers created from it will write to the backend.  When adding new
+// subsystems, add the subsystem logger variable here and to the
+// subsystemLoggers map.
+var (
+	// backendLog is the logging backend used to create all subsystem loggers.
+	backendLog = btclog.NewBackend(os.Stdout)
+
+	nodeLog = backendLog.Logger("NODE")
+	httpLog = backendLog.Logger("HTTP")
+	xferLog = backendLog.Logger("XFER")
+	peerLog = backendLog.Logger("PEER")
+	prxyLog = backendLog.Logger("PRXY")
+	storLog = backendLog.Logger("STOR")
+)
+
+// subsystemLoggers maps each subsystem identifier to its associated logger.
+var subsystemLoggers = map[string]btclog.Logger{
+	"NODE": nodeLog,
+	"HTTP": httpLog,
+	"XFER": xferLog,
+	"PEER": peerLog,
+	"PRXY": prxyLog,
+	"STOR": storLog,
+}
+
+// setLogLevel sets the logging level for provided subsystem.  Invalid
+// subsystems are ignored.
+func setLogLevel(subsystemID string, logLevel string) {
+	// Ignore invalid subsystems.
+	logger, ok := subsystemLoggers[subsystemID]
+	if !ok {
+		return
+	}
+
+	// Defaults to info if the log level is invalid.
+	level, _ := btclog.LevelFromString(logLevel)
+	logger.SetLevel(level)
+}
+
+// setLogLevels sets the log level for all subsystem loggers to the passed
+// level.
+func setLogLevels(logLevel string) {
+	for subsystemID := range subsystemLoggers {
+		setLogLevel(subsystemID, logLevel)
+	}
+}
+
+// supportedSubsystems returns a sorted slice of the supported subsystems for
+// logging purposes.
+func supportedSubsystems() []string {
+	subsystems := make([]string, 0, len(subsystemLoggers))
+	for subsysID := range subsystemLoggers {
+		subsystems = append(subsystems, subsysID)
+	}
+	sort.Strings(subsystems)
+	return subsystems
+}
+
+// validLogLevel returns whether or not logLevel is a valid debug log level.
+func validLogLevel(logLevel string) bool {
+	_, ok := btclog.LevelFromString(logLevel)
+	return ok
+}
+
+// parseAndSetDebugLevels attempts to parse the specified debug level and set
+// the levels accordingly.  The level is either a single level applied to every
+// subsystem or a comma separated list of subsystem=level pairs.  An
+// appropriate error is returned if anything is invalid.
+func parseAndSetDebugLevels(debugLevel string) error {
+	// When the specified string doesn't have any delimiters, treat it as
+	// the log level for all subsystems.
+	if !strings.Contains(debugLevel, ",") && !strings.Contains(debugLevel, "=") {
+		if !validLogLevel(debugLevel) {
+			return fmt.Errorf("the specified debug level [%v] is invalid", debugLevel)
+		}
+		setLogLevels(debugLevel)
+		return nil
+	}
+
+	// Validate every pair before changing anything so a bad request leaves
+	// the current levels untouched.
+	levels := make(map[string]string)
+	for _, logLevelPair := range strings.Split(debugLevel, ",") {
+		fields := strings.Split(logLevelPair, "=")
+		if len(fields) != 2 {
+			return fmt.Errorf("the specified debug level contains an "+
+				"invalid subsystem/level pair [%v]", logLevelPair)
+		}
+		subsysID, logLevel := fields[0], fields[1]
+		if _, exists := subsystemLoggers[subsysID]; !exists {
+			return fmt.Errorf("the specified subsystem [%v] is invalid -- "+
+				"supported subsystems %v", subsysID, supportedSubsystems())
+		}
+		if !validLogLevel(logLevel) {
+			return fmt.Errorf("the specified debug level [%v] is invalid", logLevel)
+		}
+		levels[subsysID] = logLevel
+	}
+	for subsysID, logLevel := range levels {
+		setLogLevel(subsysID, logLevel)
+	}
+	return nil
+}
+
+// handleDebugLevel reports the current level of every subsystem on GET and
+// changes levels at runtime on POST.  The POST body is {"level": "<spec>"},
+// where spec uses the same syntax as the -debuglevel flag.
+func handleDebugLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := parseAndSetDebugLevels(request.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpLog.Infof("Debug level changed to %q", request.Level)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	levels := make(map[string]string, len(subsystemLoggers))
+	for subsysID, logger := range subsystemLoggers {
+		levels[subsysID] = logger.Level().String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(levels)
+}
@@ -1,26 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/ipfs/go-cid"
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/multiformats/go-multihash"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 var (
@@ -31,43 +29,105 @@ var (
 )
 
 func main() {
+	var err error
+	cfg, err = loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initBandwidth(cfg)
+
 	// Find local IPv4 address and location
-	ip := getLocalIPv4Address()
+	ip, err := getLocalIPv4Address()
+	if err != nil {
+		nodeLog.Warnf("Failed to list network interfaces: %v", err)
+	}
 	if ip != "" {
-		fmt.Println("Local IPv4 Address: ", ip)
+		nodeLog.Infof("Local IPv4 address: %s", ip)
 	} else {
-		fmt.Println("No local IPv4 address found")
+		nodeLog.Warn("No local IPv4 address found")
 	}
 	location := ""
 	geoInfo, geoErr := getGeolocation()
 	if geoErr != nil {
-		fmt.Printf("Failed to get location: %v\n", geoErr)
+		nodeLog.Warnf("Failed to get location: %v", geoErr)
 	} else {
 		location = geoInfo.Region + ", " + geoInfo.Country
 	}
-	fmt.Println("Location: ", location)
-	err := InitializeDatabase("mongodb://localhost:27017")
+	nodeLog.Infof("Location: %s", location)
+	ntfnMgr.Start()
+	defer ntfnMgr.Shutdown()
+
+	err = InitializeDatabase("mongodb://localhost:27017")
 	if err != nil {
-		fmt.Printf("Failed to initialize MongoDB: %v\n", err)
+		storLog.Criticalf("Failed to initialize MongoDB: %v", err)
+		return
+	}
+	if err := MigrateAmounts(); err != nil {
+		storLog.Criticalf("Failed to convert stored amounts: %v", err)
+		return
+	}
+	if err := EnsureLedgerIndexes(); err != nil {
+		storLog.Criticalf("Failed to index the ledger: %v", err)
+		return
+	}
+	if err := loadAccess(); err != nil {
+		storLog.Criticalf("Failed to load file access: %v", err)
 		return
 	}
 	defer func() {
 		if err := DisconnectDatabase(); err != nil {
-			fmt.Printf("Failed to disconnect MongoDB: %v\n", err)
+			storLog.Errorf("Failed to disconnect MongoDB: %v", err)
 		}
 	}()
+	blocked, err = loadBlocklist(cfg.Blocklist)
+	if err != nil {
+		peerLog.Criticalf("Failed to load blocklist: %v", err)
+		return
+	}
 	node, dhtRoute, err = createNode()
 	if err != nil {
-		log.Fatalf("Failed to create node: %s", err)
+		nodeLog.Criticalf("Failed to create node: %s", err)
+		return
 	}
 	var cancel context.CancelFunc
 	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 	globalCtx = ctx
-	fmt.Println("Node multiaddresses:", node.Addrs())
-	fmt.Println("Node Peer ID:", node.ID())
+	nodeLog.Infof("Node multiaddresses: %v", node.Addrs())
+	nodeLog.Infof("Node Peer ID: %s", node.ID())
+	for _, addr := range node.Network().ListenAddresses() {
+		nodeLog.Infof("Listening on %s", addr)
+	}
+	peers, err = loadPeerBook(cfg.PeerBook)
+	if err != nil {
+		peerLog.Warnf("Starting with an empty peer book: %v", err)
+		peers = newPeerBook(cfg.PeerBook)
+	}
+	defer func() {
+		if err := peers.save(); err != nil {
+			peerLog.Errorf("Failed to save peer book: %v", err)
+		}
+	}()
+	denied, err = loadDenylist(cfg.Denylist, cfg.DenylistSubs)
+	if err != nil {
+		storLog.Criticalf("Failed to load denylist: %v", err)
+		return
+	}
+	if len(cfg.DenylistSubs) > 0 {
+		go watchDenylists(denied, denylistRefreshInterval)
+	}
+	handlePex(node)
+	handleReceipts(node)
+	handleMeta(node)
+	go runPeerExchange(node)
+	go trackReachability(node)
 	connectToPeer(node, relay_node_addr) // connect to relay node
-	makeReservation(node)                // make reservation on relay node
+	// make reservation on relay node
+	if err := makeReservation(node); err != nil {
+		nodeLog.Criticalf("%v", err)
+		return
+	}
 	go refreshReservation(node, 10*time.Minute)
 
 	connectToPeer(node, native_bootstrap)
@@ -76,12 +136,23 @@ func main() {
 
 	go handlePeerExchange(node)
 	go receiveDataFromPeer(node)
+	go republishNames(nameRepublishInterval)
+	if cfg.PaymentPoll > 0 {
+		go watchPayments(cfg.PaymentPoll)
+	}
+	if cfg.StorageQuota > 0 {
+		go watchStorage(storageGCInterval)
+	}
+	go payRoyalties(royaltyPayoutInterval)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/getproviders", getProviders)
 	mux.HandleFunc("/upload", handleFileUpload)
 	mux.HandleFunc("/files", handleFetchFiles)
 	mux.HandleFunc("/delete", handleDeleteFile)
 	mux.HandleFunc("/purchase", handlePurchase)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/debuglevel", handleDebugLevel)
+	registerAPIv1(mux, ip, location)
 	// New handler for returning Peer ID
 	type ProxyRequest struct {
 		Action     string `json:"action"`
@@ -100,14 +171,19 @@ func main() {
 		// Call registerProxyAsService based on the action (register or deregister)
 		if req.Action == "deregister" {
 			// Deregister the proxy by passing an empty string for the IP
-			registerProxyAsService(ctx, dhtRoute, "", "", "", "", "", node)
+			err = registerProxyAsService(ctx, dhtRoute, "", "", "", "", "", node)
 		} else if req.Action == "register" {
 			// Register the proxy by passing the IP address
-			registerProxyAsService(ctx, dhtRoute, location, ip, req.Name, req.InitialFee, req.Price, node)
+			err = registerProxyAsService(ctx, dhtRoute, location, ip, req.Name, req.InitialFee, req.Price, node)
 		} else {
 			http.Error(w, "Invalid action", http.StatusBadRequest)
 			return
 		}
+		if err != nil {
+			prxyLog.Errorf("Failed to %s proxy: %v", req.Action, err)
+			http.Error(w, "Failed to update proxy registration", http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -151,7 +227,11 @@ func main() {
 		}
 
 		// Call mapPeerIDtoWallet function
-		mapPeerIDtoWallet(ctx, dhtRoute, requestBody.WalletAddress, node)
+		if err := mapPeerIDtoWallet(ctx, dhtRoute, requestBody.WalletAddress, node); err != nil {
+			nodeLog.Errorf("Failed to map wallet address: %v", err)
+			http.Error(w, "Failed to map wallet address", http.StatusInternalServerError)
+			return
+		}
 
 		// Respond with success
 		w.Header().Set("Content-Type", "application/json")
@@ -201,7 +281,7 @@ func main() {
 		for peerID := range connectedPeers {
 			proxyInfo, err := getProxyInfo(ctx, dhtRoute, peerID)
 			if err != nil {
-				// fmt.Printf("Failed to get proxy info for peer %s: %v\n", peerID, err)
+				prxyLog.Tracef("Failed to get proxy info for peer %s: %v", peerID, err)
 				continue
 			}
 			if proxyInfo != nil {
@@ -209,7 +289,7 @@ func main() {
 			}
 		}
 		for _, proxyInfo := range proxyInfoList {
-			fmt.Printf("PeerID: %s\n IP: %s\n Port: %d\n", proxyInfo.PeerID, proxyInfo.IPAddress, proxyInfo.Port)
+			prxyLog.Debugf("Proxy %s at %s:%d", proxyInfo.PeerID, proxyInfo.IPAddress, proxyInfo.Port)
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -220,9 +300,23 @@ func main() {
 		}
 	})
 	provideAllUpload()
-	fmt.Println("Starting server at port 8080")
-	if err := http.ListenAndServe("0.0.0.0:8080", enableCORS(logRequests(mux))); err != nil {
-		fmt.Println("Error starting server: ", err)
+
+	auth, err := newAPIAuth(cfg.AuthCookie, cfg.APITokens)
+	if err != nil {
+		httpLog.Criticalf("%v", err)
+		return
+	}
+	defer auth.removeCookie()
+	httpLog.Infof("HTTP API credentials written to %s", cfg.AuthCookie)
+
+	if cfg.GatewayListen != "" {
+		go runGateway(cfg.GatewayListen, cfg.GatewaySpendLimit)
+	}
+
+	httpLog.Infof("Starting server on %s", cfg.HTTPListen)
+	handler := enableCORS(cfg.AllowedOrigins, logRequests(auth.middleware(mux)))
+	if err := http.ListenAndServe(cfg.HTTPListen, handler); err != nil {
+		httpLog.Criticalf("Error starting server: %v", err)
 	}
 	defer node.Close()
 	select {}
@@ -230,16 +324,26 @@ func main() {
 
 func logRequests(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request: Method=%s, URL=%s, RemoteAddr=%s", r.Method, r.URL.String(), r.RemoteAddr)
+		httpLog.Debugf("Received request: Method=%s, URL=%s, RemoteAddr=%s", r.Method, r.URL.String(), r.RemoteAddr)
 		next.ServeHTTP(w, r)
 	})
 }
 
-// CORS middleware
-func enableCORS(next http.Handler) http.Handler {
+// CORS middleware.  Requests carrying an Origin outside allowedOrigins are
+// refused outright, so a page on another site can't trigger side effects even
+// with requests the browser would send without a preflight.
+func enableCORS(allowedOrigins []string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow all origins
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !slices.Contains(allowedOrigins, origin) {
+				httpLog.Warnf("Rejected request to %s from origin %s", r.URL.Path, origin)
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
@@ -284,17 +388,24 @@ func getGeolocation() (*GeolocationResponse, error) {
 func provideAllUpload() {
 	records, err := FetchAllFileRecords()
 	if err != nil {
-		log.Printf("Failed to fetch all file records")
+		storLog.Errorf("Failed to fetch all file records: %v", err)
 		return
 	}
 	for _, record := range records {
-		err = dhtRoute.PutValue(ctx, "/orcanet/files/"+node.ID().String()+"/"+record["hash"].(string), []byte(strconv.FormatFloat(record["cost"].(float64), 'f', -1, 64)))
+		if unlisted, _ := record["unlisted"].(bool); unlisted {
+			continue
+		}
+		if deniedContent(record["hash"].(string), "provide") {
+			continue
+		}
+		cost := recordAmount(record, "cost")
+		err = dhtRoute.PutValue(ctx, fileKey(record["hash"].(string)), []byte(formatCost(cost)))
 		if err != nil {
-			log.Printf("Failed to put %v: %v, err: %v", "/orcanet/files/"+node.ID().String()+"/"+record["hash"].(string), record["cost"].(float64), err)
+			nodeLog.Errorf("Failed to put %v: %v, err: %v", fileKey(record["hash"].(string)), formatCost(cost), err)
 		}
 		err = provideKey(ctx, dhtRoute, record["hash"].(string), true)
 		if err != nil {
-			log.Printf("Failed to provide record for key: %v, err: %v", record["hash"], err)
+			nodeLog.Errorf("Failed to provide record for key: %v, err: %v", record["hash"], err)
 		}
 	}
 }
@@ -306,10 +417,10 @@ func handlePurchase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var request struct {
-		Id      string `json:"id"`
-		Hash    string `json:"hash"`
-		Cost    int    `json:"cost"`
-		Address string `json:"address"`
+		Id      string     `json:"id"`
+		Hash    string     `json:"hash"`
+		Cost    api.Amount `json:"cost"`
+		Address string     `json:"address"`
 	}
 	err = json.Unmarshal(body, &request)
 	if err != nil {
@@ -317,50 +428,44 @@ func handlePurchase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	request.Hash = strings.TrimSpace(request.Hash)
-	sendDataToPeer(node, request.Id, "EXIST:"+request.Hash)
-	exist := <-dataChannel
-
-	if string(exist) == "false" {
+	if deniedContent(request.Hash, "purchase") {
+		http.Error(w, errDenied.Error(), http.StatusUnavailableForLegalReasons)
+		return
+	}
+	if p, _ := peer.Decode(request.Id); isBanned(p) {
+		http.Error(w, fmt.Sprintf("Peer %s is banned", request.Id), http.StatusForbidden)
+		return
+	}
+	filename, data, err := fetchFromPeer(request.Id, request.Hash)
+	if err == errNotProvided {
 		http.Error(w, "File is no longer provided", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		xferLog.Errorf("%v", err)
+		http.Error(w, "Failed to reach provider", http.StatusBadGateway)
+		return
+	}
 
-	sendDataToPeer(node, request.Id, "NAME:"+request.Hash)
-
-	// Retrieve filename from dataChannel
-	filename := <-dataChannel
-
-	sendDataToPeer(node, request.Id, "REQUEST:"+request.Hash)
-	data := <-dataChannel
+	// Pay before answering so the status reflects the payment outcome.
+	if request.Cost > 0 {
+		txid, err := sendPayment(request.Address, btcutil.Amount(request.Cost))
+		if err != nil {
+			xferLog.Errorf("Payment to %s failed: %v", request.Address, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		go recordPurchase(request.Id, request.Hash, filename, request.Address, btcutil.Amount(request.Cost), txid)
+	}
+	go keepPurchase(&api.PurchaseRequest{PeerID: request.Id, Hash: request.Hash, Cost: request.Cost}, filename, data)
 
 	// Set headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
 	w.Header().Set("Content-Type", "application/octet-stream")                                // Indicate raw binary data
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename)) // Send filename
 	if _, err := w.Write(data); err != nil {
-		http.Error(w, "Error writing raw data to response", http.StatusInternalServerError)
-	}
-	// SEND MONEY
-	recipientAddress := request.Address
-	cost := request.Cost
-
-	walletServerURL := "http://localhost:18080/wallet/send"
-	paymentRequest := fmt.Sprintf(`{"address": "%s", "amount": "%d"}`, recipientAddress, cost)
-
-	resp, err := http.Post(walletServerURL, "application/json", bytes.NewBuffer([]byte(paymentRequest)))
-	if err != nil {
-		http.Error(w, "Error sending payment request to btcwallet server", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("Payment failed with status: %s", resp.Status), http.StatusInternalServerError)
-		return
+		httpLog.Warnf("Failed to write purchased file to client: %v", err)
 	}
-
-	log.Println("Payment successful to wallet:", recipientAddress, "Amount:", cost)
 }
 
 func getProviders(w http.ResponseWriter, r *http.Request) {
@@ -378,36 +483,25 @@ func getProviders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	request.Hash = strings.TrimSpace(request.Hash)
-	fmt.Println("hash: ", request.Hash)
-	data := []byte(request.Hash)
-	hash := sha256.Sum256(data)
-	mh, err := multihash.EncodeName(hash[:], "sha2-256")
-	if err != nil {
-		http.Error(w, "Error creating multihash", http.StatusInternalServerError)
-		return
-	}
-	c := cid.NewCidV1(cid.Raw, mh)
-	providers, err := dhtRoute.FindProviders(ctx, c)
+	httpLog.Debugf("Finding providers for %s", request.Hash)
+	providers, err := findProviders(request.Hash)
 	if err != nil {
+		httpLog.Errorf("%v", err)
 		http.Error(w, "Error finding providers", http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("Providers sync: ", providers)
 	var resp []map[string]string
 	for _, provider := range providers {
-		cost, err := dhtRoute.GetValue(ctx, "/orcanet/files/"+provider.ID.String()+"/"+request.Hash)
-		if err == nil && string(cost) != "null" {
-			var temp = make(map[string]string)
-			if provider.ID == node.ID() {
-				temp["id"] = "Me"
-			} else {
-				temp["id"] = provider.ID.String()
-			}
-			temp["cost"] = string(cost)
-			resp = append(resp, temp)
+		var temp = make(map[string]string)
+		if provider.Self {
+			temp["id"] = "Me"
+		} else {
+			temp["id"] = provider.PeerID
 		}
+		temp["cost"] = formatCost(btcutil.Amount(provider.Cost))
+		resp = append(resp, temp)
 	}
-	fmt.Printf("resp: %v", resp)
+	httpLog.Tracef("Providers response: %v", resp)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -415,11 +509,11 @@ func getProviders(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getLocalIPv4Address() string {
+func getLocalIPv4Address() (string, error) {
 	// Get all interfaces on the local machine
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	for _, iface := range interfaces {
@@ -431,137 +525,81 @@ func getLocalIPv4Address() string {
 		// Get the addresses associated with this interface
 		addrs, err := iface.Addrs()
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 
 		// Look for an IPv4 address
 		for _, addr := range addrs {
 			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
+				return ipnet.IP.String(), nil
 			}
 		}
 	}
-	return ""
+	return "", nil
 }
 
 func handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	result := "error"
+	defer func() {
+		uploadsTotal.WithLabelValues(result).Inc()
+	}()
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		log.Printf("Invalid request method: %s", r.Method)
+		httpLog.Warnf("Invalid request method: %s", r.Method)
 		return
 	}
 
 	err := r.ParseMultipartForm(10 << 20) // 10 MB limit
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to parse form: %v", err), http.StatusBadRequest)
-		log.Printf("Failed to parse form: %v", err)
+		httpLog.Warnf("Failed to parse form: %v", err)
 		return
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to retrieve file: %v", err), http.StatusBadRequest)
-		log.Printf("Failed to retrieve file: %v", err)
+		httpLog.Warnf("Failed to retrieve file: %v", err)
 		return
 	}
 	defer file.Close()
 
-	// Compute hash directly from the uploaded file
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to hash file: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to hash file: %v", err)
-		return
-	}
-	fileHash := hex.EncodeToString(hasher.Sum(nil))
-
-	// Check if the file hash already exists in the database
-	existingFile, err := GetFileRecord(fileHash)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to check existing file: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to check existing file: %v", err)
-		return
-	}
-
-	if existingFile != nil {
-		http.Error(w, fmt.Sprintf("File exists: %v", header.Filename), http.StatusBadRequest)
-		log.Printf("Duplicate file rejected: %v", fileHash)
-		return
-	}
-
-	// Rewind the file reader to save the file
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to rewind file reader: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to rewind file reader: %v", err)
-		return
-	}
-
-	// Create the 'files' directory if it doesn't exist
-	err = os.MkdirAll("files", os.ModePerm)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create directory: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to create directory: %v", err)
-		return
-	}
-
-	// Save the file to the 'files' directory
-	filePath := filepath.Join("files", header.Filename)
-	dst, err := os.Create(filePath)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create file in directory: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to create file in directory: %v", err)
-		return
-	}
-	defer func() {
-		dst.Close()
-		// Ensure the file is deleted if an error occurs
-		if err != nil {
-			log.Printf("Encountered error, deleting file: %s", filePath)
-			os.Remove(filePath)
-		}
-	}()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to save file: %v", err)
-		return
-	}
-
 	price := r.FormValue("price")
 	if price == "" {
 		http.Error(w, "Missing price", http.StatusBadRequest)
-		log.Printf("Missing price")
+		httpLog.Warn("Missing price")
 		return
 	}
-	priceFloat, err := strconv.ParseFloat(price, 64)
+	amount, err := api.ParseAmount(price)
 	if err != nil {
 		http.Error(w, "Invalid price value", http.StatusBadRequest)
-		log.Printf("Invalid price value: %v", price)
+		httpLog.Warnf("Invalid price value: %v", price)
 		return
 	}
 
-	// Store file metadata in the database
-	err = StoreFileRecord(fileHash, header.Filename, priceFloat)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to store file metadata: %v", err), http.StatusInternalServerError)
-		log.Printf("Failed to store file metadata: %v", err)
+	fileHash, err := uploadFile(file, header.Filename, amount, publicAccess)
+	if err == errFileExists {
+		http.Error(w, fmt.Sprintf("File exists: %v", header.Filename), http.StatusBadRequest)
+		httpLog.Warnf("Duplicate file rejected: %v", fileHash)
 		return
 	}
-
-	err = dhtRoute.PutValue(ctx, "/orcanet/files/"+node.ID().String()+"/"+fileHash, []byte(strconv.FormatFloat(priceFloat, 'f', -1, 64)))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to put record for key %v and value %v", fileHash, priceFloat), http.StatusInternalServerError)
-		log.Printf("Failed to put record for key %v and value %v: %v\n", fileHash, priceFloat, err)
+	if errors.Is(err, errDenied) {
+		http.Error(w, errDenied.Error(), http.StatusUnavailableForLegalReasons)
+		httpLog.Warnf("Denied file rejected: %v", fileHash)
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
 		return
 	}
-	err = provideKey(ctx, dhtRoute, fileHash, true)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to provide record for key: %v", fileHash), http.StatusInternalServerError)
-		log.Printf("Failed to provide record for key: %v", fileHash)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpLog.Errorf("Failed to upload %s: %v", header.Filename, err)
 		return
 	}
 
+	result = "ok"
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -582,6 +620,14 @@ func handleFetchFiles(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to fetch records: %v", err), http.StatusInternalServerError)
 		return
 	}
+	// Amounts are stored in atoms but shown in DC.
+	for _, record := range records {
+		for _, key := range []string{"cost", "royalty_owed", "royalty_paid"} {
+			if _, ok := record[key]; ok {
+				record[key] = api.Amount(recordAmount(record, key))
+			}
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -591,7 +637,7 @@ func handleFetchFiles(w http.ResponseWriter, r *http.Request) {
 func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		log.Printf("Invalid request method: %s", r.Method)
+		httpLog.Warnf("Invalid request method: %s", r.Method)
 		return
 	}
 
@@ -601,67 +647,25 @@ func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid JSON request body", http.StatusBadRequest)
-		log.Printf("Error decoding JSON request body: %v", err)
+		httpLog.Warnf("Error decoding JSON request body: %v", err)
 		return
 	}
 
 	if request.Hash == "" {
 		http.Error(w, "Hash is required", http.StatusBadRequest)
-		log.Println("Error: Hash is required")
+		httpLog.Warn("Hash is required")
 		return
 	}
 
-	// Retrieve the file record from the database
-	record, err := GetFileRecord(request.Hash)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to retrieve record: %v", err), http.StatusInternalServerError)
-		log.Printf("Error retrieving file record: %v", err)
-		return
-	}
-	if record == nil {
+	err := deleteFile(request.Hash)
+	if err == errFileNotFound {
 		http.Error(w, "File record not found", http.StatusNotFound)
-		log.Printf("File record not found for hash: %s", request.Hash)
-		return
-	}
-
-	// Get the filename from the record
-	filename, ok := record["filename"].(string)
-	if !ok {
-		http.Error(w, "Invalid record format", http.StatusInternalServerError)
-		log.Println("Error: Invalid record format - filename not found")
-		return
-	}
-
-	// Delete the file from the filesystem
-	filePath := filepath.Join("files", filename)
-	if err := os.Remove(filePath); err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("File not found on disk, skipping deletion: %s", filePath)
-		} else {
-			http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
-			log.Printf("Error deleting file from filesystem: %v", err)
-			return
-		}
-	}
-
-	// Delete the record from the database
-	err = DeleteFileRecord(request.Hash)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete record: %v", err), http.StatusInternalServerError)
-		log.Printf("Error deleting file record from database: %v", err)
-		return
-	}
-
-	err = dhtRoute.PutValue(ctx, "/orcanet/files/"+node.ID().String()+"/"+request.Hash, []byte("null"))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to put record for key %v and value null", request.Hash), http.StatusInternalServerError)
-		log.Printf("Failed to put record for key %v and value null: %v\n", request.Hash, err)
+		httpLog.Warnf("File record not found for hash: %s", request.Hash)
 		return
 	}
-	err = provideKey(ctx, dhtRoute, request.Hash, false)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to stop providing record for key: %v", request.Hash), http.StatusInternalServerError)
-		log.Printf("Failed to provide record for key: %v", request.Hash)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpLog.Errorf("Failed to delete %s: %v", request.Hash, err)
 		return
 	}
 
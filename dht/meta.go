@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"dht/api"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Before buying a file, a peer can ask a provider about it on metaProtocol:
+// it sends the hash and is told the file's name, size, MIME type, chunk
+// count, description and price, with a free preview when there is one, and
+// the publication record naming the file's original publisher.  The
+// preview is a thumbnail the publisher uploaded with the file or, with
+// -previewsize, the head of the file.  Previews are samples for people to
+// look at and aren't verified against the hash.  Files the asking peer may
+// not fetch are reported as not found.
+const (
+	// metaProtocol is the file metadata protocol.
+	metaProtocol = "/orcanet/meta/1.0.0"
+
+	// metaTimeout bounds a whole metadata exchange.
+	metaTimeout = 15 * time.Second
+
+	// maxPreviewSize is the largest preview served or accepted, and so the
+	// largest thumbnail that may be uploaded and the most -previewsize
+	// may ask for.
+	maxPreviewSize = 64 << 10
+
+	// maxDescriptionLength is the most bytes a file description may have.
+	maxDescriptionLength = 1 << 10
+
+	// mimeSniffSize is how much of a file is read to detect its MIME type
+	// when its name doesn't tell.
+	mimeSniffSize = 512
+)
+
+// Kinds of previews.
+const (
+	previewThumbnail = api.PreviewThumbnail
+	previewHead      = api.PreviewHead
+)
+
+// metaRequest asks a provider about a file.
+type metaRequest struct {
+	Hash string `json:"hash"`
+}
+
+// metaReply answers a metaRequest.  The other fields are only set if Found.
+type metaReply struct {
+	Found       bool       `json:"found"`
+	Filename    string     `json:"filename,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	MIMEType    string     `json:"mime_type,omitempty"`
+	Chunks      int64      `json:"chunks,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Cost        api.Amount `json:"cost,omitempty"`
+	PreviewKind string     `json:"preview_kind,omitempty"`
+	Preview     []byte     `json:"preview,omitempty"`
+	Publication []byte     `json:"publication,omitempty"`
+}
+
+// errNoMeta is returned when a provider doesn't describe a file it was
+// asked about.
+var errNoMeta = errors.New("provider has no such file")
+
+// validateDetails checks the description and thumbnail of an upload.
+func validateDetails(description string, thumbnail []byte) error {
+	if len(description) > maxDescriptionLength || !utf8.ValidString(description) {
+		return fmt.Errorf("description must be UTF-8 text of at most %d bytes", maxDescriptionLength)
+	}
+	if len(thumbnail) > maxPreviewSize {
+		return fmt.Errorf("thumbnail must be at most %d bytes", maxPreviewSize)
+	}
+	if len(thumbnail) > 0 && !strings.HasPrefix(http.DetectContentType(thumbnail), "image/") {
+		return fmt.Errorf("thumbnail must be an image")
+	}
+	return nil
+}
+
+// fileMIMEType returns the MIME type of the stored file filename, from its
+// extension or else its content.
+func fileMIMEType(filename string) string {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t
+	}
+	f, err := os.Open(filepath.Join("files", filename))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, mimeSniffSize)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
+
+// filePreview returns the preview of a stored file and its kind: its
+// thumbnail if it has one, and otherwise up to cfg.PreviewSize bytes of its
+// head, but never more than half the file so small files aren't given away.
+func filePreview(record map[string]interface{}, filename string, size int64) (string, []byte) {
+	if thumbnail, ok := record["thumbnail"].(primitive.Binary); ok && len(thumbnail.Data) > 0 {
+		return previewThumbnail, thumbnail.Data
+	}
+	n := min(cfg.PreviewSize, size/2)
+	if n <= 0 {
+		return "", nil
+	}
+	f, err := os.Open(filepath.Join("files", filename))
+	if err != nil {
+		xferLog.Debugf("Failed to open %s for a preview: %v", filename, err)
+		return "", nil
+	}
+	defer f.Close()
+	head := make([]byte, n)
+	if _, err := io.ReadFull(f, head); err != nil {
+		xferLog.Debugf("Failed to read preview of %s: %v", filename, err)
+		return "", nil
+	}
+	return previewHead, head
+}
+
+// localMeta describes the stored file hash, reporting it as not found if
+// there is no record of it.
+func localMeta(hash string) (*metaReply, error) {
+	record, err := GetFileRecord(hash)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return &metaReply{}, nil
+	}
+	reply := &metaReply{Found: true}
+	reply.Filename, _ = record["filename"].(string)
+	reply.Size, _ = record["size"].(int64)
+	reply.Description, _ = record["description"].(string)
+	reply.Cost = api.Amount(recordAmount(record, "cost"))
+	reply.MIMEType = fileMIMEType(reply.Filename)
+	if _, ok := parseContentID(hash); ok {
+		reply.Chunks = (reply.Size + chunkSize - 1) / chunkSize
+	}
+	reply.PreviewKind, reply.Preview = filePreview(record, reply.Filename, reply.Size)
+	reply.Publication, err = filePublication(hash, record)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// fileMetaFromReply converts the reply a provider gave about hash to its
+// API form.
+func fileMetaFromReply(hash string, reply *metaReply) (*api.FileMeta, error) {
+	meta := &api.FileMeta{
+		Hash:        hash,
+		Filename:    filepath.Base(reply.Filename),
+		Size:        reply.Size,
+		MIMEType:    reply.MIMEType,
+		Chunks:      reply.Chunks,
+		Description: reply.Description,
+		Cost:        reply.Cost,
+		PreviewKind: reply.PreviewKind,
+		Preview:     reply.Preview,
+	}
+	if len(meta.Preview) > 0 {
+		meta.PreviewType = http.DetectContentType(meta.Preview)
+	}
+	if len(reply.Publication) > 0 {
+		publisher, err := openPublication(reply.Publication, hash)
+		if err != nil {
+			return nil, err
+		}
+		meta.Publisher = publisher.String()
+	}
+	return meta, nil
+}
+
+// checkMetaReply checks that a provider's reply about hash is consistent.
+func checkMetaReply(hash string, reply *metaReply) error {
+	switch {
+	case reply.Size < 0:
+		return fmt.Errorf("%w: negative size", errMalformedMessage)
+	case len(reply.Preview) > maxPreviewSize:
+		return fmt.Errorf("%w: preview of %d bytes", errMalformedMessage, len(reply.Preview))
+	case len(reply.Description) > maxDescriptionLength:
+		return fmt.Errorf("%w: description of %d bytes", errMalformedMessage, len(reply.Description))
+	case reply.PreviewKind != "" && reply.PreviewKind != previewThumbnail && reply.PreviewKind != previewHead:
+		return fmt.Errorf("%w: unknown preview kind %q", errMalformedMessage, reply.PreviewKind)
+	}
+	if _, ok := parseContentID(hash); ok && reply.Chunks != (reply.Size+chunkSize-1)/chunkSize {
+		return fmt.Errorf("%w: %d chunks for %d bytes", errMalformedMessage, reply.Chunks, reply.Size)
+	}
+	if len(reply.Publication) > 0 {
+		if _, err := openPublication(reply.Publication, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchMeta asks p about the file hash.  It returns errNoMeta if p doesn't
+// have the file or won't let this node fetch it.
+func fetchMeta(node host.Host, p peer.ID, hash string) (*api.FileMeta, error) {
+	reply, err := fetchMetaReply(node, p, hash)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := fileMetaFromReply(hash, reply)
+	if err != nil && p != node.ID() {
+		misbehave(p, misbehaviorMalformed, err.Error())
+	}
+	return meta, err
+}
+
+// fetchMetaReply asks p about the file hash and returns its checked reply.
+// It returns errNoMeta if p doesn't have the file or won't let this node
+// fetch it.
+func fetchMetaReply(node host.Host, p peer.ID, hash string) (reply *metaReply, err error) {
+	if p == node.ID() {
+		reply, err := localMeta(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !reply.Found {
+			return nil, errNoMeta
+		}
+		return reply, nil
+	}
+	defer func() {
+		metaRequestsTotal.WithLabelValues("outbound", resultLabel(err)).Inc()
+	}()
+
+	ctx, cancel := context.WithTimeout(globalCtx, metaTimeout)
+	defer cancel()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, metaProtocol), p, metaProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open meta stream to %s: %w", p, err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetDeadline(deadline); err != nil {
+			xferLog.Debugf("Failed to set deadline on stream of %s: %v", p, err)
+		}
+	}
+
+	req, err := json.Marshal(metaRequest{Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to send meta request to %s: %w", p, err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("failed to send meta request to %s: %w", p, err)
+	}
+	data, err := readMessage(s, maxMetaReplySize)
+	if errors.Is(err, errMessageTooLarge) {
+		misbehave(p, misbehaviorOversized, err.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta reply from %s: %w", p, err)
+	}
+
+	reply = &metaReply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		err = fmt.Errorf("%w: %v", errMalformedMessage, err)
+		misbehave(p, misbehaviorMalformed, err.Error())
+		return nil, err
+	}
+	if !reply.Found {
+		return nil, errNoMeta
+	}
+	if err := checkMetaReply(hash, reply); err != nil {
+		misbehave(p, misbehaviorMalformed, err.Error())
+		return nil, err
+	}
+	return reply, nil
+}
+
+// fetchProvidersMeta asks every provider in providers about hash at once
+// and fills in the metadata of those that answer.
+func fetchProvidersMeta(node host.Host, hash string, providers []api.Provider) {
+	var wg sync.WaitGroup
+	for i := range providers {
+		p, err := peer.Decode(providers[i].PeerID)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(provider *api.Provider) {
+			defer wg.Done()
+			meta, err := fetchMeta(node, p, hash)
+			if err != nil {
+				xferLog.Debugf("No metadata of %s from %s: %v", hash, p, err)
+				return
+			}
+			provider.Meta = meta
+		}(&providers[i])
+	}
+	wg.Wait()
+}
+
+// handleMeta answers the metadata requests of peers.
+func handleMeta(node host.Host) {
+	node.SetStreamHandler(metaProtocol, func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		if isBanned(remote) {
+			s.Reset()
+			return
+		}
+		if !allowMessage(metaLimiters, remote) {
+			s.Reset()
+			return
+		}
+
+		if err := s.SetDeadline(time.Now().Add(metaTimeout)); err != nil {
+			xferLog.Debugf("Failed to set deadline on stream of %s: %v", remote, err)
+		}
+		data, err := readMessage(s, maxMetaRequestSize)
+		switch {
+		case errors.Is(err, errMessageTooLarge):
+			misbehave(remote, misbehaviorOversized, err.Error())
+			return
+		case isTimeout(err):
+			misbehave(remote, misbehaviorTimeout, "meta request not closed in time")
+			return
+		case err != nil:
+			xferLog.Debugf("Error reading meta request of %s: %v", remote, err)
+			return
+		}
+
+		var req metaRequest
+		if err := json.Unmarshal(data, &req); err != nil || !validFileHash(req.Hash) {
+			misbehave(remote, misbehaviorMalformed, "bad meta request")
+			return
+		}
+
+		reply := &metaReply{}
+		if mayAccess(remote, req.Hash) && !deniedContent(req.Hash, "serve") {
+			reply, err = localMeta(req.Hash)
+		}
+		metaRequestsTotal.WithLabelValues("inbound", resultLabel(err)).Inc()
+		if err != nil {
+			xferLog.Warnf("Failed to describe %s to %s: %v", req.Hash, remote, err)
+			return
+		}
+		out, err := json.Marshal(reply)
+		if err != nil {
+			xferLog.Errorf("Failed to encode meta reply: %v", err)
+			return
+		}
+		if _, err := s.Write(out); err != nil {
+			xferLog.Debugf("Failed to send meta reply to %s: %v", remote, err)
+		}
+	})
+}
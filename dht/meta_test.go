@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"lukechampine.com/blake3"
+)
+
+// TestCheckMetaReply checks the validation of metadata replies and that the
+// largest valid reply fits the reply size limit.
+func TestCheckMetaReply(t *testing.T) {
+	contentID := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	sum := sha256.Sum256([]byte("orcanet"))
+	legacy := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		hash    string
+		reply   metaReply
+		invalid bool
+	}{
+		{name: "empty file", hash: contentID, reply: metaReply{Found: true}},
+		{name: "chunked file", hash: contentID, reply: metaReply{Found: true, Size: chunkSize + 1, Chunks: 2}},
+		{name: "legacy file", hash: legacy, reply: metaReply{Found: true, Size: chunkSize + 1}},
+		{name: "thumbnail", hash: contentID, reply: metaReply{Found: true, PreviewKind: previewThumbnail, Preview: []byte("x")}},
+
+		{name: "negative size", hash: legacy, reply: metaReply{Found: true, Size: -1}, invalid: true},
+		{name: "wrong chunk count", hash: contentID, reply: metaReply{Found: true, Size: chunkSize + 1, Chunks: 1}, invalid: true},
+		{name: "oversized preview", hash: contentID, reply: metaReply{Found: true, Preview: make([]byte, maxPreviewSize+1)}, invalid: true},
+		{name: "oversized description", hash: contentID, reply: metaReply{Found: true, Description: strings.Repeat("a", maxDescriptionLength+1)}, invalid: true},
+		{name: "unknown preview kind", hash: contentID, reply: metaReply{Found: true, PreviewKind: "video"}, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkMetaReply(test.hash, &test.reply)
+			if test.invalid {
+				if !errors.Is(err, errMalformedMessage) {
+					t.Fatalf("want errMalformedMessage, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	largest, err := json.Marshal(metaReply{
+		Found:       true,
+		Filename:    strings.Repeat("a", 255),
+		Size:        1 << 40,
+		MIMEType:    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		Chunks:      (1<<40 + chunkSize - 1) / chunkSize,
+		Description: strings.Repeat("\u2028", maxDescriptionLength/3),
+		Cost:        api.Amount(btcutil.MaxSatoshi),
+		PreviewKind: previewThumbnail,
+		Preview:     make([]byte, maxPreviewSize),
+		Publication: make([]byte, maxPublicationSize),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode reply: %v", err)
+	}
+	if len(largest) > maxMetaReplySize {
+		t.Fatalf("largest reply is %d bytes, over the limit of %d", len(largest), maxMetaReplySize)
+	}
+}
+
+// TestMetaReplyCost checks that the cost in a meta reply is decoded exactly,
+// from the number this node sends or the string older nodes sent, and that
+// invalid costs make the reply malformed.
+func TestMetaReplyCost(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    api.Amount
+		invalid bool
+	}{
+		{data: `{"found":true}`, want: 0},
+		{data: `{"found":true,"cost":0.1}`, want: 10_000_000},
+		{data: `{"found":true,"cost":"0.1"}`, want: 10_000_000},
+		{data: `{"found":true,"cost":21000000}`, want: api.Amount(btcutil.MaxSatoshi)},
+		{data: `{"found":true,"cost":20999999.99999999}`, want: api.Amount(btcutil.MaxSatoshi - 1)},
+		{data: `{"found":true,"cost":-1}`, invalid: true},
+		{data: `{"found":true,"cost":0.000000001}`, invalid: true},
+		{data: `{"found":true,"cost":21000001}`, invalid: true},
+		{data: `{"found":true,"cost":"free"}`, invalid: true},
+	}
+	for _, test := range tests {
+		var reply metaReply
+		err := json.Unmarshal([]byte(test.data), &reply)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: decoded cost %d, want error", test.data, reply.Cost)
+			}
+			continue
+		}
+		if err != nil || reply.Cost != test.want {
+			t.Errorf("%s: got cost %d, err %v, want %d", test.data, reply.Cost, err, test.want)
+		}
+	}
+
+	data, err := json.Marshal(metaReply{Found: true, Cost: 10_000_000})
+	if err != nil {
+		t.Fatalf("failed to encode reply: %v", err)
+	}
+	if want := `{"found":true,"cost":0.1}`; string(data) != want {
+		t.Errorf("encoded reply %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "orcanet"
+
+var (
+	// bandwidthCounter is handed to libp2p so traffic can be reported per
+	// protocol on every scrape.
+	bandwidthCounter = metrics.NewBandwidthCounter()
+
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_total",
+		Help:      "Number of file uploads handled, by result.",
+	}, []string{"result"})
+
+	providesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "provides_total",
+		Help:      "Number of DHT provide and unprovide operations, by operation and result.",
+	}, []string{"op", "result"})
+
+	findProvidersSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "find_providers_duration_seconds",
+		Help:      "Latency of DHT FindProviders lookups.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	relayReservationActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "relay_reservation_active",
+		Help:      "Whether the node currently holds a reservation on the relay (1) or not (0).",
+	})
+
+	relayReservationExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "relay_reservation_expiry_timestamp_seconds",
+		Help:      "Unix time at which the current relay reservation expires.",
+	})
+
+	storeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "store_operation_duration_seconds",
+		Help:      "Latency of file record store operations, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"op"})
+
+	paymentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "payments_total",
+		Help:      "Number of outgoing payments attempted, by outcome.",
+	}, []string{"outcome"})
+
+	chunksReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "chunks_received_total",
+		Help:      "Number of file chunks received from providers, by verification result.",
+	}, []string{"result"})
+
+	storageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_bytes",
+		Help:      "Bytes used by stored files, by kind (pinned or cached).",
+	}, []string{"kind"})
+
+	gcEvictedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_evicted_bytes_total",
+		Help:      "Bytes of cached files evicted to stay within the storage quota.",
+	})
+
+	activeTransfers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_transfers",
+		Help:      "Number of file transfers being served to peers.",
+	})
+
+	misbehaviorTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "peer_misbehavior_total",
+		Help:      "Number of protocol violations by peers, by reason.",
+	}, []string{"reason"})
+
+	peersBannedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "peers_banned_total",
+		Help:      "Number of peers banned for reaching the ban threshold.",
+	})
+
+	pexExchangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "peer_exchanges_total",
+		Help:      "Number of peer exchanges, by direction and result.",
+	}, []string{"direction", "result"})
+
+	ledgerEntriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ledger_entries_total",
+		Help:      "Number of purchases and sales recorded in the ledger, by kind.",
+	}, []string{"kind"})
+
+	receiptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "receipts_total",
+		Help:      "Number of purchase receipt exchanges, by direction and result.",
+	}, []string{"direction", "result"})
+
+	metaRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "meta_requests_total",
+		Help:      "Number of file metadata requests, by direction and result.",
+	}, []string{"direction", "result"})
+
+	blocklistEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocklist_entries",
+		Help:      "Number of entries on the blocklist, by kind (peer or range).",
+	}, []string{"kind"})
+
+	denylistEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "denylist_entries",
+		Help:      "Number of entries on the denylist, by list (local or subscribed).",
+	}, []string{"list"})
+
+	deniedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "denied_total",
+		Help:      "Number of times denied content was refused, by check.",
+	}, []string{"check"})
+
+	denylistFetchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "denylist_fetches_total",
+		Help:      "Number of subscribed denylist fetches, by result.",
+	}, []string{"result"})
+
+	connectivityStepsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connectivity_steps_total",
+		Help:      "Number of connectivity self-test steps run, by step and result.",
+	}, []string{"step", "result"})
+
+	peerBookSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "peer_book_size",
+		Help:      "Number of peers in the peer book.",
+	})
+
+	gatewayRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gateway_requests_total",
+		Help:      "Number of content gateway requests, by where the content came from and result.",
+	}, []string{"source", "result"})
+
+	gatewaySpentAtomsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gateway_spent_atoms_total",
+		Help:      "Amount the content gateway paid for remote files, in atoms (1e-8 DC).",
+	})
+
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_total",
+		Help:      "Number of events published to the event stream, by type.",
+	}, []string{"type"})
+
+	eventClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_stream_clients",
+		Help:      "Number of connected event stream clients.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(&nodeCollector{})
+}
+
+// nodeCollector reports values that are read from the libp2p host and the
+// routing table at scrape time rather than updated as they change.
+type nodeCollector struct{}
+
+var (
+	bytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "protocol_bytes_total"),
+		"Bytes transferred over libp2p streams, by protocol and direction.",
+		[]string{"protocol", "direction"}, nil,
+	)
+	streamsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "active_streams"),
+		"Number of open libp2p streams, by protocol.",
+		[]string{"protocol"}, nil,
+	)
+	peersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "connected_peers"),
+		"Number of peers with an open connection.",
+		nil, nil,
+	)
+	routingTableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "dht_routing_table_size"),
+		"Number of peers in the DHT routing table.",
+		nil, nil,
+	)
+)
+
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bytesDesc
+	ch <- streamsDesc
+	ch <- peersDesc
+	ch <- routingTableDesc
+}
+
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	for proto, stats := range bandwidthCounter.GetBandwidthByProtocol() {
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(stats.TotalOut), string(proto), "out")
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(stats.TotalIn), string(proto), "in")
+	}
+
+	if node != nil {
+		streams := make(map[string]int)
+		for _, conn := range node.Network().Conns() {
+			for _, s := range conn.GetStreams() {
+				streams[string(s.Protocol())]++
+			}
+		}
+		for proto, n := range streams {
+			ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(n), proto)
+		}
+		ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(len(node.Network().Peers())))
+	}
+
+	if dhtRoute != nil {
+		ch <- prometheus.MustNewConstMetric(routingTableDesc, prometheus.GaugeValue, float64(dhtRoute.RoutingTable().Size()))
+	}
+}
+
+// metricsHandler serves everything registered with the default Prometheus
+// registry, which includes the metrics libp2p itself records.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// observeStore records how long a store operation started at start took.
+func observeStore(op string, start time.Time) {
+	storeSeconds.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// resultLabel maps an error to the "ok"/"error" label used by result metrics.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
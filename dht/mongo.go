@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -14,6 +16,19 @@ var (
 	dbClient     *mongo.Client
 	dbName       = "fileRecordsDB"
 	dbCollection = "fileRecords"
+
+	// nameCollection holds the version history of the names this node
+	// publishes.
+	nameCollection = "nameVersions"
+
+	// collectionCollection holds the file collections this node published.
+	collectionCollection = "collections"
+
+	// gcCollection holds the history of storage garbage collections.
+	gcCollection = "gcRuns"
+
+	// ledgerCollection holds the purchases and sales of this node.
+	ledgerCollection = "ledger"
 )
 
 // InitializeDatabase connects to the MongoDB instance
@@ -32,7 +47,7 @@ func InitializeDatabase(uri string) error {
 		return fmt.Errorf("failed to ping MongoDB: %w", err)
 	}
 
-	fmt.Println("Connected to MongoDB!")
+	storLog.Infof("Connected to MongoDB at %s", uri)
 
 	collectionNames, err := dbClient.Database(dbName).ListCollectionNames(ctx, bson.M{})
 	if err != nil {
@@ -52,25 +67,38 @@ func InitializeDatabase(uri string) error {
 		if err != nil {
 			return fmt.Errorf("failed to create collection: %w", err)
 		}
-		fmt.Printf("Collection '%s' created successfully.\n", dbCollection)
+		storLog.Infof("Collection '%s' created", dbCollection)
 	} else {
-		fmt.Printf("Collection '%s' already exists.\n", dbCollection)
+		storLog.Debugf("Collection '%s' already exists", dbCollection)
 	}
 
 	return nil
 }
 
-// StoreFileRecord saves the file hash and path to the database
-func StoreFileRecord(hash string, filename string, cost float64) error {
+// StoreFileRecord saves the file hash and path to the database.  Files that
+// aren't public are served but not published to the DHT.  Cached files were
+// downloaded rather than added by the user and may be evicted when storage
+// runs short.
+func StoreFileRecord(hash string, filename string, cost btcutil.Amount, size int64, access fileAccess, cached bool) error {
+	defer observeStore("insert", time.Now())
 	collection := dbClient.Database(dbName).Collection(dbCollection)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	now := time.Now()
 	record := bson.M{
-		"hash":      hash,
-		"filename":  filename,
-		"timestamp": time.Now(),
-		"cost":      cost,
+		"hash":        hash,
+		"filename":    filename,
+		"timestamp":   now,
+		"cost":        int64(cost),
+		"size":        size,
+		"last_access": now,
+	}
+	for k, v := range accessFields(access) {
+		record[k] = v
+	}
+	if cached {
+		record["cached"] = true
 	}
 
 	_, err := collection.InsertOne(ctx, record)
@@ -82,6 +110,7 @@ func StoreFileRecord(hash string, filename string, cost float64) error {
 
 // GetFileRecord retrieves a file record by hash
 func GetFileRecord(hash string) (map[string]interface{}, error) {
+	defer observeStore("find", time.Now())
 	collection := dbClient.Database(dbName).Collection(dbCollection)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -97,6 +126,283 @@ func GetFileRecord(hash string) (map[string]interface{}, error) {
 	return result, nil
 }
 
+// TouchFileRecord sets the last access time of a file record to now.
+func TouchFileRecord(hash string) error {
+	defer observeStore("touch", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, bson.M{"$set": bson.M{"last_access": time.Now()}})
+	if err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	return nil
+}
+
+// accessFields returns the fields of a file record that store access.
+// Records of files that aren't public are marked unlisted, which is all
+// versions before visibilities knew of.
+func accessFields(access fileAccess) bson.M {
+	if access.Visibility == visibilityPublic {
+		return bson.M{}
+	}
+	fields := bson.M{"unlisted": true, "visibility": access.Visibility}
+	if access.Visibility == visibilityPrivate {
+		allow := make([]string, len(access.Allow))
+		for i, p := range access.Allow {
+			allow[i] = p.String()
+		}
+		fields["allow"] = allow
+		if !access.TokensSince.IsZero() {
+			fields["tokens_since"] = access.TokensSince
+		}
+	}
+	return fields
+}
+
+// SetFileAccess stores who may fetch a file.  It returns errFileNotFound if
+// there is no record for hash.
+func SetFileAccess(hash string, access fileAccess) error {
+	defer observeStore("update", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	set := accessFields(access)
+	unset := bson.M{}
+	for _, k := range []string{"unlisted", "visibility", "allow", "tokens_since"} {
+		if _, ok := set[k]; !ok {
+			unset[k] = ""
+		}
+	}
+	update := bson.M{}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return errFileNotFound
+	}
+	return nil
+}
+
+// SetFileCached marks a file record as cached, or as pinned if cached is
+// false.  It returns errFileNotFound if there is no record for hash.
+func SetFileCached(hash string, cached bool) error {
+	defer observeStore("update", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$unset": bson.M{"cached": ""}}
+	if cached {
+		update = bson.M{"$set": bson.M{"cached": true}}
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return errFileNotFound
+	}
+	return nil
+}
+
+// SetFileDetails stores the description and thumbnail peers are shown
+// before buying a file.  Empty values are left out.
+func SetFileDetails(hash, description string, thumbnail []byte) error {
+	defer observeStore("update", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	set := bson.M{}
+	if description != "" {
+		set["description"] = description
+	}
+	if len(thumbnail) > 0 {
+		set["thumbnail"] = thumbnail
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, bson.M{"$set": set})
+	if err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return errFileNotFound
+	}
+	return nil
+}
+
+// SetFileResale records that a file is resold on behalf of publisher, named
+// by the sealed publication record, who is owed royalty percent of its sales.
+func SetFileResale(hash, publisher string, royalty float64, publication []byte) error {
+	defer observeStore("update", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"publisher": publisher, "royalty": royalty, "publication": publication}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, update); err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	return nil
+}
+
+// AddRoyaltyOwed adds amount to the royalty owed for a file.
+func AddRoyaltyOwed(hash string, amount btcutil.Amount) error {
+	defer observeStore("update", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$inc": bson.M{"royalty_owed": int64(amount)}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, update); err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	return nil
+}
+
+// RecordRoyaltyPaid moves paid from the royalty owed for a file to the
+// royalties paid for it.
+func RecordRoyaltyPaid(hash string, paid btcutil.Amount) error {
+	defer observeStore("update", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$inc": bson.M{"royalty_owed": -int64(paid), "royalty_paid": int64(paid)}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"hash": hash}, update); err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	return nil
+}
+
+// recordAmount returns the amount stored under key in a file record.
+// Amounts are stored in atoms; records written by older versions hold a
+// float number of DC until MigrateAmounts converts them.
+func recordAmount(record map[string]interface{}, key string) btcutil.Amount {
+	switch v := record[key].(type) {
+	case int64:
+		return btcutil.Amount(v)
+	case int32:
+		return btcutil.Amount(v)
+	case float64:
+		if amount, err := btcutil.NewAmount(v); err == nil {
+			return amount
+		}
+	}
+	return 0
+}
+
+// MigrateAmounts converts the prices and royalties older versions stored as
+// float numbers of DC to atoms.  Converted records are left alone, so it is
+// safe to run at every start.
+func MigrateAmounts() error {
+	defer observeStore("migrate_amounts", time.Now())
+	db := dbClient.Database(dbName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	files := 0
+	for _, field := range []string{"cost", "royalty_owed", "royalty_paid"} {
+		n, err := migrateAmountField(ctx, db.Collection(dbCollection), field)
+		if err != nil {
+			return err
+		}
+		files += n
+	}
+	collections, err := migrateCollectionPrices(ctx, db.Collection(collectionCollection))
+	if err != nil {
+		return err
+	}
+	if files > 0 || collections > 0 {
+		storLog.Infof("Converted %d file amounts and %d collections to atoms", files, collections)
+	}
+	return nil
+}
+
+// floatAmount converts a float number of DC written by an older version.
+// Invalid amounts become zero.
+func floatAmount(dc float64) btcutil.Amount {
+	amount, err := btcutil.NewAmount(dc)
+	if err != nil || amount < 0 {
+		storLog.Warnf("Replacing invalid stored amount %v with 0", dc)
+		return 0
+	}
+	return amount
+}
+
+// migrateAmountField converts field of every document in c that holds a
+// float to atoms.  It returns the number of documents converted.
+func migrateAmountField(ctx context.Context, c *mongo.Collection, field string) (int, error) {
+	filter := bson.M{field: bson.M{"$type": "double"}}
+	cursor, err := c.Find(ctx, filter, options.Find().SetProjection(bson.M{field: 1}))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find %s amounts: %w", field, err)
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return 0, fmt.Errorf("failed to decode %s amounts: %w", field, err)
+	}
+	for _, doc := range docs {
+		dc, _ := doc[field].(float64)
+		update := bson.M{"$set": bson.M{field: int64(floatAmount(dc))}}
+		if _, err := c.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, update); err != nil {
+			return 0, fmt.Errorf("failed to convert %s amount: %w", field, err)
+		}
+	}
+	return len(docs), nil
+}
+
+// migrateCollectionPrices converts the bundle and entry prices of the
+// collections in c that hold floats to atoms.  It returns the number of
+// collections converted.
+func migrateCollectionPrices(ctx context.Context, c *mongo.Collection) (int, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"price": bson.M{"$type": "double"}},
+		bson.M{"entries.price": bson.M{"$type": "double"}},
+	}}
+	cursor, err := c.Find(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find collection prices: %w", err)
+	}
+	var docs []struct {
+		ID      interface{} `bson:"_id"`
+		Price   interface{} `bson:"price"`
+		Entries []struct {
+			Price interface{} `bson:"price"`
+		} `bson:"entries"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return 0, fmt.Errorf("failed to decode collection prices: %w", err)
+	}
+	for _, doc := range docs {
+		set := bson.M{}
+		if dc, ok := doc.Price.(float64); ok {
+			set["price"] = int64(floatAmount(dc))
+		}
+		for i, entry := range doc.Entries {
+			if dc, ok := entry.Price.(float64); ok {
+				set[fmt.Sprintf("entries.%d.price", i)] = int64(floatAmount(dc))
+			}
+		}
+		if _, err := c.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": set}); err != nil {
+			return 0, fmt.Errorf("failed to convert collection prices: %w", err)
+		}
+	}
+	return len(docs), nil
+}
+
 // DisconnectDatabase closes the MongoDB connection
 func DisconnectDatabase() error {
 	if dbClient == nil {
@@ -111,12 +417,17 @@ func DisconnectDatabase() error {
 	return nil
 }
 
+// listProjection leaves the thumbnails out of file records fetched in
+// bulk; only GetFileRecord returns them.
+var listProjection = bson.M{"thumbnail": 0}
+
 func FetchAllFileRecords() ([]map[string]interface{}, error) {
+	defer observeStore("find_all", time.Now())
 	collection := dbClient.Database(dbName).Collection(dbCollection)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{})
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetProjection(listProjection))
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch records: %w", err)
 	}
@@ -136,6 +447,7 @@ func FetchAllFileRecords() ([]map[string]interface{}, error) {
 
 // DeleteFileRecord deletes a file record by hash
 func DeleteFileRecord(hash string) error {
+	defer observeStore("delete", time.Now())
 	collection := dbClient.Database(dbName).Collection(dbCollection)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -153,3 +465,399 @@ func DeleteFileRecord(hash string) error {
 
 	return nil
 }
+
+// FetchFileRecordsPage returns up to limit file records, oldest first,
+// skipping the first offset, together with the total number of records.
+func FetchFileRecordsPage(offset, limit int64) ([]map[string]interface{}, int64, error) {
+	defer observeStore("find_page", time.Now())
+	collection := dbClient.Database(dbName).Collection(dbCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	total, err := collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count records: %w", err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(offset).
+		SetLimit(limit).
+		SetProjection(listProjection)
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch records: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []map[string]interface{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode records: %w", err)
+	}
+	return records, total, nil
+}
+
+// nameVersion is one published version of a mutable name.
+type nameVersion struct {
+	Name      string    `bson:"name"`
+	Sequence  uint64    `bson:"sequence"`
+	Hash      string    `bson:"hash"`
+	Published time.Time `bson:"published"`
+}
+
+// StoreNameVersion records a newly published version of a name.
+func StoreNameVersion(v *nameVersion) error {
+	defer observeStore("insert_name", time.Now())
+	collection := dbClient.Database(dbName).Collection(nameCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, v); err != nil {
+		return fmt.Errorf("failed to insert name version: %w", err)
+	}
+	return nil
+}
+
+// FetchNameVersions returns the versions published under name, newest
+// first.
+func FetchNameVersions(name string) ([]nameVersion, error) {
+	defer observeStore("find_name", time.Now())
+	collection := dbClient.Database(dbName).Collection(nameCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "sequence", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"name": name}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch name versions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var versions []nameVersion
+	if err := cursor.All(ctx, &versions); err != nil {
+		return nil, fmt.Errorf("failed to decode name versions: %w", err)
+	}
+	return versions, nil
+}
+
+// FetchLatestNameVersions returns the newest version of every name this
+// node has published, ordered by name.
+func FetchLatestNameVersions() ([]nameVersion, error) {
+	defer observeStore("find_all_names", time.Now())
+	collection := dbClient.Database(dbName).Collection(nameCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "sequence", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch name versions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var latest []nameVersion
+	for cursor.Next(ctx) {
+		var v nameVersion
+		if err := cursor.Decode(&v); err != nil {
+			return nil, fmt.Errorf("failed to decode name version: %w", err)
+		}
+		if len(latest) == 0 || latest[len(latest)-1].Name != v.Name {
+			latest = append(latest, v)
+		}
+	}
+	return latest, cursor.Err()
+}
+
+// collectionRecord is a file collection published by this node.
+type collectionRecord struct {
+	Root      string                  `bson:"root"`
+	Name      string                  `bson:"name"`
+	Price     btcutil.Amount          `bson:"price"`
+	Entries   []collectionEntryRecord `bson:"entries"`
+	Timestamp time.Time               `bson:"timestamp"`
+}
+
+// collectionEntryRecord is one file of a collection.  Price is set if the
+// file is also sold on its own.  Owned is set if the file was stored for
+// this collection, rather than already present, and so is deleted with it.
+type collectionEntryRecord struct {
+	Path  string          `bson:"path"`
+	Size  int64           `bson:"size"`
+	Hash  string          `bson:"hash"`
+	Price *btcutil.Amount `bson:"price,omitempty"`
+	Owned bool            `bson:"owned"`
+}
+
+// StoreCollectionRecord saves a newly published collection.
+func StoreCollectionRecord(c *collectionRecord) error {
+	defer observeStore("insert_collection", time.Now())
+	collection := dbClient.Database(dbName).Collection(collectionCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, c); err != nil {
+		return fmt.Errorf("failed to insert collection: %w", err)
+	}
+	return nil
+}
+
+// GetCollectionRecord retrieves a collection by root hash.  It returns nil
+// if there is none.
+func GetCollectionRecord(root string) (*collectionRecord, error) {
+	defer observeStore("find_collection", time.Now())
+	collection := dbClient.Database(dbName).Collection(collectionCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var c collectionRecord
+	err := collection.FindOne(ctx, bson.M{"root": root}).Decode(&c)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve collection: %w", err)
+	}
+	return &c, nil
+}
+
+// FetchCollectionRecords returns every collection, oldest first.
+func FetchCollectionRecords() ([]collectionRecord, error) {
+	defer observeStore("find_all_collections", time.Now())
+	collection := dbClient.Database(dbName).Collection(collectionCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch collections: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []collectionRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode collections: %w", err)
+	}
+	return records, nil
+}
+
+// DeleteCollectionRecord deletes a collection by root hash.
+func DeleteCollectionRecord(root string) error {
+	defer observeStore("delete_collection", time.Now())
+	collection := dbClient.Database(dbName).Collection(collectionCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"root": root})
+	if err != nil {
+		return fmt.Errorf("failed to delete collection: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("no collection found with root: %s", root)
+	}
+	return nil
+}
+
+// gcRun is one garbage collection of the file store.
+type gcRun struct {
+	Time       time.Time    `bson:"time"`
+	Trigger    string       `bson:"trigger"`
+	Quota      int64        `bson:"quota"`
+	UsedBefore int64        `bson:"used_before"`
+	UsedAfter  int64        `bson:"used_after"`
+	Evicted    []gcEviction `bson:"evicted"`
+}
+
+// gcEviction is a cached file removed by a garbage collection.
+type gcEviction struct {
+	Hash     string `bson:"hash"`
+	Filename string `bson:"filename"`
+	Size     int64  `bson:"size"`
+}
+
+// StoreGCRun records a garbage collection.
+func StoreGCRun(run *gcRun) error {
+	defer observeStore("insert_gc", time.Now())
+	collection := dbClient.Database(dbName).Collection(gcCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, run); err != nil {
+		return fmt.Errorf("failed to insert gc run: %w", err)
+	}
+	return nil
+}
+
+// FetchGCRuns returns the last limit garbage collections, newest first.
+func FetchGCRuns(limit int64) ([]gcRun, error) {
+	defer observeStore("find_gc", time.Now())
+	collection := dbClient.Database(dbName).Collection(gcCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit)
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gc runs: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var runs []gcRun
+	if err := cursor.All(ctx, &runs); err != nil {
+		return nil, fmt.Errorf("failed to decode gc runs: %w", err)
+	}
+	return runs, nil
+}
+
+// ledgerRecord is a purchase or sale of this node.  ID is the hash of the
+// buyer's receipt, so both sides file a trade under the same ID.  Receipt is
+// the receipt this node signed and PeerReceipt the one its counterparty
+// signed, once received.
+type ledgerRecord struct {
+	ID          string         `bson:"id"`
+	Kind        string         `bson:"kind"`
+	Hash        string         `bson:"hash"`
+	Filename    string         `bson:"filename,omitempty"`
+	Peer        string         `bson:"peer"`
+	Address     string         `bson:"address,omitempty"`
+	Amount      btcutil.Amount `bson:"amount"`
+	TxID        string         `bson:"txid"`
+	Time        time.Time      `bson:"time"`
+	Receipt     []byte         `bson:"receipt,omitempty"`
+	PeerReceipt []byte         `bson:"peer_receipt,omitempty"`
+}
+
+// errTxIDRecorded is returned when storing a ledger record paid with a
+// transaction another record of the same kind was already paid with.
+var errTxIDRecorded = errors.New("transaction already recorded")
+
+// EnsureLedgerIndexes creates the ledger's unique index on the kind and
+// transaction of each record, so a transaction can't be recorded twice even
+// by concurrent requests.  It is safe to run at every start.
+func EnsureLedgerIndexes() error {
+	defer observeStore("index_ledger", time.Now())
+	collection := dbClient.Database(dbName).Collection(ledgerCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "txid", Value: 1}},
+		Options: options.Index().SetName("kind_txid").SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ledger index: %w", err)
+	}
+	return nil
+}
+
+// StoreLedgerRecord records a purchase or sale.  It returns errTxIDRecorded
+// if a record of the same kind was already paid with its transaction.
+func StoreLedgerRecord(rec *ledgerRecord) error {
+	defer observeStore("insert_ledger", time.Now())
+	collection := dbClient.Database(dbName).Collection(ledgerCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, rec); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %s %s", errTxIDRecorded, rec.Kind, rec.TxID)
+		}
+		return fmt.Errorf("failed to insert ledger record: %w", err)
+	}
+	return nil
+}
+
+// GetLedgerRecord retrieves the ledger record of the given kind and ID.  It
+// returns nil if there is none.
+func GetLedgerRecord(kind, id string) (*ledgerRecord, error) {
+	defer observeStore("find_ledger", time.Now())
+	collection := dbClient.Database(dbName).Collection(ledgerCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var rec ledgerRecord
+	err := collection.FindOne(ctx, bson.M{"kind": kind, "id": id}).Decode(&rec)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve ledger record: %w", err)
+	}
+	return &rec, nil
+}
+
+// GetLedgerRecordByTxID retrieves the ledger record of the given kind paid
+// with the transaction txid.  It returns nil if there is none.
+func GetLedgerRecordByTxID(kind, txid string) (*ledgerRecord, error) {
+	defer observeStore("find_ledger", time.Now())
+	collection := dbClient.Database(dbName).Collection(ledgerCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var rec ledgerRecord
+	err := collection.FindOne(ctx, bson.M{"kind": kind, "txid": txid}).Decode(&rec)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve ledger record: %w", err)
+	}
+	return &rec, nil
+}
+
+// SetPeerReceipt stores the counterparty's receipt of the ledger record of
+// the given kind and ID.
+func SetPeerReceipt(kind, id string, receipt []byte) error {
+	defer observeStore("update_ledger", time.Now())
+	collection := dbClient.Database(dbName).Collection(ledgerCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"kind": kind, "id": id}
+	update := bson.M{"$set": bson.M{"peer_receipt": receipt}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to update ledger record: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("no %s found with id: %s", kind, id)
+	}
+	return nil
+}
+
+// FetchLedgerRecords returns the ledger records of the given kind, or of
+// every kind if it is empty, made in [since, until), oldest first.  Zero
+// times leave that end of the range open.
+func FetchLedgerRecords(kind string, since, until time.Time) ([]ledgerRecord, error) {
+	defer observeStore("find_all_ledger", time.Now())
+	collection := dbClient.Database(dbName).Collection(ledgerCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if kind != "" {
+		filter["kind"] = kind
+	}
+	between := bson.M{}
+	if !since.IsZero() {
+		between["$gte"] = since
+	}
+	if !until.IsZero() {
+		between["$lt"] = until
+	}
+	if len(between) > 0 {
+		filter["time"] = between
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ledger records: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []ledgerRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode ledger records: %w", err)
+	}
+	return records, nil
+}
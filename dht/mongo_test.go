@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// TestFloatAmount checks the conversion of the float amounts older versions
+// stored, which MigrateAmounts applies.
+func TestFloatAmount(t *testing.T) {
+	tests := []struct {
+		dc   float64
+		want btcutil.Amount
+	}{
+		{0, 0},
+		{1, 100_000_000},
+		{1.5, 150_000_000},
+		{0.1, 10_000_000},
+		{0.3, 30_000_000},
+		{0.00000001, 1},
+		{1e-8, 1},
+		{2.5e3, 250_000_000_000},
+		{21e6, btcutil.MaxSatoshi},
+		{0.000000004, 0},
+		{0.000000006, 1},
+
+		{-1, 0},
+		{math.NaN(), 0},
+		{math.Inf(1), 0},
+		{math.Inf(-1), 0},
+	}
+	for _, test := range tests {
+		if got := floatAmount(test.dc); got != test.want {
+			t.Errorf("floatAmount(%v) = %d, want %d", test.dc, got, test.want)
+		}
+	}
+}
+
+// TestRecordAmount checks that amounts are read from file records whether
+// they were stored as atoms or, before MigrateAmounts, as floats.
+func TestRecordAmount(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  btcutil.Amount
+	}{
+		{"atoms", int64(150_000_000), 150_000_000},
+		{"largest", int64(btcutil.MaxSatoshi), btcutil.MaxSatoshi},
+		{"int32 atoms", int32(1000), 1000},
+		{"float", 1.5, 150_000_000},
+		{"float tenth", 0.1, 10_000_000},
+		{"float NaN", math.NaN(), 0},
+		{"string", "1.5", 0},
+		{"missing", nil, 0},
+	}
+	for _, test := range tests {
+		record := map[string]interface{}{}
+		if test.value != nil {
+			record["cost"] = test.value
+		}
+		if got := recordAmount(record, "cost"); got != test.want {
+			t.Errorf("%s: recordAmount = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"dht/api"
+	"dht/names"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// Names are mutable pointers at content, kept in the DHT as records signed
+// by their publisher; package names defines the records and their
+// validator.
+const (
+	// nameRecordLifetime is how long a signed name record stays valid.
+	nameRecordLifetime = 48 * time.Hour
+
+	// nameRepublishInterval is how often the latest version of every name
+	// is signed again and put back into the DHT, well within
+	// nameRecordLifetime.
+	nameRepublishInterval = 12 * time.Hour
+)
+
+// errNameNotFound is returned when no version of a name was published.
+var errNameNotFound = errors.New("name not found")
+
+// putNameRecord signs a record pointing name at hash with the given
+// sequence and stores it in the DHT.  It returns the record's expiry.
+func putNameRecord(name, hash string, seq uint64) (time.Time, error) {
+	priv := node.Peerstore().PrivKey(node.ID())
+	if priv == nil {
+		return time.Time{}, fmt.Errorf("no private key for %s", node.ID())
+	}
+	key := names.Key(node.ID(), name)
+	expires := time.Now().Add(nameRecordLifetime)
+	value, err := names.Sign(priv, key, hash, seq, expires)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := dhtRoute.PutValue(ctx, key, value); err != nil {
+		return time.Time{}, fmt.Errorf("failed to put name record %s: %w", key, err)
+	}
+	return expires, nil
+}
+
+// publishName points name at hash with a sequence number above every
+// version published before, locally or as found in the DHT, and records the
+// new version in the history.
+func publishName(name, hash string) (*api.NameRecord, error) {
+	versions, err := FetchNameVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64 = 1
+	if len(versions) > 0 {
+		seq = versions[0].Sequence + 1
+	}
+	// The local history may have been lost while records published from
+	// it are still live; never go back below those.
+	if current, err := resolveName(node.ID(), name); err == nil && current.Sequence >= seq {
+		seq = current.Sequence + 1
+	}
+
+	expires, err := putNameRecord(name, hash, seq)
+	if err != nil {
+		return nil, err
+	}
+	v := nameVersion{Name: name, Sequence: seq, Hash: hash, Published: time.Now()}
+	if err := StoreNameVersion(&v); err != nil {
+		return nil, err
+	}
+	nodeLog.Infof("Published name %s version %d -> %s", name, seq, hash)
+	return &api.NameRecord{
+		PeerID:   node.ID().String(),
+		Name:     name,
+		Hash:     hash,
+		Sequence: seq,
+		Expires:  expires.UTC(),
+	}, nil
+}
+
+// resolveName looks up the current record of name published by p.
+func resolveName(p peer.ID, name string) (*api.NameRecord, error) {
+	key := names.Key(p, name)
+	value, err := dhtRoute.GetValue(ctx, key)
+	if errors.Is(err, routing.ErrNotFound) {
+		return nil, errNameNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get name record %s: %w", key, err)
+	}
+	rec, err := names.Verify(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return &api.NameRecord{
+		PeerID:   p.String(),
+		Name:     name,
+		Hash:     rec.Hash,
+		Sequence: rec.Sequence,
+		Expires:  time.Unix(rec.Expires, 0).UTC(),
+	}, nil
+}
+
+// republishNames signs the latest version of every name again every
+// interval so the records don't expire from the DHT.
+func republishNames(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		latest, err := FetchLatestNameVersions()
+		if err != nil {
+			nodeLog.Errorf("Failed to load names to republish: %v", err)
+		}
+		for _, v := range latest {
+			if _, err := putNameRecord(v.Name, v.Hash, v.Sequence); err != nil {
+				nodeLog.Warnf("Failed to republish name %s: %v", v.Name, err)
+				continue
+			}
+			nodeLog.Debugf("Republished name %s version %d", v.Name, v.Sequence)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package names defines the mutable name records of the "orcanet" DHT
+// namespace and the validator that checks them, shared by the DHT node and
+// the bootstrap node so neither stores or hands out records the other would
+// reject.
+package names
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// KeyPrefix is the DHT namespace of mutable name records.  A record lives
+// at /orcanet/name/<peer>/<name> and can only be written by <peer>.
+const KeyPrefix = "/orcanet/name/"
+
+var (
+	// ErrInvalidRecord is returned for name records that are malformed or
+	// not signed by the peer in their key.
+	ErrInvalidRecord = errors.New("invalid name record")
+
+	// ErrExpired is returned for name records past their validity.
+	ErrExpired = errors.New("name record expired")
+)
+
+// nameRE is the set of names that may be published.
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Record is the value stored under a name key.  It points at the current
+// content hash and is signed by the publisher, so any node can check it
+// without trusting the peer it got it from.
+type Record struct {
+	Hash      string `json:"hash"`
+	Sequence  uint64 `json:"sequence"`
+	Expires   int64  `json:"expires"`
+	Signature []byte `json:"signature"`
+}
+
+// Key returns the DHT key of name published by p.
+func Key(p peer.ID, name string) string {
+	return KeyPrefix + p.String() + "/" + name
+}
+
+// ValidateName checks that name may be published.
+func ValidateName(name string) error {
+	if !nameRE.MatchString(name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, '.', '_' or '-' and start with a letter or digit")
+	}
+	return nil
+}
+
+// ParseKey splits a name key into the publisher and the name.
+func ParseKey(key string) (peer.ID, string, error) {
+	rest, ok := strings.CutPrefix(key, KeyPrefix)
+	if !ok {
+		return "", "", fmt.Errorf("%w: key %q is not a name key", ErrInvalidRecord, key)
+	}
+	publisher, name, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", "", fmt.Errorf("%w: key %q has no name", ErrInvalidRecord, key)
+	}
+	id, err := peer.Decode(publisher)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: bad publisher in key %q: %v", ErrInvalidRecord, key, err)
+	}
+	if err := ValidateName(name); err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	return id, name, nil
+}
+
+// signedBytes returns the bytes covered by the record's signature.  The key
+// is included so a record can't be replayed under another name.
+func (r *Record) signedBytes(key string) []byte {
+	return []byte("orcanet-name-record:" + key + "\n" + r.Hash + "\n" +
+		strconv.FormatUint(r.Sequence, 10) + "\n" + strconv.FormatInt(r.Expires, 10))
+}
+
+// Sign returns the marshalled record pointing key at hash, signed with
+// priv.
+func Sign(priv crypto.PrivKey, key, hash string, seq uint64, expires time.Time) ([]byte, error) {
+	rec := Record{Hash: hash, Sequence: seq, Expires: expires.Unix()}
+	sig, err := priv.Sign(rec.signedBytes(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign name record: %w", err)
+	}
+	rec.Signature = sig
+	return json.Marshal(&rec)
+}
+
+// Verify decodes value and checks that it was signed by the publisher in
+// key and has not expired.
+func Verify(key string, value []byte) (*Record, error) {
+	publisher, _, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var rec Record
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if !validHash(rec.Hash) {
+		return nil, fmt.Errorf("%w: bad hash %q", ErrInvalidRecord, rec.Hash)
+	}
+	pub, err := publisher.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: no public key in peer ID %s: %v", ErrInvalidRecord, publisher, err)
+	}
+	ok, err := pub.Verify(rec.signedBytes(key), rec.Signature)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidRecord)
+	}
+	if time.Now().Unix() > rec.Expires {
+		return nil, ErrExpired
+	}
+	return &rec, nil
+}
+
+// Select returns the index of the best of values: the valid record with
+// the highest sequence, the later expiry breaking ties.
+func Select(key string, values [][]byte) (int, error) {
+	best := -1
+	var bestRec *Record
+	for i, value := range values {
+		rec, err := Verify(key, value)
+		if err != nil {
+			continue
+		}
+		if bestRec == nil || rec.Sequence > bestRec.Sequence ||
+			(rec.Sequence == bestRec.Sequence && rec.Expires > bestRec.Expires) {
+			best, bestRec = i, rec
+		}
+	}
+	if best < 0 {
+		return 0, ErrInvalidRecord
+	}
+	return best, nil
+}
+
+// validHash reports whether hash is a content ID, a CIDv1 of the BLAKE3
+// root of a file, or the hex SHA-256 of a legacy file.
+func validHash(hash string) bool {
+	if len(hash) == 2*sha256.Size {
+		_, err := hex.DecodeString(hash)
+		return err == nil
+	}
+	c, err := cid.Decode(hash)
+	if err != nil || c.Version() != 1 || c.Type() != cid.Raw {
+		return false
+	}
+	dec, err := multihash.Decode(c.Hash())
+	return err == nil && dec.Code == multihash.BLAKE3 && len(dec.Digest) == 32
+}
+
+// Validator validates the records of the "orcanet" DHT namespace.  Name
+// records must be signed by the peer they are published under, and the best
+// of several is the one Select picks.  Other keys are accepted as they are.
+type Validator struct{}
+
+// Validate implements record.Validator.
+func (Validator) Validate(key string, value []byte) error {
+	if strings.HasPrefix(key, KeyPrefix) {
+		_, err := Verify(key, value)
+		return err
+	}
+	return nil
+}
+
+// Select implements record.Validator.
+func (Validator) Select(key string, values [][]byte) (int, error) {
+	if strings.HasPrefix(key, KeyPrefix) {
+		return Select(key, values)
+	}
+	return 0, nil
+}
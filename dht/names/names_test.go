@@ -0,0 +1,205 @@
+package names
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// testHash is a content ID records can point at.
+var testHash = testContentID("orcanet")
+
+// testContentID returns a content ID for s.  It need not be the real root
+// of s, only well formed.
+func testContentID(s string) string {
+	digest := sha256.Sum256([]byte(s))
+	mh, err := multihash.Encode(digest[:], multihash.BLAKE3)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh).String()
+}
+
+// testKey returns a new random private key and its peer ID.
+func testKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to derive peer ID: %v", err)
+	}
+	return priv, id
+}
+
+// sign signs a record pointing key at hash, failing the test on error.
+func sign(t *testing.T, priv crypto.PrivKey, key, hash string, seq uint64, expires time.Time) []byte {
+	t.Helper()
+	value, err := Sign(priv, key, hash, seq, expires)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return value
+}
+
+// TestParseKey checks the keys name records may live under.
+func TestParseKey(t *testing.T) {
+	_, publisher := testKey(t)
+	id, name, err := ParseKey(Key(publisher, "site.v1"))
+	if err != nil || id != publisher || name != "site.v1" {
+		t.Fatalf("ParseKey returned %s, %q, %v", id, name, err)
+	}
+	for _, key := range []string{
+		"/orcanet/" + testHash,
+		KeyPrefix + publisher.String(),
+		KeyPrefix + "not-a-peer/site",
+		Key(publisher, ""),
+		Key(publisher, "-site"),
+		Key(publisher, "a/b"),
+	} {
+		if _, _, err := ParseKey(key); !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("ParseKey(%q) returned %v, want %v", key, err, ErrInvalidRecord)
+		}
+	}
+}
+
+// TestSign checks that a signed record verifies under its own key only,
+// and that tampered, misplaced and expired records are rejected.
+func TestSign(t *testing.T) {
+	priv, publisher := testKey(t)
+	otherPriv, other := testKey(t)
+	key := Key(publisher, "site")
+	expires := time.Now().Add(time.Hour)
+
+	rec, err := Verify(key, sign(t, priv, key, testHash, 3, expires))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if rec.Hash != testHash || rec.Sequence != 3 || rec.Expires != expires.Unix() {
+		t.Fatalf("Verify returned %+v", rec)
+	}
+
+	tamper := func(value []byte, modify func(*Record)) []byte {
+		var r Record
+		if err := json.Unmarshal(value, &r); err != nil {
+			t.Fatalf("failed to decode record: %v", err)
+		}
+		modify(&r)
+		data, err := json.Marshal(&r)
+		if err != nil {
+			t.Fatalf("failed to encode record: %v", err)
+		}
+		return data
+	}
+	valid := sign(t, priv, key, testHash, 3, expires)
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		want  error
+	}{
+		{"signed by another peer", key, sign(t, otherPriv, key, testHash, 3, expires), ErrInvalidRecord},
+		{"replayed under another name", Key(publisher, "other"), valid, ErrInvalidRecord},
+		{"replayed under another peer", Key(other, "site"), valid, ErrInvalidRecord},
+		{"changed hash", key, tamper(valid, func(r *Record) { r.Hash = testContentID("other") }), ErrInvalidRecord},
+		{"raised sequence", key, tamper(valid, func(r *Record) { r.Sequence++ }), ErrInvalidRecord},
+		{"extended expiry", key, tamper(valid, func(r *Record) { r.Expires += 3600 }), ErrInvalidRecord},
+		{"bad hash", key, sign(t, priv, key, "not-a-hash", 3, expires), ErrInvalidRecord},
+		{"garbage", key, []byte("record"), ErrInvalidRecord},
+		{"expired", key, sign(t, priv, key, testHash, 3, time.Now().Add(-time.Minute)), ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(tt.key, tt.value); !errors.Is(err, tt.want) {
+				t.Errorf("Verify returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestSelect checks that the valid record with the highest sequence wins,
+// the later expiry breaking ties.
+func TestSelect(t *testing.T) {
+	priv, publisher := testKey(t)
+	otherPriv, _ := testKey(t)
+	key := Key(publisher, "site")
+	soon, later := time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)
+
+	tests := []struct {
+		name   string
+		values [][]byte
+		want   int
+	}{
+		{"single", [][]byte{sign(t, priv, key, testHash, 1, soon)}, 0},
+		{"higher sequence", [][]byte{
+			sign(t, priv, key, testHash, 1, later),
+			sign(t, priv, key, testHash, 2, soon),
+		}, 1},
+		{"later expiry", [][]byte{
+			sign(t, priv, key, testHash, 2, later),
+			sign(t, priv, key, testHash, 2, soon),
+		}, 0},
+		{"forged higher sequence", [][]byte{
+			sign(t, otherPriv, key, testHash, 9, later),
+			sign(t, priv, key, testHash, 1, soon),
+		}, 1},
+		{"expired higher sequence", [][]byte{
+			sign(t, priv, key, testHash, 1, soon),
+			sign(t, priv, key, testHash, 9, time.Now().Add(-time.Minute)),
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Select(key, tt.values)
+			if err != nil || got != tt.want {
+				t.Errorf("Select returned %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := Select(key, [][]byte{[]byte("record"), sign(t, otherPriv, key, testHash, 1, soon)}); !errors.Is(err, ErrInvalidRecord) {
+		t.Errorf("Select of invalid records returned %v, want %v", err, ErrInvalidRecord)
+	}
+}
+
+// TestValidator checks the validator as the DHT uses it, under the orcanet
+// namespace: name records are checked and other keys are let through.
+func TestValidator(t *testing.T) {
+	priv, publisher := testKey(t)
+	otherPriv, _ := testKey(t)
+	v := record.NamespacedValidator{"orcanet": Validator{}}
+	key := Key(publisher, "site")
+	expires := time.Now().Add(time.Hour)
+
+	if err := v.Validate(key, sign(t, priv, key, testHash, 1, expires)); err != nil {
+		t.Errorf("valid name record rejected: %v", err)
+	}
+	if err := v.Validate(key, sign(t, otherPriv, key, testHash, 1, expires)); !errors.Is(err, ErrInvalidRecord) {
+		t.Errorf("forged name record: got %v, want %v", err, ErrInvalidRecord)
+	}
+	if err := v.Validate("/orcanet/"+testHash, []byte("0.5")); err != nil {
+		t.Errorf("file record rejected: %v", err)
+	}
+	if err := v.Validate("/other/"+testHash, []byte("0.5")); err == nil {
+		t.Error("record outside the orcanet namespace accepted")
+	}
+
+	values := [][]byte{
+		sign(t, priv, key, testHash, 1, expires),
+		sign(t, priv, key, testHash, 2, expires),
+	}
+	if got, err := v.Select(key, values); err != nil || got != 1 {
+		t.Errorf("Select returned %d, %v, want 1", got, err)
+	}
+}
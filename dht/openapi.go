@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht/api"
+)
+
+// pathParamRE matches the {name} wildcards of a route path.
+var pathParamRE = regexp.MustCompile(`\{([a-zA-Z_]+)\}`)
+
+// openAPIDocument generates an OpenAPI 3 document describing routes.
+func openAPIDocument(routes []apiRoute) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	errorSchema := schemaFor(reflect.TypeOf(api.ErrorResponse{}), schemas)
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		op := map[string]interface{}{
+			"summary":      route.summary,
+			"operationId":  operationID(route),
+			"security":     []map[string][]string{{"bearerAuth": {}}},
+			"x-permission": route.perm,
+		}
+
+		var params []map[string]interface{}
+		for _, m := range pathParamRE.FindAllStringSubmatch(route.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]string{"type": "string"},
+			})
+		}
+		for _, q := range route.query {
+			params = append(params, map[string]interface{}{
+				"name":        q.name,
+				"in":          "query",
+				"description": q.description,
+				"required":    q.required,
+				"schema":      map[string]string{"type": q.kind},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		switch {
+		case route.form != nil:
+			props := make(map[string]interface{})
+			var required []string
+			for _, f := range route.form {
+				props[f.name] = formFieldSchema(f)
+				if f.required {
+					required = append(required, f.name)
+				}
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type":       "object",
+							"required":   required,
+							"properties": props,
+						},
+					},
+				},
+			}
+		case route.request != nil:
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaFor(reflect.TypeOf(route.request), schemas),
+					},
+				},
+			}
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(route.status)}
+		if route.response != nil {
+			contentType := route.contentType
+			schema := map[string]interface{}{"type": "string", "format": "binary"}
+			if contentType == "" {
+				contentType = "application/json"
+				schema = schemaFor(reflect.TypeOf(route.response), schemas)
+			}
+			success["content"] = map[string]interface{}{
+				contentType: map[string]interface{}{"schema": schema},
+			}
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(route.status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": errorSchema,
+					},
+				},
+			},
+		}
+
+		path := api.BasePath + route.path
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "OrcaNet DHT node API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// formFieldSchema returns the schema of a multipart form field.
+func formFieldSchema(f apiParam) map[string]interface{} {
+	binary := map[string]interface{}{"type": "string", "format": "binary"}
+	switch f.kind {
+	case "file":
+		binary["description"] = f.description
+		return binary
+	case "files":
+		return map[string]interface{}{"type": "array", "items": binary, "description": f.description}
+	default:
+		return map[string]interface{}{"type": f.kind, "description": f.description}
+	}
+}
+
+// operationID derives a stable operation ID such as "getFilesHashProviders"
+// from a route's method and path.
+func operationID(route apiRoute) string {
+	id := strings.ToLower(route.method)
+	for _, part := range strings.FieldsFunc(route.path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '.' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	amountType = reflect.TypeOf(api.Amount(0))
+)
+
+// schemaFor returns the JSON schema of t.  Named struct types are added to
+// schemas and referenced so each is described once.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return schemaFor(t.Elem(), schemas)
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == amountType {
+		return map[string]interface{}{"type": "number", "minimum": 0, "multipleOf": 0.00000001,
+			"description": "Amount of DC with at most 8 decimals."}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+	default:
+		return map[string]interface{}{}
+	}
+
+	name := t.Name()
+	if _, ok := schemas[name]; name != "" && ok {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		fieldName, opts, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		props[fieldName] = schemaFor(field.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			required = append(required, fieldName)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if name == "" {
+		return schema
+	}
+	schemas[name] = schema
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"dht/api"
+	"dht/pex"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The peer book remembers peers learned through peer exchange, with the
+// signed records they were learned from, and is written to disk so a
+// restarted node has peers to connect to besides the bootstrap nodes.  Like
+// btcd's address manager it is bounded, limits what a single source may
+// add, and prefers peers that were reachable when asked for peers or when
+// picking ones to connect to.
+const (
+	// peerBookSaveInterval is how often the peer book is written to disk.
+	peerBookSaveInterval = 10 * time.Minute
+
+	// maxPeerBookSize is the most peers kept in the peer book.
+	maxPeerBookSize = 1000
+
+	// maxPeersPerSource is the most peers in the book learned from any
+	// one peer other than themselves.
+	maxPeersPerSource = 64
+
+	// peerBookVersion is the version of the peer book file format.
+	peerBookVersion = 1
+)
+
+// knownPeer is a peer book entry.
+type knownPeer struct {
+	ID           peer.ID
+	Record       []byte
+	Capabilities []byte
+	Seq          uint64
+	Source       peer.ID
+	Added        time.Time
+	LastSeen     time.Time
+	LastAttempt  time.Time
+	LastSuccess  time.Time
+	Attempts     int
+
+	// verified holds what Record and Capabilities say.
+	verified *pex.Peer
+}
+
+// lastGood returns the last time the peer was known to be around.
+func (kp *knownPeer) lastGood() time.Time {
+	if kp.LastSuccess.After(kp.LastSeen) {
+		return kp.LastSuccess
+	}
+	return kp.LastSeen
+}
+
+// serializedKnownPeer is the form a knownPeer is saved in.
+type serializedKnownPeer struct {
+	Record       []byte    `json:"record"`
+	Capabilities []byte    `json:"capabilities,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	Added        time.Time `json:"added"`
+	LastSeen     time.Time `json:"last_seen"`
+	LastAttempt  time.Time `json:"last_attempt,omitempty"`
+	LastSuccess  time.Time `json:"last_success,omitempty"`
+	Attempts     int       `json:"attempts,omitempty"`
+}
+
+// serializedPeerBook is the peer book file.
+type serializedPeerBook struct {
+	Version int                   `json:"version"`
+	Peers   []serializedKnownPeer `json:"peers"`
+}
+
+// peerBook is a bounded set of known peers.
+type peerBook struct {
+	path string
+
+	mtx   sync.Mutex
+	peers map[peer.ID]*knownPeer
+}
+
+// peers is the node's peer book, set up by loadPeerBook.
+var peers *peerBook
+
+// newPeerBook returns an empty peer book saved to path.
+func newPeerBook(path string) *peerBook {
+	return &peerBook{path: path, peers: make(map[peer.ID]*knownPeer)}
+}
+
+// loadPeerBook reads the peer book at path.  A missing file is an empty
+// book; entries whose signatures don't check out are dropped.
+func loadPeerBook(path string) (*peerBook, error) {
+	b := newPeerBook(path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sb serializedPeerBook
+	if err := json.Unmarshal(data, &sb); err != nil {
+		return nil, fmt.Errorf("failed to parse peer book %s: %w", path, err)
+	}
+	if sb.Version != peerBookVersion {
+		return nil, fmt.Errorf("peer book %s has unknown version %d", path, sb.Version)
+	}
+	for _, sp := range sb.Peers {
+		v, err := pex.Verify(pex.Entry{Record: sp.Record, Capabilities: sp.Capabilities})
+		if err != nil {
+			peerLog.Debugf("Dropping peer book entry: %v", err)
+			continue
+		}
+		source, _ := peer.Decode(sp.Source)
+		b.peers[v.ID] = &knownPeer{
+			ID:           v.ID,
+			Record:       sp.Record,
+			Capabilities: sp.Capabilities,
+			Seq:          v.Seq,
+			Source:       source,
+			Added:        sp.Added,
+			LastSeen:     sp.LastSeen,
+			LastAttempt:  sp.LastAttempt,
+			LastSuccess:  sp.LastSuccess,
+			Attempts:     sp.Attempts,
+			verified:     v,
+		}
+		if len(b.peers) == maxPeerBookSize {
+			break
+		}
+	}
+	peerBookSize.Set(float64(len(b.peers)))
+	return b, nil
+}
+
+// save writes the peer book to its file.
+func (b *peerBook) save() error {
+	b.mtx.Lock()
+	sb := serializedPeerBook{Version: peerBookVersion, Peers: make([]serializedKnownPeer, 0, len(b.peers))}
+	for _, kp := range b.peers {
+		sp := serializedKnownPeer{
+			Record:       kp.Record,
+			Capabilities: kp.Capabilities,
+			Added:        kp.Added,
+			LastSeen:     kp.LastSeen,
+			LastAttempt:  kp.LastAttempt,
+			LastSuccess:  kp.LastSuccess,
+			Attempts:     kp.Attempts,
+		}
+		if kp.Source != "" {
+			sp.Source = kp.Source.String()
+		}
+		sb.Peers = append(sb.Peers, sp)
+	}
+	b.mtx.Unlock()
+
+	data, err := json.Marshal(&sb)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// add records v, learned from source.  A record older than the one known is
+// ignored.  It reports whether v was new to the book.
+func (b *peerBook) add(v *pex.Peer, entry pex.Entry, source peer.ID) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	if kp, ok := b.peers[v.ID]; ok {
+		if v.Seq < kp.Seq {
+			return false
+		}
+		kp.LastSeen = now
+		kp.Seq = v.Seq
+		kp.Record = entry.Record
+		// Known capabilities stay until newer ones arrive.
+		if entry.Capabilities != nil && v.CapsSeq >= kp.verified.CapsSeq {
+			kp.Capabilities = entry.Capabilities
+		} else {
+			v.Capabilities, v.CapsSeq = kp.verified.Capabilities, kp.verified.CapsSeq
+		}
+		kp.verified = v
+		return false
+	}
+
+	if source != v.ID && b.fromSource(source) >= maxPeersPerSource {
+		return false
+	}
+	if len(b.peers) >= maxPeerBookSize && !b.evict() {
+		return false
+	}
+	b.peers[v.ID] = &knownPeer{
+		ID:           v.ID,
+		Record:       entry.Record,
+		Capabilities: entry.Capabilities,
+		Seq:          v.Seq,
+		Source:       source,
+		Added:        now,
+		LastSeen:     now,
+		verified:     v,
+	}
+	peerBookSize.Set(float64(len(b.peers)))
+	return true
+}
+
+// fromSource returns the number of peers learned from source.  The caller
+// must hold mtx.
+func (b *peerBook) fromSource(source peer.ID) int {
+	n := 0
+	for _, kp := range b.peers {
+		if kp.Source == source && kp.ID != source {
+			n++
+		}
+	}
+	return n
+}
+
+// evict drops the peer that was last around the longest ago, preferring
+// peers that never answered.  The caller must hold mtx.
+func (b *peerBook) evict() bool {
+	var worst *knownPeer
+	for _, kp := range b.peers {
+		if worst == nil ||
+			(kp.LastSuccess.IsZero() && !worst.LastSuccess.IsZero()) ||
+			(kp.LastSuccess.IsZero() == worst.LastSuccess.IsZero() && kp.lastGood().Before(worst.lastGood())) {
+			worst = kp
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(b.peers, worst.ID)
+	return true
+}
+
+// markAttempt records a connection attempt to p and whether it succeeded.
+func (b *peerBook) markAttempt(p peer.ID, ok bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	kp, found := b.peers[p]
+	if !found {
+		return
+	}
+	now := time.Now()
+	kp.LastAttempt = now
+	if ok {
+		kp.LastSuccess = now
+		kp.Attempts = 0
+	} else {
+		kp.Attempts++
+	}
+}
+
+// sample returns up to n entries other than exclude, favouring peers that
+// were around recently.
+func (b *peerBook) sample(n int, exclude peer.ID) []pex.Entry {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	candidates := make([]*knownPeer, 0, len(b.peers))
+	for _, kp := range b.peers {
+		if kp.ID != exclude && kp.Attempts < 3 {
+			candidates = append(candidates, kp)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	// Keep the most recent half of a shuffled list so long-gone peers
+	// still get passed on now and then.
+	if len(candidates) > 2*n {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].lastGood().After(candidates[j].lastGood())
+		})
+		candidates = candidates[:2*n]
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	entries := make([]pex.Entry, 0, min(n, len(candidates)))
+	for _, kp := range candidates[:min(n, len(candidates))] {
+		entries = append(entries, pex.Entry{Record: kp.Record, Capabilities: kp.Capabilities})
+	}
+	return entries
+}
+
+// best returns up to n peers to connect to, those that answered most
+// recently first.
+func (b *peerBook) best(n int) []*pex.Peer {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	candidates := make([]*knownPeer, 0, len(b.peers))
+	for _, kp := range b.peers {
+		candidates = append(candidates, kp)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Attempts != candidates[j].Attempts {
+			return candidates[i].Attempts < candidates[j].Attempts
+		}
+		return candidates[i].lastGood().After(candidates[j].lastGood())
+	})
+	best := make([]*pex.Peer, 0, min(n, len(candidates)))
+	for _, kp := range candidates[:min(n, len(candidates))] {
+		best = append(best, kp.verified)
+	}
+	return best
+}
+
+// list returns the peer book for the API, most recently seen first.
+func (b *peerBook) list() []api.KnownPeer {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	list := make([]api.KnownPeer, 0, len(b.peers))
+	for _, kp := range b.peers {
+		p := api.KnownPeer{
+			PeerID:       kp.ID.String(),
+			Addrs:        make([]string, 0, len(kp.verified.Addrs)),
+			Capabilities: kp.verified.Capabilities,
+			Added:        kp.Added.UTC(),
+			LastSeen:     kp.LastSeen.UTC(),
+			Attempts:     kp.Attempts,
+		}
+		if p.Capabilities == nil {
+			p.Capabilities = []string{}
+		}
+		for _, addr := range kp.verified.Addrs {
+			p.Addrs = append(p.Addrs, addr.String())
+		}
+		if kp.Source != "" && kp.Source != kp.ID {
+			p.Source = kp.Source.String()
+		}
+		if !kp.LastSuccess.IsZero() {
+			t := kp.LastSuccess.UTC()
+			p.LastSuccess = &t
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"dht/pex"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Peers exchange signed records of the peers they know on pex.Protocol
+// (see the pex package for the records and how they are checked).
+const (
+	// pexInterval is how often peers are exchanged with a connected peer.
+	pexInterval = 30 * time.Minute
+
+	// pexTimeout bounds a whole exchange.
+	pexTimeout = time.Minute
+
+	// peerBookDials is how many peers from the book are dialed at startup
+	// and when the node runs low on connections.
+	peerBookDials = 8
+
+	// minConnectedPeers is the number of connections below which peers
+	// from the book are dialed.
+	minConnectedPeers = 4
+)
+
+var (
+	// proxyCapable is set while this node is registered as a proxy.
+	proxyCapable atomic.Bool
+
+	// publiclyReachable is set while AutoNAT finds this node reachable
+	// from the internet, which makes it useful as a relay.
+	publiclyReachable atomic.Bool
+)
+
+// localCapabilities returns what this node currently offers.
+func localCapabilities() []string {
+	caps := []string{pex.CapProvider}
+	if proxyCapable.Load() {
+		caps = append(caps, pex.CapProxy)
+	}
+	if publiclyReachable.Load() {
+		caps = append(caps, pex.CapRelay)
+	}
+	return caps
+}
+
+// learnPeer verifies e, received from source, and adds it to the peer book
+// and the peerstore.  It reports whether the peer is new to the book.
+func learnPeer(node host.Host, e pex.Entry, source peer.ID) (*pex.Peer, bool, error) {
+	v, err := pex.Verify(e)
+	if err != nil {
+		return nil, false, err
+	}
+	if v.ID == node.ID() {
+		return v, false, nil
+	}
+	if cab, ok := peerstore.GetCertifiedAddrBook(node.Peerstore()); ok {
+		if _, err := cab.ConsumePeerRecord(v.Envelope, peerstore.RecentlyConnectedAddrTTL); err != nil {
+			peerLog.Debugf("Failed to store record of %s: %v", v.ID, err)
+		}
+	}
+	return v, peers.add(v, e, source), nil
+}
+
+// handlePex answers peer exchange requests.
+func handlePex(node host.Host) {
+	node.SetStreamHandler(pex.Protocol, func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		if isBanned(remote) {
+			s.Reset()
+			return
+		}
+		if !allowMessage(peerExchangeLimiters, remote) {
+			s.Reset()
+			return
+		}
+
+		if err := s.SetDeadline(time.Now().Add(pexTimeout)); err != nil {
+			peerLog.Debugf("Failed to set deadline on stream of %s: %v", remote, err)
+		}
+		data, err := readMessage(s, maxPeerExchangeSize)
+		switch {
+		case errors.Is(err, errMessageTooLarge):
+			misbehave(remote, misbehaviorOversized, err.Error())
+			return
+		case isTimeout(err):
+			misbehave(remote, misbehaviorTimeout, "peer exchange request not closed in time")
+			return
+		case err != nil:
+			peerLog.Debugf("Error reading peer exchange request of %s: %v", remote, err)
+			return
+		}
+		var req pex.Request
+		if err := json.Unmarshal(data, &req); err != nil {
+			misbehave(remote, misbehaviorMalformed, err.Error())
+			return
+		}
+		v, _, err := learnPeer(node, req.Self, remote)
+		if err == nil && v.ID != remote {
+			err = fmt.Errorf("%w: %s sent the record of %s as its own", pex.ErrBadSignature, remote, v.ID)
+		}
+		if err != nil {
+			misbehave(remote, misbehaviorMalformed, err.Error())
+			return
+		}
+		peers.markAttempt(remote, true)
+
+		self, err := pex.LocalEntry(node, localCapabilities())
+		if err != nil {
+			peerLog.Errorf("Failed to answer peer exchange: %v", err)
+			return
+		}
+		resp := pex.Response{Self: self, Peers: peers.sample(min(max(req.Want, 0), pex.MaxPeers), remote)}
+		if err := json.NewEncoder(s).Encode(&resp); err != nil {
+			peerLog.Debugf("Failed to send peers to %s: %v", remote, err)
+			pexExchangesTotal.WithLabelValues("inbound", "error").Inc()
+			return
+		}
+		pexExchangesTotal.WithLabelValues("inbound", "ok").Inc()
+		peerLog.Debugf("Sent %d peers to %s", len(resp.Peers), remote)
+	})
+}
+
+// exchangePeers asks p for peers and dials some of the new ones.
+func exchangePeers(node host.Host, p peer.ID) error {
+	learned, err := requestPeers(node, p)
+	pexExchangesTotal.WithLabelValues("outbound", resultLabel(err)).Inc()
+	if err != nil {
+		return err
+	}
+	dialed := 0
+	for _, v := range learned {
+		if dialed == maxPeerExchangeDials {
+			break
+		}
+		if isBanned(v.ID) || node.Network().Connectedness(v.ID) == network.Connected {
+			continue
+		}
+		go dialKnownPeer(node, v)
+		dialed++
+	}
+	return nil
+}
+
+// requestPeers runs one peer exchange with p and returns the peers that were
+// new to the book.
+func requestPeers(node host.Host, p peer.ID) ([]*pex.Peer, error) {
+	ctx, cancel := context.WithTimeout(globalCtx, pexTimeout)
+	defer cancel()
+
+	self, err := pex.LocalEntry(node, localCapabilities())
+	if err != nil {
+		return nil, err
+	}
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, pex.Protocol), p, pex.Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open peer exchange stream to %s: %w", p, err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetDeadline(deadline); err != nil {
+			peerLog.Debugf("Failed to set deadline on stream of %s: %v", p, err)
+		}
+	}
+
+	if err := json.NewEncoder(s).Encode(&pex.Request{Self: self, Want: pex.MaxPeers}); err != nil {
+		return nil, fmt.Errorf("failed to send peer exchange request to %s: %w", p, err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("failed to send peer exchange request to %s: %w", p, err)
+	}
+	data, err := readMessage(s, maxPeerExchangeSize)
+	if errors.Is(err, errMessageTooLarge) {
+		misbehave(p, misbehaviorOversized, err.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peers from %s: %w", p, err)
+	}
+
+	var resp pex.Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		misbehave(p, misbehaviorMalformed, err.Error())
+		return nil, fmt.Errorf("%w from %s: %v", errMalformedMessage, p, err)
+	}
+	v, _, err := learnPeer(node, resp.Self, p)
+	if err == nil && v.ID != p {
+		err = fmt.Errorf("%w: %s sent the record of %s as its own", pex.ErrBadSignature, p, v.ID)
+	}
+	if err != nil {
+		misbehave(p, misbehaviorMalformed, err.Error())
+		return nil, err
+	}
+	peers.markAttempt(p, true)
+
+	if len(resp.Peers) > pex.MaxPeers {
+		misbehave(p, misbehaviorOversized, fmt.Sprintf("%d peers sent", len(resp.Peers)))
+		resp.Peers = resp.Peers[:pex.MaxPeers]
+	}
+	var learned []*pex.Peer
+	for _, e := range resp.Peers {
+		v, isNew, err := learnPeer(node, e, p)
+		if err != nil {
+			misbehave(p, misbehaviorMalformed, err.Error())
+			return learned, err
+		}
+		if isNew {
+			learned = append(learned, v)
+		}
+	}
+	peerLog.Debugf("Received %d peers from %s, %d new", len(resp.Peers), p, len(learned))
+	return learned, nil
+}
+
+// dialKnownPeer connects to v at its signed addresses, or through the relay
+// if none of them work.
+func dialKnownPeer(node host.Host, v *pex.Peer) {
+	ctx, cancel := context.WithTimeout(globalCtx, pexTimeout)
+	defer cancel()
+
+	err := node.Connect(ctx, peer.AddrInfo{ID: v.ID, Addrs: v.Addrs})
+	if err != nil {
+		relayAddr, rerr := multiaddr.NewMultiaddr(relay_node_addr)
+		if rerr == nil {
+			if addr, rerr := relayedAddr(relayAddr, v.ID.String()); rerr == nil {
+				err = node.Connect(ctx, peer.AddrInfo{ID: v.ID, Addrs: []multiaddr.Multiaddr{addr}})
+			}
+		}
+	}
+	peers.markAttempt(v.ID, err == nil)
+	if err != nil {
+		peerLog.Debugf("Failed to connect to known peer %s: %v", v.ID, err)
+		return
+	}
+	peerLog.Debugf("Connected to known peer %s", v.ID)
+}
+
+// runPeerExchange exchanges peers with every peer that is identified as
+// speaking pex.Protocol, dials peers from the book while the node has few
+// connections and saves the book periodically.
+func runPeerExchange(node host.Host) {
+	sub, err := node.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerIdentificationCompleted),
+	})
+	if err != nil {
+		peerLog.Errorf("Failed to subscribe to peer identification: %v", err)
+		return
+	}
+	defer sub.Close()
+
+	for _, v := range peers.best(peerBookDials) {
+		go dialKnownPeer(node, v)
+	}
+
+	exchangeTicker := time.NewTicker(pexInterval)
+	defer exchangeTicker.Stop()
+	saveTicker := time.NewTicker(peerBookSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case e := <-sub.Out():
+			switch e := e.(type) {
+			case event.EvtPeerIdentificationCompleted:
+				if slices.Contains(e.Protocols, pex.Protocol) && !isBanned(e.Peer) {
+					go func(p peer.ID) {
+						if err := exchangePeers(node, p); err != nil {
+							peerLog.Debugf("Peer exchange with %s: %v", p, err)
+						}
+					}(e.Peer)
+				}
+			}
+
+		case <-exchangeTicker.C:
+			connected := node.Network().Peers()
+			rand.Shuffle(len(connected), func(i, j int) {
+				connected[i], connected[j] = connected[j], connected[i]
+			})
+			for _, p := range connected {
+				if protos, err := node.Peerstore().SupportsProtocols(p, pex.Protocol); err == nil && len(protos) > 0 {
+					go func(p peer.ID) {
+						if err := exchangePeers(node, p); err != nil {
+							peerLog.Debugf("Peer exchange with %s: %v", p, err)
+						}
+					}(p)
+					break
+				}
+			}
+			if len(node.Network().Peers()) < minConnectedPeers {
+				for _, v := range peers.best(peerBookDials) {
+					if node.Network().Connectedness(v.ID) != network.Connected {
+						go dialKnownPeer(node, v)
+					}
+				}
+			}
+
+		case <-saveTicker.C:
+			if err := peers.save(); err != nil {
+				peerLog.Warnf("Failed to save peer book: %v", err)
+			}
+
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
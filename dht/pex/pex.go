@@ -0,0 +1,183 @@
+// Package pex defines the records exchanged on the authenticated peer
+// exchange protocol and how they are checked, shared by the DHT node and the
+// bootstrap node so both accept and hand out the same peers.
+//
+// The dialing side sends a Request carrying its own records and how many
+// peers it wants, and the other side answers with a Response holding its own
+// records and a sample of the peers it knows.  Every peer is described by a
+// libp2p peer record envelope, holding its addresses, and a capabilities
+// envelope, both signed by the peer itself, so records can be passed on by
+// others without being forged.
+package pex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// Protocol is the authenticated peer exchange protocol.
+	Protocol = "/orcanet/pex/1.0.0"
+
+	// CapabilitiesDomain is the signature domain of capability records.
+	CapabilitiesDomain = "orcanet-peer-capabilities"
+
+	// MaxPeers is the most peers asked for or handed out in one exchange.
+	MaxPeers = 32
+
+	// MaxAddrs is the most addresses of a peer that are used.  Records
+	// with more are accepted, but the extra addresses are dropped.
+	MaxAddrs = 16
+)
+
+// Capabilities a peer can advertise.
+const (
+	CapProvider = "provider"
+	CapProxy    = "proxy"
+	CapRelay    = "relay"
+)
+
+// knownCapabilities lists the capabilities understood; others are dropped.
+var knownCapabilities = []string{CapProvider, CapProxy, CapRelay}
+
+// capabilitiesCodec is the payload type of capability records.
+var capabilitiesCodec = []byte("/orcanet/peer-capabilities")
+
+var (
+	// ErrMalformedRecord is returned for records that can't be decoded.
+	ErrMalformedRecord = errors.New("malformed peer exchange record")
+
+	// ErrBadSignature is returned for a record not signed by the peer it
+	// describes.
+	ErrBadSignature = errors.New("record not signed by its peer")
+)
+
+func init() {
+	record.RegisterType(&CapabilitiesRecord{})
+}
+
+// CapabilitiesRecord lists what a peer offers besides the DHT.
+type CapabilitiesRecord struct {
+	PeerID       peer.ID  `json:"peer_id"`
+	Seq          uint64   `json:"seq"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (r *CapabilitiesRecord) Domain() string { return CapabilitiesDomain }
+
+func (r *CapabilitiesRecord) Codec() []byte { return capabilitiesCodec }
+
+func (r *CapabilitiesRecord) MarshalRecord() ([]byte, error) { return json.Marshal(r) }
+
+func (r *CapabilitiesRecord) UnmarshalRecord(data []byte) error { return json.Unmarshal(data, r) }
+
+// Entry is a peer as exchanged: its signed peer record and, optionally, its
+// signed capabilities.
+type Entry struct {
+	Record       []byte `json:"record"`
+	Capabilities []byte `json:"capabilities,omitempty"`
+}
+
+// Request asks a peer for up to Want of the peers it knows.
+type Request struct {
+	Self Entry `json:"self"`
+	Want int   `json:"want"`
+}
+
+// Response answers a Request.
+type Response struct {
+	Self  Entry   `json:"self"`
+	Peers []Entry `json:"peers"`
+}
+
+// Peer is what an Entry whose signatures check out says.
+type Peer struct {
+	ID           peer.ID
+	Addrs        []multiaddr.Multiaddr
+	Seq          uint64
+	Capabilities []string
+	CapsSeq      uint64
+
+	// Envelope is the signed peer record, for the certified address book.
+	Envelope *record.Envelope
+}
+
+// Verify checks the signatures of e and returns what it says.  Only the
+// first MaxAddrs addresses and the known capabilities are kept.
+func Verify(e Entry) (*Peer, error) {
+	env, rec, err := record.ConsumeEnvelope(e.Record, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: peer record: %v", ErrMalformedRecord, err)
+	}
+	pr, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a peer record", ErrMalformedRecord)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil || signer != pr.PeerID {
+		return nil, fmt.Errorf("%w: peer record of %s", ErrBadSignature, pr.PeerID)
+	}
+	v := &Peer{ID: pr.PeerID, Addrs: pr.Addrs, Seq: pr.Seq, Envelope: env}
+	if len(v.Addrs) > MaxAddrs {
+		v.Addrs = v.Addrs[:MaxAddrs]
+	}
+	if e.Capabilities == nil {
+		return v, nil
+	}
+
+	capsEnv, rec, err := record.ConsumeEnvelope(e.Capabilities, CapabilitiesDomain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: capabilities of %s: %v", ErrMalformedRecord, pr.PeerID, err)
+	}
+	cr, ok := rec.(*CapabilitiesRecord)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a capabilities record", ErrMalformedRecord)
+	}
+	signer, err = peer.IDFromPublicKey(capsEnv.PublicKey)
+	if err != nil || signer != pr.PeerID || cr.PeerID != pr.PeerID {
+		return nil, fmt.Errorf("%w: capabilities of %s", ErrBadSignature, pr.PeerID)
+	}
+	v.CapsSeq = cr.Seq
+	for _, c := range cr.Capabilities {
+		if slices.Contains(knownCapabilities, c) && !slices.Contains(v.Capabilities, c) {
+			v.Capabilities = append(v.Capabilities, c)
+		}
+	}
+	return v, nil
+}
+
+// LocalEntry returns the signed records of node, advertising caps.
+func LocalEntry(node host.Host, caps []string) (Entry, error) {
+	key := node.Peerstore().PrivKey(node.ID())
+	if key == nil {
+		return Entry{}, errors.New("no private key for the local peer")
+	}
+	env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: node.ID(), Addrs: node.Addrs()}), key)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to sign peer record: %w", err)
+	}
+	rec, err := env.Marshal()
+	if err != nil {
+		return Entry{}, err
+	}
+	capsEnv, err := record.Seal(&CapabilitiesRecord{
+		PeerID:       node.ID(),
+		Seq:          peer.TimestampSeq(),
+		Capabilities: caps,
+	}, key)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to sign capabilities: %w", err)
+	}
+	capsData, err := capsEnv.Marshal()
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Record: rec, Capabilities: capsData}, nil
+}
@@ -0,0 +1,124 @@
+package pex
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// testKey returns a new random private key and its peer ID.
+func testKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to derive peer ID: %v", err)
+	}
+	return priv, id
+}
+
+// seal signs rec with key, failing the test on error.
+func seal(t *testing.T, rec record.Record, key crypto.PrivKey) []byte {
+	t.Helper()
+	env, err := record.Seal(rec, key)
+	if err != nil {
+		t.Fatalf("failed to seal record: %v", err)
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal record: %v", err)
+	}
+	return data
+}
+
+// testAddrs returns n distinct addresses.
+func testAddrs(t *testing.T, n int) []multiaddr.Multiaddr {
+	t.Helper()
+	addrs := make([]multiaddr.Multiaddr, n)
+	for i := range addrs {
+		addrs[i] = multiaddr.StringCast(fmt.Sprintf("/ip4/192.0.2.1/tcp/%d", 4000+i))
+	}
+	return addrs
+}
+
+// peerRecord returns the signed peer record of id at addrs.
+func peerRecord(t *testing.T, key crypto.PrivKey, id peer.ID, addrs []multiaddr.Multiaddr) []byte {
+	t.Helper()
+	return seal(t, peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: id, Addrs: addrs}), key)
+}
+
+// TestVerify checks that a peer's own records are accepted, with its
+// addresses capped at MaxAddrs and unknown or repeated capabilities
+// dropped.
+func TestVerify(t *testing.T) {
+	key, id := testKey(t)
+	e := Entry{
+		Record: peerRecord(t, key, id, testAddrs(t, MaxAddrs+4)),
+		Capabilities: seal(t, &CapabilitiesRecord{
+			PeerID:       id,
+			Seq:          7,
+			Capabilities: []string{CapRelay, "teleport", CapRelay, CapProvider},
+		}, key),
+	}
+	v, err := Verify(e)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if v.ID != id || v.CapsSeq != 7 || v.Envelope == nil {
+		t.Fatalf("Verify returned %+v", v)
+	}
+	if len(v.Addrs) != MaxAddrs {
+		t.Errorf("got %d addresses, want %d", len(v.Addrs), MaxAddrs)
+	}
+	if want := []string{CapRelay, CapProvider}; !slices.Equal(v.Capabilities, want) {
+		t.Errorf("got capabilities %v, want %v", v.Capabilities, want)
+	}
+
+	v, err = Verify(Entry{Record: e.Record})
+	if err != nil || v.ID != id || v.Capabilities != nil {
+		t.Fatalf("without capabilities: got %+v, %v", v, err)
+	}
+}
+
+// TestVerifyRejects checks that records not signed by the peer they
+// describe, or that aren't what they claim to be, are rejected.
+func TestVerifyRejects(t *testing.T) {
+	key, id := testKey(t)
+	otherKey, other := testKey(t)
+	addrs := testAddrs(t, 2)
+	rec := peerRecord(t, key, id, addrs)
+	caps := func(key crypto.PrivKey, id peer.ID) []byte {
+		return seal(t, &CapabilitiesRecord{PeerID: id, Seq: 1, Capabilities: []string{CapRelay}}, key)
+	}
+
+	tests := []struct {
+		name  string
+		entry Entry
+		want  error
+	}{
+		{"record signed by another peer", Entry{Record: peerRecord(t, otherKey, id, addrs)}, ErrBadSignature},
+		{"capabilities signed by another peer", Entry{Record: rec, Capabilities: caps(otherKey, id)}, ErrBadSignature},
+		{"capabilities of another peer", Entry{Record: rec, Capabilities: caps(key, other)}, ErrBadSignature},
+		{"garbage record", Entry{Record: []byte("record")}, ErrMalformedRecord},
+		{"capabilities as the record", Entry{Record: caps(key, id)}, ErrMalformedRecord},
+		{"record as the capabilities", Entry{Record: rec, Capabilities: rec}, ErrMalformedRecord},
+		{"garbage capabilities", Entry{Record: rec, Capabilities: []byte("caps")}, ErrMalformedRecord},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(tt.entry); !errors.Is(err, tt.want) {
+				t.Errorf("Verify returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
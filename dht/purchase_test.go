@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dht/api"
+
+	"lukechampine.com/blake3"
+)
+
+// withDenylist runs the test with a denylist denying hashes.
+func withDenylist(t *testing.T, hashes ...string) {
+	t.Helper()
+	d, err := loadDenylist(filepath.Join(t.TempDir(), "denylist.txt"), nil)
+	if err != nil {
+		t.Fatalf("loadDenylist: %v", err)
+	}
+	for _, hash := range hashes {
+		if _, err := d.add(api.DenyDigest(hash)); err != nil {
+			t.Fatalf("failed to deny %s: %v", hash, err)
+		}
+	}
+	old := denied
+	denied = d
+	t.Cleanup(func() { denied = old })
+}
+
+// TestLegacyPurchaseRefused checks that the legacy purchase endpoint
+// refuses denied content and banned providers before fetching or paying.
+func TestLegacyPurchaseRefused(t *testing.T) {
+	resetAbuse(t)
+	deniedHash := rootCID(blake3.Sum256([]byte("denied"))).String()
+	hash := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	withDenylist(t, deniedHash)
+	provider, banned := testPeerID(t), testPeerID(t)
+	banPeer(banned, time.Time{}, "test")
+
+	tests := []struct {
+		name string
+		peer string
+		hash string
+		want int
+	}{
+		{"denied content", provider.String(), deniedHash, http.StatusUnavailableForLegalReasons},
+		{"banned provider", banned.String(), hash, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"id":"` + test.peer + `","hash":"` + test.hash + `","cost":1,"address":"addr"}`
+			r := httptest.NewRequest(http.MethodPost, "/purchase", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			handlePurchase(w, r)
+			if w.Code != test.want {
+				t.Fatalf("got status %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"dht/api"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// With re-seeding on, a verified purchase is stored as a cached file and
+// provided to the DHT at a resale price, so popular files spread to their
+// buyers.  A royalty share of every sale of the file is owed to its
+// original publisher.  The publisher is named by a publication record it
+// signed, which providers send with the file's metadata and resellers keep
+// and pass on unchanged, so it survives any number of resales and can't be
+// replaced by a reseller.  Royalties accrue as sales are recorded in the
+// ledger and owed royalties are paid out every royaltyPayoutInterval.
+const (
+	// publicationDomain is the signature domain of publication records.
+	publicationDomain = "orcanet-publication"
+
+	// maxPublicationSize is the largest sealed publication record accepted.
+	maxPublicationSize = 1 << 10
+
+	// royaltyPayoutInterval is how often owed royalties are paid.
+	royaltyPayoutInterval = time.Hour
+
+	// minRoyaltyPayout is the smallest royalty payment made.  Smaller
+	// amounts are carried over to the next payout.
+	minRoyaltyPayout btcutil.Amount = 100000
+)
+
+// publicationCodec is the payload type of publication records.
+var publicationCodec = []byte("/orcanet/publication")
+
+func init() {
+	record.RegisterType(&publicationRecord{})
+}
+
+// publicationRecord says that Publisher published the file Hash.
+type publicationRecord struct {
+	Publisher peer.ID   `json:"publisher"`
+	Hash      string    `json:"hash"`
+	Time      time.Time `json:"time"`
+}
+
+func (r *publicationRecord) Domain() string { return publicationDomain }
+
+func (r *publicationRecord) Codec() []byte { return publicationCodec }
+
+func (r *publicationRecord) MarshalRecord() ([]byte, error) { return json.Marshal(r) }
+
+func (r *publicationRecord) UnmarshalRecord(data []byte) error { return json.Unmarshal(data, r) }
+
+// sealPublication signs a record of this node publishing hash.
+func sealPublication(hash string) ([]byte, error) {
+	key := node.Peerstore().PrivKey(node.ID())
+	if key == nil {
+		return nil, fmt.Errorf("no private key for the local peer")
+	}
+	env, err := record.Seal(&publicationRecord{Publisher: node.ID(), Hash: hash, Time: time.Now().UTC()}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign publication of %s: %w", hash, err)
+	}
+	return env.Marshal()
+}
+
+// openPublication verifies that data is a publication record of hash signed
+// by its publisher and returns the publisher.
+func openPublication(data []byte, hash string) (peer.ID, error) {
+	if len(data) > maxPublicationSize {
+		return "", fmt.Errorf("%w: publication record of %d bytes", errMalformedMessage, len(data))
+	}
+	env, rec, err := record.ConsumeEnvelope(data, publicationDomain)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	pub, ok := rec.(*publicationRecord)
+	if !ok {
+		return "", fmt.Errorf("%w: not a publication record", errMalformedMessage)
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil || signer != pub.Publisher {
+		return "", fmt.Errorf("%w: publication of %s not signed by its publisher", errMalformedMessage, pub.Hash)
+	}
+	if pub.Hash != hash {
+		return "", fmt.Errorf("%w: publication of %s sent for %s", errMalformedMessage, pub.Hash, hash)
+	}
+	return pub.Publisher, nil
+}
+
+// filePublication returns the sealed publication record of the stored file
+// hash: the one it was re-seeded with, none for other downloads, and a new
+// one naming this node for files it published.
+func filePublication(hash string, record map[string]interface{}) ([]byte, error) {
+	if pub, ok := record["publication"].(primitive.Binary); ok {
+		return pub.Data, nil
+	}
+	if filename, _ := record["filename"].(string); isDownload(filename) {
+		return nil, nil
+	}
+	return sealPublication(hash)
+}
+
+// resaleTerms are the terms a re-seeded file is sold on.
+type resaleTerms struct {
+	Price   btcutil.Amount
+	Royalty float64
+}
+
+// resaleTermsFor returns the terms the purchase req is re-seeded under, or
+// nil if it isn't.  Fields set in the request override the configuration.
+func resaleTermsFor(req *api.PurchaseRequest) *resaleTerms {
+	reseed := cfg.Reseed
+	if req.Reseed != nil {
+		reseed = *req.Reseed
+	}
+	if !reseed {
+		return nil
+	}
+	terms := resaleTerms{Price: cfg.ResalePrice, Royalty: cfg.Royalty}
+	if terms.Price < 0 {
+		terms.Price = btcutil.Amount(req.Cost)
+	}
+	if req.ResalePrice != nil {
+		terms.Price = btcutil.Amount(*req.ResalePrice)
+	}
+	if req.Royalty != nil {
+		terms.Royalty = *req.Royalty
+	}
+	return &terms
+}
+
+// keepPurchase stores a verified purchase, re-seeding it if req asks for it
+// or the node is configured to.
+func keepPurchase(req *api.PurchaseRequest, filename string, data []byte) {
+	if deniedContent(req.Hash, "reseed") {
+		return
+	}
+	if req.Token != "" {
+		// A private file is kept for its buyer alone, never served on.
+		cacheDownload(req.Hash, filename, data, fileAccess{Visibility: visibilityPrivate})
+		return
+	}
+	terms := resaleTermsFor(req)
+	if terms == nil {
+		cacheDownload(req.Hash, filename, data, unlistedAccess)
+		return
+	}
+	if _, ok := parseContentID(req.Hash); !ok {
+		xferLog.Debugf("Not re-seeding %s: legacy hashes can't be verified", req.Hash)
+		return
+	}
+	publication, publisher, err := fetchPublication(req.PeerID, req.Hash)
+	if err != nil {
+		xferLog.Infof("Not re-seeding %s: %v", req.Hash, err)
+		cacheDownload(req.Hash, filename, data, unlistedAccess)
+		return
+	}
+
+	name := cachePath(req.Hash, filename)
+	stored, err := storeFile(bytes.NewReader(data), name, terms.Price, publicAccess, true)
+	if err == errFileExists {
+		touchFile(req.Hash)
+		return
+	}
+	if err != nil {
+		xferLog.Warnf("Failed to re-seed %s: %v", req.Hash, err)
+		return
+	}
+	if err := SetFileResale(stored, publisher.String(), terms.Royalty, publication); err != nil {
+		xferLog.Warnf("Failed to record resale terms of %s: %v", stored, err)
+	}
+	xferLog.Infof("Re-seeding %s at %s, %v%% royalty to %s", stored, formatCost(terms.Price), terms.Royalty, publisher)
+	notifyEvent(api.EventUploadCompleted, api.UploadEvent{Hash: stored, Filename: name, Cost: api.Amount(terms.Price)})
+}
+
+// fetchPublication asks providerID for the publication record of hash and
+// returns it with the publisher it names.
+func fetchPublication(providerID, hash string) ([]byte, peer.ID, error) {
+	p, err := peer.Decode(providerID)
+	if err != nil {
+		return nil, "", err
+	}
+	reply, err := fetchMetaReply(node, p, hash)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(reply.Publication) == 0 {
+		return nil, "", fmt.Errorf("%s doesn't name the publisher of %s", p, hash)
+	}
+	publisher, err := openPublication(reply.Publication, hash)
+	if err != nil {
+		return nil, "", err
+	}
+	return reply.Publication, publisher, nil
+}
+
+// royaltyOwed returns the royalty percent royalty of a sale for amount.
+func royaltyOwed(amount btcutil.Amount, royalty float64) btcutil.Amount {
+	if amount <= 0 || royalty <= 0 {
+		return 0
+	}
+	return btcutil.Amount(math.Round(float64(amount) * royalty / 100))
+}
+
+// accrueRoyalty adds the royalty owed to the publisher of the file record
+// for a sale of it for amount.  Only files re-seeded with a publication
+// record owe royalties, and none are owed to this node.
+func accrueRoyalty(record map[string]interface{}, amount btcutil.Amount) {
+	hash, _ := record["hash"].(string)
+	publisher, _ := record["publisher"].(string)
+	royalty, _ := record["royalty"].(float64)
+	if _, ok := record["publication"]; !ok || publisher == "" || publisher == node.ID().String() {
+		return
+	}
+	owed := royaltyOwed(amount, royalty)
+	if owed <= 0 {
+		return
+	}
+	if err := AddRoyaltyOwed(hash, owed); err != nil {
+		xferLog.Errorf("Failed to record royalty of %s owed for %s: %v", formatCost(owed), hash, err)
+		return
+	}
+	xferLog.Debugf("Owe %s royalty for %s to %s", formatCost(owed), hash, publisher)
+}
+
+// payRoyalties settles owed royalties every interval.
+func payRoyalties(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			settleRoyalties()
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
+
+// settleRoyalties pays every publisher owed at least minRoyaltyPayout.
+func settleRoyalties() {
+	records, err := FetchAllFileRecords()
+	if err != nil {
+		xferLog.Errorf("Failed to load files to settle royalties: %v", err)
+		return
+	}
+	for _, record := range records {
+		hash, _ := record["hash"].(string)
+		publisher, _ := record["publisher"].(string)
+		owed := recordAmount(record, "royalty_owed")
+		if publisher == "" || owed < minRoyaltyPayout {
+			continue
+		}
+		if err := payRoyalty(publisher, hash, owed); err != nil {
+			xferLog.Warnf("Failed to pay royalty of %s for %s to %s: %v", formatCost(owed), hash, publisher, err)
+			continue
+		}
+		if err := RecordRoyaltyPaid(hash, owed); err != nil {
+			xferLog.Errorf("Failed to record royalty of %s: %v", hash, err)
+		}
+	}
+}
+
+// payRoyalty pays amount to the wallet publisher published.
+func payRoyalty(publisher, hash string, amount btcutil.Amount) error {
+	address, err := getWalletAddress(ctx, dhtRoute, publisher)
+	if err != nil {
+		return fmt.Errorf("failed to look up wallet of %s: %w", publisher, err)
+	}
+	if _, err := sendPayment(address, amount); err != nil {
+		return err
+	}
+	xferLog.Infof("Paid royalty of %s for %s to %s", formatCost(amount), hash, publisher)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"lukechampine.com/blake3"
+)
+
+// TestPublication checks that only publication records signed by the
+// publisher they name, for the file asked about, are accepted.
+func TestPublication(t *testing.T) {
+	publisherKey, publisher := testPeerKey(t)
+	resellerKey, _ := testPeerKey(t)
+	hash := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	other := rootCID(blake3.Sum256([]byte("other"))).String()
+	rec := publicationRecord{Publisher: publisher, Hash: hash, Time: time.Now().UTC()}
+
+	data := sealTestRecord(t, &rec, publisherKey)
+	got, err := openPublication(data, hash)
+	if err != nil {
+		t.Fatalf("openPublication: %v", err)
+	}
+	if got != publisher {
+		t.Fatalf("got publisher %s, want %s", got, publisher)
+	}
+	if err := checkMetaReply(hash, &metaReply{Found: true, Publication: data}); err != nil {
+		t.Errorf("checkMetaReply rejected a valid publication: %v", err)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+	invalid := []struct {
+		name string
+		data []byte
+		hash string
+	}{
+		{"signed by a reseller", sealTestRecord(t, &rec, resellerKey), hash},
+		{"other file", data, other},
+		{"tampered", tampered, hash},
+		{"garbage", []byte("publication"), hash},
+		{"oversized", make([]byte, maxPublicationSize+1), hash},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := openPublication(test.data, test.hash); !errors.Is(err, errMalformedMessage) {
+				t.Errorf("openPublication returned %v, want %v", err, errMalformedMessage)
+			}
+			reply := metaReply{Found: true, Publication: test.data}
+			if err := checkMetaReply(test.hash, &reply); !errors.Is(err, errMalformedMessage) {
+				t.Errorf("checkMetaReply returned %v, want %v", err, errMalformedMessage)
+			}
+		})
+	}
+}
+
+// TestFilePublication checks that a re-seeded file is served with the
+// publication record it was bought with, so the publisher carries through
+// resales, and that other downloads aren't passed off as published here.
+func TestFilePublication(t *testing.T) {
+	publisherKey, publisher := testPeerKey(t)
+	hash := rootCID(blake3.Sum256([]byte("orcanet"))).String()
+	data := sealTestRecord(t, &publicationRecord{Publisher: publisher, Hash: hash, Time: time.Now().UTC()}, publisherKey)
+
+	resold := map[string]interface{}{
+		"hash":        hash,
+		"filename":    cachePath(hash, "file.txt"),
+		"publisher":   publisher.String(),
+		"publication": primitive.Binary{Data: data},
+	}
+	for range 2 {
+		got, err := filePublication(hash, resold)
+		if err != nil {
+			t.Fatalf("filePublication: %v", err)
+		}
+		if p, err := openPublication(got, hash); err != nil || p != publisher {
+			t.Fatalf("resale names publisher %s (%v), want %s", p, err, publisher)
+		}
+		// The next reseller stores the record it was sent.
+		resold["publication"] = primitive.Binary{Data: got}
+	}
+
+	download := map[string]interface{}{"hash": hash, "filename": cachePath(hash, "file.txt")}
+	if got, err := filePublication(hash, download); err != nil || got != nil {
+		t.Errorf("download: got publication %q, err %v, want none", got, err)
+	}
+}
+
+// TestRoyaltyOwed checks the royalty owed for a sale.
+func TestRoyaltyOwed(t *testing.T) {
+	tests := []struct {
+		amount  btcutil.Amount
+		royalty float64
+		want    btcutil.Amount
+	}{
+		{1_000_000, 10, 100_000},
+		{1_000_000, 0, 0},
+		{1_000_000, 100, 1_000_000},
+		{0, 10, 0},
+		{-1_000_000, 10, 0},
+		{15, 10, 2},
+		{14, 10, 1},
+		{btcutil.MaxSatoshi, 100, btcutil.MaxSatoshi},
+	}
+	for _, test := range tests {
+		if got := royaltyOwed(test.amount, test.royalty); got != test.want {
+			t.Errorf("royaltyOwed(%d, %v) = %d, want %d", test.amount, test.royalty, got, test.want)
+		}
+	}
+}
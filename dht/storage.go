@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Stored files are either pinned or cached.  Pinned files were added by the
+// user and are only removed on request.  Cached files are verified downloads
+// kept so the node can serve them too; when the store grows past the quota
+// the least recently used of them are evicted.
+const (
+	// cacheDir is the directory below the files directory that cached
+	// downloads are stored in, one subdirectory per content ID.
+	cacheDir = "cache"
+
+	// storageGCInterval is how often the store is checked against the
+	// quota, besides before every file is added.
+	storageGCInterval = 10 * time.Minute
+
+	// gcHistoryLimit is the number of garbage collections reported by the
+	// storage endpoint.
+	gcHistoryLimit = 20
+)
+
+// errQuotaExceeded is returned when pinned files leave no room for a file
+// within the storage quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// gcMtx serializes garbage collections so two of them don't evict files for
+// the same shortfall.
+var gcMtx sync.Mutex
+
+// storedFile is a file record as seen by storage accounting.
+type storedFile struct {
+	Hash       string
+	Filename   string
+	Size       int64
+	Cached     bool
+	LastAccess time.Time
+}
+
+// storedFileFromRecord converts a store record.  Records written before
+// sizes were kept are sized from the file on disk.
+func storedFileFromRecord(record map[string]interface{}) storedFile {
+	var f storedFile
+	f.Hash, _ = record["hash"].(string)
+	f.Filename, _ = record["filename"].(string)
+	f.Cached, _ = record["cached"].(bool)
+	if size, ok := record["size"].(int64); ok {
+		f.Size = size
+	} else if info, err := os.Stat(filepath.Join("files", f.Filename)); err == nil {
+		f.Size = info.Size()
+	}
+	if ts, ok := record["last_access"].(primitive.DateTime); ok {
+		f.LastAccess = ts.Time()
+	} else if ts, ok := record["timestamp"].(primitive.DateTime); ok {
+		f.LastAccess = ts.Time()
+	}
+	return f
+}
+
+// listStoredFiles returns every stored file.
+func listStoredFiles() ([]storedFile, error) {
+	records, err := FetchAllFileRecords()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]storedFile, 0, len(records))
+	for _, record := range records {
+		files = append(files, storedFileFromRecord(record))
+	}
+	return files, nil
+}
+
+// storageUsage returns the bytes used by pinned and by cached files.
+func storageUsage(files []storedFile) (pinned, cached int64) {
+	for _, f := range files {
+		if f.Cached {
+			cached += f.Size
+		} else {
+			pinned += f.Size
+		}
+	}
+	storageBytes.WithLabelValues("pinned").Set(float64(pinned))
+	storageBytes.WithLabelValues("cached").Set(float64(cached))
+	return pinned, cached
+}
+
+// ensureSpace makes room for size more bytes within the quota, evicting
+// cached files if needed.
+func ensureSpace(size int64, trigger string) error {
+	if cfg.StorageQuota <= 0 {
+		return nil
+	}
+	_, err := collectGarbage(trigger, size)
+	return err
+}
+
+// collectGarbage evicts the least recently used cached files until the store
+// and need more bytes fit in the quota.  Runs that evicted something are
+// recorded in the history.  It returns errQuotaExceeded if pinned files
+// alone leave no room for need.
+func collectGarbage(trigger string, need int64) (*gcRun, error) {
+	gcMtx.Lock()
+	defer gcMtx.Unlock()
+
+	files, err := listStoredFiles()
+	if err != nil {
+		return nil, err
+	}
+	pinned, cached := storageUsage(files)
+	quota := cfg.StorageQuota
+	run := gcRun{
+		Time:       time.Now(),
+		Trigger:    trigger,
+		Quota:      quota,
+		UsedBefore: pinned + cached,
+		UsedAfter:  pinned + cached,
+	}
+	if quota <= 0 {
+		return &run, nil
+	}
+	if pinned+need > quota {
+		return &run, fmt.Errorf("%w: %d bytes pinned, %d more needed, quota is %d",
+			errQuotaExceeded, pinned, need, quota)
+	}
+
+	var candidates []storedFile
+	for _, f := range files {
+		if f.Cached {
+			candidates = append(candidates, f)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastAccess.Before(candidates[j].LastAccess)
+	})
+	for _, f := range candidates {
+		if run.UsedAfter+need <= quota {
+			break
+		}
+		if err := deleteFile(f.Hash); err != nil && err != errFileNotFound {
+			storLog.Warnf("Failed to evict %s (%s): %v", f.Filename, f.Hash, err)
+			continue
+		}
+		run.UsedAfter -= f.Size
+		run.Evicted = append(run.Evicted, gcEviction{Hash: f.Hash, Filename: f.Filename, Size: f.Size})
+		gcEvictedBytesTotal.Add(float64(f.Size))
+	}
+	if len(run.Evicted) == 0 {
+		return &run, nil
+	}
+
+	storageBytes.WithLabelValues("cached").Set(float64(cached - (run.UsedBefore - run.UsedAfter)))
+	storLog.Infof("Evicted %d cached files, %d bytes in use of %d", len(run.Evicted), run.UsedAfter, quota)
+	if err := StoreGCRun(&run); err != nil {
+		storLog.Warnf("Failed to record garbage collection: %v", err)
+	}
+	if run.UsedAfter+need > quota {
+		return &run, fmt.Errorf("%w: could only free %d bytes", errQuotaExceeded, run.UsedBefore-run.UsedAfter)
+	}
+	return &run, nil
+}
+
+// watchStorage collects garbage every interval, so a lowered quota takes
+// effect without waiting for the next file to be added.
+func watchStorage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := collectGarbage("periodic", 0); err != nil {
+			storLog.Warnf("Storage garbage collection: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-globalCtx.Done():
+			return
+		}
+	}
+}
+
+// cacheDownload keeps a verified download in the store as a cached file
+// with the given access.  Legacy hashes are not cached since their contents
+// can't be checked.
+func cacheDownload(hash, filename string, data []byte, access fileAccess) {
+	if !cfg.CacheDownloads {
+		return
+	}
+	if _, ok := parseContentID(hash); !ok {
+		return
+	}
+	name := cachePath(hash, filename)
+	stored, err := storeFile(bytes.NewReader(data), name, 0, access, true)
+	switch {
+	case err == errFileExists:
+		touchFile(hash)
+	case err != nil:
+		storLog.Warnf("Not caching %s: %v", hash, err)
+	default:
+		storLog.Debugf("Cached %s (%d bytes) as %s", stored, len(data), name)
+	}
+}
+
+// isDownload reports whether the stored file filename was downloaded
+// rather than added by this node.
+func isDownload(filename string) bool {
+	return strings.HasPrefix(filepath.ToSlash(filename), cacheDir+"/")
+}
+
+// cachePath returns the name below the files directory a download of hash
+// called filename is kept as.  Only the base of filename is used, since it
+// comes from the provider.
+func cachePath(hash, filename string) string {
+	base := filepath.Base(filename)
+	if base == "." || base == string(filepath.Separator) || strings.HasPrefix(base, ".") {
+		base = "content"
+	}
+	return filepath.Join(cacheDir, hash, base)
+}
+
+// touchFile marks the file hash as just used, moving it to the back of the
+// eviction order.
+func touchFile(hash string) {
+	if err := TouchFileRecord(hash); err != nil {
+		storLog.Debugf("Failed to update access time of %s: %v", hash, err)
+	}
+}
+
+// storageReport describes the store for the storage endpoint.
+func storageReport() (*api.StorageReport, error) {
+	files, err := listStoredFiles()
+	if err != nil {
+		return nil, err
+	}
+	runs, err := FetchGCRuns(gcHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned, cached := storageUsage(files)
+	report := &api.StorageReport{
+		Quota:       cfg.StorageQuota,
+		Used:        pinned + cached,
+		Pinned:      api.StorageUsage{Bytes: pinned},
+		Cached:      api.StorageUsage{Bytes: cached},
+		PinnedFiles: []api.StoredFile{},
+		GCRuns:      make([]api.GCRun, 0, len(runs)),
+	}
+	for _, f := range files {
+		if f.Cached {
+			report.Cached.Files++
+			continue
+		}
+		report.Pinned.Files++
+		report.PinnedFiles = append(report.PinnedFiles, api.StoredFile{
+			Hash:       f.Hash,
+			Filename:   f.Filename,
+			Size:       f.Size,
+			LastAccess: f.LastAccess.UTC(),
+		})
+	}
+	for i := range runs {
+		report.GCRuns = append(report.GCRuns, gcRunToAPI(&runs[i]))
+	}
+	return report, nil
+}
+
+// gcRunToAPI converts a garbage collection record to its API form.
+func gcRunToAPI(run *gcRun) api.GCRun {
+	r := api.GCRun{
+		Time:       run.Time.UTC(),
+		Trigger:    run.Trigger,
+		Quota:      run.Quota,
+		UsedBefore: run.UsedBefore,
+		UsedAfter:  run.UsedAfter,
+		Evicted:    make([]api.EvictedFile, 0, len(run.Evicted)),
+	}
+	for _, e := range run.Evicted {
+		r.Evicted = append(r.Evicted, api.EvictedFile{Hash: e.Hash, Filename: e.Filename, Size: e.Size})
+	}
+	return r
+}
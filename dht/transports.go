@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	libp2pwebrtc "github.com/libp2p/go-libp2p/p2p/transport/webrtc"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// The node only enables the transports given with -transports, and dials a
+// peer's addresses in the order they are listed: the addresses of the first
+// transport at once, those of each following one a little later if no
+// connection was made yet, and relayed addresses last.  WebSocket,
+// WebTransport and WebRTC let browsers connect; QUIC helps on networks that
+// are hostile to TCP.  Every -listen address must use an enabled transport.
+const (
+	transportTCP          = "tcp"
+	transportQUIC         = "quic"
+	transportWebTransport = "webtransport"
+	transportWebSocket    = "websocket"
+	transportWebRTC       = "webrtc"
+
+	// transportRelay names relayed addresses, which are dialed through
+	// whichever transport reaches the relay.
+	transportRelay = "relay"
+)
+
+// allTransports lists the supported transports.
+var allTransports = []string{transportQUIC, transportTCP, transportWebTransport, transportWebSocket, transportWebRTC}
+
+const (
+	// dialTransportDelay is how long the dial of each transport waits for
+	// the one preferred to it.
+	dialTransportDelay = 250 * time.Millisecond
+
+	// dialRelayDelay is how much longer relayed addresses wait for direct
+	// ones.
+	dialRelayDelay = 500 * time.Millisecond
+)
+
+// transportOption returns the libp2p option enabling the transport name.
+func transportOption(name string) libp2p.Option {
+	switch name {
+	case transportTCP:
+		return libp2p.Transport(tcp.NewTCPTransport)
+	case transportQUIC:
+		return libp2p.Transport(quic.NewTransport)
+	case transportWebTransport:
+		return libp2p.Transport(webtransport.New)
+	case transportWebSocket:
+		return libp2p.Transport(ws.New)
+	case transportWebRTC:
+		return libp2p.Transport(libp2pwebrtc.New)
+	}
+	panic("unknown transport " + name)
+}
+
+// addrTransport returns the transport addr is dialed or listened on with,
+// or an empty string if it isn't supported.
+func addrTransport(addr multiaddr.Multiaddr) string {
+	has := func(code int) bool {
+		_, err := addr.ValueForProtocol(code)
+		return err == nil
+	}
+	switch {
+	case has(multiaddr.P_CIRCUIT):
+		return transportRelay
+	case has(multiaddr.P_WEBTRANSPORT):
+		return transportWebTransport
+	case has(multiaddr.P_WEBRTC_DIRECT):
+		return transportWebRTC
+	case has(multiaddr.P_WS) || has(multiaddr.P_WSS):
+		return transportWebSocket
+	case has(multiaddr.P_QUIC_V1):
+		return transportQUIC
+	case has(multiaddr.P_TCP):
+		return transportTCP
+	}
+	return ""
+}
+
+// checkListenAddrs checks that every address in addrs uses one of the
+// enabled transports.
+func checkListenAddrs(addrs []multiaddr.Multiaddr, transports []string) error {
+	for _, addr := range addrs {
+		t := addrTransport(addr)
+		switch {
+		case t == "" || t == transportRelay:
+			return fmt.Errorf("invalid -listen address %s: no supported transport", addr)
+		case !slices.Contains(transports, t):
+			return fmt.Errorf("invalid -listen address %s: transport %s isn't enabled in -transports", addr, t)
+		}
+	}
+	return nil
+}
+
+// transportOptions returns the libp2p options enabling transports and
+// dialing them in order.
+func transportOptions(transports []string) []libp2p.Option {
+	opts := []libp2p.Option{libp2p.DialRanker(dialRanker(transports))}
+	for _, t := range transports {
+		opts = append(opts, transportOption(t))
+	}
+	return opts
+}
+
+// dialRanker returns a dial ranker that dials addresses in the order of
+// their transports in preference, waiting dialTransportDelay before moving
+// on to the next transport a peer has addresses for, and dials relayed
+// addresses after all direct ones.
+func dialRanker(preference []string) network.DialRanker {
+	return func(addrs []multiaddr.Multiaddr) []network.AddrDelay {
+		rank := func(addr multiaddr.Multiaddr) int {
+			if i := slices.Index(preference, addrTransport(addr)); i >= 0 {
+				return i
+			}
+			return len(preference)
+		}
+		sorted := slices.Clone(addrs)
+		slices.SortStableFunc(sorted, func(a, b multiaddr.Multiaddr) int {
+			return rank(a) - rank(b)
+		})
+
+		res := make([]network.AddrDelay, 0, len(sorted))
+		var delay time.Duration
+		for i, addr := range sorted {
+			if i > 0 && rank(addr) != rank(sorted[i-1]) {
+				if rank(addr) == len(preference) {
+					delay += dialRelayDelay
+				} else {
+					delay += dialTransportDelay
+				}
+			}
+			res = append(res, network.AddrDelay{Addr: addr, Delay: delay})
+		}
+		return res
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"dht/api"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// websocketSendBufferSize is the number of messages that can be
+	// waiting to be written to a websocket client before the notification
+	// queue starts to grow.
+	websocketSendBufferSize = 50
+
+	// websocketWriteWait is how long a single write to a client may take.
+	websocketWriteWait = 10 * time.Second
+
+	// websocketPingInterval is how often clients are pinged.  A client that
+	// has not answered within websocketPongWait is disconnected.
+	websocketPingInterval = 30 * time.Second
+	websocketPongWait     = 2 * websocketPingInterval
+
+	// websocketReadLimit bounds the size of a message a client may send.
+	// Clients only send small subscription requests.
+	websocketReadLimit = 4096
+)
+
+// wsUpgrader upgrades event stream requests.  The Origin header is already
+// checked against the allowlist by the CORS middleware, so it is not checked
+// again here.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// ntfnMgr delivers events to the connected event stream clients.
+var ntfnMgr = newWsNotificationManager()
+
+// notifyEvent queues an event of type typ carrying data for delivery to
+// every client subscribed to it.
+func notifyEvent(typ api.EventType, data interface{}) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		httpLog.Errorf("Failed to marshal %s event: %v", typ, err)
+		return
+	}
+	ntfnMgr.queue(&api.Event{Type: typ, Time: time.Now().UTC(), Data: raw})
+}
+
+// wsNotificationManager is a connection and notification manager used for
+// websocket event stream clients.  Events are queued without blocking the
+// caller and fanned out to the clients subscribed to them.
+type wsNotificationManager struct {
+	// queueNotification queues a notification for handling.
+	queueNotification chan interface{}
+
+	// notificationMsgs feeds notificationHandler with notifications
+	// and client (un)registration requests from a queue as well as
+	// registration and unregistration requests from clients.
+	notificationMsgs chan interface{}
+
+	// Shutdown handling
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// newWsNotificationManager returns a new notification manager ready for use.
+// See Start for how to begin processing.
+func newWsNotificationManager() *wsNotificationManager {
+	return &wsNotificationManager{
+		queueNotification: make(chan interface{}),
+		notificationMsgs:  make(chan interface{}),
+		quit:              make(chan struct{}),
+	}
+}
+
+// Start starts the goroutines required for the manager to queue and process
+// websocket client notifications.
+func (m *wsNotificationManager) Start() {
+	m.wg.Add(2)
+	go func() {
+		queueHandler(m.queueNotification, m.notificationMsgs, m.quit)
+		m.wg.Done()
+	}()
+	go m.notificationHandler()
+}
+
+// Shutdown shuts down the manager, disconnecting every client, and waits for
+// its goroutines to exit.
+func (m *wsNotificationManager) Shutdown() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// queue hands n to the manager.  It does not block once the manager is
+// started, as queueHandler always accepts new input.
+func (m *wsNotificationManager) queue(n interface{}) {
+	select {
+	case m.queueNotification <- n:
+	case <-m.quit:
+	}
+}
+
+// Notification types
+type notificationRegisterClient wsClient
+type notificationUnregisterClient wsClient
+
+// AddClient adds the passed websocket client to the notification manager.
+func (m *wsNotificationManager) AddClient(c *wsClient) {
+	m.queue((*notificationRegisterClient)(c))
+}
+
+// RemoveClient removes the passed websocket client and all notifications
+// registered for it.
+func (m *wsNotificationManager) RemoveClient(c *wsClient) {
+	m.queue((*notificationUnregisterClient)(c))
+}
+
+// queueHandler manages a queue of empty interfaces, reading from in and
+// sending the oldest unsent to out.  This handler stops when either of the
+// in or quit channels are closed, and closes out before returning, without
+// waiting to send any variables still remaining in the queue.
+func queueHandler(in <-chan interface{}, out chan<- interface{}, quit <-chan struct{}) {
+	var q []interface{}
+	var dequeue chan<- interface{}
+	skipQueue := out
+	var next interface{}
+out:
+	for {
+		select {
+		case n, ok := <-in:
+			if !ok {
+				// Sender closed input channel.
+				break out
+			}
+
+			// Either send to out immediately if skipQueue is
+			// non-nil (queue is empty) and reader is ready,
+			// or append to the queue and send later.
+			select {
+			case skipQueue <- n:
+			default:
+				q = append(q, n)
+				dequeue = out
+				skipQueue = nil
+				next = q[0]
+			}
+
+		case dequeue <- next:
+			copy(q, q[1:])
+			q[len(q)-1] = nil // avoid leak
+			q = q[:len(q)-1]
+			if len(q) == 0 {
+				dequeue = nil
+				skipQueue = out
+			} else {
+				next = q[0]
+			}
+
+		case <-quit:
+			break out
+		}
+	}
+	close(out)
+}
+
+// notificationHandler reads notifications and control messages from the
+// queue handler and processes one at a time.
+func (m *wsNotificationManager) notificationHandler() {
+	// clients is a map of all currently connected websocket clients.
+	clients := make(map[chan struct{}]*wsClient)
+
+out:
+	for {
+		select {
+		case n, ok := <-m.notificationMsgs:
+			if !ok {
+				// queueHandler quit.
+				break out
+			}
+			switch n := n.(type) {
+			case *api.Event:
+				// Marshal once and hand the same bytes to
+				// every subscribed client.
+				marshalled, err := json.Marshal(n)
+				if err != nil {
+					httpLog.Errorf("Failed to marshal %s event: %v", n.Type, err)
+					continue
+				}
+				for _, wsc := range clients {
+					if wsc.subscribed(n.Type) {
+						wsc.QueueNotification(marshalled)
+					}
+				}
+				eventsTotal.WithLabelValues(string(n.Type)).Inc()
+
+			case *notificationRegisterClient:
+				wsc := (*wsClient)(n)
+				clients[wsc.quit] = wsc
+
+			case *notificationUnregisterClient:
+				wsc := (*wsClient)(n)
+				delete(clients, wsc.quit)
+
+			default:
+				httpLog.Warnf("Unhandled notification type %T", n)
+			}
+			eventClients.Set(float64(len(clients)))
+
+		case <-m.quit:
+			// Manager is shutting down.
+			break out
+		}
+	}
+
+	for _, c := range clients {
+		c.Disconnect()
+	}
+	m.wg.Done()
+}
+
+// wsClient provides an abstraction for handling a websocket client.  The
+// overall data flow is split into 3 main goroutines.  inHandler reads
+// subscription requests, queueHandler buffers outgoing messages
+// so a slow client never blocks the notification manager, and outHandler
+// writes them to the connection.
+type wsClient struct {
+	sync.Mutex
+
+	// conn is the underlying websocket connection.
+	conn *websocket.Conn
+
+	// disconnected indicated whether or not the websocket client is
+	// disconnected.
+	disconnected bool
+
+	// addr is the remote address of the client.
+	addr string
+
+	// filter is the set of event types the client receives.  A nil filter
+	// means every event.
+	filter map[api.EventType]struct{}
+
+	// Networking infrastructure.
+	ntfnChan chan interface{}
+	sendChan chan interface{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newWebsocketClient returns a new websocket client for conn that receives
+// the events in filter, or every event if filter is nil.
+func newWebsocketClient(conn *websocket.Conn, remoteAddr string, filter map[api.EventType]struct{}) *wsClient {
+	return &wsClient{
+		conn:     conn,
+		addr:     remoteAddr,
+		filter:   filter,
+		ntfnChan: make(chan interface{}, 1), // nonblocking sync
+		sendChan: make(chan interface{}, websocketSendBufferSize),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start begins processing input and output messages.
+func (c *wsClient) Start() {
+	httpLog.Tracef("Starting websocket client %s", c.addr)
+
+	c.wg.Add(3)
+	go c.inHandler()
+	go func() {
+		queueHandler(c.ntfnChan, c.sendChan, c.quit)
+		c.wg.Done()
+	}()
+	go c.outHandler()
+}
+
+// WaitForShutdown blocks until the websocket client goroutines are stopped
+// and the connection is closed.
+func (c *wsClient) WaitForShutdown() {
+	c.wg.Wait()
+}
+
+// Disconnect disconnects the websocket client.
+func (c *wsClient) Disconnect() {
+	c.Lock()
+	defer c.Unlock()
+
+	// Nothing to do if already disconnected.
+	if c.disconnected {
+		return
+	}
+
+	httpLog.Tracef("Disconnecting websocket client %s", c.addr)
+	close(c.quit)
+	c.conn.Close()
+	c.disconnected = true
+}
+
+// QueueNotification queues the passed marshalled message to be sent to the
+// client.  It never blocks for long since the queue grows as needed.
+func (c *wsClient) QueueNotification(marshalled []byte) {
+	select {
+	case c.ntfnChan <- marshalled:
+	case <-c.quit:
+	}
+}
+
+// subscribed reports whether the client wants events of type t.
+func (c *wsClient) subscribed(t api.EventType) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.filter == nil {
+		return true
+	}
+	_, ok := c.filter[t]
+	return ok
+}
+
+// inHandler handles all incoming messages for the websocket connection.  It
+// must be run as a goroutine.
+func (c *wsClient) inHandler() {
+	c.conn.SetReadLimit(websocketReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	})
+
+out:
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			// Log the error if it's not due to disconnecting.
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				select {
+				case <-c.quit:
+				default:
+					httpLog.Debugf("Websocket receive error from %s: %v", c.addr, err)
+				}
+			}
+			break out
+		}
+
+		var resp api.EventResponse
+		var req api.EventRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = &api.Error{Code: api.ErrInvalidRequest, Message: fmt.Sprintf("invalid request: %v", err)}
+		} else {
+			resp.ID = req.ID
+			resp.Result, resp.Error = c.handleRequest(&req)
+		}
+		marshalled, err := json.Marshal(&resp)
+		if err != nil {
+			httpLog.Errorf("Failed to marshal event stream reply: %v", err)
+			continue
+		}
+		c.QueueNotification(marshalled)
+	}
+
+	// Ensure the connection is closed.
+	c.Disconnect()
+	c.wg.Done()
+	httpLog.Tracef("Websocket client input handler done for %s", c.addr)
+}
+
+// handleRequest applies a subscribe or unsubscribe request and returns the
+// event types the client receives afterwards.
+func (c *wsClient) handleRequest(req *api.EventRequest) ([]api.EventType, *api.Error) {
+	for _, t := range req.Params {
+		if !api.ValidEventType(t) {
+			return nil, &api.Error{Code: api.ErrInvalidRequest, Message: fmt.Sprintf("unknown event type %q", t)}
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch req.Method {
+	case "subscribe":
+		if c.filter != nil {
+			for _, t := range req.Params {
+				c.filter[t] = struct{}{}
+			}
+		}
+	case "unsubscribe":
+		if c.filter == nil {
+			c.filter = make(map[api.EventType]struct{}, len(api.EventTypes))
+			for _, t := range api.EventTypes {
+				c.filter[t] = struct{}{}
+			}
+		}
+		for _, t := range req.Params {
+			delete(c.filter, t)
+		}
+	default:
+		return nil, &api.Error{Code: api.ErrInvalidRequest, Message: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+
+	result := make([]api.EventType, 0, len(api.EventTypes))
+	for _, t := range api.EventTypes {
+		if _, ok := c.filter[t]; c.filter == nil || ok {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+// outHandler handles all outgoing messages for the websocket connection and
+// pings the client periodically.  It must be run as a goroutine.
+func (c *wsClient) outHandler() {
+	ticker := time.NewTicker(websocketPingInterval)
+	defer ticker.Stop()
+
+out:
+	for {
+		select {
+		case msg, ok := <-c.sendChan:
+			if !ok {
+				break out
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg.([]byte)); err != nil {
+				httpLog.Debugf("Websocket send error to %s: %v", c.addr, err)
+				c.Disconnect()
+				break out
+			}
+
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteWait))
+			if err != nil {
+				c.Disconnect()
+				break out
+			}
+
+		case <-c.quit:
+			break out
+		}
+	}
+
+	c.wg.Done()
+	httpLog.Tracef("Websocket client output handler done for %s", c.addr)
+}
+
+// parseEventFilter parses a comma separated list of event types.  An empty
+// list yields a nil filter, meaning every event.
+func parseEventFilter(s string) (map[api.EventType]struct{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	filter := make(map[api.EventType]struct{})
+	for _, name := range strings.Split(s, ",") {
+		t := api.EventType(strings.TrimSpace(name))
+		if !api.ValidEventType(t) {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		filter[t] = struct{}{}
+	}
+	return filter, nil
+}
+
+func (s *apiServer) events(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r.URL.Query().Get("events"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, err.Error())
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeAPIError(w, http.StatusBadRequest, api.ErrInvalidRequest, "expected a websocket upgrade request")
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		httpLog.Debugf("Failed to upgrade event stream for %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	httpLog.Infof("New event stream client %s", r.RemoteAddr)
+	client := newWebsocketClient(conn, r.RemoteAddr, filter)
+	ntfnMgr.AddClient(client)
+	client.Start()
+	client.WaitForShutdown()
+	ntfnMgr.RemoveClient(client)
+	httpLog.Infof("Disconnected event stream client %s", r.RemoteAddr)
+}
@@ -5,3 +5,21 @@ go 1.22
 require github.com/creack/pty v1.1.24 // direct
 
 require github.com/rs/cors v1.11.1 // direct
+
+require github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f // direct
+
+require github.com/btcsuite/btcd/btcutil v1.1.5 // direct
+
+require (
+	github.com/btcsuite/btcd v0.24.2 // indirect
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4 // indirect
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.1.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
+	golang.org/x/crypto v0.22.0 // indirect
+)
+
+// The wallet server uses the btcd and btcutil in this repository.
+replace (
+	github.com/btcsuite/btcd => ./btcd
+	github.com/btcsuite/btcd/btcutil => ./btcd/btcutil
+)
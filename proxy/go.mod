@@ -3,6 +3,7 @@ module proxy
 go 1.23.3
 
 require (
+	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f
 	github.com/elazarl/goproxy v0.0.0-20240909085733-6741dbfc16a1
 	golang.org/x/net v0.26.0
 )
@@ -1,10 +1,13 @@
 package main
 
 import (
-    "github.com/elazarl/goproxy"
-    "log"
-    "net/http"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
 	"sync"
+
+	"github.com/elazarl/goproxy"
 )
 
 var (
@@ -37,12 +40,13 @@ func startProxyServer() error {
 
 	// Proxy already running
 	if proxy != nil {
-		log.Println("Proxy server is already running.")
+		prxyLog.Debug("Proxy server is already running.")
 		return nil
 	}
 
 	proxy = goproxy.NewProxyHttpServer()
 	proxy.Verbose = true
+	proxy.Logger = goproxyLogger{}
 
 	server = &http.Server {
 		Addr:	  ":50000",
@@ -50,9 +54,9 @@ func startProxyServer() error {
 	}
 
 	go func() {
-		log.Println("Proxy server listening on port 50000")
-		if err := server.ListenAndServe(); err != nil {
-			log.Printf("Error starting proxy server: %v", err)
+		prxyLog.Info("Proxy server listening on port 50000")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			prxyLog.Errorf("Error starting proxy server: %v", err)
 		}
 	}()
 
@@ -65,23 +69,23 @@ func stopProxyServer() error {
 
 	// Proxy already stopped
 	if proxy == nil {
-		log.Println("Proxy server is already stopped.")
+		prxyLog.Debug("Proxy server is already stopped.")
 		return nil
 	}
 
 	if err := server.Close(); err != nil {
-		log.Printf("Error stopping proxy server: %v", err)
+		prxyLog.Errorf("Error stopping proxy server: %v", err)
 		return err
 	}
 
 	proxy = nil
 	server = nil
-	log.Println("Proxy server stopped successfully.")
+	prxyLog.Info("Proxy server stopped successfully.")
 	return nil
 }
 
 func startHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Received request to start proxy server.")
+	httpLog.Debug("Received request to start proxy server.")
 	if err := startProxyServer(); err != nil {
 		http.Error(w, "Failed to start proxy", http.StatusInternalServerError)
 		return
@@ -90,7 +94,7 @@ func startHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func stopHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Received request to stop proxy server.")
+	httpLog.Debug("Received request to stop proxy server.")
 	if err := stopProxyServer(); err != nil {
 		http.Error(w, "Failed to stop proxy", http.StatusInternalServerError)
 		return
@@ -98,12 +102,25 @@ func stopHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+var debugLevel = flag.String("debuglevel", "info", "Logging level for all subsystems {trace, debug, info, warn, error, critical} "+
+	"-- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems")
+
 func main() {
+	flag.Parse()
+	if err := parseAndSetDebugLevels(*debugLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/startProxy", startHandler)
 	mux.HandleFunc("/stopProxy", stopHandler)
+	mux.HandleFunc("/debuglevel", handleDebugLevel)
 
-	log.Println("Serving on port 50001")
-	log.Fatal(http.ListenAndServe(":50001", enableCORS(mux)))
+	httpLog.Info("Serving on port 50001")
+	if err := http.ListenAndServe(":50001", enableCORS(mux)); err != nil {
+		httpLog.Criticalf("Error starting server: %v", err)
+		os.Exit(1)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// TestParseAmount checks that amounts are parsed exactly and that amounts
+// which can't be paid are rejected rather than rounded.
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want btcutil.Amount
+		ok   bool
+	}{
+		{"1", 100_000_000, true},
+		{"1.5", 150_000_000, true},
+		{"0.1", 10_000_000, true},
+		{"0.00000001", 1, true},
+		{"1e-8", 1, true},
+		{"2.5E3", 250_000_000_000, true},
+		{" 3 ", 300_000_000, true},
+		{"20999999.99999999", 2_099_999_999_999_999, true},
+		{"21000000", btcutil.MaxSatoshi, true},
+
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"0.000000001", 0, false},
+		{"21000000.00000001", 0, false},
+		{"1e33", 0, false},
+		{"1/2", 0, false},
+		{"0x10", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"", 0, false},
+		{".", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseAmount(json.Number(test.in))
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("parseAmount(%q) = %d, %v, want %d", test.in, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("parseAmount(%q) = %d, want an error", test.in, got)
+		}
+	}
+}
+
+// TestFormatAmount checks that formatted amounts are exact and parse back.
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		in   btcutil.Amount
+		want string
+	}{
+		{1, "0.00000001"},
+		{10_000_000, "0.1"},
+		{150_000_000, "1.5"},
+		{2_099_999_999_999_999, "20999999.99999999"},
+		{btcutil.MaxSatoshi, "21000000"},
+	}
+	for _, test := range tests {
+		got := formatAmount(test.in)
+		if got != test.want {
+			t.Errorf("formatAmount(%d) = %q, want %q", test.in, got, test.want)
+		}
+		if back, err := parseAmount(json.Number(got)); err != nil || back != test.in {
+			t.Errorf("parseAmount(%q) = %d, %v, want %d", got, back, err, test.in)
+		}
+	}
+}
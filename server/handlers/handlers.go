@@ -3,7 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/MazenIbrahim1/PHAJAM/server/manager"
+	"github.com/btcsuite/btcd/btcutil"
 )
 
 // Global var for password
@@ -25,7 +26,7 @@ func GetRoot(w http.ResponseWriter, r *http.Request) {
 	response := map[string]string{"message": "API is live"}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Println("Root endpoint accessed.")
+	log.Debug("Root endpoint accessed.")
 }
 
 // Function to create wallet
@@ -37,23 +38,23 @@ func CreateWallet(w http.ResponseWriter, r *http.Request) {
 	// Parse JSON body
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, `{"error": "Invalid request payload"}`, http.StatusBadRequest)
-		log.Printf("Error decoding JSON payload: %v", err)
+		log.Warnf("Error decoding JSON payload: %v", err)
 		return
 	}
 
 	// Validate password
 	if len(request.Password) < 8 || len(request.Password) > 15 {
 		http.Error(w, `{"error": "Password must be between 8 and 15 characters"}`, http.StatusBadRequest)
-		log.Printf("Password validation failed for request: %+v", request)
+		log.Warn("Password validation failed")
 		return
 	}
 
-	log.Println("Creating a new wallet...")
+	log.Info("Creating a new wallet...")
 	seed, err := manager.CreateWallet(request.Password)
 	if err != nil {
 		// Handle wallet creation error
 		http.Error(w, `{"error": "Failed to create wallet"}`, http.StatusInternalServerError)
-		log.Printf("Failed to create wallet: %v", err)
+		log.Errorf("Failed to create wallet: %v", err)
 		return
 	}
 
@@ -74,11 +75,11 @@ func CreateWallet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		http.Error(w, `{"error": "Failed to encode response"}`, http.StatusInternalServerError)
-		log.Printf("Error encoding response: %v", err)
+		log.Errorf("Error encoding response: %v", err)
 		return
 	}
 
-	log.Println("Wallet created successfully, seed returned.")
+	log.Info("Wallet created successfully, seed returned.")
 }
 
 // CheckWallet verifies if a wallet exists on the system.
@@ -87,7 +88,7 @@ func CheckWallet(w http.ResponseWriter, r *http.Request) {
 	response := map[string]bool{"exists": exists}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Printf("Wallet existence check: %v", exists)
+	log.Debugf("Wallet existence check: %v", exists)
 }
 
 // Login logs in the user by checking password and unlocking wallet
@@ -99,7 +100,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	// Parse JSON body
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, `{"error": "Invalid request payload"}`, http.StatusBadRequest)
-		log.Printf("Error decoding JSON payload: %v", err)
+		log.Warnf("Error decoding JSON payload: %v", err)
 		return
 	}
 
@@ -114,7 +115,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			"value":   false,
 		}
 		json.NewEncoder(w).Encode(response)
-		log.Println("Login attempt failed: Incorrect password.")
+		log.Warn("Login attempt failed: Incorrect password.")
 		return
 	}
 
@@ -126,19 +127,19 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			"value":   false,
 		}
 		json.NewEncoder(w).Encode(response)
-		log.Printf("Error starting wallet services: %v", err)
+		log.Errorf("Error starting wallet services: %v", err)
 		return
 	}
 
 	// Unlock wallet
-	fmt.Println("Unlocking wallet...")
+	log.Info("Unlocking wallet...")
 	timeUnlocked := 3600*5
 	command := fmt.Sprintf("walletpassphrase %s %d", walletPassword, timeUnlocked)
 	_, err := manager.BtcctlCommand(command)
 	if err != nil {
-		fmt.Printf("Error unlocking wallet: %v\n", err)
+		log.Errorf("Error unlocking wallet: %v", err)
 	} else {
-		fmt.Println("Wallet unlocked successfully!")
+		log.Info("Wallet unlocked successfully!")
 	}
 	// Unlock wallet
 	time.Sleep(2 * time.Second)
@@ -168,7 +169,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		"value":   true,
 	}
 	json.NewEncoder(w).Encode(response)
-	log.Println("Wallet login successful.")
+	log.Info("Wallet login successful.")
 }
 
 // ResetPassword resets the wallet password
@@ -181,7 +182,7 @@ func ResetPassword(w http.ResponseWriter, r *http.Request) {
 	// Parse JSON body
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, `{"error": "Invalid request payload"}`, http.StatusBadRequest)
-		log.Printf("Error decoding JSON payload: %v", err)
+		log.Warnf("Error decoding JSON payload: %v", err)
 		return
 	}
 
@@ -202,7 +203,7 @@ func ResetPassword(w http.ResponseWriter, r *http.Request) {
 	response := map[string]bool{"success": true}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Println("Wallet password changed successfully.")
+	log.Info("Wallet password changed successfully.")
 }
 
 
@@ -215,7 +216,7 @@ func DeleteWallet(w http.ResponseWriter, r *http.Request) {
 
 	if err := manager.StopWallet(); err != nil {
 		http.Error(w, `{"error": "Failed to stop wallet service"}`, http.StatusInternalServerError)
-		log.Printf("Error stopping wallet service: %v", err)
+		log.Errorf("Error stopping wallet service: %v", err)
 		return
 	}
 
@@ -228,13 +229,13 @@ func DeleteWallet(w http.ResponseWriter, r *http.Request) {
 func Logout(w http.ResponseWriter, r *http.Request) {
 	if err := manager.StopWallet(); err != nil {
 		http.Error(w, `{"error": "Failed to stop wallet service"}`, http.StatusInternalServerError)
-		log.Printf("Error stopping wallet service: %v", err)
+		log.Errorf("Error stopping wallet service: %v", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Btcwallet stopped"})
-	log.Println("Wallet logout successful.")
+	log.Info("Wallet logout successful.")
 }
 
 // Getting the wallet address of the default account
@@ -250,7 +251,7 @@ func GetDefaultAddress(w http.ResponseWriter, r *http.Request) {
 	response := map[string]string{"address": defaultAddress}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Println("Default address retrieved successfully.")
+	log.Info("Default address retrieved successfully.")
 }
 
 // GetBalance retrieves the wallet balance
@@ -264,7 +265,7 @@ func GetBalance(w http.ResponseWriter, r *http.Request) {
 	response := map[string]string{"balance": balance}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Println("Wallet balance retrieved successfully.")
+	log.Info("Wallet balance retrieved successfully.")
 }
 
 // Mine triggers generate with num_blocks as arg
@@ -280,7 +281,7 @@ func Mine(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Invalid request payload or number of blocks",
 		})
-		log.Printf("Invalid request payload: %v", err)
+		log.Warnf("Invalid request payload: %v", err)
 		return
 	}
 
@@ -293,7 +294,7 @@ func Mine(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Failed to start mining",
 		})
-		log.Printf("Error starting mining: %v", err)
+		log.Errorf("Error starting mining: %v", err)
 		return
 	}
 
@@ -307,7 +308,7 @@ func Mine(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Mining succeeded but no block hashes were returned",
 		})
-		log.Println("Mining succeeded but no block hashes were returned")
+		log.Warn("Mining succeeded but no block hashes were returned")
 		return
 	}
 
@@ -318,35 +319,103 @@ func Mine(w http.ResponseWriter, r *http.Request) {
 		"message":    "Mining started successfully",
 		"block_hash": blockHashes,
 	})
-	log.Println("Mining started successfully:", blockHashes)
+	log.Infof("Mining started successfully: %v", blockHashes)
+}
+
+// atomsPerDC is the number of atoms in one DC.
+var atomsPerDC = big.NewRat(btcutil.SatoshiPerBitcoin, 1)
+
+// maxAmountExponent bounds the exponent of a parsed amount, keeping absurd
+// ones like 1e-999999999 from taking long to parse.
+const maxAmountExponent = 32
+
+// parseAmount parses a positive decimal number of DC, given as a JSON number
+// or a quoted one, into an exact amount of atoms.  Amounts finer than an
+// atom or above the coin supply are rejected rather than rounded.
+func parseAmount(n json.Number) (btcutil.Amount, error) {
+	s := strings.TrimSpace(string(n))
+	if !isDecimal(s) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	dc, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	atoms := dc.Mul(dc, atomsPerDC)
+	if !atoms.IsInt() {
+		return 0, fmt.Errorf("amount %q has more than 8 decimals", s)
+	}
+	if atoms.Sign() <= 0 || !atoms.Num().IsInt64() || atoms.Num().Int64() > btcutil.MaxSatoshi {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+	return btcutil.Amount(atoms.Num().Int64()), nil
+}
+
+// formatAmount renders a as an exact number of DC without trailing zeros,
+// such as "1.5".  It is the inverse of parseAmount.
+func formatAmount(a btcutil.Amount) string {
+	whole := strconv.FormatInt(int64(a)/btcutil.SatoshiPerBitcoin, 10)
+	frac := int64(a) % btcutil.SatoshiPerBitcoin
+	if frac == 0 {
+		return whole
+	}
+	return whole + "." + strings.TrimRight(fmt.Sprintf("%08d", frac), "0")
+}
+
+// isDecimal reports whether s is a plain decimal number with an optional,
+// small exponent.  It keeps out the fractions and base prefixes big.Rat
+// also accepts.
+func isDecimal(s string) bool {
+	mantissa, exponent, hasExponent := strings.Cut(strings.ToLower(s), "e")
+	if hasExponent {
+		exp, err := strconv.Atoi(exponent)
+		if err != nil || exp < -maxAmountExponent || exp > maxAmountExponent {
+			return false
+		}
+	}
+	mantissa = strings.TrimLeft(mantissa, "+-")
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	if whole == "" && frac == "" {
+		return false
+	}
+	return strings.Trim(whole+frac, "0123456789") == ""
 }
 
 // SendToAddress sends funds to a specific address.
 func SendToAddress(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Address string `json:"address"`
-		Amount  string `json:"amount"`
+		Address string      `json:"address"`
+		Amount  json.Number `json:"amount"`
 	}
 
 	// Parse JSON body
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, `{"error": "Invalid request payload"}`, http.StatusBadRequest)
-		log.Printf("Error decoding JSON payload: %v", err)
+		log.Warnf("Error decoding JSON payload: %v", err)
+		return
+	}
+
+	// Validate amount
+	amount, err := parseAmount(request.Amount)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid amount"}`, http.StatusBadRequest)
+		log.Warnf("Invalid amount: %v", err)
 		return
 	}
 
 	// Validate recipient address
 	if err := manager.ValidateAddress(request.Address); err != nil {
 		http.Error(w, `{"error": "Invalid recipient address"}`, http.StatusBadRequest)
-		log.Printf("Invalid recipient address: %v", err)
+		log.Warnf("Invalid recipient address: %v", err)
 		return
 	}
 
 	// Send funds
-	txid, err := manager.BtcctlCommand(fmt.Sprintf("sendtoaddress %s %s", request.Address, request.Amount))
+	dc := formatAmount(amount)
+	txid, err := manager.BtcctlCommand(fmt.Sprintf("sendtoaddress %s %s", request.Address, dc))
 	if err != nil {
 		http.Error(w, `{"error": "Failed to send funds"}`, http.StatusInternalServerError)
-		log.Printf("Error sending funds: %v", err)
+		log.Errorf("Error sending funds: %v", err)
 		return
 	}
 
@@ -356,7 +425,7 @@ func SendToAddress(w http.ResponseWriter, r *http.Request) {
 		"message": "Funds sent to " + request.Address,
 		"txid":    txid,
 	})
-	log.Println("Funds sent successfully.")
+	log.Infof("Sent %s DC to %s.", dc, request.Address)
 }
 
 // GetTransactionHistory retrieves the transaction history from btcwallet
@@ -386,7 +455,7 @@ func GetTransactionHistory(w http.ResponseWriter, r *http.Request) {
 	transactions, err := manager.ListTransactions(account, count, from, includeWatchOnly)
 	if err != nil {
 		http.Error(w, `{"error": "Failed to fetch transactions"}`, http.StatusInternalServerError)
-		log.Printf("Error fetching transactions: %v", err)
+		log.Errorf("Error fetching transactions: %v", err)
 		return
 	}
 
@@ -395,7 +464,7 @@ func GetTransactionHistory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"transactions": transactions,
 	})
-	log.Println("Transaction history retrieved successfully.")
+	log.Info("Transaction history retrieved successfully.")
 }
 
 func AddTransaction(w http.ResponseWriter, r *http.Request) {
@@ -411,14 +480,14 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
 	// Parse the JSON body
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, `{"error": "Invalid request payload"}`, http.StatusBadRequest)
-		log.Printf("Error decoding JSON payload: %v", err)
+		log.Warnf("Error decoding JSON payload: %v", err)
 		return
 	}
 
 	// Validate required fields
 	if request.Type == "" || request.Amount <= 0 || request.Status == "" {
 		http.Error(w, `{"error": "Invalid transaction data"}`, http.StatusBadRequest)
-		log.Printf("Invalid transaction data: %+v", request)
+		log.Warnf("Invalid transaction data: %+v", request)
 		return
 	}
 
@@ -439,7 +508,7 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
 	// Save the transaction
 	if err := manager.AddTransaction(transaction); err != nil {
 		http.Error(w, `{"error": "Failed to add transaction"}`, http.StatusInternalServerError)
-		log.Printf("Error adding transaction: %v", err)
+		log.Errorf("Error adding transaction: %v", err)
 		return
 	}
 
@@ -449,5 +518,5 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
 		"message":     "Transaction added successfully",
 		"transaction": transaction,
 	})
-	log.Println("Transaction added successfully:", transaction)
+	log.Debugf("Transaction added successfully: %v", transaction)
 }
\ No newline at end of file
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,8 +13,17 @@ import (
 	"github.com/rs/cors"
 )
 
+var debugLevel = flag.String("debuglevel", "info", "Logging level for all subsystems {trace, debug, info, warn, error, critical} "+
+	"-- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems")
+
 func main() {
-	log.Printf("BTC Server running...")
+	flag.Parse()
+	if err := parseAndSetDebugLevels(*debugLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	srvrLog.Info("BTC Server running...")
 	setupRoutes()
 
 	handleGracefulShutdown()
@@ -28,9 +38,10 @@ func main() {
 	handler := corsOptions.Handler(http.DefaultServeMux)
 
 	const serverAddr = ":18080"
-	log.Printf("Server is starting on %s...\n", serverAddr)
+	srvrLog.Infof("Server is starting on %s...", serverAddr)
 	if err := http.ListenAndServe(serverAddr, handler); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+		srvrLog.Criticalf("Server failed to start: %v", err)
+		os.Exit(1)
 	}
 }
 
@@ -49,6 +60,7 @@ func setupRoutes() {
 	http.HandleFunc("/wallet/balance", handlers.GetBalance)
 	http.HandleFunc("/wallet/mine", handlers.Mine)
 	http.HandleFunc("/wallet/send", handlers.SendToAddress)
+	http.HandleFunc("/debuglevel", handleDebugLevel)
 }
 
 // handleGracefulShutdown ensures services stop cleanly when the application exits
@@ -58,14 +70,15 @@ func handleGracefulShutdown() {
 
 	go func() {
 		<-stopChan
-		log.Println("Shutdown signal received. Stopping services...")
+		srvrLog.Info("Shutdown signal received. Stopping services...")
 
 		// Stop btcwallet server when shutdown
 		if err := manager.StopWallet(); err != nil {
-			log.Fatalf("Failed to stop btcwallet: %v", err)
+			srvrLog.Criticalf("Failed to stop btcwallet: %v", err)
+			os.Exit(1)
 		}
 
-		log.Println("Services stopped successfully. Exiting...")
+		srvrLog.Info("Services stopped successfully. Exiting...")
 		os.Exit(0)
 	}()
 }
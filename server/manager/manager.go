@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -21,7 +20,7 @@ var transactionDB = []map[string]interface{}{}
 
 // CreateWallet creates a new wallet using the provided password.
 func CreateWallet(password string) (string, error) {
-    log.Println("Executing the create command from btcwallet using pty...")
+    log.Info("Executing the create command from btcwallet using pty...")
 
     // Command to create the wallet
     cmd := exec.Command("btcwallet", "--create")
@@ -46,37 +45,37 @@ func CreateWallet(password string) (string, error) {
                 if err == io.EOF {
                     break
                 }
-                log.Printf("Error reading from pty: %v", err)
+                log.Errorf("Error reading from pty: %v", err)
                 return
             }
             output := string(buf[:n])
             outputBuffer.WriteString(output)
-            log.Println("btcwallet output:", output)
+            log.Tracef("btcwallet output: %s", output)
 
             // Responding to expected prompts
             if strings.Contains(output, "Enter the private passphrase") {
-                log.Println("Responding to passphrase prompt...")
+                log.Info("Responding to passphrase prompt...")
                 ptyFile.Write([]byte(password + "\n"))
 				time.Sleep(1 * time.Second)
             }
             if strings.Contains(output, "Confirm passphrase") {
-                log.Println("Responding to confirm passphrase prompt...")
+                log.Info("Responding to confirm passphrase prompt...")
                 ptyFile.Write([]byte(password + "\n"))
 				time.Sleep(1 * time.Second)
             }
             if strings.Contains(output, "Do you want to add an additional layer of encryption") {
-                log.Println("Responding to additional encryption prompt...")
+                log.Info("Responding to additional encryption prompt...")
                 ptyFile.Write([]byte("no\n"))
 				time.Sleep(1 * time.Second)
             }
             if strings.Contains(output, "Do you have an existing wallet seed") {
-                log.Println("Responding to existing seed prompt...")
+                log.Info("Responding to existing seed prompt...")
                 ptyFile.Write([]byte("no\n"))
 				time.Sleep(1 * time.Second)
             }
             if strings.Contains(output, "Your wallet generation seed is:") {
 				ptyFile.Write([]byte("OK\n"))
-                log.Println("Capturing wallet seed...")
+                log.Info("Capturing wallet seed...")
                 lines := strings.Split(output, "\n")
                 for i, line := range lines {
                     if strings.Contains(line, "Your wallet generation seed is:") && i+1 < len(lines) {
@@ -99,18 +98,18 @@ func CreateWallet(password string) (string, error) {
     }
 
     walletSeed = strings.TrimSpace(walletSeed)
-    log.Println("Wallet creation successful. Wallet seed:", walletSeed)
+    log.Info("Wallet creation successful.")
     return walletSeed, nil
 }
 
 // Delete wallet.db and account
 func DeleteWallet() error {
 	// Determine the wallet path based on the operating system
-	log.Println("Checking wallet")
+	log.Debug("Checking wallet")
 	var walletPath string
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		log.Println("Error locating home directory")
+		log.Error("Error locating home directory")
 	}
 
 	if runtime.GOOS == "windows" {
@@ -124,7 +123,7 @@ func DeleteWallet() error {
 	// check if it exists
 	_, err = os.Stat(walletPath)
 	if err != nil {
-		log.Println("Wallet doesn't exist...")
+		log.Info("Wallet doesn't exist...")
 	}
 
 	// Delete wallet
@@ -132,14 +131,14 @@ func DeleteWallet() error {
 		return fmt.Errorf("failed to delete wallet at path %s: %v", walletPath, err)
 	}
 
-	fmt.Println("Wallet deleted successfully.")
+	log.Info("Wallet deleted successfully.")
 	return nil
 }
 
 // WalletExists checks if the wallet file exists on the system.
 func WalletExists() bool {
 	// Determine the wallet path based on the operating system
-	log.Println("Checking wallet")
+	log.Debug("Checking wallet")
 	var walletPath string
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -161,7 +160,7 @@ func WalletExists() bool {
 
 // StartWallet starts the DolphinCoin wallet service
 func StartWalletServer() (error) {
-	log.Println("Starting DolphinCoin wallet service...")
+	log.Info("Starting DolphinCoin wallet service...")
 	rpcUser := "user"
 	rpcPass := "password"
 	rpcConnect := "127.0.0.1:8334"
@@ -180,26 +179,26 @@ func StartWalletServer() (error) {
 
 	// Command to start server with above params
 	cmd := exec.Command("btcwallet", params...)
-	fmt.Printf("Executing command: btcwallet %s", strings.Join(params, " "))
+	log.Debugf("Executing command: btcwallet %s", strings.Join(params, " "))
 
 	// Start the server
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start wallet service: %s", err.Error())
+		log.Errorf("Failed to start wallet service: %s", err.Error())
 		return fmt.Errorf("error starting wallet service: %w", err)
 	}
 
-	log.Println("Waiting for the wallet server to initialize...")
+	log.Info("Waiting for the wallet server to initialize...")
 	time.Sleep(1 * time.Second)
 
 	// Log the success message
 	walletPID = cmd.Process.Pid
-	log.Printf("DolphinCoin wallet service started successfully with PID: %d", walletPID)
+	log.Infof("DolphinCoin wallet service started successfully with PID: %d", walletPID)
 	return nil
 }
 
 // StopWallet stops the DolphinCoin wallet service
 func StopWallet() error {
-	log.Println("Stopping DolphinCoin wallet service...")
+	log.Info("Stopping DolphinCoin wallet service...")
 
 	// If walletPID is 0, that means the process wasn't started yet or it's already stopped
 	if walletPID == 0 {
@@ -218,7 +217,7 @@ func StopWallet() error {
 		return fmt.Errorf("failed to stop wallet service with PID %d: %w", walletPID, err)
 	}
 
-	log.Printf("DolphinCoin wallet service with PID %d stopped successfully", walletPID)
+	log.Infof("DolphinCoin wallet service with PID %d stopped successfully", walletPID)
 
 	// Reset walletPID after stopping the process to avoid accidental attempts to stop a non-existent process
 	walletPID = 0
@@ -227,7 +226,7 @@ func StopWallet() error {
 
 // ValidateAddress checks if a given address is valid
 func ValidateAddress(address string) error {
-	log.Printf("Validating address: %s", address)
+	log.Debugf("Validating address: %s", address)
 	output, err := BtcctlCommand(fmt.Sprintf("validateaddress %s", address))
 	if err != nil {
 		return fmt.Errorf("failed to validate address: %w", err)
@@ -257,28 +256,29 @@ func BtcctlCommand(command string) (string, error) {
 
 	params = append(params, strings.Split(command, " ")...)
 	cmd := exec.Command("btcctl", params...)
-	fmt.Printf("Executing command: %s", strings.Join(params, " "))
+	// Only the method is logged since commands may carry the wallet passphrase.
+	log.Debugf("Executing btcctl command: %s", strings.Fields(command)[0])
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("error executing btcctl command: %s\nOutput: %s\nError: %v", strings.Join(params, " "), string(output), err)
 	}
 	output = []byte(strings.TrimSpace(string(output)))
-	log.Printf("Btcctl output: %s", output)
+	log.Debugf("Btcctl output: %s", output)
 
 	return string(output), nil
 }
 
 // AddTransaction adds a transaction to the in-memory database
 func AddTransaction(transaction map[string]interface{}) error {
-	log.Println("Adding transaction to the database...")
+	log.Info("Adding transaction to the database...")
 	transactionDB = append(transactionDB, transaction)
-	log.Println("Transaction added:", transaction)
+	log.Debugf("Transaction added: %v", transaction)
 	return nil
 }
 
 // GetTransactions retrieves all transactions from the database
 func GetTransactions() ([]map[string]interface{}, error) {
-	log.Println("Retrieving all transactions from the database...")
+	log.Info("Retrieving all transactions from the database...")
 	return transactionDB, nil
 }
 
@@ -290,7 +290,7 @@ func GetTransactionsUnsafe() []map[string]interface{} {
 
 // ListTransactions retrieves a list of transactions from btcwallet using btcctl.
 func ListTransactions(account string, count, from int, includeWatchOnly bool) ([]map[string]interface{}, error) {
-	log.Println("Fetching transaction history from btcwallet...")
+	log.Info("Fetching transaction history from btcwallet...")
 
 	// Build the btcctl command
 	includeWatchOnlyStr := "false"
@@ -314,6 +314,6 @@ func ListTransactions(account string, count, from int, includeWatchOnly bool) ([
 		return nil, fmt.Errorf("failed to parse transaction data: %w", err)
 	}
 
-	log.Println("Transactions fetched successfully.")
+	log.Info("Transactions fetched successfully.")
 	return transactions, nil
 }